@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"sambhav/pkg/config"
+)
+
+// configCommand runs "sambhav config <subcommand>" and returns the exit
+// code. The only subcommand is print, which writes the configuration that
+// would be used, as YAML, followed by any validation errors.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "print" {
+		fmt.Fprintln(os.Stderr, "usage: sambhav config print [-redacted] [flags]")
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config print", flag.ContinueOnError)
+	redacted := fs.Bool("redacted", false, "mask secrets in the output")
+	cfg, err := config.Load(fs, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	out := cfg
+	if *redacted {
+		out = cfg.Redacted()
+	}
+	if err := out.Write(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration:\n%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -2,115 +2,533 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"flag"
+	"io"
 	"log"
-	"net/http"
-	"os/signal"
-	"sambhav/internal/auth"
-	"sambhav/internal/general"
+	"log/slog"
+	"net"
+	"os"
+	"sambhav/internal/apikey"
+	"sambhav/internal/audit"
+	"sambhav/internal/oauth"
 	"sambhav/internal/repository"
+	"sambhav/internal/saml"
 	"sambhav/internal/user"
+	"sambhav/internal/webhook"
 	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/config"
 	"sambhav/pkg/database"
-	"sambhav/pkg/env"
-	"syscall"
+	"sambhav/pkg/events"
+	"sambhav/pkg/health"
+	"sambhav/pkg/idempotency"
+	"sambhav/pkg/jwt"
+	"sambhav/pkg/lifecycle"
+	"sambhav/pkg/logger"
+	"sambhav/pkg/metrics"
+	"sambhav/pkg/ratelimit"
+	samlpkg "sambhav/pkg/saml"
+	"sambhav/pkg/tracing"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/quic-go/quic-go/http3"
 
 	_ "github.com/golang-migrate/migrate/v4/database/postgres"
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	_ "github.com/lib/pq"
 )
 
+// Exit codes of the server.
+const (
+	// exitFailure is returned when the server fails to start or a
+	// component fails while running.
+	exitFailure = 1
+	// exitConfig is returned when the configuration cannot be loaded or
+	// is invalid.
+	exitConfig = 2
+	// exitUncleanShutdown is returned when the server stopped on a signal
+	// but not every component stopped cleanly within the shutdown timeout.
+	exitUncleanShutdown = 3
+)
+
 func main() {
-	cfg, err := env.EnvVars()
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "config" {
+		os.Exit(configCommand(args[1:]))
+	}
+
+	cfg, err := config.Load(flag.NewFlagSet("sambhav", flag.ExitOnError), args)
 	if err != nil {
-		log.Fatalf("Error parsing environment variables: %v", err)
+		log.Printf("Error loading configuration: %v", err)
+		os.Exit(exitConfig)
+	}
+	if err := cfg.Validate(); err != nil {
+		log.Printf("Invalid configuration:\n%v", err)
+		os.Exit(exitConfig)
 	}
 
-	serverPort := cfg.ServerPort
+	logFormat := cfg.Observability.Log.Format
+	if logFormat == "" && cfg.IsProduction() {
+		logFormat = logger.FormatJSON
+	}
+	logLevel := new(slog.LevelVar)
+	appLogger, err := logger.New(os.Stdout, logger.Config{
+		Level:    cfg.Observability.Log.Level,
+		Format:   logFormat,
+		LevelVar: logLevel,
+	})
+	if err != nil {
+		log.Fatalf("Error setting up logger: %v", err)
+	}
+	// route the standard library logger, used by some dependencies, through
+	// the structured logger as well
+	slog.SetDefault(appLogger)
+	if cfg.IsProduction() {
+		gin.SetMode(gin.ReleaseMode)
+	}
 
-	// Declare a flag to run migrations only
-	// Create a done channel to signal when the shutdown is complete
-	done := make(chan bool, 1)
+	serverPort := cfg.Server.Port
 
-	dbInst := database.NewDatabaseMongo(
-		cfg.DatabaseUser,
-		cfg.DatabasePassword,
-		cfg.DatabaseHost,
-		cfg.DatabaseName,
-		cfg.DatabaseAppName)
+	// reloadable settings are re-read on SIGHUP and when the config file
+	// changes; the rest of the configuration is fixed until a restart
+	configManager := config.NewManager(cfg, func() (*config.Config, error) {
+		fs := flag.NewFlagSet("sambhav", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		return config.Load(fs, args)
+	}, appLogger)
+	configManager.Subscribe(func(cfg *config.Config) {
+		level, err := logger.ParseLevel(cfg.Observability.Log.Level)
+		if err != nil {
+			appLogger.Error("invalid log level", "error", err)
+			return
+		}
+		logLevel.Set(level)
+	})
 
-	newServer := &http.Server{
-		Addr:    fmt.Sprintf(":%d", serverPort),
-		Handler: registerRoutes(dbInst),
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Config{
+		ServiceName: cfg.Observability.ServiceName,
+		Exporter:    cfg.Observability.Tracing.Exporter,
+		Endpoint:    cfg.Observability.Tracing.Endpoint,
+		Insecure:    cfg.Observability.Tracing.Insecure,
+		SampleRatio: cfg.Observability.Tracing.SampleRatio,
+	})
+	if err != nil {
+		fatal(appLogger, "error setting up tracing", err)
 	}
-	// Run graceful shutdown in a separate goroutine
-	go gracefulShutdown(done, newServer, dbInst)
 
-	// start the server
-	if err := newServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		panic(fmt.Sprintf("http server error: %s", err))
+	serverTLS, err := newServerTLS(cfg.Server, appLogger)
+	if err != nil {
+		fatal(appLogger, "error setting up TLS", err)
 	}
 
-	// Wait for the graceful shutdown to complete
-	<-done
-	log.Println("Graceful shutdown complete.")
-}
+	dbInst, err := database.NewDatabaseMongo(
+		cfg.Database.User,
+		cfg.Database.Password,
+		cfg.Database.Host,
+		cfg.Database.Name,
+		cfg.Database.AppName,
+		cfg.Database.SlowQueryThreshold,
+		appLogger)
+	if err != nil {
+		fatal(appLogger, "error connecting to database", err)
+	}
+
+	authKeys, err := abpkg.LoadKeys(cfg.Auth.Keys, cfg.Auth.KeyFile)
+	if err != nil {
+		fatal(appLogger, "error loading auth keys", err)
+	}
+	sameSite, err := abpkg.ParseSameSite(cfg.Auth.Cookie.SameSite)
+	if err != nil {
+		fatal(appLogger, "error parsing auth cookie same site", err)
+	}
 
-func registerRoutes(dbInst database.Database) *gin.Engine {
+	// domain events; with the outbox, asynchronous subscribers are fed by a
+	// relay and retried until they succeed
+	var busOpts []events.Option
+	var outboxRepository events.OutboxStore
+	if cfg.Events.Outbox {
+		repo := repository.NewOutboxRepository(dbInst)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := repo.EnsureIndexes(ctx)
+		cancel()
+		if err != nil {
+			fatal(appLogger, "error creating outbox indexes", err)
+		}
+		outboxRepository = repo
+		busOpts = append(busOpts, events.WithOutbox(outboxRepository))
+	}
+	bus := events.New(appLogger, busOpts...)
+
+	var abOpts []abpkg.Option
+	if cfg.Auth.SessionStore == "server" {
+		sessionRepository := repository.NewSessionRepository(dbInst)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := sessionRepository.EnsureIndexes(ctx)
+		cancel()
+		if err != nil {
+			fatal(appLogger, "error creating session indexes", err)
+		}
+		abOpts = append(abOpts, abpkg.WithServerSessions(sessionRepository))
+	}
+
+	auditKey := []byte(cfg.Audit.Key)
+	if len(auditKey) == 0 {
+		appLogger.Warn("no audit key configured, generating a temporary one")
+		auditKey = make([]byte, 32)
+		if _, err := rand.Read(auditKey); err != nil {
+			fatal(appLogger, "error generating audit key", err)
+		}
+	}
+	auditRepository := repository.NewAuditRepository(dbInst, auditKey)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = auditRepository.EnsureIndexes(ctx)
+	cancel()
+	if err != nil {
+		fatal(appLogger, "error creating audit indexes", err)
+	}
+	auditService := audit.NewAuditService(auditRepository, appLogger)
+
+	// service accounts authenticate with API keys in place of a session
+	apiKeyRepository := repository.NewAPIKeyRepository(dbInst)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = apiKeyRepository.EnsureIndexes(ctx)
+	cancel()
+	if err != nil {
+		fatal(appLogger, "error creating api key indexes", err)
+	}
+	apiKeyService := apikey.NewAPIKeyService(apiKeyRepository, appLogger, auditService)
+	abOpts = append(abOpts, abpkg.WithAPIKeys(apiKeyService))
 
-	// declare generic handlers
-	generalHandlers := general.NewGeneralHandler(dbInst)
-	// declare user handlers
 	userRepository := repository.NewUserRepository(dbInst)
-	userService := user.NewUserService(userRepository)
-	userHandlers := user.NewUserHandler(userService)
-
-	router := gin.Default()
-	// generic routes
-	router.GET("/health", generalHandlers.HealthCheck)
-	// user routes
-	userRouter := router.Group("/user")
-	userRouter.POST("/", userHandlers.RegisterUser)
-	userRouter.GET("/", userHandlers.GetAllUsers)
-
-	router.Any("/authboss", gin.WrapH(http.StripPrefix("/authboss", abpkg.Router())))
-
-	// API auth endpoints that proxy into authboss
-	authHandler := auth.NewAuthHandler()
-	apiAuth := router.Group("/api/auth")
-	apiAuth.POST("/login", authHandler.Login)
-	apiAuth.POST("/google/callback", authHandler.GoogleCallback)
-	return router
-}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = userRepository.EnsureIndexes(ctx)
+	cancel()
+	if err != nil {
+		fatal(appLogger, "error creating user indexes", err)
+	}
+	userStore := abpkg.NewUserStorer(userRepository, dbInst, appLogger, bus)
+	abInst, err := abpkg.New(abpkg.Config{
+		RootURL:    cfg.Server.RootURL,
+		MountPath:  "/authboss",
+		Production: cfg.IsProduction(),
+		Keys:       authKeys,
+		Cookie: abpkg.CookieConfig{
+			Domain:   cfg.Auth.Cookie.Domain,
+			Secure:   cfg.Auth.Cookie.Secure,
+			HTTPOnly: cfg.Auth.Cookie.HTTPOnly,
+			SameSite: sameSite,
+		},
+		GoogleClientID:     cfg.Auth.Google.ClientID,
+		GoogleClientSecret: cfg.Auth.Google.ClientSecret,
+		Mail: abpkg.MailConfig{
+			From:         cfg.Mail.From,
+			FromName:     cfg.Mail.FromName,
+			SMTPAddr:     smtpAddr(cfg.Mail),
+			SMTPUsername: cfg.Mail.SMTPUsername,
+			SMTPPassword: cfg.Mail.SMTPPassword,
+		},
+	}, userStore, append(abOpts, abpkg.WithLogger(appLogger))...)
+	if err != nil {
+		fatal(appLogger, "error setting up authboss", err)
+	}
 
-func gracefulShutdown(done chan bool, server *http.Server, db database.Database) {
-	// Create context that listens for the interrupt signal from the OS.
-	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
-	defer stop()
+	appMetrics := metrics.New()
+	configManager.OnReload(appMetrics.ConfigReloaded)
+	appMetrics.ObserveAuthboss(abInst.Events)
+	appMetrics.ObserveDatabasePool(func() database.PoolStats { return dbInst.Stats().Pool })
 
-	// Listen for the interrupt signal.
-	<-ctx.Done()
+	audit.ObserveAuthboss(abInst.Events, auditService)
 
-	log.Println("shutting down gracefully, press Ctrl+C again to force")
+	checks := health.NewRegistry()
+	checks.Register("database", dbInst.Ping, health.WithDetails(func() any { return dbInst.Stats().Pool }))
+	if sessions := abInst.Sessions(); sessions != nil {
+		checks.Register("session_store", sessions.Check)
+	}
+
+	abInst.PublishEvents(bus)
 
-	// shut down any database connections
-	db.Close()
+	// outgoing webhooks are fanned out from the bus and sent by a
+	// dispatcher, which retries failed deliveries with backoff
+	webhookRepository := repository.NewWebhookRepository(dbInst)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = webhookRepository.EnsureIndexes(ctx)
+	cancel()
+	if err != nil {
+		fatal(appLogger, "error creating webhook indexes", err)
+	}
+	webhookService := webhook.NewWebhookService(webhookRepository, appLogger)
+	bus.SubscribeAsync("", webhookService.Enqueue)
 
-	// The context is used to inform the server it has 5 seconds to finish
-	// the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+	// components are started in order and stopped in reverse: on shutdown
+	// the service reports itself not ready, drains the servers, stops the
+	// workers, flushes the event bus and only then closes the database and
+	// flushes spans
+	lc := lifecycle.New(appLogger, lifecycle.WithStopTimeout(cfg.Server.ShutdownTimeout))
+	lc.Append(lifecycle.Hook{Name: "tracing", OnStop: shutdownTracing})
+	lc.Append(lifecycle.Hook{Name: "database", OnStop: dbInst.Close})
+	lc.Append(lifecycle.Hook{Name: "event bus", OnStop: bus.Close})
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Printf("Server forced to shutdown with error: %v", err)
+	// background workers run until shutdown
+	workers := []func(ctx context.Context){
+		func(ctx context.Context) {
+			if err := configManager.Watch(ctx); err != nil {
+				appLogger.Error("error watching configuration", "error", err)
+			}
+		},
+		webhook.NewDispatcher(webhookRepository, nil, appLogger, 0).Run,
 	}
+	if outboxRepository != nil {
+		relay := events.NewRelay(bus, outboxRepository, appLogger, 0)
+		workers = append(workers, relay.Run)
+		checks.Register("outbox", func(ctx context.Context) error {
+			_, err := relay.Pending(ctx)
+			return err
+		}, health.NonCritical())
+	}
+	if serverTLS != nil {
+		workers = append(workers, func(ctx context.Context) {
+			if err := serverTLS.watch(ctx); err != nil {
+				appLogger.Error("error watching certificates", "error", err)
+			}
+		})
+	}
+	lc.Append(lifecycle.Workers("workers", workers...))
+
+	// CORS policies are reloaded along with the configuration
+	corsPolicies, err := newCORSGroups(cfg.CORS)
+	if err != nil {
+		fatal(appLogger, "error setting up CORS", err)
+	}
+	configManager.Subscribe(func(cfg *config.Config) {
+		if err := corsPolicies.update(cfg.CORS); err != nil {
+			appLogger.Error("invalid CORS configuration", "error", err)
+		}
+	})
 
-	log.Println("Server exiting")
+	// rate limits are kept in memory per replica, or shared in the
+	// database; their rules are reloaded along with the configuration
+	var limitStore ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg.RateLimit.Store == "mongo" {
+		repo := repository.NewRateLimitRepository(dbInst)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err := repo.EnsureIndexes(ctx)
+		cancel()
+		if err != nil {
+			fatal(appLogger, "error creating rate limit indexes", err)
+		}
+		limitStore = repo
+	}
+	limits := ratelimit.New(limitStore, appLogger)
+	limits.OnReject(appMetrics.RateLimited)
+	if err := limits.Update(rateLimitRules(cfg.RateLimit)); err != nil {
+		fatal(appLogger, "error setting up rate limits", err)
+	}
+	configManager.Subscribe(func(cfg *config.Config) {
+		if err := limits.Update(rateLimitRules(cfg.RateLimit)); err != nil {
+			appLogger.Error("invalid rate limit configuration", "error", err)
+		}
+	})
+
+	idempotencyRepository := repository.NewIdempotencyRepository(dbInst)
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	err = idempotencyRepository.EnsureIndexes(ctx)
+	cancel()
+	if err != nil {
+		fatal(appLogger, "error creating idempotency indexes", err)
+	}
+	idempotencySecret := []byte(cfg.Idempotency.Secret)
+	if len(idempotencySecret) == 0 {
+		appLogger.Warn("no idempotency secret configured, generating a temporary one")
+		idempotencySecret = make([]byte, 32)
+		if _, err := rand.Read(idempotencySecret); err != nil {
+			fatal(appLogger, "error generating idempotency secret", err)
+		}
+	}
+	idempotencyKeys := idempotency.New(idempotencyRepository, idempotency.Config{
+		TTL:         cfg.Idempotency.TTL,
+		LockTimeout: cfg.Idempotency.LockTimeout,
+		Secret:      idempotencySecret,
+	}, appLogger)
+
+	// OAuth2 authorization server and OpenID Connect provider for our own
+	// and third-party apps, signing in the users of the user store
+	var oauthService oauth.OAuthService
+	if cfg.OAuth.Enabled {
+		var signingKeys []jwt.Key
+		if cfg.OAuth.KeyFile != "" {
+			signingKeys, err = jwt.LoadKeyFile(cfg.OAuth.KeyFile)
+		} else {
+			appLogger.Warn("no oauth signing key configured, generating a temporary key")
+			var key jwt.Key
+			key, err = jwt.GenerateKey()
+			signingKeys = []jwt.Key{key}
+		}
+		if err != nil {
+			fatal(appLogger, "error loading oauth signing keys", err)
+		}
+		signer, err := jwt.NewSigner(signingKeys)
+		if err != nil {
+			fatal(appLogger, "error setting up oauth signing keys", err)
+		}
+		oauthRepository := repository.NewOAuthRepository(dbInst)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = oauthRepository.EnsureIndexes(ctx)
+		cancel()
+		if err != nil {
+			fatal(appLogger, "error creating oauth indexes", err)
+		}
+		oauthService = oauth.NewOAuthService(oauthRepository, userStore, signer, oauth.Config{
+			Issuer:          cfg.OAuth.Issuer,
+			ConsentURL:      cfg.OAuth.ConsentURL,
+			AccessTokenTTL:  cfg.OAuth.AccessTokenTTL,
+			RefreshTokenTTL: cfg.OAuth.RefreshTokenTTL,
+			CodeTTL:         cfg.OAuth.CodeTTL,
+		}, appMetrics, appLogger)
+	}
+
+	// SAML 2.0 service providers of the enterprise tenants, which sign in
+	// and provision users of the user store
+	var samlService saml.SAMLService
+	if cfg.SAML.Enabled {
+		var spKey *rsa.PrivateKey
+		var spCert *x509.Certificate
+		if cfg.SAML.CertFile != "" {
+			spKey, spCert, err = samlpkg.LoadKeyPair(cfg.SAML.CertFile, cfg.SAML.KeyFile)
+		} else {
+			appLogger.Warn("no saml certificate configured, generating a temporary one")
+			spKey, spCert, err = samlpkg.GenerateKeyPair("sambhav")
+		}
+		if err != nil {
+			fatal(appLogger, "error loading saml certificate", err)
+		}
+		samlRepository := repository.NewSAMLRepository(dbInst)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		err = samlRepository.EnsureIndexes(ctx)
+		cancel()
+		if err != nil {
+			fatal(appLogger, "error creating saml indexes", err)
+		}
+		samlService = saml.NewSAMLService(samlRepository, userStore, dbInst, saml.Config{
+			BaseURL:     cfg.SAML.BaseURL,
+			RootURL:     cfg.Server.RootURL,
+			Key:         spKey,
+			Certificate: spCert,
+		}, auditService, bus, appMetrics, appLogger)
+	}
+
+	routeServices := services{
+		db:          dbInst,
+		ab:          abInst,
+		checks:      checks,
+		metrics:     appMetrics,
+		logger:      appLogger,
+		audit:       auditService,
+		users:       user.NewUserService(userRepository, dbInst, appMetrics, appLogger, auditService, bus),
+		webhooks:    webhookService,
+		apiKeys:     apiKeyService,
+		oauth:       oauthService,
+		saml:        samlService,
+		admins:      cfg.Auth.AdminEmails,
+		cors:        corsPolicies,
+		limits:      limits,
+		idempotency: idempotencyKeys,
+		server:      cfg.Server,
+		feature:     func(name string) bool { return configManager.Current().Feature(name) },
+	}
+
+	// probes, metrics and the admin API are served on an internal port, so
+	// that they are not exposed alongside the public API. It is started
+	// before and stopped after the public server, so that probes keep
+	// answering while the public server drains.
+	internalRouter, err := internalRoutes(routeServices)
+	if err != nil {
+		fatal(appLogger, "error setting up internal routes", err)
+	}
+	internalServer := newHTTPServer(cfg.Server, cfg.Server.InternalPort, internalRouter)
+	if serverTLS != nil {
+		internalServer.TLSConfig = serverTLS.internal
+	}
+	lc.Append(lc.Server("internal server", internalServer))
+
+	publicRouter, err := publicRoutes(routeServices)
+	if err != nil {
+		fatal(appLogger, "error setting up public routes", err)
+	}
+	server := newHTTPServer(cfg.Server, serverPort, publicRouter)
+	if serverTLS != nil {
+		server.TLSConfig = serverTLS.public
+	}
+	var h3Server *http3.Server
+	if cfg.Server.TLS.HTTP3 {
+		h3Server = newHTTP3Server(server, cfg.Server.IdleTimeout)
+	}
+	lc.Append(lc.Server("http server", server))
+	if h3Server != nil {
+		lc.Append(http3Hook(lc, "http3 server", h3Server))
+	}
+	if cfg.Server.TLS.RedirectPort > 0 {
+		redirectServer := newHTTPServer(cfg.Server, cfg.Server.TLS.RedirectPort, serverTLS.redirect)
+		lc.Append(lc.Server("redirect server", redirectServer))
+	}
+
+	// readiness is flipped last on start and first on stop, so that load
+	// balancers stop routing requests before the servers drain
+	lc.Append(lifecycle.Hook{
+		Name: "readiness",
+		OnStart: func(context.Context) error {
+			checks.SetReady(true)
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			checks.SetReady(false)
+			if cfg.Server.DrainDelay <= 0 {
+				return nil
+			}
+			appLogger.Info("draining before shutdown", "delay", cfg.Server.DrainDelay)
+			drain := time.NewTimer(cfg.Server.DrainDelay)
+			defer drain.Stop()
+			select {
+			case <-drain.C:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	})
+
+	if err := lc.Start(context.Background()); err != nil {
+		fatal(appLogger, "error starting server", err)
+	}
+	runErr := lc.Wait(context.Background())
+	stopErr := lc.Stop(context.Background())
+
+	switch {
+	case runErr != nil:
+		os.Exit(exitFailure)
+	case stopErr != nil:
+		appLogger.Error("shutdown was not clean", "error", stopErr)
+		os.Exit(exitUncleanShutdown)
+	}
+	appLogger.Info("graceful shutdown complete")
+}
+
+// smtpAddr returns the host:port of the configured SMTP server, or "" when
+// mail is not sent over SMTP.
+func smtpAddr(cfg config.MailConfig) string {
+	if cfg.SMTPHost == "" {
+		return ""
+	}
+	return net.JoinHostPort(cfg.SMTPHost, strconv.Itoa(cfg.SMTPPort))
+}
 
-	// Notify the main goroutine that the shutdown is complete
-	done <- true
+// fatal logs err and exits. It stands in for log.Fatalf once the structured
+// logger is set up.
+func fatal(logger *slog.Logger, msg string, err error) {
+	logger.Error(msg, "error", err)
+	os.Exit(exitFailure)
 }
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/pprof"
+	"sambhav/internal/apikey"
+	"sambhav/internal/audit"
+	"sambhav/internal/auth"
+	"sambhav/internal/general"
+	"sambhav/internal/oauth"
+	"sambhav/internal/saml"
+	"sambhav/internal/user"
+	"sambhav/internal/webhook"
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/config"
+	"sambhav/pkg/cors"
+	"sambhav/pkg/database"
+	"sambhav/pkg/health"
+	"sambhav/pkg/idempotency"
+	"sambhav/pkg/logger"
+	"sambhav/pkg/metrics"
+	"sambhav/pkg/ratelimit"
+	"sambhav/pkg/security"
+	"sambhav/pkg/tracing"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// services are the dependencies the routers are built from.
+type services struct {
+	db       database.Database
+	ab       *abpkg.Authboss
+	checks   *health.Registry
+	metrics  *metrics.Metrics
+	logger   *slog.Logger
+	audit    audit.AuditService
+	users    user.UserService
+	webhooks webhook.WebhookService
+	apiKeys  apikey.APIKeyService
+	// oauth is nil when the authorization server is disabled.
+	oauth oauth.OAuthService
+	// saml is nil when the SAML service provider is disabled.
+	saml saml.SAMLService
+	// admins are the PIDs of the users allowed on the admin routes.
+	admins []string
+	cors   *corsGroups
+	limits *ratelimit.Limiter
+	// idempotency replays the responses of retried POST requests.
+	idempotency *idempotency.Idempotency
+	server      config.ServerConfig
+	// feature reports whether a feature flag is on in the current
+	// configuration, which may be reloaded.
+	feature func(name string) bool
+}
+
+// authBodyLimit bounds the bodies of the login endpoints, which only take
+// credentials.
+const authBodyLimit = 16 << 10
+
+// newEngine returns an engine resolving client IPs through the trusted
+// proxies, with the recovery and security headers shared by both routers.
+func newEngine(s services) (*gin.Engine, error) {
+	router := gin.New()
+	if err := router.SetTrustedProxies(s.server.TrustedProxies); err != nil {
+		return nil, err
+	}
+	h := s.server.Headers
+	router.Use(
+		security.Recovery(s.logger),
+		security.ClientIPMiddleware(),
+		security.Headers(security.HeadersConfig{
+			HSTSMaxAge:            h.HSTSMaxAge,
+			HSTSIncludeSubdomains: h.HSTSIncludeSubdomains,
+			HSTSPreload:           h.HSTSPreload,
+			ContentSecurityPolicy: h.ContentSecurityPolicy,
+			ReferrerPolicy:        h.ReferrerPolicy,
+			FrameOptions:          h.FrameOptions,
+		}),
+	)
+	return router, nil
+}
+
+// corsGroups are the CORS policies of the route groups.
+type corsGroups struct {
+	auth  *cors.CORS
+	user  *cors.CORS
+	admin *cors.CORS
+}
+
+func newCORSGroups(cfg config.CORSConfig) (*corsGroups, error) {
+	g := &corsGroups{auth: new(cors.CORS), user: new(cors.CORS), admin: new(cors.CORS)}
+	if err := g.update(cfg); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// update applies cfg to every group, or to none when it is invalid.
+func (g *corsGroups) update(cfg config.CORSConfig) error {
+	policy := func(origins []string) cors.Policy {
+		if len(origins) == 0 {
+			origins = cfg.AllowedOrigins
+		}
+		return cors.Policy{
+			AllowedOrigins:   origins,
+			AllowedMethods:   cfg.AllowedMethods,
+			AllowedHeaders:   cfg.AllowedHeaders,
+			ExposedHeaders:   cfg.ExposedHeaders,
+			AllowCredentials: cfg.AllowCredentials,
+			MaxAge:           cfg.MaxAge,
+		}
+	}
+	auth, user, admin := policy(cfg.Groups.Auth), policy(cfg.Groups.User), policy(cfg.Groups.Admin)
+	for _, p := range []cors.Policy{auth, user, admin} {
+		if _, err := cors.New(p); err != nil {
+			return err
+		}
+	}
+	return errors.Join(g.auth.Update(auth), g.user.Update(user), g.admin.Update(admin))
+}
+
+// Rate limit rules, named after their settings.
+const (
+	limitDefault  = "default"
+	limitRegister = "register"
+	limitLogin    = "login"
+	limitRecover  = "recover"
+	limitOAuth    = "oauth"
+)
+
+// Feature flags, named after their keys under features.
+const (
+	// featureRegistrationClosed turns new sign ups with a password away,
+	// eg. during an attack, without a restart.
+	featureRegistrationClosed = "registration_closed"
+)
+
+// registrationOpen rejects sign ups with 403 while the registration_closed
+// feature flag is on. On the authboss catch-all route, only the register
+// endpoints are affected.
+func registrationOpen(feature func(name string) bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if path := c.Param("path"); path != "" && !strings.HasPrefix(path, "/register") {
+			c.Next()
+			return
+		}
+		if feature(featureRegistrationClosed) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Registration is closed"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// rateLimitRules returns the rate limit rules of cfg, or none when rate
+// limiting is disabled.
+func rateLimitRules(cfg config.RateLimitConfig) map[string]ratelimit.Rule {
+	if !cfg.Enabled {
+		return nil
+	}
+	rule := func(r config.RateLimitRule) ratelimit.Rule {
+		return ratelimit.Rule{
+			Requests:  r.Requests,
+			Period:    r.Period,
+			Algorithm: ratelimit.Algorithm(strings.ToLower(r.Algorithm)),
+			Burst:     r.Burst,
+			Key:       ratelimit.Key(strings.ToLower(r.Key)),
+		}
+	}
+	return map[string]ratelimit.Rule{
+		limitDefault:  rule(cfg.Default),
+		limitRegister: rule(cfg.Register),
+		limitLogin:    rule(cfg.Login),
+		limitRecover:  rule(cfg.Recover),
+		limitOAuth:    rule(cfg.OAuth),
+	}
+}
+
+// authbossLimits applies the rate limit rules of the authboss endpoints,
+// which are all served by one catch-all route.
+func authbossLimits(limits *ratelimit.Limiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		path := c.Param("path")
+		var rule string
+		switch {
+		case strings.HasPrefix(path, "/login"):
+			rule = limitLogin
+		case strings.HasPrefix(path, "/register"):
+			rule = limitRegister
+		case strings.HasPrefix(path, "/recover"):
+			rule = limitRecover
+		case strings.HasPrefix(path, "/oauth2/"):
+			rule = limitOAuth
+		}
+		if rule != "" && !limits.Allow(c, rule) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// publicRoutes returns the router of the public API.
+func publicRoutes(s services) (*gin.Engine, error) {
+	userHandlers := user.NewUserHandler(s.users)
+
+	router, err := newEngine(s)
+	if err != nil {
+		return nil, err
+	}
+	router.Use(
+		logger.RequestIDMiddleware(),
+		tracing.Middleware(),
+		logger.Middleware(s.logger),
+		s.metrics.Middleware(),
+		audit.Middleware(),
+		s.limits.Middleware(limitDefault),
+		security.BodyLimit(int64(s.server.MaxBodySize)),
+		// panics are recovered again once logged and counted
+		security.Recovery(s.logger),
+	)
+	// user routes
+	userRouter := router.Group("/user", s.cors.user.Middleware(), security.RequireJSON())
+	cors.Preflight(userRouter)
+	userRouter.POST("/", registrationOpen(s.feature), s.limits.Middleware(limitRegister), s.idempotency.Middleware(), userHandlers.RegisterUser)
+	// reading users takes a session or an API key with the users:read
+	// scope
+	readUsers := []gin.HandlerFunc{s.ab.RequireAuth(), abpkg.RequireScope(database.ScopeUsersRead)}
+	userRouter.GET("/", append(readUsers, userHandlers.GetAllUsers)...)
+	userRouter.GET("/:userID", append(readUsers, userHandlers.GetUserByID)...)
+
+	// cookie authenticated routes require a CSRF token on state changing
+	// requests; the catch-all authboss route handles OPTIONS, so preflights
+	// reach the CORS middleware without a preflight route. Authboss also
+	// takes forms.
+	s.ab.Mount(router.Group("/authboss", s.cors.auth.Middleware(), authbossLimits(s.limits), registrationOpen(s.feature), s.ab.CSRF()))
+
+	// API auth endpoints served by authboss
+	authHandler := auth.NewAuthHandler(s.ab)
+	apiAuth := router.Group("/api/auth", s.cors.auth.Middleware(), security.RequireJSON(), s.ab.CSRF())
+	cors.Preflight(apiAuth)
+	apiAuth.GET("/csrf", s.ab.CSRFToken)
+	apiAuth.POST("/login", s.limits.Middleware(limitLogin), security.BodyLimit(authBodyLimit), s.idempotency.Middleware(), authHandler.Login)
+	apiAuth.POST("/google/callback", s.limits.Middleware(limitOAuth), security.BodyLimit(authBodyLimit), authHandler.GoogleCallback)
+
+	sessionRouter := apiAuth.Group("/sessions", s.ab.RequireAuth())
+	sessionRouter.GET("/", authHandler.ListSessions)
+	sessionRouter.DELETE("/:id", authHandler.RevokeSession)
+	sessionRouter.POST("/revoke-others", authHandler.RevokeOtherSessions)
+
+	// OAuth2 authorization server; the token, introspection and revocation
+	// endpoints take forms and authenticate clients rather than users,
+	// while the consent API is used by the frontend with a session
+	if s.oauth != nil {
+		oauthHandler := oauth.NewOAuthHandler(s.oauth)
+		wellKnown := router.Group("/.well-known", s.cors.auth.Middleware())
+		cors.Preflight(wellKnown)
+		wellKnown.GET("/openid-configuration", oauthHandler.Discovery)
+		wellKnown.GET("/oauth-authorization-server", oauthHandler.Discovery)
+
+		oauthRouter := router.Group("/oauth", s.cors.auth.Middleware())
+		cors.Preflight(oauthRouter)
+		oauthRouter.GET("/jwks", oauthHandler.JWKS)
+		oauthRouter.GET("/authorize", oauthHandler.Authorize)
+		oauthRouter.POST("/token", security.BodyLimit(authBodyLimit), oauthHandler.Token)
+		oauthRouter.GET("/userinfo", oauthHandler.UserInfo)
+		oauthRouter.POST("/userinfo", oauthHandler.UserInfo)
+		oauthRouter.POST("/introspect", security.BodyLimit(authBodyLimit), oauthHandler.Introspect)
+		oauthRouter.POST("/revoke", security.BodyLimit(authBodyLimit), oauthHandler.Revoke)
+
+		consentRouter := oauthRouter.Group("/consent", security.RequireJSON(), s.ab.RequireAuth(), s.ab.CSRF())
+		consentRouter.GET("/:id", oauthHandler.GetConsent)
+		consentRouter.POST("/:id", oauthHandler.Consent)
+	}
+
+	// SAML service providers of the enterprise tenants; these are browser
+	// navigations, and the identity provider posts the response cross-site
+	// with a form, so they take neither CORS nor CSRF tokens
+	if s.saml != nil {
+		samlHandler := saml.NewSAMLHandler(s.saml, s.ab)
+		samlRouter := router.Group("/saml/:tenant")
+		samlRouter.GET("/metadata", samlHandler.Metadata)
+		samlRouter.GET("/login", s.limits.Middleware(limitOAuth), samlHandler.Login)
+		samlRouter.POST("/acs", s.limits.Middleware(limitOAuth), samlHandler.ACS)
+	}
+	return router, nil
+}
+
+// internalRoutes returns the router of the internal port: health probes,
+// metrics and profiling, which are polled often and are neither logged nor
+// traced, and the admin API, which requires an admin session like the
+// public API does.
+func internalRoutes(s services) (*gin.Engine, error) {
+	generalHandlers := general.NewGeneralHandler(s.checks, s.db)
+	userHandlers := user.NewUserHandler(s.users)
+
+	router, err := newEngine(s)
+	if err != nil {
+		return nil, err
+	}
+	router.Use(security.BodyLimit(int64(s.server.MaxBodySize)))
+	// probes and metrics
+	router.GET("/health", generalHandlers.HealthCheck)
+	router.GET("/livez", generalHandlers.Liveness)
+	router.GET("/readyz", generalHandlers.Readiness)
+	router.GET("/metrics", gin.WrapH(s.metrics.Handler()))
+	router.GET("/metrics/database", generalHandlers.DatabaseMetrics)
+
+	// profiling
+	debugRouter := router.Group("/debug/pprof", logger.Middleware(s.logger))
+	debugRouter.GET("/", gin.WrapF(pprof.Index))
+	debugRouter.GET("/cmdline", gin.WrapF(pprof.Cmdline))
+	debugRouter.GET("/profile", gin.WrapF(pprof.Profile))
+	debugRouter.GET("/symbol", gin.WrapF(pprof.Symbol))
+	debugRouter.POST("/symbol", gin.WrapF(pprof.Symbol))
+	debugRouter.GET("/trace", gin.WrapF(pprof.Trace))
+	debugRouter.GET("/:profile", gin.WrapF(pprof.Index))
+
+	// admin routes
+	adminRouter := router.Group("/admin",
+		s.cors.admin.Middleware(),
+		logger.RequestIDMiddleware(),
+		tracing.Middleware(),
+		logger.Middleware(s.logger),
+		s.metrics.Middleware(),
+		audit.Middleware(),
+		security.Recovery(s.logger),
+		security.RequireJSON(),
+		s.ab.RequireAuth(),
+		abpkg.RequireScope(database.ScopeAdmin),
+		abpkg.RequireAdmin(s.admins),
+		s.ab.CSRF(),
+	)
+	cors.Preflight(adminRouter)
+	auditHandler := audit.NewAuditHandler(s.audit)
+	adminRouter.GET("/audit", auditHandler.ListEntries)
+	adminRouter.GET("/audit/verify", auditHandler.VerifyChain)
+
+	adminRouter.PATCH("/users/:userID", userHandlers.UpdateUser)
+	adminRouter.DELETE("/users/:userID", userHandlers.DeleteUser)
+
+	webhookHandler := webhook.NewWebhookHandler(s.webhooks)
+	webhookRouter := adminRouter.Group("/webhooks")
+	webhookRouter.POST("/", webhookHandler.CreateSubscription)
+	webhookRouter.GET("/", webhookHandler.ListSubscriptions)
+	webhookRouter.GET("/:id", webhookHandler.GetSubscription)
+	webhookRouter.PATCH("/:id", webhookHandler.UpdateSubscription)
+	webhookRouter.DELETE("/:id", webhookHandler.DeleteSubscription)
+	webhookRouter.POST("/:id/rotate-secret", webhookHandler.RotateSecret)
+	webhookRouter.GET("/:id/deliveries", webhookHandler.ListDeliveries)
+	webhookRouter.POST("/:id/deliveries/:deliveryID/replay", webhookHandler.ReplayDelivery)
+
+	apiKeyHandler := apikey.NewAPIKeyHandler(s.apiKeys)
+	accountRouter := adminRouter.Group("/service-accounts")
+	accountRouter.POST("/", apiKeyHandler.CreateServiceAccount)
+	accountRouter.GET("/", apiKeyHandler.ListServiceAccounts)
+	accountRouter.GET("/:id", apiKeyHandler.GetServiceAccount)
+	accountRouter.DELETE("/:id", apiKeyHandler.DeleteServiceAccount)
+	accountRouter.POST("/:id/api-keys", apiKeyHandler.IssueKey)
+	accountRouter.GET("/:id/api-keys", apiKeyHandler.ListKeys)
+	accountRouter.DELETE("/:id/api-keys/:keyID", apiKeyHandler.RevokeKey)
+
+	if s.oauth != nil {
+		oauthHandler := oauth.NewOAuthHandler(s.oauth)
+		clientRouter := adminRouter.Group("/oauth/clients")
+		clientRouter.POST("/", oauthHandler.RegisterClient)
+		clientRouter.GET("/", oauthHandler.ListClients)
+		clientRouter.GET("/:id", oauthHandler.GetClient)
+		clientRouter.DELETE("/:id", oauthHandler.DeleteClient)
+		clientRouter.POST("/:id/rotate-secret", oauthHandler.RotateClientSecret)
+	}
+
+	if s.saml != nil {
+		samlHandler := saml.NewSAMLHandler(s.saml, s.ab)
+		tenantRouter := adminRouter.Group("/saml/tenants")
+		tenantRouter.POST("/", samlHandler.CreateTenant)
+		tenantRouter.GET("/", samlHandler.ListTenants)
+		tenantRouter.GET("/:id", samlHandler.GetTenant)
+		tenantRouter.PATCH("/:id", samlHandler.UpdateTenant)
+		tenantRouter.PUT("/:id/metadata", samlHandler.ImportMetadata)
+		tenantRouter.DELETE("/:id", samlHandler.DeleteTenant)
+	}
+	return router, nil
+}
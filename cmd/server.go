@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sambhav/pkg/certs"
+	"sambhav/pkg/config"
+	"sambhav/pkg/lifecycle"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+	"golang.org/x/crypto/acme"
+)
+
+// newHTTPServer creates a server listening on port with the timeouts of
+// cfg.
+func newHTTPServer(cfg config.ServerConfig, port int, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+// serverTLS is the TLS configuration of the servers.
+type serverTLS struct {
+	// public is the configuration of the API server.
+	public *tls.Config
+	// internal is the configuration of the internal server, which also
+	// verifies client certificates when client CAs are configured.
+	internal *tls.Config
+	// redirect redirects plain HTTP requests to HTTPS and answers ACME
+	// HTTP challenges.
+	redirect http.Handler
+	// watch keeps the certificates read from files up to date.
+	watch func(ctx context.Context) error
+}
+
+// newServerTLS builds the TLS configuration of the servers, or returns nil
+// when TLS is disabled.
+func newServerTLS(cfg config.ServerConfig, logger *slog.Logger) (*serverTLS, error) {
+	if !cfg.TLS.Enabled() {
+		return nil, nil
+	}
+	minVersion, err := certs.ParseVersion(cfg.TLS.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	reloader, err := certs.NewReloader(cfg.TLS.CertFile, cfg.TLS.KeyFile, cfg.TLS.ClientCAFile, logger)
+	if err != nil {
+		return nil, err
+	}
+	st := &serverTLS{
+		redirect: certs.RedirectHandler(cfg.Port),
+		watch:    reloader.Watch,
+	}
+
+	tlsCfg := certs.Config{MinVersion: minVersion, GetCertificate: reloader.GetCertificate}
+	if len(cfg.TLS.ACME.Domains) > 0 {
+		manager := certs.NewACME(certs.ACMEConfig{
+			Domains:      cfg.TLS.ACME.Domains,
+			Email:        cfg.TLS.ACME.Email,
+			CacheDir:     cfg.TLS.ACME.CacheDir,
+			DirectoryURL: cfg.TLS.ACME.DirectoryURL,
+		})
+		tlsCfg.GetCertificate = manager.GetCertificate
+		tlsCfg.NextProtos = []string{acme.ALPNProto}
+		st.redirect = manager.HTTPHandler(st.redirect)
+	}
+	st.public = certs.ServerConfig(tlsCfg)
+
+	if cfg.TLS.ClientCAFile != "" {
+		tlsCfg.ClientCAs = reloader.ClientCAs
+	}
+	st.internal = certs.ServerConfig(tlsCfg)
+	return st, nil
+}
+
+// newHTTP3Server creates a server for HTTP/3 over QUIC on the UDP port of
+// srv, and makes srv advertise it to clients with the Alt-Svc header.
+func newHTTP3Server(srv *http.Server, idleTimeout time.Duration) *http3.Server {
+	h3 := &http3.Server{
+		Addr:        srv.Addr,
+		Handler:     srv.Handler,
+		TLSConfig:   srv.TLSConfig,
+		IdleTimeout: idleTimeout,
+		// 0-RTT requests can be replayed, keep them disabled
+		QUICConfig: &quic.Config{Allow0RTT: false},
+	}
+	next := srv.Handler
+	srv.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// fails until the QUIC listener is up, there is nothing to
+		// advertise until then
+		_ = h3.SetQUICHeaders(w.Header())
+		next.ServeHTTP(w, r)
+	})
+	return h3
+}
+
+// http3Hook returns a hook serving srv. Like lifecycle.Server, it opens
+// the UDP socket on start and shuts the server down gracefully on stop.
+func http3Hook(lc *lifecycle.Lifecycle, name string, srv *http3.Server) lifecycle.Hook {
+	var conn net.PacketConn
+	return lifecycle.Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			var lcfg net.ListenConfig
+			var err error
+			if conn, err = lcfg.ListenPacket(ctx, "udp", srv.Addr); err != nil {
+				return err
+			}
+			go func() {
+				if err := srv.Serve(conn); err != nil && !errors.Is(err, http.ErrServerClosed) && !errors.Is(err, quic.ErrServerClosed) {
+					lc.Fail(name, err)
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			err := srv.Shutdown(ctx)
+			// the server does not close sockets it was given
+			return errors.Join(err, conn.Close())
+		},
+	}
+}
@@ -0,0 +1,138 @@
+package apikey
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+type APIKeyHandler interface {
+	CreateServiceAccount(c *gin.Context)
+	ListServiceAccounts(c *gin.Context)
+	GetServiceAccount(c *gin.Context)
+	DeleteServiceAccount(c *gin.Context)
+	IssueKey(c *gin.Context)
+	ListKeys(c *gin.Context)
+	RevokeKey(c *gin.Context)
+}
+
+type apiKeyHandler struct {
+	apiKeyService APIKeyService
+}
+
+func NewAPIKeyHandler(apiKeyService APIKeyService) APIKeyHandler {
+	return &apiKeyHandler{apiKeyService: apiKeyService}
+}
+
+func (h *apiKeyHandler) CreateServiceAccount(c *gin.Context) {
+	var req struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	account, err := h.apiKeyService.CreateServiceAccount(c.Request.Context(), c.GetString(abpkg.ContextKeyPID), req.Name, req.Description)
+	if err != nil {
+		writeError(c, err, "Failed to create service account")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"service_account": account, "pid": account.PID()})
+}
+
+func (h *apiKeyHandler) ListServiceAccounts(c *gin.Context) {
+	accounts, err := h.apiKeyService.ListServiceAccounts(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list service accounts"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"service_accounts": accounts})
+}
+
+func (h *apiKeyHandler) GetServiceAccount(c *gin.Context) {
+	account, err := h.apiKeyService.GetServiceAccount(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to get service account")
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+// DeleteServiceAccount deletes a service account and revokes its keys.
+func (h *apiKeyHandler) DeleteServiceAccount(c *gin.Context) {
+	if err := h.apiKeyService.DeleteServiceAccount(c.Request.Context(), c.Param("id")); err != nil {
+		writeError(c, err, "Failed to delete service account")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// IssueKey creates an API key for a service account. The key is only
+// returned in this response.
+func (h *apiKeyHandler) IssueKey(c *gin.Context) {
+	var req struct {
+		Name      string     `json:"name"`
+		Scopes    []string   `json:"scopes"`
+		ExpiresAt *time.Time `json:"expires_at"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	in := KeyInput{Name: req.Name, Scopes: req.Scopes, ExpiresAt: req.ExpiresAt}
+	apiKey, key, err := h.apiKeyService.IssueKey(c.Request.Context(), c.GetString(abpkg.ContextKeyPID), c.Param("id"), in)
+	if err != nil {
+		writeError(c, err, "Failed to issue API key")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"api_key": apiKey, "key": key})
+}
+
+func (h *apiKeyHandler) ListKeys(c *gin.Context) {
+	keys, err := h.apiKeyService.ListKeys(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to list API keys")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"api_keys": keys})
+}
+
+func (h *apiKeyHandler) RevokeKey(c *gin.Context) {
+	if err := h.apiKeyService.RevokeKey(c.Request.Context(), c.Param("id"), c.Param("keyID")); err != nil {
+		writeError(c, err, "Failed to revoke API key")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func writeError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrServiceAccountNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+	case errors.Is(err, database.ErrAPIKeyNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "API key not found"})
+	case errors.Is(err, ErrInvalidName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name is required"})
+	case errors.Is(err, ErrInvalidScopes):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Scopes must name known scopes"})
+	case errors.Is(err, ErrInvalidExpiry):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Expiry must be in the future"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,250 @@
+// Package apikey manages service accounts and the API keys machine clients
+// authenticate with in place of a session.
+package apikey
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	"sambhav/internal/audit"
+	"sambhav/internal/repository"
+	"sambhav/pkg/database"
+	"sambhav/pkg/security"
+)
+
+const (
+	// keyPrefix starts every API key, so that leaked keys are easy to
+	// recognise and scan for.
+	keyPrefix = "sk_"
+	// lastUsedInterval limits how often using a key records its last use,
+	// so that not every request results in a write.
+	lastUsedInterval = time.Minute
+)
+
+var (
+	ErrInvalidName   = errors.New("apikey: name is required")
+	ErrInvalidScopes = errors.New("apikey: scopes must name known scopes")
+	ErrInvalidExpiry = errors.New("apikey: expiry must be in the future")
+)
+
+// KeyInput holds the fields of a new API key. A nil ExpiresAt makes a key
+// that does not expire.
+type KeyInput struct {
+	Name      string
+	Scopes    []string
+	ExpiresAt *time.Time
+}
+
+type APIKeyService interface {
+	CreateServiceAccount(ctx context.Context, createdBy, name, description string) (*database.ServiceAccount, error)
+	ListServiceAccounts(ctx context.Context) ([]*database.ServiceAccount, error)
+	GetServiceAccount(ctx context.Context, id string) (*database.ServiceAccount, error)
+	// DeleteServiceAccount deletes a service account and revokes its keys.
+	DeleteServiceAccount(ctx context.Context, id string) error
+	// IssueKey creates an API key for a service account and returns it
+	// along with the key itself, which is not shown again.
+	IssueKey(ctx context.Context, createdBy, serviceAccountID string, in KeyInput) (*database.APIKey, string, error)
+	ListKeys(ctx context.Context, serviceAccountID string) ([]*database.APIKey, error)
+	RevokeKey(ctx context.Context, serviceAccountID, id string) error
+	// AuthenticateAPIKey returns the PID of the service account key
+	// belongs to and the scopes it grants, and records its use from ip.
+	AuthenticateAPIKey(ctx context.Context, key, ip string) (string, []string, error)
+}
+
+type apiKeyService struct {
+	apiKeyRepository repository.APIKeyRepository
+	logger           *slog.Logger
+	audit            audit.AuditService
+}
+
+// NewAPIKeyService constructor. Issuing and revoking keys changes what a
+// service account may do, so both are recorded as role changes.
+func NewAPIKeyService(apiKeyRepo repository.APIKeyRepository, logger *slog.Logger, auditService audit.AuditService) APIKeyService {
+	return &apiKeyService{apiKeyRepository: apiKeyRepo, logger: logger, audit: auditService}
+}
+
+func (s *apiKeyService) CreateServiceAccount(ctx context.Context, createdBy, name, description string) (*database.ServiceAccount, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return nil, ErrInvalidName
+	}
+
+	account := &database.ServiceAccount{
+		ID:          security.RandomHex(12),
+		Name:        name,
+		Description: description,
+		CreatedBy:   createdBy,
+		CreatedAt:   time.Now().UTC(),
+	}
+	if err := s.apiKeyRepository.CreateServiceAccount(ctx, account); err != nil {
+		return nil, err
+	}
+	s.logger.InfoContext(ctx, "service account created", "service_account_id", account.ID)
+	return account, nil
+}
+
+func (s *apiKeyService) ListServiceAccounts(ctx context.Context) ([]*database.ServiceAccount, error) {
+	return s.apiKeyRepository.ListServiceAccounts(ctx)
+}
+
+func (s *apiKeyService) GetServiceAccount(ctx context.Context, id string) (*database.ServiceAccount, error) {
+	return s.apiKeyRepository.GetServiceAccount(ctx, id)
+}
+
+func (s *apiKeyService) DeleteServiceAccount(ctx context.Context, id string) error {
+	// the keys of the account are revoked before it is deleted, so that a
+	// delete failing halfway leaves an account that cannot authenticate
+	// and can be deleted again
+	if _, err := s.apiKeyRepository.GetServiceAccount(ctx, id); err != nil {
+		return err
+	}
+	account := database.ServiceAccount{ID: id}
+	entry := database.AuditEntry{
+		Action:  database.AuditRoleChange,
+		Target:  account.PID(),
+		Details: map[string]string{"change": "revoke_all"},
+	}
+	if err := s.apiKeyRepository.RevokeAPIKeys(ctx, id, time.Now().UTC()); err != nil {
+		entry.Outcome = database.AuditFailure
+		s.audit.Record(ctx, entry)
+		return err
+	}
+	entry.Outcome = database.AuditSuccess
+	s.audit.Record(ctx, entry)
+	if err := s.apiKeyRepository.DeleteServiceAccount(ctx, id); err != nil {
+		return err
+	}
+	s.logger.InfoContext(ctx, "service account deleted", "service_account_id", id)
+	return nil
+}
+
+func (s *apiKeyService) IssueKey(ctx context.Context, createdBy, serviceAccountID string, in KeyInput) (*database.APIKey, string, error) {
+	name := strings.TrimSpace(in.Name)
+	if name == "" {
+		return nil, "", ErrInvalidName
+	}
+	if len(in.Scopes) == 0 {
+		return nil, "", ErrInvalidScopes
+	}
+	for _, scope := range in.Scopes {
+		if !slices.Contains(database.Scopes, scope) {
+			return nil, "", ErrInvalidScopes
+		}
+	}
+	now := time.Now().UTC()
+	if in.ExpiresAt != nil && !in.ExpiresAt.After(now) {
+		return nil, "", ErrInvalidExpiry
+	}
+	if _, err := s.apiKeyRepository.GetServiceAccount(ctx, serviceAccountID); err != nil {
+		return nil, "", err
+	}
+
+	prefix, key := newKey()
+	apiKey := &database.APIKey{
+		ID:               security.RandomHex(12),
+		ServiceAccountID: serviceAccountID,
+		Name:             name,
+		Prefix:           prefix,
+		Hash:             hashKey(key),
+		Scopes:           slices.Compact(slices.Sorted(slices.Values(in.Scopes))),
+		CreatedBy:        createdBy,
+		CreatedAt:        now,
+		ExpiresAt:        in.ExpiresAt,
+	}
+	account := database.ServiceAccount{ID: serviceAccountID}
+	entry := database.AuditEntry{
+		Action:  database.AuditRoleChange,
+		Actor:   createdBy,
+		Target:  account.PID(),
+		Details: map[string]string{"change": "grant", "api_key_id": apiKey.ID, "scopes": strings.Join(apiKey.Scopes, ",")},
+	}
+	if err := s.apiKeyRepository.CreateAPIKey(ctx, apiKey); err != nil {
+		entry.Outcome = database.AuditFailure
+		s.audit.Record(ctx, entry)
+		return nil, "", err
+	}
+	entry.Outcome = database.AuditSuccess
+	s.audit.Record(ctx, entry)
+	s.logger.InfoContext(ctx, "api key issued", "service_account_id", serviceAccountID, "api_key_id", apiKey.ID, "scopes", apiKey.Scopes)
+	return apiKey, key, nil
+}
+
+func (s *apiKeyService) ListKeys(ctx context.Context, serviceAccountID string) ([]*database.APIKey, error) {
+	if _, err := s.apiKeyRepository.GetServiceAccount(ctx, serviceAccountID); err != nil {
+		return nil, err
+	}
+	return s.apiKeyRepository.ListAPIKeys(ctx, serviceAccountID)
+}
+
+func (s *apiKeyService) RevokeKey(ctx context.Context, serviceAccountID, id string) error {
+	account := database.ServiceAccount{ID: serviceAccountID}
+	entry := database.AuditEntry{
+		Action:  database.AuditRoleChange,
+		Target:  account.PID(),
+		Details: map[string]string{"change": "revoke", "api_key_id": id},
+	}
+	if err := s.apiKeyRepository.RevokeAPIKey(ctx, serviceAccountID, id, time.Now().UTC()); err != nil {
+		entry.Outcome = database.AuditFailure
+		s.audit.Record(ctx, entry)
+		return err
+	}
+	entry.Outcome = database.AuditSuccess
+	s.audit.Record(ctx, entry)
+	s.logger.InfoContext(ctx, "api key revoked", "service_account_id", serviceAccountID, "api_key_id", id)
+	return nil
+}
+
+func (s *apiKeyService) AuthenticateAPIKey(ctx context.Context, key, ip string) (string, []string, error) {
+	prefix, ok := parseKey(key)
+	if !ok {
+		return "", nil, database.ErrAPIKeyNotFound
+	}
+	apiKey, err := s.apiKeyRepository.GetAPIKeyByPrefix(ctx, prefix)
+	if err != nil {
+		return "", nil, err
+	}
+	now := time.Now().UTC()
+	if subtle.ConstantTimeCompare([]byte(hashKey(key)), []byte(apiKey.Hash)) != 1 || !apiKey.Active(now) {
+		return "", nil, database.ErrAPIKeyNotFound
+	}
+
+	if apiKey.LastUsedAt == nil || now.Sub(*apiKey.LastUsedAt) > lastUsedInterval || apiKey.LastUsedIP != ip {
+		if err := s.apiKeyRepository.TouchAPIKey(ctx, apiKey.ID, now, ip); err != nil {
+			s.logger.ErrorContext(ctx, "failed to record api key use", "api_key_id", apiKey.ID, "error", err)
+		}
+	}
+
+	account := database.ServiceAccount{ID: apiKey.ServiceAccountID}
+	return account.PID(), apiKey.Scopes, nil
+}
+
+// newKey generates an API key, sk_<prefix>_<secret>, and returns its
+// prefix along with it.
+func newKey() (prefix, key string) {
+	prefix = security.RandomHex(6)
+	return prefix, keyPrefix + prefix + "_" + security.RandomToken(32)
+}
+
+// parseKey returns the prefix of key, if it is shaped like an API key.
+func parseKey(key string) (string, bool) {
+	rest, ok := strings.CutPrefix(key, keyPrefix)
+	if !ok {
+		return "", false
+	}
+	prefix, secret, ok := strings.Cut(rest, "_")
+	return prefix, ok && len(prefix) == 12 && secret != ""
+}
+
+// hashKey hashes an API key for storage. Keys are random and long, so a
+// fast hash is enough; a slow one would only slow every request down.
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
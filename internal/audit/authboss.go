@@ -0,0 +1,46 @@
+package audit
+
+import (
+	"net/http"
+
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+	"sambhav/pkg/security"
+
+	"github.com/aarondl/authboss/v3"
+)
+
+// ObserveAuthboss records logins, logouts, password resets, 2FA changes,
+// OAuth2 logins and registrations handled by authboss. A failure to record
+// an entry is logged but does not fail the request.
+func ObserveAuthboss(events *authboss.Events, s AuditService) {
+	events.After(authboss.EventAuth, record(s, database.AuditLogin, database.AuditSuccess))
+	events.After(authboss.EventAuthFail, record(s, database.AuditLogin, database.AuditFailure))
+	events.After(authboss.EventLogout, record(s, database.AuditLogout, database.AuditSuccess))
+	events.After(authboss.EventRecoverEnd, record(s, database.AuditPasswordChange, database.AuditSuccess))
+	events.After(authboss.EventTwoFactorAdded, record(s, database.AuditTwoFactorAdd, database.AuditSuccess))
+	events.After(authboss.EventTwoFactorRemoved, record(s, database.AuditTwoFactorRemove, database.AuditSuccess))
+	events.After(authboss.EventOAuth2, record(s, database.AuditOAuth2Link, database.AuditSuccess))
+	events.After(authboss.EventOAuth2Fail, record(s, database.AuditOAuth2Link, database.AuditFailure))
+	events.After(authboss.EventRegister, record(s, database.AuditUserCreate, database.AuditSuccess))
+}
+
+func record(s AuditService, action, outcome string) authboss.EventHandler {
+	return func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		pid := abpkg.EventPID(r)
+		entry := database.AuditEntry{
+			Action:    action,
+			Outcome:   outcome,
+			Actor:     pid,
+			Target:    pid,
+			IP:        security.ClientIP(r),
+			UserAgent: r.UserAgent(),
+		}
+		if action == database.AuditOAuth2Link {
+			entry.Details = map[string]string{"provider": abpkg.OAuth2Provider(r)}
+		}
+
+		s.Record(r.Context(), entry)
+		return handled, nil
+	}
+}
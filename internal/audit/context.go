@@ -0,0 +1,25 @@
+package audit
+
+import (
+	"context"
+
+	"github.com/gin-gonic/gin"
+)
+
+type userAgentKey struct{}
+
+// Middleware stores the user agent of the request in its context, so that
+// actions recorded further down, outside of the HTTP layer, are attributed
+// to the right client. The client IP is read from the context set by
+// security.ClientIPMiddleware.
+func Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), userAgentKey{}, c.Request.UserAgent()))
+		c.Next()
+	}
+}
+
+func userAgentFromContext(ctx context.Context) string {
+	ua, _ := ctx.Value(userAgentKey{}).(string)
+	return ua
+}
@@ -0,0 +1,101 @@
+package audit
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditHandler interface {
+	ListEntries(c *gin.Context)
+	VerifyChain(c *gin.Context)
+}
+
+type auditHandler struct {
+	auditService AuditService
+}
+
+func NewAuditHandler(auditService AuditService) AuditHandler {
+	return &auditHandler{auditService: auditService}
+}
+
+// ListEntries returns audit entries, newest first. They can be filtered by
+// the actor, target, action and outcome query parameters and by a from/to
+// time range in RFC 3339 format. Pages are fetched by passing the
+// next_before value of a response as the before parameter.
+func (h *auditHandler) ListEntries(c *gin.Context) {
+	filter := database.AuditFilter{
+		Actor:   c.Query("actor"),
+		Target:  c.Query("target"),
+		Action:  c.Query("action"),
+		Outcome: c.Query("outcome"),
+	}
+
+	var err error
+	if filter.From, err = parseTime(c.Query("from")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid from time"})
+		return
+	}
+	if filter.To, err = parseTime(c.Query("to")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid to time"})
+		return
+	}
+	if filter.BeforeSeq, err = parseInt(c.Query("before")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid before parameter"})
+		return
+	}
+	if filter.Limit, err = parseInt(c.Query("limit")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+		return
+	}
+
+	entries, err := h.auditService.List(c.Request.Context(), filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list audit entries"})
+		return
+	}
+
+	resp := gin.H{"entries": entries}
+	if len(entries) > 0 {
+		resp["next_before"] = entries[len(entries)-1].Seq
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// VerifyChain checks the hash chain of the whole audit log. It responds 409
+// when an entry was altered or removed.
+func (h *auditHandler) VerifyChain(c *gin.Context) {
+	checked, err := h.auditService.Verify(c.Request.Context())
+	if errors.Is(err, database.ErrAuditChainBroken) {
+		c.JSON(http.StatusConflict, gin.H{"valid": false, "checked": checked, "error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify audit log"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"valid": true, "checked": checked})
+}
+
+func parseTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+func parseInt(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err == nil && n < 0 {
+		return 0, errors.New("negative value")
+	}
+	return n, err
+}
@@ -0,0 +1,64 @@
+package audit
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"sambhav/internal/repository"
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+	"sambhav/pkg/logger"
+	"sambhav/pkg/security"
+)
+
+type AuditService interface {
+	// Record appends entry to the audit log. The time, actor, IP, user
+	// agent and request ID are filled in from ctx when left empty, the
+	// actor being the user or service account the request was
+	// authenticated as.
+	Record(ctx context.Context, entry database.AuditEntry) error
+	List(ctx context.Context, filter database.AuditFilter) ([]*database.AuditEntry, error)
+	Verify(ctx context.Context) (int64, error)
+}
+
+type auditService struct {
+	auditRepository repository.AuditRepository
+	logger          *slog.Logger
+}
+
+func NewAuditService(auditRepo repository.AuditRepository, logger *slog.Logger) AuditService {
+	return &auditService{auditRepository: auditRepo, logger: logger}
+}
+
+func (s *auditService) Record(ctx context.Context, entry database.AuditEntry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.Actor == "" {
+		entry.Actor = abpkg.PIDFromContext(ctx)
+	}
+	if entry.IP == "" {
+		entry.IP = security.ClientIPFromContext(ctx)
+	}
+	if entry.UserAgent == "" {
+		entry.UserAgent = userAgentFromContext(ctx)
+	}
+	if entry.RequestID == "" {
+		entry.RequestID = logger.RequestID(ctx)
+	}
+
+	if err := s.auditRepository.AppendAuditEntry(ctx, &entry); err != nil {
+		s.logger.ErrorContext(ctx, "failed to record audit entry", "action", entry.Action, "error", err)
+		return err
+	}
+	return nil
+}
+
+func (s *auditService) List(ctx context.Context, filter database.AuditFilter) ([]*database.AuditEntry, error) {
+	return s.auditRepository.ListAuditEntries(ctx, filter)
+}
+
+func (s *auditService) Verify(ctx context.Context) (int64, error) {
+	return s.auditRepository.VerifyAuditChain(ctx)
+}
@@ -0,0 +1,88 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+type sessionResponse struct {
+	*database.Session
+	Current bool `json:"current"`
+}
+
+// ListSessions returns the active sessions of the logged in user, marking
+// the one the request was made with.
+func (h *AuthHandler) ListSessions(c *gin.Context) {
+	sessions := h.ab.Sessions()
+	if sessions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server side sessions are not enabled"})
+		return
+	}
+
+	pid := c.GetString(abpkg.ContextKeyPID)
+	list, err := sessions.List(c.Request.Context(), pid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list sessions"})
+		return
+	}
+
+	currentID := sessions.SessionID(c.Request)
+	resp := make([]sessionResponse, 0, len(list))
+	for _, s := range list {
+		resp = append(resp, sessionResponse{Session: s, Current: s.ID == currentID})
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// RevokeSession signs the logged in user out of the session whose handle is
+// given by the id path parameter.
+func (h *AuthHandler) RevokeSession(c *gin.Context) {
+	sessions := h.ab.Sessions()
+	if sessions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server side sessions are not enabled"})
+		return
+	}
+
+	pid := c.GetString(abpkg.ContextKeyPID)
+	err := sessions.Revoke(c.Request.Context(), pid, c.Param("id"))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Session not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke session"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RevokeOtherSessions signs the logged in user out of every session except
+// the one the request was made with. Requests made without a session, eg.
+// with an API key, get 400.
+func (h *AuthHandler) RevokeOtherSessions(c *gin.Context) {
+	sessions := h.ab.Sessions()
+	if sessions == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Server side sessions are not enabled"})
+		return
+	}
+
+	// without a session of its own, eg. with an API key, the request would
+	// sign the user out everywhere
+	pid := c.GetString(abpkg.ContextKeyPID)
+	revoked, err := sessions.RevokeOthers(c.Request.Context(), pid, sessions.SessionID(c.Request))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Request was not made with a session"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
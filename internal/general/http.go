@@ -3,27 +3,71 @@ package general
 import (
 	"net/http"
 	"sambhav/pkg/database"
+	"sambhav/pkg/health"
 
 	"github.com/gin-gonic/gin"
 )
 
 type GeneralHandler interface {
 	HealthCheck(c *gin.Context)
+	Liveness(c *gin.Context)
+	Readiness(c *gin.Context)
+	DatabaseMetrics(c *gin.Context)
 }
 
 type generalHandler struct {
-	db database.Database
+	checks *health.Registry
+	db     database.Database
 }
 
-func NewGeneralHandler(db database.Database) GeneralHandler {
+func NewGeneralHandler(checks *health.Registry, db database.Database) GeneralHandler {
 	return &generalHandler{
-		db: db,
+		checks: checks,
+		db:     db,
 	}
 }
 
+// HealthCheck reports the result of every registered check along with its
+// latency. It responds 503 only when a critical check is down, a degraded
+// service still answers 200.
 func (gh *generalHandler) HealthCheck(c *gin.Context) {
-	c.JSON(http.StatusOK, gin.H{
-		"server":   "ok",
-		"database": gh.db.Health(),
-	})
+	report := gh.checks.Run(c.Request.Context())
+
+	status := http.StatusOK
+	if report.Status == health.StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, report)
+}
+
+// Liveness reports that the process is running and able to serve requests.
+// It never looks at dependencies so a flaky database does not get the
+// process restarted.
+func (gh *generalHandler) Liveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": health.StatusUp})
+}
+
+// Readiness reports whether the service should receive traffic, responding
+// 503 while it is starting or draining, or when a critical check is down. A
+// service degraded by a failing non-critical check is reported as such but
+// stays in rotation.
+func (gh *generalHandler) Readiness(c *gin.Context) {
+	if !gh.checks.Ready() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not_ready"})
+		return
+	}
+
+	report := gh.checks.Run(c.Request.Context())
+
+	status := http.StatusOK
+	if report.Status == health.StatusDown {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"status": report.Status})
+}
+
+// DatabaseMetrics reports connection pool statistics and per collection
+// command latencies gathered from the database driver.
+func (gh *generalHandler) DatabaseMetrics(c *gin.Context) {
+	c.JSON(http.StatusOK, gh.db.Stats())
 }
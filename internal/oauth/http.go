@@ -0,0 +1,332 @@
+package oauth
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+type OAuthHandler interface {
+	Discovery(c *gin.Context)
+	JWKS(c *gin.Context)
+	Authorize(c *gin.Context)
+	GetConsent(c *gin.Context)
+	Consent(c *gin.Context)
+	Token(c *gin.Context)
+	UserInfo(c *gin.Context)
+	Introspect(c *gin.Context)
+	Revoke(c *gin.Context)
+
+	RegisterClient(c *gin.Context)
+	ListClients(c *gin.Context)
+	GetClient(c *gin.Context)
+	DeleteClient(c *gin.Context)
+	RotateClientSecret(c *gin.Context)
+}
+
+type oauthHandler struct {
+	oauthService OAuthService
+}
+
+func NewOAuthHandler(oauthService OAuthService) OAuthHandler {
+	return &oauthHandler{oauthService: oauthService}
+}
+
+func (h *oauthHandler) Discovery(c *gin.Context) {
+	c.JSON(http.StatusOK, h.oauthService.Discovery())
+}
+
+func (h *oauthHandler) JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, h.oauthService.JWKS())
+}
+
+// Authorize redirects the user agent to the consent page, or back to the
+// client with an error.
+func (h *oauthHandler) Authorize(c *gin.Context) {
+	redirectTo, err := h.oauthService.Authorize(c.Request.Context(), AuthorizeRequest{
+		ResponseType:        c.Query("response_type"),
+		ClientID:            c.Query("client_id"),
+		RedirectURI:         c.Query("redirect_uri"),
+		Scope:               c.Query("scope"),
+		State:               c.Query("state"),
+		Nonce:               c.Query("nonce"),
+		CodeChallenge:       c.Query("code_challenge"),
+		CodeChallengeMethod: c.Query("code_challenge_method"),
+	})
+	if err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+
+	c.Redirect(http.StatusFound, redirectTo)
+}
+
+// GetConsent returns the authorization request id for the consent page to
+// show to the signed in user.
+func (h *oauthHandler) GetConsent(c *gin.Context) {
+	req, err := h.oauthService.GetConsentRequest(c.Request.Context(), c.GetString(abpkg.ContextKeyPID), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to get authorization request")
+		return
+	}
+
+	c.JSON(http.StatusOK, req)
+}
+
+// Consent accepts JSON {"approve": true|false} and returns the URL the
+// consent page sends the user agent back to the client with.
+func (h *oauthHandler) Consent(c *gin.Context) {
+	var req struct {
+		Approve *bool `json:"approve"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Approve == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	redirectTo, err := h.oauthService.Consent(c.Request.Context(), c.GetString(abpkg.ContextKeyPID), c.Param("id"), *req.Approve)
+	if err != nil {
+		writeError(c, err, "Failed to answer authorization request")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"redirect_to": redirectTo})
+}
+
+// Token takes a form encoded token request, with the client credentials
+// in an Authorization: Basic header or in the form.
+func (h *oauthHandler) Token(c *gin.Context) {
+	creds, ok := clientCredentials(c)
+	if !ok {
+		return
+	}
+
+	res, err := h.oauthService.Token(c.Request.Context(), creds, TokenRequest{
+		GrantType:    c.PostForm("grant_type"),
+		Code:         c.PostForm("code"),
+		RedirectURI:  c.PostForm("redirect_uri"),
+		CodeVerifier: c.PostForm("code_verifier"),
+		RefreshToken: c.PostForm("refresh_token"),
+		Scope:        c.PostForm("scope"),
+	})
+	noStore(c)
+	if err != nil {
+		writeOAuthError(c, err, creds)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// UserInfo returns the claims about the user of a bearer access token.
+func (h *oauthHandler) UserInfo(c *gin.Context) {
+	scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		c.Header("WWW-Authenticate", `Bearer realm="oauth"`)
+		c.AbortWithStatus(http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := h.oauthService.UserInfo(c.Request.Context(), strings.TrimSpace(token))
+	noStore(c)
+	if err != nil {
+		writeOAuthError(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, claims)
+}
+
+func (h *oauthHandler) Introspect(c *gin.Context) {
+	creds, ok := clientCredentials(c)
+	if !ok {
+		return
+	}
+
+	res, err := h.oauthService.Introspect(c.Request.Context(), creds, c.PostForm("token"))
+	noStore(c)
+	if err != nil {
+		writeOAuthError(c, err, creds)
+		return
+	}
+
+	c.JSON(http.StatusOK, res)
+}
+
+// Revoke answers 200 OK for unknown tokens too, as RFC 7009 requires.
+func (h *oauthHandler) Revoke(c *gin.Context) {
+	creds, ok := clientCredentials(c)
+	if !ok {
+		return
+	}
+
+	if err := h.oauthService.Revoke(c.Request.Context(), creds, c.PostForm("token")); err != nil {
+		writeOAuthError(c, err, creds)
+		return
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// RegisterClient creates a client. Its secret is only returned in this
+// response.
+func (h *oauthHandler) RegisterClient(c *gin.Context) {
+	var req struct {
+		ClientName              string   `json:"client_name"`
+		RedirectURIs            []string `json:"redirect_uris"`
+		GrantTypes              []string `json:"grant_types"`
+		TokenEndpointAuthMethod string   `json:"token_endpoint_auth_method"`
+		Scope                   string   `json:"scope"`
+		FirstParty              bool     `json:"first_party"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	client, secret, err := h.oauthService.RegisterClient(c.Request.Context(), c.GetString(abpkg.ContextKeyPID), ClientInput{
+		Name:         req.ClientName,
+		RedirectURIs: req.RedirectURIs,
+		GrantTypes:   req.GrantTypes,
+		AuthMethod:   req.TokenEndpointAuthMethod,
+		Scopes:       strings.Fields(req.Scope),
+		FirstParty:   req.FirstParty,
+	})
+	if err != nil {
+		writeError(c, err, "Failed to register client")
+		return
+	}
+
+	res := gin.H{"client": client}
+	if secret != "" {
+		res["client_secret"] = secret
+	}
+	c.JSON(http.StatusCreated, res)
+}
+
+func (h *oauthHandler) ListClients(c *gin.Context) {
+	clients, err := h.oauthService.ListClients(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list clients"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"clients": clients})
+}
+
+func (h *oauthHandler) GetClient(c *gin.Context) {
+	client, err := h.oauthService.GetClient(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to get client")
+		return
+	}
+
+	c.JSON(http.StatusOK, client)
+}
+
+// DeleteClient deletes a client and revokes the tokens issued to it.
+func (h *oauthHandler) DeleteClient(c *gin.Context) {
+	if err := h.oauthService.DeleteClient(c.Request.Context(), c.Param("id")); err != nil {
+		writeError(c, err, "Failed to delete client")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func (h *oauthHandler) RotateClientSecret(c *gin.Context) {
+	secret, err := h.oauthService.RotateClientSecret(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to rotate client secret")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"client_secret": secret})
+}
+
+// clientCredentials reads the client credentials of a request, from an
+// Authorization: Basic header or the client_id and client_secret form
+// fields. Using both is rejected.
+func clientCredentials(c *gin.Context) (ClientCredentials, bool) {
+	id, secret, basic := c.Request.BasicAuth()
+	if !basic {
+		return ClientCredentials{ID: c.PostForm("client_id"), Secret: c.PostForm("client_secret")}, true
+	}
+	if c.PostForm("client_secret") != "" {
+		writeOAuthError(c, oauthError(errInvalidRequest, "client credentials must be sent in one way only"))
+		return ClientCredentials{}, false
+	}
+	// the credentials are form encoded before being put in the header
+	var err error
+	if id, err = url.QueryUnescape(id); err == nil {
+		secret, err = url.QueryUnescape(secret)
+	}
+	if err != nil {
+		writeOAuthError(c, oauthError(errInvalidRequest, "malformed client credentials"))
+		return ClientCredentials{}, false
+	}
+	return ClientCredentials{ID: id, Secret: secret, Basic: true}, true
+}
+
+// noStore keeps responses carrying tokens or claims out of caches.
+func noStore(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+}
+
+// writeOAuthError writes an error of the protocol in the form of RFC 6749,
+// or a server error. creds, when given, are those the client sent.
+func writeOAuthError(c *gin.Context, err error, creds ...ClientCredentials) {
+	var oauthErr *Error
+	if !errors.As(err, &oauthErr) {
+		c.JSON(http.StatusInternalServerError, Error{Code: "server_error"})
+		return
+	}
+
+	status := http.StatusBadRequest
+	switch oauthErr.Code {
+	case errInvalidClient:
+		status = http.StatusUnauthorized
+		if len(creds) > 0 && creds[0].Basic {
+			c.Header("WWW-Authenticate", `Basic realm="oauth"`)
+		}
+	case errInvalidToken:
+		status = http.StatusUnauthorized
+		c.Header("WWW-Authenticate", `Bearer realm="oauth", error="invalid_token"`)
+	case errInsufficientScope:
+		status = http.StatusForbidden
+		c.Header("WWW-Authenticate", `Bearer realm="oauth", error="insufficient_scope"`)
+	}
+	c.JSON(status, oauthErr)
+}
+
+func writeError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrOAuthClientNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+	case errors.Is(err, database.ErrOAuthRequestNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Authorization request not found or expired"})
+	case errors.Is(err, ErrNotAUser):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only users can authorize clients"})
+	case errors.Is(err, ErrInvalidName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Client name is required"})
+	case errors.Is(err, ErrInvalidRedirectURIs):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Redirect URIs must be https, loopback or private-use URIs, and are required for the authorization code grant only"})
+	case errors.Is(err, ErrInvalidGrantTypes):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Grant types must be authorization_code, refresh_token or client_credentials; refresh_token requires authorization_code"})
+	case errors.Is(err, ErrInvalidAuthMethod):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Token endpoint auth method must be client_secret_basic, client_secret_post or none; client_credentials requires a secret"})
+	case errors.Is(err, ErrInvalidScopes):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Scopes must be valid scope tokens"})
+	case errors.Is(err, ErrPublicClient):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Public clients have no secret"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,613 @@
+// Package oauth is the OAuth 2.1 authorization server and OpenID Connect
+// provider our own and third-party apps sign users in with.
+//
+// Users authorize clients with the authorization code grant and PKCE: the
+// authorize endpoint sends the user agent to the consent page of the
+// frontend, which signs the user in and approves or denies the request
+// through the JSON consent API. Access tokens are JWTs, which services
+// verify with the published keys or by introspection; refresh tokens are
+// opaque and rotated on every use. Every token belongs to a grant, and
+// revoking any of them revokes the grant.
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"sambhav/internal/repository"
+	"sambhav/pkg/database"
+	"sambhav/pkg/jwt"
+	"sambhav/pkg/metrics"
+	"sambhav/pkg/security"
+
+	"github.com/aarondl/authboss/v3"
+)
+
+// Paths of the endpoints the discovery document advertises, as routed by
+// the public router.
+const (
+	pathAuthorize  = "/oauth/authorize"
+	pathToken      = "/oauth/token"
+	pathUserInfo   = "/oauth/userinfo"
+	pathJWKS       = "/oauth/jwks"
+	pathIntrospect = "/oauth/introspect"
+	pathRevoke     = "/oauth/revoke"
+)
+
+const (
+	// requestTTL is how long users have to sign in and consent.
+	requestTTL = 10 * time.Minute
+	// refreshTokenPrefix starts every refresh token, so that leaked
+	// tokens are easy to recognise and scan for.
+	refreshTokenPrefix = "rt_"
+)
+
+// OAuth error codes, from RFC 6749, RFC 6750 and RFC 7009.
+const (
+	errInvalidRequest          = "invalid_request"
+	errInvalidClient           = "invalid_client"
+	errInvalidGrant            = "invalid_grant"
+	errUnauthorizedClient      = "unauthorized_client"
+	errUnsupportedGrantType    = "unsupported_grant_type"
+	errUnsupportedResponseType = "unsupported_response_type"
+	errInvalidScope            = "invalid_scope"
+	errAccessDenied            = "access_denied"
+	errInvalidToken            = "invalid_token"
+	errInsufficientScope       = "insufficient_scope"
+)
+
+// Error is an error of the OAuth protocol, reported to clients as is.
+type Error struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return "oauth: " + e.Code + ": " + e.Description
+}
+
+func oauthError(code, description string) *Error {
+	return &Error{Code: code, Description: description}
+}
+
+var (
+	ErrInvalidName         = errors.New("oauth: client name is required")
+	ErrInvalidRedirectURIs = errors.New("oauth: redirect uris must be https, loopback or private-use URIs, and are required for the authorization code grant only")
+	ErrInvalidGrantTypes   = errors.New("oauth: grant types must name supported grant types")
+	ErrInvalidAuthMethod   = errors.New("oauth: token endpoint auth method is not supported for the grant types")
+	ErrInvalidScopes       = errors.New("oauth: scopes must be valid scope tokens")
+	ErrPublicClient        = errors.New("oauth: public clients have no secret")
+	// ErrNotAUser is returned when a request is authorized by something
+	// other than a user, such as a service account.
+	ErrNotAUser = errors.New("oauth: only users can authorize clients")
+)
+
+// Config configures the authorization server.
+type Config struct {
+	// Issuer is the URL the endpoints are served under.
+	Issuer          string
+	ConsentURL      string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+	CodeTTL         time.Duration
+}
+
+// UserStore loads the users signing in, by PID.
+type UserStore interface {
+	Load(ctx context.Context, key string) (authboss.User, error)
+}
+
+// AuthorizeRequest holds the parameters of an authorization request.
+type AuthorizeRequest struct {
+	ResponseType        string
+	ClientID            string
+	RedirectURI         string
+	Scope               string
+	State               string
+	Nonce               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+}
+
+// ConsentRequest describes an authorization request to the user.
+type ConsentRequest struct {
+	ID     string     `json:"id"`
+	Client ClientInfo `json:"client"`
+	Scopes []string   `json:"scopes"`
+	// ConsentRequired is false when the client is first-party or the user
+	// already consented to the scopes, so that the request can be
+	// approved without asking.
+	ConsentRequired bool      `json:"consent_required"`
+	ExpiresAt       time.Time `json:"expires_at"`
+}
+
+// ClientInfo is what users are shown of a client.
+type ClientInfo struct {
+	ID         string `json:"client_id"`
+	Name       string `json:"client_name"`
+	FirstParty bool   `json:"first_party"`
+}
+
+// ClientInput holds the fields of a new client. Grant types default to
+// authorization_code, the auth method to client_secret_basic and scopes
+// to openid, profile and email.
+type ClientInput struct {
+	Name         string
+	RedirectURIs []string
+	GrantTypes   []string
+	AuthMethod   string
+	Scopes       []string
+	FirstParty   bool
+}
+
+type OAuthService interface {
+	Discovery() Discovery
+	JWKS() jwt.JWKS
+	// Authorize checks an authorization request and returns the URL the
+	// user agent is sent to: the consent page or, for an invalid request,
+	// the redirect URI of the client with an error. Requests that cannot
+	// be redirected, because their client or redirect URI is not valid,
+	// return an *Error instead.
+	Authorize(ctx context.Context, req AuthorizeRequest) (string, error)
+	// GetConsentRequest returns the authorization request id for the user
+	// pid to consent to.
+	GetConsentRequest(ctx context.Context, pid, id string) (*ConsentRequest, error)
+	// Consent approves or denies the authorization request id on behalf of
+	// the user pid and returns the redirect URI of the client, with an
+	// authorization code or an error.
+	Consent(ctx context.Context, pid, id string, approve bool) (string, error)
+
+	// Token handles a token request of client. Errors of the protocol are
+	// returned as *Error.
+	Token(ctx context.Context, client ClientCredentials, req TokenRequest) (*TokenResponse, error)
+	// UserInfo returns the claims about the user an access token was
+	// issued for.
+	UserInfo(ctx context.Context, accessToken string) (map[string]any, error)
+	Introspect(ctx context.Context, client ClientCredentials, token string) (*Introspection, error)
+	// Revoke revokes the grant of a token issued to client. Unknown tokens
+	// are ignored.
+	Revoke(ctx context.Context, client ClientCredentials, token string) error
+
+	// RegisterClient creates a client and returns it along with its
+	// secret, which is not shown again. Public clients have no secret.
+	RegisterClient(ctx context.Context, createdBy string, in ClientInput) (*database.OAuthClient, string, error)
+	ListClients(ctx context.Context) ([]*database.OAuthClient, error)
+	GetClient(ctx context.Context, id string) (*database.OAuthClient, error)
+	// DeleteClient deletes a client, revoking its grants and forgetting
+	// the consents given to it.
+	DeleteClient(ctx context.Context, id string) error
+	// RotateClientSecret replaces the secret of a client and returns the
+	// new one.
+	RotateClientSecret(ctx context.Context, id string) (string, error)
+}
+
+type oauthService struct {
+	oauthRepository repository.OAuthRepository
+	users           UserStore
+	signer          *jwt.Signer
+	cfg             Config
+	metrics         *metrics.Metrics
+	logger          *slog.Logger
+}
+
+func NewOAuthService(oauthRepo repository.OAuthRepository, users UserStore, signer *jwt.Signer, cfg Config, m *metrics.Metrics, logger *slog.Logger) OAuthService {
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &oauthService{
+		oauthRepository: oauthRepo,
+		users:           users,
+		signer:          signer,
+		cfg:             cfg,
+		metrics:         m,
+		logger:          logger,
+	}
+}
+
+func (s *oauthService) JWKS() jwt.JWKS {
+	return s.signer.JWKS()
+}
+
+func (s *oauthService) Authorize(ctx context.Context, req AuthorizeRequest) (string, error) {
+	client, err := s.oauthRepository.GetClient(ctx, req.ClientID)
+	if errors.Is(err, database.ErrOAuthClientNotFound) {
+		return "", oauthError(errInvalidRequest, "unknown client_id")
+	} else if err != nil {
+		return "", err
+	}
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	// redirect URIs are compared exactly, so that codes cannot be sent
+	// anywhere else
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return "", oauthError(errInvalidRequest, "redirect_uri is not registered for the client")
+	}
+
+	fail := func(code, description string) (string, error) {
+		return s.redirectURL(redirectURI, url.Values{
+			"error":             {code},
+			"error_description": {description},
+			"state":             {req.State},
+		}), nil
+	}
+	if req.ResponseType != "code" {
+		return fail(errUnsupportedResponseType, "response_type must be code")
+	}
+	if !slices.Contains(client.GrantTypes, database.GrantTypeAuthorizationCode) {
+		return fail(errUnauthorizedClient, "the client may not use the authorization code grant")
+	}
+	if req.CodeChallengeMethod != "S256" || !validPKCE(req.CodeChallenge) {
+		return fail(errInvalidRequest, "code_challenge is required with code_challenge_method S256")
+	}
+	scopes, ok := parseScopes(req.Scope)
+	if !ok || len(scopes) == 0 {
+		return fail(errInvalidScope, "scope is required")
+	}
+	if !subset(scopes, client.Scopes) {
+		return fail(errInvalidScope, "the client may not request the scope")
+	}
+
+	now := time.Now().UTC()
+	authReq := &database.OAuthAuthorizationRequest{
+		ID:            security.RandomHex(16),
+		ClientID:      client.ID,
+		RedirectURI:   redirectURI,
+		Scopes:        scopes,
+		State:         req.State,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+		CreatedAt:     now,
+		ExpiresAt:     now.Add(requestTTL),
+	}
+	if err := s.oauthRepository.CreateAuthorizationRequest(ctx, authReq); err != nil {
+		return "", err
+	}
+
+	consentURL, err := url.Parse(s.cfg.ConsentURL)
+	if err != nil {
+		return "", err
+	}
+	query := consentURL.Query()
+	query.Set("request", authReq.ID)
+	consentURL.RawQuery = query.Encode()
+	return consentURL.String(), nil
+}
+
+func (s *oauthService) GetConsentRequest(ctx context.Context, pid, id string) (*ConsentRequest, error) {
+	if err := s.checkUser(ctx, pid); err != nil {
+		return nil, err
+	}
+	authReq, err := s.oauthRepository.GetAuthorizationRequest(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	client, err := s.oauthRepository.GetClient(ctx, authReq.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	required := !client.FirstParty
+	if required {
+		consent, err := s.oauthRepository.GetConsent(ctx, pid, client.ID)
+		if err != nil && !errors.Is(err, database.ErrOAuthConsentNotFound) {
+			return nil, err
+		}
+		required = consent == nil || !subset(authReq.Scopes, consent.Scopes)
+	}
+
+	return &ConsentRequest{
+		ID:              authReq.ID,
+		Client:          ClientInfo{ID: client.ID, Name: client.Name, FirstParty: client.FirstParty},
+		Scopes:          authReq.Scopes,
+		ConsentRequired: required,
+		ExpiresAt:       authReq.ExpiresAt,
+	}, nil
+}
+
+func (s *oauthService) Consent(ctx context.Context, pid, id string, approve bool) (string, error) {
+	if err := s.checkUser(ctx, pid); err != nil {
+		return "", err
+	}
+	authReq, err := s.oauthRepository.GetAuthorizationRequest(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	// deleting the request claims it, so that it is answered only once
+	if err := s.oauthRepository.DeleteAuthorizationRequest(ctx, id); err != nil {
+		return "", err
+	}
+
+	params := url.Values{"state": {authReq.State}}
+	if !approve {
+		params.Set("error", errAccessDenied)
+		params.Set("error_description", "the user denied the request")
+		s.logger.InfoContext(ctx, "oauth authorization denied", "client_id", authReq.ClientID)
+		return s.redirectURL(authReq.RedirectURI, params), nil
+	}
+
+	client, err := s.oauthRepository.GetClient(ctx, authReq.ClientID)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	if !client.FirstParty {
+		consent := &database.OAuthConsent{PID: pid, ClientID: client.ID, Scopes: authReq.Scopes, UpdatedAt: now}
+		if prev, err := s.oauthRepository.GetConsent(ctx, pid, client.ID); err == nil {
+			consent.Scopes = slices.Compact(slices.Sorted(slices.Values(append(prev.Scopes, authReq.Scopes...))))
+		} else if !errors.Is(err, database.ErrOAuthConsentNotFound) {
+			return "", err
+		}
+		if err := s.oauthRepository.SaveConsent(ctx, consent); err != nil {
+			return "", err
+		}
+	}
+
+	code := security.RandomToken(32)
+	if err := s.oauthRepository.CreateCode(ctx, &database.OAuthAuthorizationCode{
+		Hash:          hashToken(code),
+		GrantID:       security.RandomHex(16),
+		ClientID:      client.ID,
+		PID:           pid,
+		RedirectURI:   authReq.RedirectURI,
+		Scopes:        authReq.Scopes,
+		Nonce:         authReq.Nonce,
+		CodeChallenge: authReq.CodeChallenge,
+		ExpiresAt:     now.Add(s.cfg.CodeTTL),
+	}); err != nil {
+		return "", err
+	}
+	s.logger.InfoContext(ctx, "oauth authorization approved", "client_id", client.ID, "scopes", authReq.Scopes)
+
+	params.Set("code", code)
+	return s.redirectURL(authReq.RedirectURI, params), nil
+}
+
+// checkUser checks that pid is a user, rather than a service account.
+func (s *oauthService) checkUser(ctx context.Context, pid string) error {
+	_, err := s.loadUser(ctx, pid)
+	return err
+}
+
+func (s *oauthService) loadUser(ctx context.Context, pid string) (*database.User, error) {
+	user, err := s.users.Load(ctx, pid)
+	if errors.Is(err, authboss.ErrUserNotFound) {
+		return nil, ErrNotAUser
+	} else if err != nil {
+		return nil, err
+	}
+	u, ok := user.(*database.User)
+	if !ok {
+		return nil, fmt.Errorf("oauth: unexpected user type %T", user)
+	}
+	return u, nil
+}
+
+// redirectURL adds params, which are left out when empty, and the issuer
+// to the query of redirectURI, as RFC 9207 recommends.
+func (s *oauthService) redirectURL(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		// registered redirect URIs are validated, this cannot happen
+		return redirectURI
+	}
+	query := u.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query.Set(key, values[0])
+		}
+	}
+	query.Set("iss", s.cfg.Issuer)
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func (s *oauthService) RegisterClient(ctx context.Context, createdBy string, in ClientInput) (*database.OAuthClient, string, error) {
+	name := strings.TrimSpace(in.Name)
+	if name == "" {
+		return nil, "", ErrInvalidName
+	}
+
+	grantTypes := in.GrantTypes
+	if len(grantTypes) == 0 {
+		grantTypes = []string{database.GrantTypeAuthorizationCode}
+	}
+	grantTypes = slices.Compact(slices.Sorted(slices.Values(grantTypes)))
+	for _, grantType := range grantTypes {
+		switch grantType {
+		case database.GrantTypeAuthorizationCode, database.GrantTypeClientCredentials:
+		case database.GrantTypeRefreshToken:
+			if !slices.Contains(grantTypes, database.GrantTypeAuthorizationCode) {
+				return nil, "", ErrInvalidGrantTypes
+			}
+		default:
+			return nil, "", ErrInvalidGrantTypes
+		}
+	}
+	usesCode := slices.Contains(grantTypes, database.GrantTypeAuthorizationCode)
+
+	authMethod := in.AuthMethod
+	if authMethod == "" {
+		authMethod = database.AuthMethodSecretBasic
+	}
+	switch authMethod {
+	case database.AuthMethodSecretBasic, database.AuthMethodSecretPost:
+	case database.AuthMethodNone:
+		// a client without a secret cannot authenticate as itself
+		if slices.Contains(grantTypes, database.GrantTypeClientCredentials) {
+			return nil, "", ErrInvalidAuthMethod
+		}
+	default:
+		return nil, "", ErrInvalidAuthMethod
+	}
+
+	if usesCode == (len(in.RedirectURIs) == 0) {
+		return nil, "", ErrInvalidRedirectURIs
+	}
+	for _, uri := range in.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return nil, "", ErrInvalidRedirectURIs
+		}
+	}
+
+	scopes := in.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{database.ScopeOpenID, database.ScopeProfile, database.ScopeEmail}
+	}
+	for _, scope := range scopes {
+		if !validScope(scope) {
+			return nil, "", ErrInvalidScopes
+		}
+	}
+
+	client := &database.OAuthClient{
+		ID:           security.RandomHex(16),
+		Name:         name,
+		RedirectURIs: slices.Compact(slices.Clone(in.RedirectURIs)),
+		GrantTypes:   grantTypes,
+		AuthMethod:   authMethod,
+		Scopes:       slices.Compact(slices.Sorted(slices.Values(scopes))),
+		FirstParty:   in.FirstParty,
+		CreatedBy:    createdBy,
+		CreatedAt:    time.Now().UTC(),
+	}
+	var secret string
+	if !client.Public() {
+		secret = security.RandomToken(32)
+		client.SecretHash = hashToken(secret)
+	}
+	if err := s.oauthRepository.CreateClient(ctx, client); err != nil {
+		return nil, "", err
+	}
+	s.logger.InfoContext(ctx, "oauth client registered", "client_id", client.ID, "grant_types", client.GrantTypes)
+	return client, secret, nil
+}
+
+func (s *oauthService) ListClients(ctx context.Context) ([]*database.OAuthClient, error) {
+	return s.oauthRepository.ListClients(ctx)
+}
+
+func (s *oauthService) GetClient(ctx context.Context, id string) (*database.OAuthClient, error) {
+	return s.oauthRepository.GetClient(ctx, id)
+}
+
+func (s *oauthService) DeleteClient(ctx context.Context, id string) error {
+	// revoking the grants ends every access and refresh token of the
+	// client, which are checked against their grant, before the client
+	// and the consents of its users are removed
+	if _, err := s.oauthRepository.GetClient(ctx, id); err != nil {
+		return err
+	}
+	if err := s.oauthRepository.RevokeClientGrants(ctx, id, time.Now().UTC()); err != nil {
+		return err
+	}
+	if err := s.oauthRepository.DeleteClientConsents(ctx, id); err != nil {
+		return err
+	}
+	if err := s.oauthRepository.DeleteClient(ctx, id); err != nil {
+		return err
+	}
+	s.logger.InfoContext(ctx, "oauth client deleted", "client_id", id)
+	return nil
+}
+
+func (s *oauthService) RotateClientSecret(ctx context.Context, id string) (string, error) {
+	client, err := s.oauthRepository.GetClient(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if client.Public() {
+		return "", ErrPublicClient
+	}
+	secret := security.RandomToken(32)
+	if err := s.oauthRepository.SetClientSecret(ctx, id, hashToken(secret)); err != nil {
+		return "", err
+	}
+	s.logger.InfoContext(ctx, "oauth client secret rotated", "client_id", id)
+	return secret, nil
+}
+
+// validRedirectURI reports whether uri is an absolute URI without a
+// fragment that is https, http on a loopback address for native apps, or
+// a private-use scheme such as com.example.app:/callback.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || !u.IsAbs() || u.Fragment != "" || strings.Contains(uri, "#") {
+		return false
+	}
+	switch u.Scheme {
+	case "https":
+		return u.Host != ""
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	default:
+		// private-use schemes are reverse domain names
+		return strings.Contains(u.Scheme, ".")
+	}
+}
+
+// validScope reports whether scope is a scope token of RFC 6749.
+func validScope(scope string) bool {
+	if scope == "" {
+		return false
+	}
+	for _, r := range scope {
+		if r < 0x21 || r > 0x7e || r == '"' || r == '\\' {
+			return false
+		}
+	}
+	return true
+}
+
+// parseScopes splits a space separated scope parameter, dropping
+// duplicates.
+func parseScopes(scope string) ([]string, bool) {
+	scopes := strings.Fields(scope)
+	for _, s := range scopes {
+		if !validScope(s) {
+			return nil, false
+		}
+	}
+	return slices.Compact(slices.Sorted(slices.Values(scopes))), true
+}
+
+// subset reports whether every scope of scopes is in allowed.
+func subset(scopes, allowed []string) bool {
+	for _, scope := range scopes {
+		if !slices.Contains(allowed, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// validPKCE reports whether s is a PKCE code verifier, or a S256 code
+// challenge: 43 to 128 unreserved characters.
+func validPKCE(s string) bool {
+	if len(s) < 43 || len(s) > 128 {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.', r == '_', r == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// hashToken hashes codes, refresh tokens and client secrets for storage.
+// They are random and long, so a fast hash is enough.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,446 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sambhav/internal/repository"
+	"sambhav/pkg/database"
+	"sambhav/pkg/jwt"
+
+	"github.com/aarondl/authboss/v3"
+)
+
+// memRepository keeps the clients, requests, codes, grants and refresh
+// tokens of OAuthRepository in memory, for tests only. The methods the
+// tests do not call are left unimplemented.
+type memRepository struct {
+	repository.OAuthRepository
+
+	mu            sync.Mutex
+	clients       map[string]database.OAuthClient
+	requests      map[string]database.OAuthAuthorizationRequest
+	codes         map[string]database.OAuthAuthorizationCode
+	grants        map[string]database.OAuthGrant
+	refreshTokens map[string]database.OAuthRefreshToken
+}
+
+func newMemRepository() *memRepository {
+	return &memRepository{
+		clients:       map[string]database.OAuthClient{},
+		requests:      map[string]database.OAuthAuthorizationRequest{},
+		codes:         map[string]database.OAuthAuthorizationCode{},
+		grants:        map[string]database.OAuthGrant{},
+		refreshTokens: map[string]database.OAuthRefreshToken{},
+	}
+}
+
+func (r *memRepository) CreateClient(_ context.Context, client *database.OAuthClient) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[client.ID] = *client
+	return nil
+}
+
+func (r *memRepository) GetClient(_ context.Context, id string) (*database.OAuthClient, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.clients[id]
+	if !ok {
+		return nil, database.ErrOAuthClientNotFound
+	}
+	return &client, nil
+}
+
+func (r *memRepository) CreateAuthorizationRequest(_ context.Context, req *database.OAuthAuthorizationRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests[req.ID] = *req
+	return nil
+}
+
+func (r *memRepository) GetAuthorizationRequest(_ context.Context, id string) (*database.OAuthAuthorizationRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	req, ok := r.requests[id]
+	if !ok {
+		return nil, database.ErrOAuthRequestNotFound
+	}
+	return &req, nil
+}
+
+func (r *memRepository) DeleteAuthorizationRequest(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.requests, id)
+	return nil
+}
+
+func (r *memRepository) CreateCode(_ context.Context, code *database.OAuthAuthorizationCode) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.codes[code.Hash] = *code
+	return nil
+}
+
+func (r *memRepository) UseCode(_ context.Context, hash string, at time.Time) (*database.OAuthAuthorizationCode, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	code, ok := r.codes[hash]
+	if !ok || !at.Before(code.ExpiresAt) {
+		return nil, database.ErrOAuthCodeNotFound
+	}
+	used := code
+	if used.UsedAt == nil {
+		used.UsedAt = &at
+	}
+	r.codes[hash] = used
+	return &code, nil
+}
+
+func (r *memRepository) CreateGrant(_ context.Context, grant *database.OAuthGrant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.grants[grant.ID] = *grant
+	return nil
+}
+
+func (r *memRepository) GetGrant(_ context.Context, id string) (*database.OAuthGrant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grant, ok := r.grants[id]
+	if !ok {
+		return nil, database.ErrOAuthGrantNotFound
+	}
+	return &grant, nil
+}
+
+func (r *memRepository) ExtendGrant(_ context.Context, id string, expiresAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grant, ok := r.grants[id]
+	if !ok {
+		return database.ErrOAuthGrantNotFound
+	}
+	if expiresAt.After(grant.ExpiresAt) {
+		grant.ExpiresAt = expiresAt
+	}
+	r.grants[id] = grant
+	return nil
+}
+
+func (r *memRepository) RevokeGrant(_ context.Context, id string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	grant, ok := r.grants[id]
+	if !ok {
+		return database.ErrOAuthGrantNotFound
+	}
+	if grant.RevokedAt == nil {
+		grant.RevokedAt = &at
+	}
+	r.grants[id] = grant
+	return nil
+}
+
+func (r *memRepository) CreateRefreshToken(_ context.Context, token *database.OAuthRefreshToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.refreshTokens[token.Hash] = *token
+	return nil
+}
+
+func (r *memRepository) GetRefreshToken(_ context.Context, hash string) (*database.OAuthRefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.refreshTokens[hash]
+	if !ok {
+		return nil, database.ErrOAuthTokenNotFound
+	}
+	return &token, nil
+}
+
+func (r *memRepository) UseRefreshToken(_ context.Context, hash string, at time.Time) (*database.OAuthRefreshToken, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	token, ok := r.refreshTokens[hash]
+	if !ok || !at.Before(token.ExpiresAt) {
+		return nil, database.ErrOAuthTokenNotFound
+	}
+	used := token
+	if used.UsedAt == nil {
+		used.UsedAt = &at
+	}
+	r.refreshTokens[hash] = used
+	return &token, nil
+}
+
+// memUsers is an in-memory UserStore, for tests only.
+type memUsers map[string]database.User
+
+func (u memUsers) Load(_ context.Context, key string) (authboss.User, error) {
+	user, ok := u[key]
+	if !ok {
+		return nil, authboss.ErrUserNotFound
+	}
+	return &user, nil
+}
+
+const (
+	testPID         = "alice@example.com"
+	testRedirectURI = "https://app.example.com/callback"
+	testVerifier    = "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+)
+
+type fixture struct {
+	service *oauthService
+	repo    *memRepository
+	client  *database.OAuthClient
+}
+
+// newFixture returns a service with a public first-party client, which
+// may refresh its tokens, and the user alice@example.com.
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	key, err := jwt.GenerateKey()
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	signer, err := jwt.NewSigner([]jwt.Key{key})
+	if err != nil {
+		t.Fatalf("NewSigner: %v", err)
+	}
+
+	f := &fixture{repo: newMemRepository()}
+	users := memUsers{testPID: {Email: testPID, Name: "Alice", Confirmed: true}}
+	f.service = NewOAuthService(f.repo, users, signer, Config{
+		Issuer:          "https://auth.example.com",
+		ConsentURL:      "https://app.example.com/consent",
+		AccessTokenTTL:  time.Hour,
+		RefreshTokenTTL: 24 * time.Hour,
+		CodeTTL:         time.Minute,
+	}, nil, slog.New(slog.NewTextHandler(io.Discard, nil))).(*oauthService)
+
+	f.client, _, err = f.service.RegisterClient(context.Background(), "admin@example.com", ClientInput{
+		Name:         "App",
+		RedirectURIs: []string{testRedirectURI},
+		GrantTypes:   []string{database.GrantTypeAuthorizationCode, database.GrantTypeRefreshToken},
+		AuthMethod:   database.AuthMethodNone,
+		FirstParty:   true,
+	})
+	if err != nil {
+		t.Fatalf("RegisterClient: %v", err)
+	}
+	return f
+}
+
+// challenge returns the S256 code challenge of verifier.
+func challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// authorize has the user approve an authorization request with the code
+// challenge of testVerifier, and returns the code.
+func (f *fixture) authorize(t *testing.T) string {
+	t.Helper()
+	ctx := context.Background()
+	consentURL, err := f.service.Authorize(ctx, AuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            f.client.ID,
+		RedirectURI:         testRedirectURI,
+		Scope:               "openid email",
+		CodeChallenge:       challenge(testVerifier),
+		CodeChallengeMethod: "S256",
+	})
+	if err != nil {
+		t.Fatalf("Authorize: %v", err)
+	}
+	id := query(t, consentURL).Get("request")
+	if id == "" {
+		t.Fatalf("Authorize redirected to %s", consentURL)
+	}
+
+	redirect, err := f.service.Consent(ctx, testPID, id, true)
+	if err != nil {
+		t.Fatalf("Consent: %v", err)
+	}
+	code := query(t, redirect).Get("code")
+	if code == "" {
+		t.Fatalf("Consent redirected to %s", redirect)
+	}
+	return code
+}
+
+func (f *fixture) exchange(code, redirectURI, verifier string) (*TokenResponse, error) {
+	return f.service.Token(context.Background(), ClientCredentials{ID: f.client.ID}, TokenRequest{
+		GrantType:    database.GrantTypeAuthorizationCode,
+		Code:         code,
+		RedirectURI:  redirectURI,
+		CodeVerifier: verifier,
+	})
+}
+
+func (f *fixture) refresh(refreshToken string) (*TokenResponse, error) {
+	return f.service.Token(context.Background(), ClientCredentials{ID: f.client.ID}, TokenRequest{
+		GrantType:    database.GrantTypeRefreshToken,
+		RefreshToken: refreshToken,
+	})
+}
+
+// revoked reports whether the grant of accessToken is revoked.
+func (f *fixture) revoked(t *testing.T, accessToken string) bool {
+	t.Helper()
+	claims, _, err := f.service.verifyAccessToken(context.Background(), accessToken, time.Now())
+	if claims != nil {
+		return false
+	}
+	if !isOAuthError(err, errInvalidToken) {
+		t.Fatalf("verifyAccessToken: %v", err)
+	}
+	return true
+}
+
+func query(t *testing.T, rawURL string) url.Values {
+	t.Helper()
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		t.Fatalf("parse %s: %v", rawURL, err)
+	}
+	return u.Query()
+}
+
+func isOAuthError(err error, code string) bool {
+	var oerr *Error
+	return errors.As(err, &oerr) && oerr.Code == code
+}
+
+func TestExchangeCodeVerifiesPKCE(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		verifier string
+		want     string
+	}{
+		{"matching verifier", testVerifier, ""},
+		{"wrong verifier", strings.Repeat("a", 43), errInvalidGrant},
+		{"verifier of another case", strings.ToUpper(testVerifier), errInvalidGrant},
+		{"challenge sent as verifier", challenge(testVerifier), errInvalidGrant},
+		{"malformed verifier", "too-short", errInvalidRequest},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFixture(t)
+			res, err := f.exchange(f.authorize(t), testRedirectURI, tc.verifier)
+			if tc.want == "" {
+				if err != nil || res.AccessToken == "" || res.RefreshToken == "" || res.IDToken == "" {
+					t.Fatalf("got %+v, %v", res, err)
+				}
+				return
+			}
+			if !isOAuthError(err, tc.want) {
+				t.Fatalf("got %v, want %s", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestExchangeCodeRejectsReuse(t *testing.T) {
+	f := newFixture(t)
+	code := f.authorize(t)
+
+	res, err := f.exchange(code, testRedirectURI, testVerifier)
+	if err != nil {
+		t.Fatalf("first exchange: %v", err)
+	}
+	if f.revoked(t, res.AccessToken) {
+		t.Fatal("grant is revoked after the first exchange")
+	}
+
+	if _, err := f.exchange(code, testRedirectURI, testVerifier); !isOAuthError(err, errInvalidGrant) {
+		t.Fatalf("second exchange: got %v, want %s", err, errInvalidGrant)
+	}
+	// the code may have been stolen, so the tokens issued for it go too
+	if !f.revoked(t, res.AccessToken) {
+		t.Error("access token of the first exchange is still valid")
+	}
+	if _, err := f.refresh(res.RefreshToken); !isOAuthError(err, errInvalidGrant) {
+		t.Errorf("refresh token of the first exchange: got %v, want %s", err, errInvalidGrant)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	f := newFixture(t)
+	first, err := f.exchange(f.authorize(t), testRedirectURI, testVerifier)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+
+	second, err := f.refresh(first.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if second.RefreshToken == "" || second.RefreshToken == first.RefreshToken {
+		t.Fatalf("refresh token was not rotated: got %q", second.RefreshToken)
+	}
+	third, err := f.refresh(second.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh with the rotated token: %v", err)
+	}
+	if f.revoked(t, third.AccessToken) {
+		t.Fatal("grant is revoked after rotating")
+	}
+
+	// a rotated token used again means it leaked, so the grant is revoked
+	// for whoever holds the latest one as well
+	if _, err := f.refresh(first.RefreshToken); !isOAuthError(err, errInvalidGrant) {
+		t.Fatalf("reused refresh token: got %v, want %s", err, errInvalidGrant)
+	}
+	if !f.revoked(t, third.AccessToken) {
+		t.Error("access token of the grant is still valid after reuse")
+	}
+	if _, err := f.refresh(third.RefreshToken); !isOAuthError(err, errInvalidGrant) {
+		t.Errorf("latest refresh token after reuse: got %v, want %s", err, errInvalidGrant)
+	}
+}
+
+func TestRedirectURIMustMatchExactly(t *testing.T) {
+	for _, uri := range []string{
+		"https://app.example.com/callback/",
+		"https://app.example.com/callback?next=/",
+		"https://app.example.com/callback/../evil",
+		"https://app.example.com/callbackx",
+		"https://APP.example.com/callback",
+		"https://app.example.com:443/callback",
+		"http://app.example.com/callback",
+		"https://evil.example.com/callback",
+	} {
+		t.Run(uri, func(t *testing.T) {
+			f := newFixture(t)
+			// a mismatch is not redirected to, not even with an error
+			redirect, err := f.service.Authorize(context.Background(), AuthorizeRequest{
+				ResponseType:        "code",
+				ClientID:            f.client.ID,
+				RedirectURI:         uri,
+				Scope:               "openid",
+				CodeChallenge:       challenge(testVerifier),
+				CodeChallengeMethod: "S256",
+			})
+			if !isOAuthError(err, errInvalidRequest) {
+				t.Errorf("Authorize: got %q, %v, want %s", redirect, err, errInvalidRequest)
+			}
+
+			// and the code is bound to the URI it was sent to
+			if _, err := f.exchange(f.authorize(t), uri, testVerifier); !isOAuthError(err, errInvalidGrant) {
+				t.Errorf("exchange: got %v, want %s", err, errInvalidGrant)
+			}
+		})
+	}
+}
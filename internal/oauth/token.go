@@ -0,0 +1,564 @@
+package oauth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"slices"
+	"strings"
+	"time"
+
+	"sambhav/pkg/database"
+	"sambhav/pkg/security"
+)
+
+// Token types of the JWTs issued: access tokens per RFC 9068 and ID
+// tokens per OpenID Connect.
+const (
+	accessTokenType = "at+jwt"
+	idTokenType     = "JWT"
+)
+
+// ClientCredentials are what a client authenticated with at the token,
+// introspection or revocation endpoint. Basic is set when they came in an
+// Authorization header.
+type ClientCredentials struct {
+	ID     string
+	Secret string
+	Basic  bool
+}
+
+// TokenRequest holds the parameters of a token request.
+type TokenRequest struct {
+	GrantType    string
+	Code         string
+	RedirectURI  string
+	CodeVerifier string
+	RefreshToken string
+	Scope        string
+}
+
+// TokenResponse is a successful token response.
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	IDToken      string `json:"id_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+// Introspection is the state of a token, per RFC 7662. Only Active is set
+// for tokens that are not active.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	Issuer    string `json:"iss,omitempty"`
+	Audience  string `json:"aud,omitempty"`
+	ID        string `json:"jti,omitempty"`
+}
+
+// Discovery is the OpenID Connect discovery document, which doubles as
+// the RFC 8414 authorization server metadata.
+type Discovery struct {
+	Issuer                                     string   `json:"issuer"`
+	AuthorizationEndpoint                      string   `json:"authorization_endpoint"`
+	TokenEndpoint                              string   `json:"token_endpoint"`
+	UserInfoEndpoint                           string   `json:"userinfo_endpoint"`
+	JWKSURI                                    string   `json:"jwks_uri"`
+	IntrospectionEndpoint                      string   `json:"introspection_endpoint"`
+	RevocationEndpoint                         string   `json:"revocation_endpoint"`
+	ScopesSupported                            []string `json:"scopes_supported"`
+	ResponseTypesSupported                     []string `json:"response_types_supported"`
+	ResponseModesSupported                     []string `json:"response_modes_supported"`
+	GrantTypesSupported                        []string `json:"grant_types_supported"`
+	SubjectTypesSupported                      []string `json:"subject_types_supported"`
+	IDTokenSigningAlgValuesSupported           []string `json:"id_token_signing_alg_values_supported"`
+	TokenEndpointAuthMethodsSupported          []string `json:"token_endpoint_auth_methods_supported"`
+	IntrospectionEndpointAuthMethodsSupported  []string `json:"introspection_endpoint_auth_methods_supported"`
+	RevocationEndpointAuthMethodsSupported     []string `json:"revocation_endpoint_auth_methods_supported"`
+	CodeChallengeMethodsSupported              []string `json:"code_challenge_methods_supported"`
+	ClaimsSupported                            []string `json:"claims_supported"`
+	AuthorizationResponseIssParameterSupported bool     `json:"authorization_response_iss_parameter_supported"`
+}
+
+func (s *oauthService) Discovery() Discovery {
+	secretMethods := []string{database.AuthMethodSecretBasic, database.AuthMethodSecretPost}
+	return Discovery{
+		Issuer:                                     s.cfg.Issuer,
+		AuthorizationEndpoint:                      s.cfg.Issuer + pathAuthorize,
+		TokenEndpoint:                              s.cfg.Issuer + pathToken,
+		UserInfoEndpoint:                           s.cfg.Issuer + pathUserInfo,
+		JWKSURI:                                    s.cfg.Issuer + pathJWKS,
+		IntrospectionEndpoint:                      s.cfg.Issuer + pathIntrospect,
+		RevocationEndpoint:                         s.cfg.Issuer + pathRevoke,
+		ScopesSupported:                            []string{database.ScopeOpenID, database.ScopeProfile, database.ScopeEmail},
+		ResponseTypesSupported:                     []string{"code"},
+		ResponseModesSupported:                     []string{"query"},
+		GrantTypesSupported:                        []string{database.GrantTypeAuthorizationCode, database.GrantTypeRefreshToken, database.GrantTypeClientCredentials},
+		SubjectTypesSupported:                      []string{"public"},
+		IDTokenSigningAlgValuesSupported:           []string{"RS256"},
+		TokenEndpointAuthMethodsSupported:          append(slices.Clone(secretMethods), database.AuthMethodNone),
+		IntrospectionEndpointAuthMethodsSupported:  secretMethods,
+		RevocationEndpointAuthMethodsSupported:     append(slices.Clone(secretMethods), database.AuthMethodNone),
+		CodeChallengeMethodsSupported:              []string{"S256"},
+		ClaimsSupported:                            []string{"iss", "sub", "aud", "exp", "iat", "nonce", "azp", "name", "email", "email_verified"},
+		AuthorizationResponseIssParameterSupported: true,
+	}
+}
+
+// accessClaims are the claims of access tokens. Services accepting them
+// check that aud is the issuer and that scope covers what they serve.
+type accessClaims struct {
+	Issuer    string `json:"iss"`
+	Subject   string `json:"sub"`
+	Audience  string `json:"aud"`
+	ClientID  string `json:"client_id"`
+	Scope     string `json:"scope,omitempty"`
+	GrantID   string `json:"grant_id"`
+	IssuedAt  int64  `json:"iat"`
+	ExpiresAt int64  `json:"exp"`
+	ID        string `json:"jti"`
+}
+
+func (s *oauthService) Token(ctx context.Context, creds ClientCredentials, req TokenRequest) (*TokenResponse, error) {
+	client, err := s.authenticateClient(ctx, creds)
+	if err != nil {
+		return nil, err
+	}
+	switch req.GrantType {
+	case database.GrantTypeAuthorizationCode, database.GrantTypeRefreshToken, database.GrantTypeClientCredentials:
+	case "":
+		return nil, oauthError(errInvalidRequest, "grant_type is required")
+	default:
+		return nil, oauthError(errUnsupportedGrantType, "the grant type is not supported")
+	}
+	if !slices.Contains(client.GrantTypes, req.GrantType) {
+		return nil, oauthError(errUnauthorizedClient, "the client may not use the grant type")
+	}
+
+	var res *TokenResponse
+	switch req.GrantType {
+	case database.GrantTypeAuthorizationCode:
+		res, err = s.exchangeCode(ctx, client, req)
+	case database.GrantTypeRefreshToken:
+		res, err = s.refresh(ctx, client, req)
+	default:
+		res, err = s.clientCredentials(ctx, client, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.OAuthTokenIssued(req.GrantType)
+	return res, nil
+}
+
+// authenticateClient returns the client creds belong to. Public clients
+// only send their ID.
+func (s *oauthService) authenticateClient(ctx context.Context, creds ClientCredentials) (*database.OAuthClient, error) {
+	invalid := oauthError(errInvalidClient, "client authentication failed")
+	if creds.ID == "" {
+		return nil, invalid
+	}
+	client, err := s.oauthRepository.GetClient(ctx, creds.ID)
+	if errors.Is(err, database.ErrOAuthClientNotFound) {
+		return nil, invalid
+	} else if err != nil {
+		return nil, err
+	}
+	if client.Public() {
+		if creds.Secret != "" {
+			return nil, invalid
+		}
+		return client, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(creds.Secret)), []byte(client.SecretHash)) != 1 {
+		return nil, invalid
+	}
+	return client, nil
+}
+
+func (s *oauthService) exchangeCode(ctx context.Context, client *database.OAuthClient, req TokenRequest) (*TokenResponse, error) {
+	if req.Code == "" || req.CodeVerifier == "" {
+		return nil, oauthError(errInvalidRequest, "code and code_verifier are required")
+	}
+	now := time.Now().UTC()
+	code, err := s.oauthRepository.UseCode(ctx, hashToken(req.Code), now)
+	if errors.Is(err, database.ErrOAuthCodeNotFound) {
+		return nil, oauthError(errInvalidGrant, "the code is invalid or expired")
+	} else if err != nil {
+		return nil, err
+	}
+	if code.UsedAt != nil {
+		// a code used twice may have been stolen, so the tokens issued
+		// for it are revoked
+		s.logger.WarnContext(ctx, "oauth authorization code reused, revoking grant", "client_id", code.ClientID, "grant_id", code.GrantID)
+		if err := s.oauthRepository.RevokeGrant(ctx, code.GrantID, now); err != nil && !errors.Is(err, database.ErrOAuthGrantNotFound) {
+			return nil, err
+		}
+		return nil, oauthError(errInvalidGrant, "the code is invalid or expired")
+	}
+	if code.ClientID != client.ID {
+		return nil, oauthError(errInvalidGrant, "the code was issued to another client")
+	}
+	if req.RedirectURI != code.RedirectURI {
+		return nil, oauthError(errInvalidGrant, "redirect_uri does not match the authorization request")
+	}
+	if !validPKCE(req.CodeVerifier) {
+		return nil, oauthError(errInvalidRequest, "code_verifier is malformed")
+	}
+	sum := sha256.Sum256([]byte(req.CodeVerifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(code.CodeChallenge)) != 1 {
+		return nil, oauthError(errInvalidGrant, "code_verifier does not match the code challenge")
+	}
+	user, err := s.loadUser(ctx, code.PID)
+	if errors.Is(err, ErrNotAUser) {
+		return nil, oauthError(errInvalidGrant, "the user no longer exists")
+	} else if err != nil {
+		return nil, err
+	}
+
+	grant := &database.OAuthGrant{
+		ID:        code.GrantID,
+		ClientID:  client.ID,
+		PID:       code.PID,
+		Scopes:    code.Scopes,
+		CreatedAt: now,
+		ExpiresAt: s.grantExpiry(client, now),
+	}
+	if err := s.oauthRepository.CreateGrant(ctx, grant); err != nil {
+		return nil, err
+	}
+	return s.issueTokens(ctx, client, grant, user, code.Scopes, code.Nonce, now)
+}
+
+func (s *oauthService) refresh(ctx context.Context, client *database.OAuthClient, req TokenRequest) (*TokenResponse, error) {
+	if req.RefreshToken == "" {
+		return nil, oauthError(errInvalidRequest, "refresh_token is required")
+	}
+	invalid := oauthError(errInvalidGrant, "the refresh token is invalid or expired")
+	hash := hashToken(req.RefreshToken)
+	token, err := s.oauthRepository.GetRefreshToken(ctx, hash)
+	if errors.Is(err, database.ErrOAuthTokenNotFound) {
+		return nil, invalid
+	} else if err != nil {
+		return nil, err
+	}
+	if token.ClientID != client.ID {
+		return nil, invalid
+	}
+	now := time.Now().UTC()
+	token, err = s.oauthRepository.UseRefreshToken(ctx, hash, now)
+	if errors.Is(err, database.ErrOAuthTokenNotFound) {
+		return nil, invalid
+	} else if err != nil {
+		return nil, err
+	}
+	if token.UsedAt != nil {
+		// either the client or an attacker holds a token that was already
+		// rotated; revoking the grant locks both out
+		s.logger.WarnContext(ctx, "oauth refresh token reused, revoking grant", "client_id", client.ID, "grant_id", token.GrantID)
+		if err := s.oauthRepository.RevokeGrant(ctx, token.GrantID, now); err != nil && !errors.Is(err, database.ErrOAuthGrantNotFound) {
+			return nil, err
+		}
+		return nil, invalid
+	}
+
+	grant, err := s.oauthRepository.GetGrant(ctx, token.GrantID)
+	if errors.Is(err, database.ErrOAuthGrantNotFound) {
+		return nil, invalid
+	} else if err != nil {
+		return nil, err
+	}
+	if !grant.Active(now) {
+		return nil, invalid
+	}
+	scopes := grant.Scopes
+	if req.Scope != "" {
+		requested, ok := parseScopes(req.Scope)
+		if !ok || !subset(requested, grant.Scopes) {
+			return nil, oauthError(errInvalidScope, "the scope exceeds the scope of the grant")
+		}
+		scopes = requested
+	}
+	user, err := s.loadUser(ctx, grant.PID)
+	if errors.Is(err, ErrNotAUser) {
+		return nil, invalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := s.oauthRepository.ExtendGrant(ctx, grant.ID, s.grantExpiry(client, now)); err != nil {
+		return nil, err
+	}
+	return s.issueTokens(ctx, client, grant, user, scopes, "", now)
+}
+
+func (s *oauthService) clientCredentials(ctx context.Context, client *database.OAuthClient, req TokenRequest) (*TokenResponse, error) {
+	// there is no user, so the OpenID Connect scopes do not apply
+	var allowed []string
+	for _, scope := range client.Scopes {
+		switch scope {
+		case database.ScopeOpenID, database.ScopeProfile, database.ScopeEmail:
+		default:
+			allowed = append(allowed, scope)
+		}
+	}
+	scopes := allowed
+	if req.Scope != "" {
+		requested, ok := parseScopes(req.Scope)
+		if !ok || !subset(requested, allowed) {
+			return nil, oauthError(errInvalidScope, "the client may not request the scope")
+		}
+		scopes = requested
+	}
+
+	now := time.Now().UTC()
+	grant := &database.OAuthGrant{
+		ID:        security.RandomHex(16),
+		ClientID:  client.ID,
+		Scopes:    scopes,
+		CreatedAt: now,
+		ExpiresAt: now.Add(s.cfg.AccessTokenTTL),
+	}
+	if err := s.oauthRepository.CreateGrant(ctx, grant); err != nil {
+		return nil, err
+	}
+	return s.issueTokens(ctx, client, grant, nil, scopes, "", now)
+}
+
+// grantExpiry returns how long a grant of client is kept: as long as its
+// refresh tokens, or its access tokens when it gets none.
+func (s *oauthService) grantExpiry(client *database.OAuthClient, now time.Time) time.Time {
+	if slices.Contains(client.GrantTypes, database.GrantTypeRefreshToken) {
+		return now.Add(s.cfg.RefreshTokenTTL)
+	}
+	return now.Add(s.cfg.AccessTokenTTL)
+}
+
+// issueTokens issues an access token for scopes of grant, along with a
+// refresh token when the client may refresh and an ID token when the user
+// signed in with openid. user is nil for the client credentials grant.
+func (s *oauthService) issueTokens(ctx context.Context, client *database.OAuthClient, grant *database.OAuthGrant, user *database.User, scopes []string, nonce string, now time.Time) (*TokenResponse, error) {
+	subject := client.ID
+	if user != nil {
+		subject = user.Email
+	}
+	scope := strings.Join(scopes, " ")
+	accessToken, err := s.signer.Sign(accessTokenType, accessClaims{
+		Issuer:    s.cfg.Issuer,
+		Subject:   subject,
+		Audience:  s.cfg.Issuer,
+		ClientID:  client.ID,
+		Scope:     scope,
+		GrantID:   grant.ID,
+		IssuedAt:  now.Unix(),
+		ExpiresAt: now.Add(s.cfg.AccessTokenTTL).Unix(),
+		ID:        security.RandomHex(16),
+	})
+	if err != nil {
+		return nil, err
+	}
+	res := &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(s.cfg.AccessTokenTTL.Seconds()),
+		Scope:       scope,
+	}
+
+	if user != nil && slices.Contains(client.GrantTypes, database.GrantTypeRefreshToken) {
+		refreshToken := refreshTokenPrefix + security.RandomToken(32)
+		if err := s.oauthRepository.CreateRefreshToken(ctx, &database.OAuthRefreshToken{
+			Hash:      hashToken(refreshToken),
+			GrantID:   grant.ID,
+			ClientID:  client.ID,
+			CreatedAt: now,
+			ExpiresAt: now.Add(s.cfg.RefreshTokenTTL),
+		}); err != nil {
+			return nil, err
+		}
+		res.RefreshToken = refreshToken
+	}
+
+	if user != nil && slices.Contains(scopes, database.ScopeOpenID) {
+		claims := userClaims(user, scopes)
+		claims["iss"] = s.cfg.Issuer
+		claims["aud"] = client.ID
+		claims["azp"] = client.ID
+		claims["iat"] = now.Unix()
+		claims["exp"] = now.Add(s.cfg.AccessTokenTTL).Unix()
+		if nonce != "" {
+			claims["nonce"] = nonce
+		}
+		if res.IDToken, err = s.signer.Sign(idTokenType, claims); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// userClaims returns the claims about user that scopes allow.
+func userClaims(user *database.User, scopes []string) map[string]any {
+	claims := map[string]any{"sub": user.Email}
+	if slices.Contains(scopes, database.ScopeProfile) {
+		claims["name"] = user.Name
+	}
+	if slices.Contains(scopes, database.ScopeEmail) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.Confirmed
+	}
+	return claims
+}
+
+// verifyAccessToken returns the claims of an access token and its grant,
+// unless the token is invalid, expired or revoked.
+func (s *oauthService) verifyAccessToken(ctx context.Context, token string, now time.Time) (*accessClaims, *database.OAuthGrant, error) {
+	invalid := oauthError(errInvalidToken, "the access token is invalid or expired")
+	var claims accessClaims
+	if err := s.signer.Verify(token, accessTokenType, &claims); err != nil {
+		return nil, nil, invalid
+	}
+	if claims.Issuer != s.cfg.Issuer || now.Unix() >= claims.ExpiresAt {
+		return nil, nil, invalid
+	}
+	grant, err := s.oauthRepository.GetGrant(ctx, claims.GrantID)
+	if errors.Is(err, database.ErrOAuthGrantNotFound) {
+		return nil, nil, invalid
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if !grant.Active(now) {
+		return nil, nil, invalid
+	}
+	return &claims, grant, nil
+}
+
+func (s *oauthService) UserInfo(ctx context.Context, accessToken string) (map[string]any, error) {
+	claims, grant, err := s.verifyAccessToken(ctx, accessToken, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	scopes := strings.Fields(claims.Scope)
+	if grant.PID == "" || !slices.Contains(scopes, database.ScopeOpenID) {
+		return nil, oauthError(errInsufficientScope, "the access token lacks the openid scope")
+	}
+	user, err := s.loadUser(ctx, grant.PID)
+	if errors.Is(err, ErrNotAUser) {
+		return nil, oauthError(errInvalidToken, "the user no longer exists")
+	} else if err != nil {
+		return nil, err
+	}
+	return userClaims(user, scopes), nil
+}
+
+func (s *oauthService) Introspect(ctx context.Context, creds ClientCredentials, token string) (*Introspection, error) {
+	client, err := s.authenticateClient(ctx, creds)
+	if err != nil {
+		return nil, err
+	}
+	if client.Public() {
+		return nil, oauthError(errInvalidClient, "public clients may not introspect tokens")
+	}
+	now := time.Now().UTC()
+
+	// access tokens are JWTs, refresh tokens are opaque
+	if strings.Count(token, ".") == 2 {
+		claims, _, err := s.verifyAccessToken(ctx, token, now)
+		var oauthErr *Error
+		if errors.As(err, &oauthErr) {
+			return &Introspection{}, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return &Introspection{
+			Active:    true,
+			Scope:     claims.Scope,
+			ClientID:  claims.ClientID,
+			Subject:   claims.Subject,
+			TokenType: "Bearer",
+			ExpiresAt: claims.ExpiresAt,
+			IssuedAt:  claims.IssuedAt,
+			Issuer:    claims.Issuer,
+			Audience:  claims.Audience,
+			ID:        claims.ID,
+		}, nil
+	}
+
+	refreshToken, grant, err := s.refreshTokenGrant(ctx, token)
+	if err != nil || refreshToken == nil {
+		return &Introspection{}, err
+	}
+	// refresh tokens are only disclosed to the client they were issued to
+	if refreshToken.ClientID != client.ID || refreshToken.UsedAt != nil || !now.Before(refreshToken.ExpiresAt) || !grant.Active(now) {
+		return &Introspection{}, nil
+	}
+	return &Introspection{
+		Active:    true,
+		Scope:     strings.Join(grant.Scopes, " "),
+		ClientID:  grant.ClientID,
+		Subject:   grant.PID,
+		ExpiresAt: refreshToken.ExpiresAt.Unix(),
+		IssuedAt:  refreshToken.CreatedAt.Unix(),
+		Issuer:    s.cfg.Issuer,
+	}, nil
+}
+
+func (s *oauthService) Revoke(ctx context.Context, creds ClientCredentials, token string) error {
+	client, err := s.authenticateClient(ctx, creds)
+	if err != nil {
+		return err
+	}
+
+	var grantID string
+	if strings.Count(token, ".") == 2 {
+		// expired access tokens are still revoked, along with their grant
+		var claims accessClaims
+		if s.signer.Verify(token, accessTokenType, &claims) != nil || claims.ClientID != client.ID {
+			return nil
+		}
+		grantID = claims.GrantID
+	} else {
+		refreshToken, grant, err := s.refreshTokenGrant(ctx, token)
+		if err != nil || refreshToken == nil || grant.ClientID != client.ID {
+			return err
+		}
+		grantID = grant.ID
+	}
+
+	err = s.oauthRepository.RevokeGrant(ctx, grantID, time.Now().UTC())
+	if errors.Is(err, database.ErrOAuthGrantNotFound) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.logger.InfoContext(ctx, "oauth grant revoked", "client_id", client.ID, "grant_id", grantID)
+	return nil
+}
+
+// refreshTokenGrant returns a refresh token and its grant, or nils when
+// either is unknown.
+func (s *oauthService) refreshTokenGrant(ctx context.Context, token string) (*database.OAuthRefreshToken, *database.OAuthGrant, error) {
+	if !strings.HasPrefix(token, refreshTokenPrefix) {
+		return nil, nil, nil
+	}
+	refreshToken, err := s.oauthRepository.GetRefreshToken(ctx, hashToken(token))
+	if errors.Is(err, database.ErrOAuthTokenNotFound) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	grant, err := s.oauthRepository.GetGrant(ctx, refreshToken.GrantID)
+	if errors.Is(err, database.ErrOAuthGrantNotFound) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	return refreshToken, grant, nil
+}
@@ -0,0 +1,157 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sambhav/pkg/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type APIKeyRepository interface {
+	CreateServiceAccount(ctx context.Context, account *database.ServiceAccount) error
+	GetServiceAccount(ctx context.Context, id string) (*database.ServiceAccount, error)
+	ListServiceAccounts(ctx context.Context) ([]*database.ServiceAccount, error)
+	DeleteServiceAccount(ctx context.Context, id string) error
+
+	CreateAPIKey(ctx context.Context, key *database.APIKey) error
+	GetAPIKeyByPrefix(ctx context.Context, prefix string) (*database.APIKey, error)
+	ListAPIKeys(ctx context.Context, serviceAccountID string) ([]*database.APIKey, error)
+	RevokeAPIKey(ctx context.Context, serviceAccountID, id string, at time.Time) error
+	RevokeAPIKeys(ctx context.Context, serviceAccountID string, at time.Time) error
+	TouchAPIKey(ctx context.Context, id string, at time.Time, ip string) error
+}
+
+type apiKeyRepository struct {
+	accounts *mongo.Collection
+	keys     *mongo.Collection
+}
+
+func NewAPIKeyRepository(dbInstance database.Database) *apiKeyRepository {
+	db := dbInstance.Connection()
+
+	return &apiKeyRepository{
+		accounts: db.Collection("service_accounts"),
+		keys:     db.Collection("api_keys"),
+	}
+}
+
+// EnsureIndexes creates the index keys are looked up by, which also keeps
+// prefixes unique, and the index used to list the keys of an account.
+func (r *apiKeyRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.keys.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "prefix", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "service_account_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+func (r *apiKeyRepository) CreateServiceAccount(ctx context.Context, account *database.ServiceAccount) error {
+	_, err := r.accounts.InsertOne(ctx, account)
+	return err
+}
+
+func (r *apiKeyRepository) GetServiceAccount(ctx context.Context, id string) (*database.ServiceAccount, error) {
+	var account database.ServiceAccount
+	if err := r.accounts.FindOne(ctx, bson.M{"_id": id}).Decode(&account); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrServiceAccountNotFound
+		}
+		return nil, err
+	}
+
+	return &account, nil
+}
+
+func (r *apiKeyRepository) ListServiceAccounts(ctx context.Context) ([]*database.ServiceAccount, error) {
+	cursor, err := r.accounts.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []*database.ServiceAccount
+	if err := cursor.All(ctx, &accounts); err != nil {
+		return nil, err
+	}
+
+	return accounts, nil
+}
+
+func (r *apiKeyRepository) DeleteServiceAccount(ctx context.Context, id string) error {
+	res, err := r.accounts.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return database.ErrServiceAccountNotFound
+	}
+	return nil
+}
+
+func (r *apiKeyRepository) CreateAPIKey(ctx context.Context, key *database.APIKey) error {
+	_, err := r.keys.InsertOne(ctx, key)
+	return err
+}
+
+func (r *apiKeyRepository) GetAPIKeyByPrefix(ctx context.Context, prefix string) (*database.APIKey, error) {
+	var key database.APIKey
+	if err := r.keys.FindOne(ctx, bson.M{"prefix": prefix}).Decode(&key); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrAPIKeyNotFound
+		}
+		return nil, err
+	}
+
+	return &key, nil
+}
+
+func (r *apiKeyRepository) ListAPIKeys(ctx context.Context, serviceAccountID string) ([]*database.APIKey, error) {
+	filter := bson.M{"service_account_id": serviceAccountID}
+	cursor, err := r.keys.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []*database.APIKey
+	if err := cursor.All(ctx, &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// RevokeAPIKey revokes the key id of a service account. Revoking a key
+// twice keeps the time of the first revocation.
+func (r *apiKeyRepository) RevokeAPIKey(ctx context.Context, serviceAccountID, id string, at time.Time) error {
+	filter := bson.M{"_id": id, "service_account_id": serviceAccountID}
+	res, err := r.keys.UpdateOne(ctx, filter, bson.A{
+		bson.M{"$set": bson.M{"revoked_at": bson.M{"$ifNull": bson.A{"$revoked_at", at}}}},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrAPIKeyNotFound
+	}
+	return nil
+}
+
+// RevokeAPIKeys revokes every key of a service account that is not revoked
+// yet.
+func (r *apiKeyRepository) RevokeAPIKeys(ctx context.Context, serviceAccountID string, at time.Time) error {
+	filter := bson.M{"service_account_id": serviceAccountID, "revoked_at": bson.M{"$exists": false}}
+	_, err := r.keys.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": at}})
+	return err
+}
+
+// TouchAPIKey records that the key id was used at at from ip.
+func (r *apiKeyRepository) TouchAPIKey(ctx context.Context, id string, at time.Time, ip string) error {
+	_, err := r.keys.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{
+		"last_used_at": at,
+		"last_used_ip": ip,
+	}})
+	return err
+}
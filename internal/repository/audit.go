@@ -0,0 +1,168 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sambhav/pkg/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 500
+	// maxAuditAppendAttempts bounds how often an append is retried when
+	// another writer takes the next sequence number first.
+	maxAuditAppendAttempts = 10
+)
+
+// AuditRepository is an append-only store of audit entries. It has no way to
+// update or delete an entry.
+type AuditRepository interface {
+	AppendAuditEntry(ctx context.Context, entry *database.AuditEntry) error
+	ListAuditEntries(ctx context.Context, filter database.AuditFilter) ([]*database.AuditEntry, error)
+	VerifyAuditChain(ctx context.Context) (int64, error)
+}
+
+type auditRepository struct {
+	collection *mongo.Collection
+	// key keys the hashes of the chain. It is kept out of the database, so
+	// that write access to the log is not enough to rewrite it.
+	key []byte
+}
+
+func NewAuditRepository(dbInstance database.Database, key []byte) *auditRepository {
+	collection := dbInstance.Connection().Collection("audit_log")
+
+	return &auditRepository{collection: collection, key: key}
+}
+
+// EnsureIndexes creates the indexes used by the audit query filters.
+func (r *auditRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "actor", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "target", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "action", Value: 1}, {Key: "_id", Value: -1}}},
+		{Keys: bson.D{{Key: "time", Value: -1}}},
+	})
+	return err
+}
+
+// AppendAuditEntry links entry to the last entry of the log and inserts it.
+// The sequence number doubles as the document ID, so two writers racing for
+// the same position cannot both succeed; the loser retries on top of the
+// winner's entry.
+func (r *auditRepository) AppendAuditEntry(ctx context.Context, entry *database.AuditEntry) error {
+	// The database stores times with millisecond precision.
+	entry.Time = entry.Time.UTC().Truncate(time.Millisecond)
+
+	for attempt := 0; attempt < maxAuditAppendAttempts; attempt++ {
+		var last database.AuditEntry
+		err := r.collection.FindOne(ctx, bson.M{}, options.FindOne().SetSort(bson.D{{Key: "_id", Value: -1}})).Decode(&last)
+		if err != nil && !errors.Is(err, mongo.ErrNoDocuments) {
+			return err
+		}
+
+		entry.Seq = last.Seq + 1
+		entry.PrevHash = last.Hash
+		entry.Hash = entry.ComputeHash(r.key)
+
+		_, err = r.collection.InsertOne(ctx, entry)
+		if mongo.IsDuplicateKeyError(err) {
+			continue
+		}
+		return err
+	}
+
+	return fmt.Errorf("failed to append audit entry after %d attempts", maxAuditAppendAttempts)
+}
+
+// ListAuditEntries returns the entries matching filter, newest first.
+func (r *auditRepository) ListAuditEntries(ctx context.Context, filter database.AuditFilter) ([]*database.AuditEntry, error) {
+	query := bson.M{}
+	if filter.Actor != "" {
+		query["actor"] = filter.Actor
+	}
+	if filter.Target != "" {
+		query["target"] = filter.Target
+	}
+	if filter.Action != "" {
+		query["action"] = filter.Action
+	}
+	if filter.Outcome != "" {
+		query["outcome"] = filter.Outcome
+	}
+	if filter.BeforeSeq > 0 {
+		query["_id"] = bson.M{"$lt": filter.BeforeSeq}
+	}
+
+	timeRange := bson.M{}
+	if !filter.From.IsZero() {
+		timeRange["$gte"] = filter.From
+	}
+	if !filter.To.IsZero() {
+		timeRange["$lt"] = filter.To
+	}
+	if len(timeRange) > 0 {
+		query["time"] = timeRange
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultAuditLimit
+	} else if limit > maxAuditLimit {
+		limit = maxAuditLimit
+	}
+
+	opts := options.Find().SetSort(bson.D{{Key: "_id", Value: -1}}).SetLimit(limit)
+	cursor, err := r.collection.Find(ctx, query, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*database.AuditEntry{}
+	if err := cursor.All(ctx, &entries); err != nil {
+		return nil, err
+	}
+
+	return entries, nil
+}
+
+// VerifyAuditChain walks the whole log in order, checking that entries are
+// numbered without gaps, that each one links to the hash of the one before
+// it and that its own hash matches its content. It returns the number of
+// entries checked.
+func (r *auditRepository) VerifyAuditChain(ctx context.Context) (int64, error) {
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	var checked int64
+	prevHash := ""
+	for cursor.Next(ctx) {
+		var entry database.AuditEntry
+		if err := cursor.Decode(&entry); err != nil {
+			return checked, err
+		}
+
+		switch {
+		case entry.Seq != checked+1:
+			return checked, fmt.Errorf("%w: expected entry %d, found %d", database.ErrAuditChainBroken, checked+1, entry.Seq)
+		case entry.PrevHash != prevHash:
+			return checked, fmt.Errorf("%w: entry %d does not link to entry %d", database.ErrAuditChainBroken, entry.Seq, checked)
+		case entry.Hash != entry.ComputeHash(r.key):
+			return checked, fmt.Errorf("%w: entry %d was modified", database.ErrAuditChainBroken, entry.Seq)
+		}
+
+		prevHash = entry.Hash
+		checked++
+	}
+
+	return checked, cursor.Err()
+}
@@ -0,0 +1,95 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sambhav/pkg/database"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type IdempotencyRepository interface {
+	ReserveIdempotencyKey(ctx context.Context, record *database.IdempotencyRecord) (*database.IdempotencyRecord, error)
+	SaveIdempotencyResponse(ctx context.Context, record *database.IdempotencyRecord) error
+	DeleteIdempotencyKey(ctx context.Context, record *database.IdempotencyRecord) error
+}
+
+type idempotencyRepository struct {
+	collection *mongo.Collection
+}
+
+func NewIdempotencyRepository(dbInstance database.Database) *idempotencyRepository {
+	collection := dbInstance.Connection().Collection("idempotency_keys")
+
+	return &idempotencyRepository{collection: collection}
+}
+
+// EnsureIndexes lets MongoDB remove records once expires_at has passed.
+func (r *idempotencyRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+// ReserveIdempotencyKey stores record unless a live record with the same ID
+// exists, in which case that one is returned instead. Expired records and
+// reservations whose lock has passed are replaced.
+func (r *idempotencyRepository) ReserveIdempotencyKey(ctx context.Context, record *database.IdempotencyRecord) (*database.IdempotencyRecord, error) {
+	now := record.CreatedAt
+	filter := bson.M{
+		"_id": record.ID,
+		"$or": bson.A{
+			bson.M{"expires_at": bson.M{"$lte": now}},
+			bson.M{"completed": false, "locked_until": bson.M{"$lte": now}},
+		},
+	}
+
+	// the document either matches the filter and is replaced, does not
+	// exist and is inserted, or is live and the insert fails; a live
+	// record can expire in between, so that is tried twice
+	for range 2 {
+		_, err := r.collection.ReplaceOne(ctx, filter, record, options.Replace().SetUpsert(true))
+		if err == nil {
+			return nil, nil
+		}
+		if !mongo.IsDuplicateKeyError(err) {
+			return nil, err
+		}
+
+		var existing database.IdempotencyRecord
+		err = r.collection.FindOne(ctx, bson.M{"_id": record.ID}).Decode(&existing)
+		if err == nil {
+			return &existing, nil
+		}
+		if !errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, err
+		}
+	}
+	return nil, errors.New("failed to reserve idempotency key")
+}
+
+// SaveIdempotencyResponse completes the reservation of record with its
+// response. It fails with ErrIdempotencyKeyNotFound when the reservation
+// was taken over in the meantime.
+func (r *idempotencyRepository) SaveIdempotencyResponse(ctx context.Context, record *database.IdempotencyRecord) error {
+	filter := bson.M{"_id": record.ID, "completed": false, "locked_until": record.LockedUntil}
+	res, err := r.collection.ReplaceOne(ctx, filter, record)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrIdempotencyKeyNotFound
+	}
+	return nil
+}
+
+// DeleteIdempotencyKey releases the reservation of record, unless it was
+// completed or taken over, so that the request can be retried.
+func (r *idempotencyRepository) DeleteIdempotencyKey(ctx context.Context, record *database.IdempotencyRecord) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": record.ID, "completed": false, "locked_until": record.LockedUntil})
+	return err
+}
@@ -0,0 +1,307 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sambhav/pkg/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type OAuthRepository interface {
+	CreateClient(ctx context.Context, client *database.OAuthClient) error
+	GetClient(ctx context.Context, id string) (*database.OAuthClient, error)
+	ListClients(ctx context.Context) ([]*database.OAuthClient, error)
+	DeleteClient(ctx context.Context, id string) error
+	SetClientSecret(ctx context.Context, id, secretHash string) error
+
+	CreateAuthorizationRequest(ctx context.Context, req *database.OAuthAuthorizationRequest) error
+	GetAuthorizationRequest(ctx context.Context, id string) (*database.OAuthAuthorizationRequest, error)
+	DeleteAuthorizationRequest(ctx context.Context, id string) error
+
+	CreateCode(ctx context.Context, code *database.OAuthAuthorizationCode) error
+	// UseCode marks the code as used at at, and returns it as it was
+	// before, so that a UsedAt already set reveals a code used twice.
+	UseCode(ctx context.Context, hash string, at time.Time) (*database.OAuthAuthorizationCode, error)
+
+	CreateGrant(ctx context.Context, grant *database.OAuthGrant) error
+	GetGrant(ctx context.Context, id string) (*database.OAuthGrant, error)
+	ExtendGrant(ctx context.Context, id string, expiresAt time.Time) error
+	RevokeGrant(ctx context.Context, id string, at time.Time) error
+	RevokeClientGrants(ctx context.Context, clientID string, at time.Time) error
+
+	CreateRefreshToken(ctx context.Context, token *database.OAuthRefreshToken) error
+	GetRefreshToken(ctx context.Context, hash string) (*database.OAuthRefreshToken, error)
+	// UseRefreshToken marks the token as used at at, and returns it as it
+	// was before, like UseCode.
+	UseRefreshToken(ctx context.Context, hash string, at time.Time) (*database.OAuthRefreshToken, error)
+
+	GetConsent(ctx context.Context, pid, clientID string) (*database.OAuthConsent, error)
+	SaveConsent(ctx context.Context, consent *database.OAuthConsent) error
+	DeleteClientConsents(ctx context.Context, clientID string) error
+}
+
+type oauthRepository struct {
+	clients       *mongo.Collection
+	requests      *mongo.Collection
+	codes         *mongo.Collection
+	grants        *mongo.Collection
+	refreshTokens *mongo.Collection
+	consents      *mongo.Collection
+}
+
+func NewOAuthRepository(dbInstance database.Database) *oauthRepository {
+	db := dbInstance.Connection()
+
+	return &oauthRepository{
+		clients:       db.Collection("oauth_clients"),
+		requests:      db.Collection("oauth_requests"),
+		codes:         db.Collection("oauth_codes"),
+		grants:        db.Collection("oauth_grants"),
+		refreshTokens: db.Collection("oauth_refresh_tokens"),
+		consents:      db.Collection("oauth_consents"),
+	}
+}
+
+// EnsureIndexes creates the TTL indexes that remove expired requests,
+// codes, grants and refresh tokens, and the indexes grants and consents
+// are looked up by.
+func (r *oauthRepository) EnsureIndexes(ctx context.Context) error {
+	ttl := mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	}
+	for _, coll := range []*mongo.Collection{r.requests, r.codes, r.grants, r.refreshTokens} {
+		if _, err := coll.Indexes().CreateOne(ctx, ttl); err != nil {
+			return err
+		}
+	}
+	if _, err := r.grants.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "client_id", Value: 1}},
+	}); err != nil {
+		return err
+	}
+	_, err := r.consents.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "pid", Value: 1}, {Key: "client_id", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "client_id", Value: 1}}},
+	})
+	return err
+}
+
+func (r *oauthRepository) CreateClient(ctx context.Context, client *database.OAuthClient) error {
+	_, err := r.clients.InsertOne(ctx, client)
+	return err
+}
+
+func (r *oauthRepository) GetClient(ctx context.Context, id string) (*database.OAuthClient, error) {
+	var client database.OAuthClient
+	if err := r.clients.FindOne(ctx, bson.M{"_id": id}).Decode(&client); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrOAuthClientNotFound
+		}
+		return nil, err
+	}
+
+	return &client, nil
+}
+
+func (r *oauthRepository) ListClients(ctx context.Context) ([]*database.OAuthClient, error) {
+	cursor, err := r.clients.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []*database.OAuthClient
+	if err := cursor.All(ctx, &clients); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+func (r *oauthRepository) DeleteClient(ctx context.Context, id string) error {
+	res, err := r.clients.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return database.ErrOAuthClientNotFound
+	}
+	return nil
+}
+
+func (r *oauthRepository) SetClientSecret(ctx context.Context, id, secretHash string) error {
+	res, err := r.clients.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$set": bson.M{"secret_hash": secretHash}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrOAuthClientNotFound
+	}
+	return nil
+}
+
+func (r *oauthRepository) CreateAuthorizationRequest(ctx context.Context, req *database.OAuthAuthorizationRequest) error {
+	_, err := r.requests.InsertOne(ctx, req)
+	return err
+}
+
+// GetAuthorizationRequest returns the request id, unless it has expired;
+// the TTL monitor only removes expired documents once a minute.
+func (r *oauthRepository) GetAuthorizationRequest(ctx context.Context, id string) (*database.OAuthAuthorizationRequest, error) {
+	var req database.OAuthAuthorizationRequest
+	filter := bson.M{"_id": id, "expires_at": bson.M{"$gt": time.Now()}}
+	if err := r.requests.FindOne(ctx, filter).Decode(&req); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrOAuthRequestNotFound
+		}
+		return nil, err
+	}
+
+	return &req, nil
+}
+
+func (r *oauthRepository) DeleteAuthorizationRequest(ctx context.Context, id string) error {
+	res, err := r.requests.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return database.ErrOAuthRequestNotFound
+	}
+	return nil
+}
+
+func (r *oauthRepository) CreateCode(ctx context.Context, code *database.OAuthAuthorizationCode) error {
+	_, err := r.codes.InsertOne(ctx, code)
+	return err
+}
+
+func (r *oauthRepository) UseCode(ctx context.Context, hash string, at time.Time) (*database.OAuthAuthorizationCode, error) {
+	var code database.OAuthAuthorizationCode
+	if err := r.use(ctx, r.codes, hash, at).Decode(&code); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrOAuthCodeNotFound
+		}
+		return nil, err
+	}
+
+	return &code, nil
+}
+
+// use sets used_at on the document id of coll, keeping the time of the
+// first use, and returns the document as it was before.
+func (r *oauthRepository) use(ctx context.Context, coll *mongo.Collection, id string, at time.Time) *mongo.SingleResult {
+	update := bson.A{bson.M{"$set": bson.M{"used_at": bson.M{"$ifNull": bson.A{"$used_at", at}}}}}
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.Before)
+	return coll.FindOneAndUpdate(ctx, bson.M{"_id": id, "expires_at": bson.M{"$gt": at}}, update, opts)
+}
+
+func (r *oauthRepository) CreateGrant(ctx context.Context, grant *database.OAuthGrant) error {
+	_, err := r.grants.InsertOne(ctx, grant)
+	return err
+}
+
+func (r *oauthRepository) GetGrant(ctx context.Context, id string) (*database.OAuthGrant, error) {
+	var grant database.OAuthGrant
+	if err := r.grants.FindOne(ctx, bson.M{"_id": id}).Decode(&grant); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrOAuthGrantNotFound
+		}
+		return nil, err
+	}
+
+	return &grant, nil
+}
+
+// ExtendGrant keeps the grant id until expiresAt, unless it already lasts
+// longer.
+func (r *oauthRepository) ExtendGrant(ctx context.Context, id string, expiresAt time.Time) error {
+	res, err := r.grants.UpdateOne(ctx, bson.M{"_id": id}, bson.M{"$max": bson.M{"expires_at": expiresAt}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrOAuthGrantNotFound
+	}
+	return nil
+}
+
+// RevokeGrant revokes the grant id. Revoking a grant twice keeps the time
+// of the first revocation.
+func (r *oauthRepository) RevokeGrant(ctx context.Context, id string, at time.Time) error {
+	res, err := r.grants.UpdateOne(ctx, bson.M{"_id": id}, bson.A{
+		bson.M{"$set": bson.M{"revoked_at": bson.M{"$ifNull": bson.A{"$revoked_at", at}}}},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrOAuthGrantNotFound
+	}
+	return nil
+}
+
+// RevokeClientGrants revokes every grant of a client that is not revoked
+// yet.
+func (r *oauthRepository) RevokeClientGrants(ctx context.Context, clientID string, at time.Time) error {
+	filter := bson.M{"client_id": clientID, "revoked_at": bson.M{"$exists": false}}
+	_, err := r.grants.UpdateMany(ctx, filter, bson.M{"$set": bson.M{"revoked_at": at}})
+	return err
+}
+
+func (r *oauthRepository) CreateRefreshToken(ctx context.Context, token *database.OAuthRefreshToken) error {
+	_, err := r.refreshTokens.InsertOne(ctx, token)
+	return err
+}
+
+func (r *oauthRepository) GetRefreshToken(ctx context.Context, hash string) (*database.OAuthRefreshToken, error) {
+	var token database.OAuthRefreshToken
+	if err := r.refreshTokens.FindOne(ctx, bson.M{"_id": hash}).Decode(&token); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrOAuthTokenNotFound
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (r *oauthRepository) UseRefreshToken(ctx context.Context, hash string, at time.Time) (*database.OAuthRefreshToken, error) {
+	var token database.OAuthRefreshToken
+	if err := r.use(ctx, r.refreshTokens, hash, at).Decode(&token); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrOAuthTokenNotFound
+		}
+		return nil, err
+	}
+
+	return &token, nil
+}
+
+func (r *oauthRepository) GetConsent(ctx context.Context, pid, clientID string) (*database.OAuthConsent, error) {
+	var consent database.OAuthConsent
+	if err := r.consents.FindOne(ctx, bson.M{"pid": pid, "client_id": clientID}).Decode(&consent); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrOAuthConsentNotFound
+		}
+		return nil, err
+	}
+
+	return &consent, nil
+}
+
+// SaveConsent replaces the consent the user gave the client, if any.
+func (r *oauthRepository) SaveConsent(ctx context.Context, consent *database.OAuthConsent) error {
+	filter := bson.M{"pid": consent.PID, "client_id": consent.ClientID}
+	_, err := r.consents.ReplaceOne(ctx, filter, consent, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *oauthRepository) DeleteClientConsents(ctx context.Context, clientID string) error {
+	_, err := r.consents.DeleteMany(ctx, bson.M{"client_id": clientID})
+	return err
+}
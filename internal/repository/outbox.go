@@ -0,0 +1,112 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sambhav/pkg/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// deliveredOutboxRetention is how long delivered events are kept around for
+// inspection before MongoDB removes them.
+const deliveredOutboxRetention = 7 * 24 * time.Hour
+
+type OutboxRepository interface {
+	AddOutboxEvent(ctx context.Context, event *database.OutboxEvent) error
+	ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]*database.OutboxEvent, error)
+	MarkOutboxEventDelivered(ctx context.Context, id string) error
+	MarkOutboxEventFailed(ctx context.Context, id string, nextAttempt time.Time, lastErr string) error
+	CountPendingOutboxEvents(ctx context.Context) (int64, error)
+}
+
+type outboxRepository struct {
+	collection *mongo.Collection
+}
+
+func NewOutboxRepository(dbInstance database.Database) *outboxRepository {
+	collection := dbInstance.Connection().Collection("outbox")
+
+	return &outboxRepository{collection: collection}
+}
+
+// EnsureIndexes creates the index the relay polls with and lets MongoDB
+// remove delivered events once they are past retention.
+func (r *outboxRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "delivered_at", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{
+			Keys:    bson.D{{Key: "delivered_at", Value: 1}},
+			Options: options.Index().SetExpireAfterSeconds(int32(deliveredOutboxRetention.Seconds())),
+		},
+	})
+	return err
+}
+
+// AddOutboxEvent inserts the event with ctx, so it is part of the
+// transaction ctx carries, if any.
+func (r *outboxRepository) AddOutboxEvent(ctx context.Context, event *database.OutboxEvent) error {
+	_, err := r.collection.InsertOne(ctx, event)
+	return err
+}
+
+// ClaimOutboxEvents leases up to limit undelivered events that are due.
+// Events are claimed one at a time with an atomic update so that concurrent
+// relays never claim the same event.
+func (r *outboxRepository) ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]*database.OutboxEvent, error) {
+	var claimed []*database.OutboxEvent
+	for len(claimed) < limit {
+		now := time.Now().UTC()
+		filter := bson.M{
+			"delivered_at":    bson.M{"$exists": false},
+			"next_attempt_at": bson.M{"$lte": now},
+			"locked_until":    bson.M{"$lte": now},
+		}
+		update := bson.M{"$set": bson.M{"locked_until": now.Add(lease)}}
+		opts := options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+			SetReturnDocument(options.After)
+
+		var event database.OutboxEvent
+		err := r.collection.FindOneAndUpdate(ctx, filter, update, opts).Decode(&event)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		} else if err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, &event)
+	}
+
+	return claimed, nil
+}
+
+func (r *outboxRepository) MarkOutboxEventDelivered(ctx context.Context, id string) error {
+	update := bson.M{
+		"$set":   bson.M{"delivered_at": time.Now().UTC()},
+		"$unset": bson.M{"last_error": ""},
+	}
+	_, err := r.collection.UpdateByID(ctx, id, update)
+	return err
+}
+
+// MarkOutboxEventFailed releases the event's lease and schedules it for
+// another attempt at nextAttempt.
+func (r *outboxRepository) MarkOutboxEventFailed(ctx context.Context, id string, nextAttempt time.Time, lastErr string) error {
+	update := bson.M{
+		"$set": bson.M{
+			"next_attempt_at": nextAttempt.UTC(),
+			"locked_until":    time.Time{},
+			"last_error":      lastErr,
+		},
+		"$inc": bson.M{"attempts": 1},
+	}
+	_, err := r.collection.UpdateByID(ctx, id, update)
+	return err
+}
+
+func (r *outboxRepository) CountPendingOutboxEvents(ctx context.Context) (int64, error) {
+	return r.collection.CountDocuments(ctx, bson.M{"delivered_at": bson.M{"$exists": false}})
+}
@@ -0,0 +1,119 @@
+package repository
+
+import (
+	"context"
+	"sambhav/pkg/database"
+	"sambhav/pkg/ratelimit"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// rateLimitRepository keeps the state of the rate limits in MongoDB, so
+// that every replica enforces the same quotas. Each check is a single
+// atomic update, computed by the server from the stored state.
+type rateLimitRepository struct {
+	collection *mongo.Collection
+}
+
+func NewRateLimitRepository(dbInstance database.Database) *rateLimitRepository {
+	collection := dbInstance.Connection().Collection("rate_limits")
+
+	return &rateLimitRepository{collection: collection}
+}
+
+// EnsureIndexes lets MongoDB remove the state of clients once it no longer
+// affects their quota.
+func (r *rateLimitRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (r *rateLimitRepository) TakeToken(ctx context.Context, key string, rule ratelimit.Rule, now time.Time) (bool, float64, error) {
+	capacity := float64(rule.Capacity())
+	// refill for the time since the last update, then take a token if
+	// there is a whole one
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"tokens": bson.M{"$min": bson.A{capacity, bson.M{"$add": bson.A{
+				bson.M{"$ifNull": bson.A{"$tokens", capacity}},
+				bson.M{"$multiply": bson.A{
+					bson.M{"$max": bson.A{0, bson.M{"$subtract": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}}}},
+					rule.Rate() / 1000,
+				}},
+			}}}},
+		}}},
+		{{Key: "$set", Value: bson.M{"taken": bson.M{"$gte": bson.A{"$tokens", 1}}}}},
+		{{Key: "$set", Value: bson.M{
+			"tokens":     bson.M{"$cond": bson.A{"$taken", bson.M{"$subtract": bson.A{"$tokens", 1}}, "$tokens"}},
+			"updated_at": bson.M{"$max": bson.A{now, bson.M{"$ifNull": bson.A{"$updated_at", now}}}},
+			"expires_at": now.Add(rule.FillTime()),
+		}}},
+	}
+
+	var doc struct {
+		Tokens float64 `bson:"tokens"`
+		Taken  bool    `bson:"taken"`
+	}
+	if err := r.update(ctx, key, pipeline, &doc); err != nil {
+		return false, 0, err
+	}
+	return doc.Taken, doc.Tokens, nil
+}
+
+func (r *rateLimitRepository) CountRequest(ctx context.Context, key string, rule ratelimit.Rule, now time.Time) (bool, int, int, error) {
+	start := rule.Window(now)
+	prevStart := start.Add(-rule.Period)
+	weight := 1 - float64(now.Sub(start))/float64(rule.Period)
+
+	// roll the windows over to the one now falls in, as
+	// ratelimit.MemoryStore does, then count the request if it fits
+	pipeline := mongo.Pipeline{
+		{{Key: "$set", Value: bson.M{
+			"previous": bson.M{"$switch": bson.M{
+				"branches": bson.A{
+					bson.M{"case": bson.M{"$eq": bson.A{"$window", start}}, "then": "$previous"},
+					bson.M{"case": bson.M{"$eq": bson.A{"$window", prevStart}}, "then": "$current"},
+				},
+				"default": 0,
+			}},
+			"current": bson.M{"$cond": bson.A{bson.M{"$eq": bson.A{"$window", start}}, "$current", 0}},
+			"window":  start,
+		}}},
+		{{Key: "$set", Value: bson.M{"counted": bson.M{"$lte": bson.A{
+			bson.M{"$add": bson.A{bson.M{"$multiply": bson.A{"$previous", weight}}, "$current", 1}},
+			rule.Requests,
+		}}}}},
+		{{Key: "$set", Value: bson.M{
+			"current":    bson.M{"$cond": bson.A{"$counted", bson.M{"$add": bson.A{"$current", 1}}, "$current"}},
+			"expires_at": start.Add(2 * rule.Period),
+		}}},
+	}
+
+	var doc struct {
+		Previous int  `bson:"previous"`
+		Current  int  `bson:"current"`
+		Counted  bool `bson:"counted"`
+	}
+	if err := r.update(ctx, key, pipeline, &doc); err != nil {
+		return false, 0, 0, err
+	}
+	return doc.Counted, doc.Previous, doc.Current, nil
+}
+
+// update applies pipeline to the document key, creating it when missing,
+// and decodes the result into doc.
+func (r *rateLimitRepository) update(ctx context.Context, key string, pipeline mongo.Pipeline, doc any) error {
+	opts := options.FindOneAndUpdate().SetUpsert(true).SetReturnDocument(options.After)
+	err := r.collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline, opts).Decode(doc)
+	if mongo.IsDuplicateKeyError(err) {
+		// a concurrent request created the document first
+		err = r.collection.FindOneAndUpdate(ctx, bson.M{"_id": key}, pipeline, opts).Decode(doc)
+	}
+	return err
+}
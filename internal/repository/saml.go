@@ -0,0 +1,147 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sambhav/pkg/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type SAMLRepository interface {
+	CreateTenant(ctx context.Context, tenant *database.SAMLTenant) error
+	GetTenant(ctx context.Context, id string) (*database.SAMLTenant, error)
+	ListTenants(ctx context.Context) ([]*database.SAMLTenant, error)
+	UpdateTenant(ctx context.Context, tenant *database.SAMLTenant) error
+	DeleteTenant(ctx context.Context, id string) error
+
+	CreateRequest(ctx context.Context, req *database.SAMLRequest) error
+	// UseRequest deletes the request id and returns it, unless it has
+	// expired, so that each response is accepted once.
+	UseRequest(ctx context.Context, id string) (*database.SAMLRequest, error)
+}
+
+type samlRepository struct {
+	tenants  *mongo.Collection
+	requests *mongo.Collection
+}
+
+func NewSAMLRepository(dbInstance database.Database) *samlRepository {
+	db := dbInstance.Connection()
+
+	return &samlRepository{
+		tenants:  db.Collection("saml_tenants"),
+		requests: db.Collection("saml_requests"),
+	}
+}
+
+// samlDomainsIndex is the name of the index giving each domain to one
+// tenant.
+const samlDomainsIndex = "domains_unique"
+
+// EnsureIndexes creates the index giving each domain to one tenant, and the
+// TTL index that removes expired requests.
+func (r *samlRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.tenants.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "domains", Value: 1}},
+		Options: options.Index().SetName(samlDomainsIndex).SetUnique(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.requests.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    bson.D{{Key: "expires_at", Value: 1}},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return err
+}
+
+func (r *samlRepository) CreateTenant(ctx context.Context, tenant *database.SAMLTenant) error {
+	_, err := r.tenants.InsertOne(ctx, tenant)
+	if domainTaken(err) {
+		return database.ErrSAMLDomainTaken
+	}
+	if mongo.IsDuplicateKeyError(err) {
+		return database.ErrSAMLTenantExists
+	}
+	return err
+}
+
+// domainTaken tells whether err is a write rejected by the domains index.
+func domainTaken(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCodeWithMessage(11000, samlDomainsIndex)
+}
+
+func (r *samlRepository) GetTenant(ctx context.Context, id string) (*database.SAMLTenant, error) {
+	var tenant database.SAMLTenant
+	if err := r.tenants.FindOne(ctx, bson.M{"_id": id}).Decode(&tenant); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrSAMLTenantNotFound
+		}
+		return nil, err
+	}
+
+	return &tenant, nil
+}
+
+func (r *samlRepository) ListTenants(ctx context.Context) ([]*database.SAMLTenant, error) {
+	cursor, err := r.tenants.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "_id", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var tenants []*database.SAMLTenant
+	if err := cursor.All(ctx, &tenants); err != nil {
+		return nil, err
+	}
+
+	return tenants, nil
+}
+
+func (r *samlRepository) UpdateTenant(ctx context.Context, tenant *database.SAMLTenant) error {
+	res, err := r.tenants.ReplaceOne(ctx, bson.M{"_id": tenant.ID}, tenant)
+	if domainTaken(err) {
+		return database.ErrSAMLDomainTaken
+	}
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrSAMLTenantNotFound
+	}
+	return nil
+}
+
+func (r *samlRepository) DeleteTenant(ctx context.Context, id string) error {
+	res, err := r.tenants.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return database.ErrSAMLTenantNotFound
+	}
+	return nil
+}
+
+func (r *samlRepository) CreateRequest(ctx context.Context, req *database.SAMLRequest) error {
+	_, err := r.requests.InsertOne(ctx, req)
+	return err
+}
+
+func (r *samlRepository) UseRequest(ctx context.Context, id string) (*database.SAMLRequest, error) {
+	var req database.SAMLRequest
+	filter := bson.M{"_id": id, "expires_at": bson.M{"$gt": time.Now()}}
+	if err := r.requests.FindOneAndDelete(ctx, filter).Decode(&req); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrSAMLRequestNotFound
+		}
+		return nil, err
+	}
+
+	return &req, nil
+}
@@ -0,0 +1,108 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sambhav/pkg/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+type SessionRepository interface {
+	GetSession(ctx context.Context, id string) (*database.Session, error)
+	SaveSession(ctx context.Context, session *database.Session) error
+	DeleteSession(ctx context.Context, id string) error
+	DeleteSessionByHandle(ctx context.Context, pid, handle string) error
+	ListSessionsByPID(ctx context.Context, pid string) ([]*database.Session, error)
+	DeleteSessionsByPID(ctx context.Context, pid string, exceptID string) (int64, error)
+}
+
+type sessionRepository struct {
+	collection *mongo.Collection
+}
+
+func NewSessionRepository(dbInstance database.Database) *sessionRepository {
+	collection := dbInstance.Connection().Collection("sessions")
+
+	return &sessionRepository{collection: collection}
+}
+
+// EnsureIndexes creates the indexes used for per-user and handle lookups
+// and lets MongoDB expire sessions on its own once expires_at has passed.
+func (r *sessionRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "pid", Value: 1}}},
+		{Keys: bson.D{{Key: "handle", Value: 1}}, Options: options.Index().SetUnique(true)},
+		{Keys: bson.D{{Key: "expires_at", Value: 1}}, Options: options.Index().SetExpireAfterSeconds(0)},
+	})
+	return err
+}
+
+func (r *sessionRepository) GetSession(ctx context.Context, id string) (*database.Session, error) {
+	var session database.Session
+	filter := bson.M{"_id": id, "expires_at": bson.M{"$gt": time.Now()}}
+	if err := r.collection.FindOne(ctx, filter).Decode(&session); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrSessionNotFound
+		}
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+func (r *sessionRepository) SaveSession(ctx context.Context, session *database.Session) error {
+	_, err := r.collection.ReplaceOne(ctx, bson.M{"_id": session.ID}, session, options.Replace().SetUpsert(true))
+	return err
+}
+
+func (r *sessionRepository) DeleteSession(ctx context.Context, id string) error {
+	_, err := r.collection.DeleteOne(ctx, bson.M{"_id": id})
+	return err
+}
+
+// DeleteSessionByHandle deletes the session with handle if it belongs to
+// the user identified by pid.
+func (r *sessionRepository) DeleteSessionByHandle(ctx context.Context, pid, handle string) error {
+	res, err := r.collection.DeleteOne(ctx, bson.M{"handle": handle, "pid": pid})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return database.ErrSessionNotFound
+	}
+
+	return nil
+}
+
+func (r *sessionRepository) ListSessionsByPID(ctx context.Context, pid string) ([]*database.Session, error) {
+	filter := bson.M{"pid": pid, "expires_at": bson.M{"$gt": time.Now()}}
+	cursor, err := r.collection.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "last_seen_at", Value: -1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []*database.Session
+	if err := cursor.All(ctx, &sessions); err != nil {
+		return nil, err
+	}
+
+	return sessions, nil
+}
+
+func (r *sessionRepository) DeleteSessionsByPID(ctx context.Context, pid string, exceptID string) (int64, error) {
+	filter := bson.M{"pid": pid}
+	if exceptID != "" {
+		filter["_id"] = bson.M{"$ne": exceptID}
+	}
+
+	res, err := r.collection.DeleteMany(ctx, filter)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.DeletedCount, nil
+}
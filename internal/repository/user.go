@@ -2,9 +2,12 @@ package repository
 
 import (
 	"context"
+	"errors"
 	"sambhav/pkg/database"
 
+	"go.mongodb.org/mongo-driver/v2/bson"
 	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
 )
 
 type UserService interface {
@@ -13,41 +16,195 @@ type UserService interface {
 	GetUserByID(ctx context.Context, userID string) (*database.User, error)
 	ListAllUsers(ctx context.Context) ([]*database.User, error)
 	GetUserById(ctx context.Context, userID string) (*database.User, error)
+	UpdateUser(ctx context.Context, user *database.User) error
+	DeleteUser(ctx context.Context, user *database.User) error
 }
 
 type userRepository struct {
-	db         *mongo.Database
-	collection *mongo.Collection
+	db             *mongo.Database
+	collection     *mongo.Collection
+	rememberTokens *mongo.Collection
+}
+
+// rememberToken is a remember me token of a user, as hashed by authboss.
+type rememberToken struct {
+	PID   string `bson:"pid"`
+	Token string `bson:"token"`
 }
 
 func NewUserRepository(dbInstance database.Database) *userRepository {
 	db := dbInstance.Connection()
 	collection := db.Collection("users")
 
-	return &userRepository{db: db, collection: collection}
+	return &userRepository{db: db, collection: collection, rememberTokens: db.Collection("remember_tokens")}
+}
+
+// EnsureIndexes creates the unique index on the e-mail address, which is
+// the PID users are looked up by, and the indexes for the other lookups of
+// authboss.
+func (r *userRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.collection.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{
+			Keys:    bson.D{{Key: "email", Value: 1}},
+			Options: options.Index().SetUnique(true),
+		},
+		{
+			Keys:    bson.D{{Key: "oauth2_provider", Value: 1}, {Key: "oauth2_uid", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "confirm_selector", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+		{
+			Keys:    bson.D{{Key: "recover_selector", Value: 1}},
+			Options: options.Index().SetSparse(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	_, err = r.rememberTokens.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "pid", Value: 1}, {Key: "token", Value: 1}},
+	})
+	return err
 }
 
+// GetUserById returns the user with the hex encoded ObjectID userID.
 func (r *userRepository) GetUserById(ctx context.Context, userID string) (*database.User, error) {
-	// Implementation goes here
-	return nil, nil
+	id, err := bson.ObjectIDFromHex(userID)
+	if err != nil {
+		return nil, database.ErrUserNotFound
+	}
+	return r.findUser(ctx, bson.M{"_id": id})
 }
 
 func (r *userRepository) GetUserByEmail(ctx context.Context, email string) (*database.User, error) {
-	// Implementation goes here
-	return nil, nil
+	return r.findUser(ctx, bson.M{"email": email})
 }
 
+// CreateUser inserts user, giving it an ID unless it has one.
 func (r *userRepository) CreateUser(ctx context.Context, user *database.User) (*database.User, error) {
-	// Implementation goes here
-	return nil, nil
+	if user.ID.IsZero() {
+		user.ID = bson.NewObjectID()
+	}
+	if _, err := r.collection.InsertOne(ctx, user); err != nil {
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, database.ErrUserExists
+		}
+		return nil, err
+	}
+	return user, nil
+}
+
+// GetUserByConfirmSelector returns the user with the e-mail confirmation
+// selector.
+func (r *userRepository) GetUserByConfirmSelector(ctx context.Context, selector string) (*database.User, error) {
+	return r.findUser(ctx, bson.M{"confirm_selector": selector})
+}
+
+// GetUserByRecoverSelector returns the user with the password recovery
+// selector.
+func (r *userRepository) GetUserByRecoverSelector(ctx context.Context, selector string) (*database.User, error) {
+	return r.findUser(ctx, bson.M{"recover_selector": selector})
+}
+
+// GetUserByOAuth2 returns the user signing in with uid at provider.
+func (r *userRepository) GetUserByOAuth2(ctx context.Context, provider, uid string) (*database.User, error) {
+	return r.findUser(ctx, bson.M{"oauth2_provider": provider, "oauth2_uid": uid})
 }
 
 func (r *userRepository) ListAllUsers(ctx context.Context) ([]*database.User, error) {
-	// Implementation goes here
-	return nil, nil
+	cursor, err := r.collection.Find(ctx, bson.M{}, options.Find().SetSort(bson.D{{Key: "email", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	users := []*database.User{}
+	if err := cursor.All(ctx, &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
 }
 
 func (r *userRepository) GetUserByID(ctx context.Context, userID string) (*database.User, error) {
-	// Implementation goes here
-	return nil, nil
+	return r.GetUserById(ctx, userID)
+}
+
+// UpdateUser saves the profile fields of user.
+func (r *userRepository) UpdateUser(ctx context.Context, user *database.User) error {
+	res, err := r.collection.UpdateByID(ctx, user.ID, bson.M{"$set": bson.M{
+		"name": user.Name,
+		"bio":  user.Bio,
+	}})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrUserNotFound
+	}
+	return nil
+}
+
+// ReplaceUser saves every field of user and returns the user as it was
+// before.
+func (r *userRepository) ReplaceUser(ctx context.Context, user *database.User) (*database.User, error) {
+	var prev database.User
+	err := r.collection.FindOneAndReplace(ctx, bson.M{"_id": user.ID}, user).Decode(&prev)
+	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrUserNotFound
+		}
+		if mongo.IsDuplicateKeyError(err) {
+			return nil, database.ErrUserExists
+		}
+		return nil, err
+	}
+	return &prev, nil
+}
+
+func (r *userRepository) DeleteUser(ctx context.Context, user *database.User) error {
+	res, err := r.collection.DeleteOne(ctx, bson.M{"_id": user.ID})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return database.ErrUserNotFound
+	}
+	return nil
+}
+
+// AddRememberToken stores a remember me token of the user pid.
+func (r *userRepository) AddRememberToken(ctx context.Context, pid, token string) error {
+	_, err := r.rememberTokens.InsertOne(ctx, rememberToken{PID: pid, Token: token})
+	return err
+}
+
+// DeleteRememberTokens deletes every remember me token of the user pid.
+func (r *userRepository) DeleteRememberTokens(ctx context.Context, pid string) error {
+	_, err := r.rememberTokens.DeleteMany(ctx, bson.M{"pid": pid})
+	return err
+}
+
+// UseRememberToken deletes the remember me token of the user pid, and
+// reports whether it existed. A token can be used once.
+func (r *userRepository) UseRememberToken(ctx context.Context, pid, token string) (bool, error) {
+	res, err := r.rememberTokens.DeleteOne(ctx, bson.M{"pid": pid, "token": token})
+	if err != nil {
+		return false, err
+	}
+	return res.DeletedCount == 1, nil
+}
+
+func (r *userRepository) findUser(ctx context.Context, filter bson.M) (*database.User, error) {
+	var user database.User
+	if err := r.collection.FindOne(ctx, filter).Decode(&user); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrUserNotFound
+		}
+		return nil, err
+	}
+
+	return &user, nil
 }
@@ -0,0 +1,281 @@
+package repository
+
+import (
+	"context"
+	"errors"
+	"sambhav/pkg/database"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+// maxWebhookAttemptLog bounds the attempts kept in the log of a delivery.
+const maxWebhookAttemptLog = 20
+
+type WebhookRepository interface {
+	CreateWebhookSubscription(ctx context.Context, sub *database.WebhookSubscription) error
+	GetWebhookSubscription(ctx context.Context, id string) (*database.WebhookSubscription, error)
+	ListWebhookSubscriptions(ctx context.Context) ([]*database.WebhookSubscription, error)
+	ListActiveWebhookSubscriptions(ctx context.Context, eventName string) ([]*database.WebhookSubscription, error)
+	UpdateWebhookSubscription(ctx context.Context, sub *database.WebhookSubscription) error
+	DeleteWebhookSubscription(ctx context.Context, id string) error
+	RecordWebhookSuccess(ctx context.Context, id string) error
+	RecordWebhookFailure(ctx context.Context, id string, disableAfter int) (bool, error)
+
+	AddWebhookDelivery(ctx context.Context, delivery *database.WebhookDelivery) error
+	GetWebhookDelivery(ctx context.Context, id string) (*database.WebhookDelivery, error)
+	ListWebhookDeliveries(ctx context.Context, subscriptionID string, limit int64) ([]*database.WebhookDelivery, error)
+	ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*database.WebhookDelivery, error)
+	SaveWebhookAttempt(ctx context.Context, id string, attempt database.WebhookAttempt, status string, nextAttempt time.Time) error
+	ResetWebhookDelivery(ctx context.Context, id string) error
+}
+
+type webhookRepository struct {
+	subscriptions *mongo.Collection
+	deliveries    *mongo.Collection
+}
+
+func NewWebhookRepository(dbInstance database.Database) *webhookRepository {
+	db := dbInstance.Connection()
+
+	return &webhookRepository{
+		subscriptions: db.Collection("webhook_subscriptions"),
+		deliveries:    db.Collection("webhook_deliveries"),
+	}
+}
+
+// EnsureIndexes creates the indexes used to fan events out to subscriptions
+// and to poll and list deliveries.
+func (r *webhookRepository) EnsureIndexes(ctx context.Context) error {
+	_, err := r.subscriptions.Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys: bson.D{{Key: "active", Value: 1}, {Key: "events", Value: 1}},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = r.deliveries.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "status", Value: 1}, {Key: "next_attempt_at", Value: 1}}},
+		{Keys: bson.D{{Key: "subscription_id", Value: 1}, {Key: "created_at", Value: -1}}},
+	})
+	return err
+}
+
+func (r *webhookRepository) CreateWebhookSubscription(ctx context.Context, sub *database.WebhookSubscription) error {
+	_, err := r.subscriptions.InsertOne(ctx, sub)
+	return err
+}
+
+func (r *webhookRepository) GetWebhookSubscription(ctx context.Context, id string) (*database.WebhookSubscription, error) {
+	var sub database.WebhookSubscription
+	if err := r.subscriptions.FindOne(ctx, bson.M{"_id": id}).Decode(&sub); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrWebhookNotFound
+		}
+		return nil, err
+	}
+
+	return &sub, nil
+}
+
+func (r *webhookRepository) ListWebhookSubscriptions(ctx context.Context) ([]*database.WebhookSubscription, error) {
+	return r.findSubscriptions(ctx, bson.M{})
+}
+
+func (r *webhookRepository) ListActiveWebhookSubscriptions(ctx context.Context, eventName string) ([]*database.WebhookSubscription, error) {
+	return r.findSubscriptions(ctx, bson.M{"active": true, "events": bson.M{"$in": bson.A{eventName, "*"}}})
+}
+
+func (r *webhookRepository) findSubscriptions(ctx context.Context, filter bson.M) ([]*database.WebhookSubscription, error) {
+	cursor, err := r.subscriptions.Find(ctx, filter, options.Find().SetSort(bson.D{{Key: "created_at", Value: 1}}))
+	if err != nil {
+		return nil, err
+	}
+
+	subs := []*database.WebhookSubscription{}
+	if err := cursor.All(ctx, &subs); err != nil {
+		return nil, err
+	}
+
+	return subs, nil
+}
+
+func (r *webhookRepository) UpdateWebhookSubscription(ctx context.Context, sub *database.WebhookSubscription) error {
+	res, err := r.subscriptions.ReplaceOne(ctx, bson.M{"_id": sub.ID}, sub)
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrWebhookNotFound
+	}
+	return nil
+}
+
+// DeleteWebhookSubscription removes the subscription and its delivery log.
+func (r *webhookRepository) DeleteWebhookSubscription(ctx context.Context, id string) error {
+	res, err := r.subscriptions.DeleteOne(ctx, bson.M{"_id": id})
+	if err != nil {
+		return err
+	}
+	if res.DeletedCount == 0 {
+		return database.ErrWebhookNotFound
+	}
+
+	_, err = r.deliveries.DeleteMany(ctx, bson.M{"subscription_id": id})
+	return err
+}
+
+func (r *webhookRepository) RecordWebhookSuccess(ctx context.Context, id string) error {
+	_, err := r.subscriptions.UpdateByID(ctx, id, bson.M{"$set": bson.M{"consecutive_failures": 0}})
+	return err
+}
+
+// RecordWebhookFailure counts a failed attempt against the subscription and
+// disables it once disableAfter attempts in a row have failed. It reports
+// whether this call disabled the subscription.
+func (r *webhookRepository) RecordWebhookFailure(ctx context.Context, id string, disableAfter int) (bool, error) {
+	var sub database.WebhookSubscription
+	err := r.subscriptions.FindOneAndUpdate(ctx,
+		bson.M{"_id": id},
+		bson.M{"$inc": bson.M{"consecutive_failures": 1}},
+		options.FindOneAndUpdate().SetReturnDocument(options.After),
+	).Decode(&sub)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		return false, database.ErrWebhookNotFound
+	} else if err != nil {
+		return false, err
+	}
+	if disableAfter <= 0 || sub.ConsecutiveFailures < disableAfter {
+		return false, nil
+	}
+
+	now := time.Now().UTC()
+	res, err := r.subscriptions.UpdateOne(ctx,
+		bson.M{"_id": id, "active": true},
+		bson.M{"$set": bson.M{
+			"active":          false,
+			"disabled_at":     now,
+			"disabled_reason": "too many consecutive failures",
+			"updated_at":      now,
+		}},
+	)
+	if err != nil {
+		return false, err
+	}
+	return res.ModifiedCount > 0, nil
+}
+
+// AddWebhookDelivery queues a delivery. Adding a delivery whose ID exists
+// already is a no-op, which makes fanning out the same event twice harmless.
+func (r *webhookRepository) AddWebhookDelivery(ctx context.Context, delivery *database.WebhookDelivery) error {
+	_, err := r.deliveries.UpdateOne(ctx,
+		bson.M{"_id": delivery.ID},
+		bson.M{"$setOnInsert": delivery},
+		options.UpdateOne().SetUpsert(true),
+	)
+	return err
+}
+
+func (r *webhookRepository) GetWebhookDelivery(ctx context.Context, id string) (*database.WebhookDelivery, error) {
+	var delivery database.WebhookDelivery
+	if err := r.deliveries.FindOne(ctx, bson.M{"_id": id}).Decode(&delivery); err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return nil, database.ErrWebhookDeliveryNotFound
+		}
+		return nil, err
+	}
+
+	return &delivery, nil
+}
+
+// ListWebhookDeliveries returns the most recent deliveries of a
+// subscription, newest first.
+func (r *webhookRepository) ListWebhookDeliveries(ctx context.Context, subscriptionID string, limit int64) ([]*database.WebhookDelivery, error) {
+	opts := options.Find().SetSort(bson.D{{Key: "created_at", Value: -1}}).SetLimit(limit)
+	cursor, err := r.deliveries.Find(ctx, bson.M{"subscription_id": subscriptionID}, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := []*database.WebhookDelivery{}
+	if err := cursor.All(ctx, &deliveries); err != nil {
+		return nil, err
+	}
+
+	return deliveries, nil
+}
+
+// ClaimWebhookDeliveries leases up to limit pending deliveries that are due,
+// one at a time so that concurrent dispatchers never claim the same one.
+func (r *webhookRepository) ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration) ([]*database.WebhookDelivery, error) {
+	var claimed []*database.WebhookDelivery
+	for len(claimed) < limit {
+		now := time.Now().UTC()
+		filter := bson.M{
+			"status":          database.WebhookPending,
+			"next_attempt_at": bson.M{"$lte": now},
+			"locked_until":    bson.M{"$lte": now},
+		}
+		update := bson.M{"$set": bson.M{"locked_until": now.Add(lease)}}
+		opts := options.FindOneAndUpdate().
+			SetSort(bson.D{{Key: "next_attempt_at", Value: 1}}).
+			SetReturnDocument(options.After)
+
+		var delivery database.WebhookDelivery
+		err := r.deliveries.FindOneAndUpdate(ctx, filter, update, opts).Decode(&delivery)
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			break
+		} else if err != nil {
+			return claimed, err
+		}
+		claimed = append(claimed, &delivery)
+	}
+
+	return claimed, nil
+}
+
+// SaveWebhookAttempt appends attempt to the delivery log, sets the delivery
+// status and releases its lease.
+func (r *webhookRepository) SaveWebhookAttempt(ctx context.Context, id string, attempt database.WebhookAttempt, status string, nextAttempt time.Time) error {
+	set := bson.M{
+		"status":          status,
+		"next_attempt_at": nextAttempt.UTC(),
+		"locked_until":    time.Time{},
+	}
+	if status == database.WebhookSucceeded {
+		set["delivered_at"] = attempt.At.UTC()
+	}
+
+	_, err := r.deliveries.UpdateByID(ctx, id, bson.M{
+		"$set": set,
+		"$inc": bson.M{"attempt": 1},
+		"$push": bson.M{"attempts": bson.M{
+			"$each":  bson.A{attempt},
+			"$slice": -maxWebhookAttemptLog,
+		}},
+	})
+	return err
+}
+
+// ResetWebhookDelivery queues a delivery again with a fresh retry budget,
+// keeping its attempt log.
+func (r *webhookRepository) ResetWebhookDelivery(ctx context.Context, id string) error {
+	res, err := r.deliveries.UpdateByID(ctx, id, bson.M{
+		"$set": bson.M{
+			"status":          database.WebhookPending,
+			"attempt":         0,
+			"next_attempt_at": time.Now().UTC(),
+			"locked_until":    time.Time{},
+		},
+		"$unset": bson.M{"delivered_at": ""},
+	})
+	if err != nil {
+		return err
+	}
+	if res.MatchedCount == 0 {
+		return database.ErrWebhookDeliveryNotFound
+	}
+	return nil
+}
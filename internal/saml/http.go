@@ -0,0 +1,250 @@
+package saml
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestCookie binds a login to the browser it was started in. The
+// response of the identity provider is posted cross-site, which only
+// SameSite=None cookies are sent with, and those must be Secure; browsers
+// treat http://localhost as secure for development.
+const requestCookie = "saml_request"
+
+type SAMLHandler interface {
+	Metadata(c *gin.Context)
+	Login(c *gin.Context)
+	ACS(c *gin.Context)
+
+	CreateTenant(c *gin.Context)
+	ListTenants(c *gin.Context)
+	GetTenant(c *gin.Context)
+	UpdateTenant(c *gin.Context)
+	ImportMetadata(c *gin.Context)
+	DeleteTenant(c *gin.Context)
+}
+
+type samlHandler struct {
+	samlService SAMLService
+	ab          *abpkg.Authboss
+}
+
+func NewSAMLHandler(samlService SAMLService, ab *abpkg.Authboss) SAMLHandler {
+	return &samlHandler{samlService: samlService, ab: ab}
+}
+
+func (h *samlHandler) Metadata(c *gin.Context) {
+	metadata, err := h.samlService.Metadata(c.Request.Context(), c.Param("tenant"))
+	if err != nil {
+		writeError(c, err, "Failed to get metadata")
+		return
+	}
+
+	c.Data(http.StatusOK, "application/samlmetadata+xml", metadata)
+}
+
+// Login sends the user agent to the identity provider of the tenant. The
+// optional redirect query parameter is where the user is sent once signed
+// in.
+func (h *samlHandler) Login(c *gin.Context) {
+	idpURL, requestID, err := h.samlService.Login(c.Request.Context(), c.Param("tenant"), c.Query("redirect"))
+	if err != nil {
+		writeError(c, err, "Failed to start login")
+		return
+	}
+
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     requestCookie,
+		Value:    requestID,
+		Path:     "/saml/",
+		MaxAge:   int(requestTTL.Seconds()),
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	c.Redirect(http.StatusFound, idpURL)
+}
+
+// ACS takes the form encoded SAMLResponse the identity provider posts, and
+// signs the user in with a redirect to where the login was started for.
+func (h *samlHandler) ACS(c *gin.Context) {
+	requestID, _ := c.Cookie(requestCookie)
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     requestCookie,
+		Path:     "/saml/",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+		SameSite: http.SameSiteNoneMode,
+	})
+
+	login, err := h.samlService.ACS(c.Request.Context(), c.Param("tenant"), ACSRequest{
+		SAMLResponse: c.PostForm("SAMLResponse"),
+		RequestID:    requestID,
+	})
+	if err != nil {
+		writeError(c, err, "Failed to sign in")
+		return
+	}
+
+	if err := h.ab.LogIn(c, login.PID, login.RedirectTo); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign in"})
+	}
+}
+
+type tenantRequest struct {
+	ID               string                        `json:"id"`
+	Name             string                        `json:"name"`
+	Metadata         string                        `json:"metadata"`
+	MetadataURL      string                        `json:"metadata_url"`
+	AttributeMapping database.SAMLAttributeMapping `json:"attribute_mapping"`
+	Domains          []string                      `json:"domains"`
+	JITProvisioning  *bool                         `json:"jit_provisioning"`
+}
+
+// CreateTenant creates a tenant, importing its identity provider from the
+// metadata XML in the request or else from the metadata URL. Users are
+// provisioned just in time unless jit_provisioning is false.
+func (h *samlHandler) CreateTenant(c *gin.Context) {
+	var req tenantRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	tenant, err := h.samlService.CreateTenant(c.Request.Context(), c.GetString(abpkg.ContextKeyPID), TenantInput{
+		ID:               strings.TrimSpace(req.ID),
+		Name:             req.Name,
+		Metadata:         req.Metadata,
+		MetadataURL:      req.MetadataURL,
+		AttributeMapping: req.AttributeMapping,
+		Domains:          req.Domains,
+		JITProvisioning:  req.JITProvisioning == nil || *req.JITProvisioning,
+	})
+	if err != nil {
+		writeError(c, err, "Failed to create tenant")
+		return
+	}
+
+	c.JSON(http.StatusCreated, tenant)
+}
+
+func (h *samlHandler) ListTenants(c *gin.Context) {
+	tenants, err := h.samlService.ListTenants(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list tenants"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"tenants": tenants})
+}
+
+func (h *samlHandler) GetTenant(c *gin.Context) {
+	tenant, err := h.samlService.GetTenant(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to get tenant")
+		return
+	}
+
+	c.JSON(http.StatusOK, tenant)
+}
+
+// UpdateTenant changes the name, attribute mapping, domains or just in time
+// provisioning of a tenant; fields left out are kept.
+func (h *samlHandler) UpdateTenant(c *gin.Context) {
+	var req struct {
+		Name             *string                        `json:"name"`
+		AttributeMapping *database.SAMLAttributeMapping `json:"attribute_mapping"`
+		Domains          []string                       `json:"domains"`
+		JITProvisioning  *bool                          `json:"jit_provisioning"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	tenant, err := h.samlService.UpdateTenant(c.Request.Context(), c.Param("id"), TenantUpdate{
+		Name:             req.Name,
+		AttributeMapping: req.AttributeMapping,
+		Domains:          req.Domains,
+		JITProvisioning:  req.JITProvisioning,
+	})
+	if err != nil {
+		writeError(c, err, "Failed to update tenant")
+		return
+	}
+
+	c.JSON(http.StatusOK, tenant)
+}
+
+// ImportMetadata replaces the identity provider of a tenant with the one of
+// the metadata XML in the request, or when there is none with the one
+// fetched again from the metadata URL of the tenant, as identity providers
+// rotate their keys.
+func (h *samlHandler) ImportMetadata(c *gin.Context) {
+	var req struct {
+		Metadata string `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	tenant, err := h.samlService.ImportMetadata(c.Request.Context(), c.Param("id"), req.Metadata)
+	if err != nil {
+		writeError(c, err, "Failed to import metadata")
+		return
+	}
+
+	c.JSON(http.StatusOK, tenant)
+}
+
+func (h *samlHandler) DeleteTenant(c *gin.Context) {
+	if err := h.samlService.DeleteTenant(c.Request.Context(), c.Param("id")); err != nil {
+		writeError(c, err, "Failed to delete tenant")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+func writeError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrSAMLTenantNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+	case errors.Is(err, database.ErrSAMLTenantExists):
+		c.JSON(http.StatusConflict, gin.H{"error": "Tenant already exists"})
+	case errors.Is(err, database.ErrSAMLDomainTaken):
+		c.JSON(http.StatusConflict, gin.H{"error": "A domain belongs to another tenant"})
+	case errors.Is(err, ErrInvalidTenantID):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tenant id must be 2 to 63 lowercase letters, digits and dashes"})
+	case errors.Is(err, ErrInvalidName):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Tenant name is required"})
+	case errors.Is(err, ErrInvalidDomains):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "At least one domain is required, and domains must be domain names"})
+	case errors.Is(err, ErrInvalidMetadata):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Metadata or a metadata URL of a SAML 2.0 identity provider is required"})
+	case errors.Is(err, ErrInvalidRedirect):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Redirect must stay on the application"})
+	case errors.Is(err, ErrRequestMismatch):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login expired or was started in another browser"})
+	case errors.Is(err, ErrInvalidResponse):
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid SAML response"})
+	case errors.Is(err, ErrDomainNotAllowed):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your e-mail domain cannot sign in through this identity provider"})
+	case errors.Is(err, ErrNoAccount):
+		c.JSON(http.StatusForbidden, gin.H{"error": "No account exists for you"})
+	case errors.Is(err, ErrAccountLocked):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your account is locked"})
+	case errors.Is(err, ErrSecondFactorRequired):
+		c.JSON(http.StatusForbidden, gin.H{"error": "Your account uses two-factor authentication, sign in with your password"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
@@ -0,0 +1,608 @@
+// Package saml is the SAML 2.0 service provider enterprise tenants sign
+// their users in through, with identity providers of their own.
+//
+// Each tenant has its own service provider, with its metadata at
+// /saml/<tenant>/metadata and its assertion consumer service at
+// /saml/<tenant>/acs. Logins start at /saml/<tenant>/login, which sends the
+// user agent to the identity provider with a signed authentication
+// request. The response must answer that very request, from the same
+// browser, and is accepted once; users are created on their first login
+// when the tenant provisions them just in time.
+package saml
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"sambhav/internal/audit"
+	"sambhav/internal/repository"
+	"sambhav/pkg/database"
+	"sambhav/pkg/events"
+	"sambhav/pkg/metrics"
+	samlpkg "sambhav/pkg/saml"
+
+	"github.com/aarondl/authboss/v3"
+)
+
+const (
+	// requestTTL is how long users have to sign in at the identity
+	// provider.
+	requestTTL = 10 * time.Minute
+	// maxMetadataSize bounds the metadata fetched from a URL.
+	maxMetadataSize = 1 << 20
+)
+
+var (
+	ErrInvalidTenantID = errors.New("saml: tenant id must be 2 to 63 lowercase letters, digits and dashes")
+	ErrInvalidName     = errors.New("saml: tenant name is required")
+	ErrInvalidDomains  = errors.New("saml: domains must be domain names, and at least one is required")
+	ErrInvalidMetadata = errors.New("saml: metadata or an https metadata url is required, and must describe a SAML 2.0 identity provider")
+	// ErrInvalidRedirect is returned for login redirects that leave the
+	// application.
+	ErrInvalidRedirect = errors.New("saml: redirect must stay on the application")
+	// ErrRequestMismatch is returned for responses posted from another
+	// browser than the login was started in, or for another tenant.
+	ErrRequestMismatch = errors.New("saml: response does not answer a login started in this browser")
+	// ErrInvalidResponse is returned for responses that fail validation.
+	// The reason is logged, not returned.
+	ErrInvalidResponse = errors.New("saml: invalid response")
+	// ErrDomainNotAllowed is returned when the identity provider signs in
+	// a user of a domain the tenant does not have.
+	ErrDomainNotAllowed = errors.New("saml: e-mail domain is not allowed for the tenant")
+	// ErrNoAccount is returned for unknown users of tenants that do not
+	// provision users just in time.
+	ErrNoAccount = errors.New("saml: no account for the user")
+	// ErrAccountLocked is returned for users whose account is locked.
+	ErrAccountLocked = errors.New("saml: account is locked")
+	// ErrSecondFactorRequired is returned for users who set up two-factor
+	// authentication, which the identity provider cannot vouch for; they
+	// sign in with their password and second factor instead.
+	ErrSecondFactorRequired = errors.New("saml: account requires two-factor authentication")
+)
+
+var (
+	tenantIDPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+	domainPattern   = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]{0,61}[a-z0-9])?\.)+[a-z]{2,63}$`)
+)
+
+// Config configures the service provider.
+type Config struct {
+	// BaseURL is the URL the SAML endpoints are served under, which entity
+	// IDs and the assertion consumer service URLs are built from.
+	BaseURL string
+	// RootURL is the URL of the application users are sent back to.
+	RootURL string
+	// Key and Certificate sign authentication requests.
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// UserStore loads and creates the users signing in, by PID.
+type UserStore interface {
+	Load(ctx context.Context, key string) (authboss.User, error)
+	New(ctx context.Context) authboss.User
+	Create(ctx context.Context, user authboss.User) error
+	Save(ctx context.Context, user authboss.User) error
+}
+
+// TenantInput holds the fields of a tenant. The identity provider is
+// imported from Metadata, or else fetched from MetadataURL.
+type TenantInput struct {
+	ID               string
+	Name             string
+	Metadata         string
+	MetadataURL      string
+	AttributeMapping database.SAMLAttributeMapping
+	Domains          []string
+	JITProvisioning  bool
+}
+
+// TenantUpdate holds the fields of a tenant to change; nil fields are left
+// as they are.
+type TenantUpdate struct {
+	Name             *string
+	AttributeMapping *database.SAMLAttributeMapping
+	Domains          []string
+	JITProvisioning  *bool
+}
+
+// ACSRequest is a response posted to the assertion consumer service.
+type ACSRequest struct {
+	SAMLResponse string
+	// RequestID is the ID of the login started in the browser that posted
+	// the response, which the response must answer.
+	RequestID string
+}
+
+// Login is a user signed in by an identity provider.
+type Login struct {
+	PID        string
+	RedirectTo string
+}
+
+type SAMLService interface {
+	// Metadata returns the service provider metadata of a tenant, for its
+	// identity provider to import.
+	Metadata(ctx context.Context, tenantID string) ([]byte, error)
+	// Login starts a login of a tenant user and returns the URL of the
+	// identity provider to send the user agent to, and the ID of the
+	// request, which the browser must post the response along with.
+	// redirectTo is where the user is sent once signed in.
+	Login(ctx context.Context, tenantID, redirectTo string) (string, string, error)
+	// ACS validates the response of the identity provider of a tenant and
+	// returns the user it signs in, creating them if the tenant allows.
+	ACS(ctx context.Context, tenantID string, req ACSRequest) (*Login, error)
+
+	CreateTenant(ctx context.Context, createdBy string, in TenantInput) (*database.SAMLTenant, error)
+	ListTenants(ctx context.Context) ([]*database.SAMLTenant, error)
+	GetTenant(ctx context.Context, id string) (*database.SAMLTenant, error)
+	UpdateTenant(ctx context.Context, id string, in TenantUpdate) (*database.SAMLTenant, error)
+	// ImportMetadata replaces the identity provider of a tenant with the
+	// one of metadata, or when empty the one fetched again from the
+	// metadata URL the tenant was created with.
+	ImportMetadata(ctx context.Context, id, metadata string) (*database.SAMLTenant, error)
+	DeleteTenant(ctx context.Context, id string) error
+}
+
+type samlService struct {
+	samlRepository repository.SAMLRepository
+	users          UserStore
+	tx             database.Transactor
+	cfg            Config
+	client         *http.Client
+	audit          audit.AuditService
+	events         events.Publisher
+	metrics        *metrics.Metrics
+	logger         *slog.Logger
+}
+
+// NewSAMLService returns the service provider. Users provisioned just in
+// time are created in a transaction of tx together with their
+// user.registered event.
+func NewSAMLService(samlRepo repository.SAMLRepository, users UserStore, tx database.Transactor, cfg Config, auditService audit.AuditService, publisher events.Publisher, m *metrics.Metrics, logger *slog.Logger) SAMLService {
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	cfg.RootURL = strings.TrimSuffix(cfg.RootURL, "/")
+	return &samlService{
+		samlRepository: samlRepo,
+		users:          users,
+		tx:             tx,
+		cfg:            cfg,
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			// The metadata holds the keys assertions are trusted by, so it
+			// is never fetched in plaintext, not even after a redirect.
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				if req.URL.Scheme != "https" {
+					return errors.New("redirected to a non-https url")
+				}
+				if len(via) >= 10 {
+					return errors.New("stopped after 10 redirects")
+				}
+				return nil
+			},
+		},
+		audit:   auditService,
+		events:  publisher,
+		metrics: m,
+		logger:  logger,
+	}
+}
+
+// serviceProvider returns the service provider of a tenant.
+func (s *samlService) serviceProvider(tenantID string) *samlpkg.ServiceProvider {
+	base := s.cfg.BaseURL + "/saml/" + tenantID
+	return &samlpkg.ServiceProvider{
+		EntityID:    base + "/metadata",
+		ACSURL:      base + "/acs",
+		Key:         s.cfg.Key,
+		Certificate: s.cfg.Certificate,
+	}
+}
+
+// identityProvider returns the identity provider of a tenant.
+func identityProvider(tenant *database.SAMLTenant) (*samlpkg.IdentityProvider, error) {
+	idp := &samlpkg.IdentityProvider{EntityID: tenant.IdPEntityID, SSOURL: tenant.IdPSSOURL}
+	for _, c := range tenant.IdPCertificates {
+		cert, err := samlpkg.ParseCertificate(c)
+		if err != nil {
+			return nil, fmt.Errorf("tenant %s: %w", tenant.ID, err)
+		}
+		idp.Certificates = append(idp.Certificates, cert)
+	}
+	return idp, nil
+}
+
+func (s *samlService) Metadata(ctx context.Context, tenantID string) ([]byte, error) {
+	if _, err := s.samlRepository.GetTenant(ctx, tenantID); err != nil {
+		return nil, err
+	}
+	return s.serviceProvider(tenantID).Metadata(), nil
+}
+
+func (s *samlService) Login(ctx context.Context, tenantID, redirectTo string) (string, string, error) {
+	tenant, err := s.samlRepository.GetTenant(ctx, tenantID)
+	if err != nil {
+		return "", "", err
+	}
+	redirectTo, err = s.redirectURL(redirectTo)
+	if err != nil {
+		return "", "", err
+	}
+	idp, err := identityProvider(tenant)
+	if err != nil {
+		return "", "", err
+	}
+
+	now := time.Now().UTC()
+	idpURL, id, err := s.serviceProvider(tenant.ID).AuthnRequest(idp, "", now)
+	if err != nil {
+		return "", "", err
+	}
+	err = s.samlRepository.CreateRequest(ctx, &database.SAMLRequest{
+		ID:         id,
+		TenantID:   tenant.ID,
+		RedirectTo: redirectTo,
+		CreatedAt:  now,
+		ExpiresAt:  now.Add(requestTTL),
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return idpURL, id, nil
+}
+
+// redirectURL resolves where to send a user once signed in: a path of the
+// application or a URL on its origin, and the application itself by
+// default. Anything else is rejected, so that logins cannot be used to
+// redirect users to other sites.
+func (s *samlService) redirectURL(redirectTo string) (string, error) {
+	if redirectTo == "" {
+		return s.cfg.RootURL + "/", nil
+	}
+	if strings.HasPrefix(redirectTo, "/") && !strings.HasPrefix(redirectTo, "//") && !strings.Contains(redirectTo, `\`) {
+		return s.cfg.RootURL + redirectTo, nil
+	}
+	u, err := url.Parse(redirectTo)
+	root, _ := url.Parse(s.cfg.RootURL)
+	if err != nil || root == nil || u.Scheme != root.Scheme || u.Host != root.Host || u.User != nil {
+		return "", ErrInvalidRedirect
+	}
+	return u.String(), nil
+}
+
+func (s *samlService) ACS(ctx context.Context, tenantID string, req ACSRequest) (*Login, error) {
+	tenant, err := s.samlRepository.GetTenant(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+
+	login, err := s.acs(ctx, tenant, req)
+	s.metrics.SAMLResponse(tenant.ID, err)
+	if err != nil {
+		entry := database.AuditEntry{
+			Action:  database.AuditLogin,
+			Outcome: database.AuditFailure,
+			Details: map[string]string{"method": "saml", "tenant": tenant.ID},
+		}
+		if login != nil {
+			entry.Actor, entry.Target = login.PID, login.PID
+		}
+		s.audit.Record(ctx, entry)
+		return nil, err
+	}
+
+	s.audit.Record(ctx, database.AuditEntry{
+		Action:  database.AuditLogin,
+		Outcome: database.AuditSuccess,
+		Actor:   login.PID,
+		Target:  login.PID,
+		Details: map[string]string{"method": "saml", "tenant": tenant.ID},
+	})
+	s.publish(ctx, events.UserLoggedIn{PID: login.PID, Method: "saml:" + tenant.ID})
+	return login, nil
+}
+
+// acs signs in the user of a response. On failure it returns the user the
+// response was about, if it got that far, for the audit log.
+func (s *samlService) acs(ctx context.Context, tenant *database.SAMLTenant, req ACSRequest) (*Login, error) {
+	if req.RequestID == "" {
+		return nil, ErrRequestMismatch
+	}
+	authnReq, err := s.samlRepository.UseRequest(ctx, req.RequestID)
+	if errors.Is(err, database.ErrSAMLRequestNotFound) {
+		return nil, ErrRequestMismatch
+	} else if err != nil {
+		return nil, err
+	}
+	if authnReq.TenantID != tenant.ID {
+		return nil, ErrRequestMismatch
+	}
+
+	idp, err := identityProvider(tenant)
+	if err != nil {
+		return nil, err
+	}
+	assertion, err := s.serviceProvider(tenant.ID).ParseResponse(idp, req.SAMLResponse, authnReq.ID, time.Now())
+	if err != nil {
+		s.logger.WarnContext(ctx, "rejected saml response", "tenant", tenant.ID, "error", err)
+		return nil, ErrInvalidResponse
+	}
+
+	email, name := mapAttributes(tenant.AttributeMapping, assertion)
+	login := &Login{PID: email, RedirectTo: authnReq.RedirectTo}
+	_, domain, ok := strings.Cut(email, "@")
+	if !ok || !slices.Contains(tenant.Domains, domain) {
+		s.logger.WarnContext(ctx, "rejected saml user", "tenant", tenant.ID, "email", email)
+		return login, ErrDomainNotAllowed
+	}
+
+	if err := s.provision(ctx, tenant, email, name); err != nil {
+		return login, err
+	}
+	return login, nil
+}
+
+// mapAttributes reads the e-mail address and name of the user from an
+// assertion, as the mapping of the tenant says.
+func mapAttributes(mapping database.SAMLAttributeMapping, a *samlpkg.Assertion) (email, name string) {
+	email = a.NameID
+	if mapping.Email != "" {
+		email = a.Attribute(mapping.Email)
+	}
+
+	if mapping.Name != "" {
+		name = a.Attribute(mapping.Name)
+	}
+	if name == "" && (mapping.FirstName != "" || mapping.LastName != "") {
+		name = strings.TrimSpace(a.Attribute(mapping.FirstName) + " " + a.Attribute(mapping.LastName))
+	}
+	return strings.ToLower(strings.TrimSpace(email)), strings.TrimSpace(name)
+}
+
+// provision creates the user email if the tenant provisions users just in
+// time, or else updates their name from the identity provider. The e-mail
+// address is confirmed, as the identity provider vouches for it. Existing
+// users are refused while locked or when they have a second factor, which
+// a password login would ask for.
+func (s *samlService) provision(ctx context.Context, tenant *database.SAMLTenant, email, name string) error {
+	loaded, err := s.users.Load(ctx, email)
+	if errors.Is(err, authboss.ErrUserNotFound) {
+		if !tenant.JITProvisioning {
+			return ErrNoAccount
+		}
+		return s.create(ctx, tenant, email, name)
+	} else if err != nil {
+		return err
+	}
+
+	user := loaded.(*database.User)
+	if user.Locked.After(time.Now()) {
+		return ErrAccountLocked
+	}
+	if user.TOTPSecretKey != "" || user.SMSPhoneNumber != "" {
+		return ErrSecondFactorRequired
+	}
+	if (name == "" || user.Name == name) && user.Confirmed {
+		return nil
+	}
+	if name != "" {
+		user.Name = name
+	}
+	user.Confirmed = true
+	return s.users.Save(ctx, user)
+}
+
+func (s *samlService) create(ctx context.Context, tenant *database.SAMLTenant, email, name string) error {
+	user := s.users.New(ctx).(*database.User)
+	user.Email = email
+	user.Name = name
+	user.Confirmed = true
+
+	err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := s.users.Create(ctx, user); err != nil {
+			return err
+		}
+		return s.events.Publish(ctx, events.UserRegistered{PID: email, Name: name, Source: "saml"})
+	})
+	if errors.Is(err, authboss.ErrUserFound) {
+		// created by a concurrent login
+		return nil
+	}
+	details := map[string]string{"source": "saml", "tenant": tenant.ID}
+	if err != nil {
+		s.audit.Record(ctx, database.AuditEntry{
+			Action:  database.AuditUserCreate,
+			Outcome: database.AuditFailure,
+			Target:  email,
+			Details: details,
+		})
+		return err
+	}
+
+	s.audit.Record(ctx, database.AuditEntry{
+		Action:  database.AuditUserCreate,
+		Outcome: database.AuditSuccess,
+		Actor:   email,
+		Target:  email,
+		Details: details,
+	})
+	s.metrics.UserRegistered("saml")
+	return nil
+}
+
+func (s *samlService) publish(ctx context.Context, event events.Event) {
+	if err := s.events.Publish(ctx, event); err != nil {
+		s.logger.ErrorContext(ctx, "failed to publish event", "event", event.EventName(), "error", err)
+	}
+}
+
+func (s *samlService) CreateTenant(ctx context.Context, createdBy string, in TenantInput) (*database.SAMLTenant, error) {
+	if !tenantIDPattern.MatchString(in.ID) {
+		return nil, ErrInvalidTenantID
+	}
+	name := strings.TrimSpace(in.Name)
+	if name == "" {
+		return nil, ErrInvalidName
+	}
+	domains, err := normalizeDomains(in.Domains)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	tenant := &database.SAMLTenant{
+		ID:               in.ID,
+		Name:             name,
+		MetadataURL:      in.MetadataURL,
+		AttributeMapping: in.AttributeMapping,
+		Domains:          domains,
+		JITProvisioning:  in.JITProvisioning,
+		CreatedBy:        createdBy,
+		CreatedAt:        now,
+		UpdatedAt:        now,
+	}
+	if err := s.importMetadata(ctx, tenant, in.Metadata); err != nil {
+		return nil, err
+	}
+	if err := s.samlRepository.CreateTenant(ctx, tenant); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (s *samlService) ListTenants(ctx context.Context) ([]*database.SAMLTenant, error) {
+	return s.samlRepository.ListTenants(ctx)
+}
+
+func (s *samlService) GetTenant(ctx context.Context, id string) (*database.SAMLTenant, error) {
+	return s.samlRepository.GetTenant(ctx, id)
+}
+
+func (s *samlService) UpdateTenant(ctx context.Context, id string, in TenantUpdate) (*database.SAMLTenant, error) {
+	tenant, err := s.samlRepository.GetTenant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if in.Name != nil {
+		if tenant.Name = strings.TrimSpace(*in.Name); tenant.Name == "" {
+			return nil, ErrInvalidName
+		}
+	}
+	if in.AttributeMapping != nil {
+		tenant.AttributeMapping = *in.AttributeMapping
+	}
+	if in.Domains != nil {
+		if tenant.Domains, err = normalizeDomains(in.Domains); err != nil {
+			return nil, err
+		}
+	}
+	if in.JITProvisioning != nil {
+		tenant.JITProvisioning = *in.JITProvisioning
+	}
+	tenant.UpdatedAt = time.Now().UTC()
+
+	if err := s.samlRepository.UpdateTenant(ctx, tenant); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+func (s *samlService) ImportMetadata(ctx context.Context, id, metadata string) (*database.SAMLTenant, error) {
+	tenant, err := s.samlRepository.GetTenant(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.importMetadata(ctx, tenant, metadata); err != nil {
+		return nil, err
+	}
+	tenant.UpdatedAt = time.Now().UTC()
+	if err := s.samlRepository.UpdateTenant(ctx, tenant); err != nil {
+		return nil, err
+	}
+	return tenant, nil
+}
+
+// importMetadata sets the identity provider of tenant from metadata, or
+// when empty from the metadata at the URL of the tenant.
+func (s *samlService) importMetadata(ctx context.Context, tenant *database.SAMLTenant, metadata string) error {
+	data := []byte(metadata)
+	if metadata == "" {
+		if tenant.MetadataURL == "" {
+			return ErrInvalidMetadata
+		}
+		var err error
+		if data, err = s.fetchMetadata(ctx, tenant.MetadataURL); err != nil {
+			s.logger.WarnContext(ctx, "failed to fetch saml metadata", "tenant", tenant.ID, "url", tenant.MetadataURL, "error", err)
+			return ErrInvalidMetadata
+		}
+	}
+
+	idp, err := samlpkg.ParseMetadata(data)
+	if err != nil {
+		s.logger.WarnContext(ctx, "rejected saml metadata", "tenant", tenant.ID, "error", err)
+		return ErrInvalidMetadata
+	}
+	tenant.IdPEntityID = idp.EntityID
+	tenant.IdPSSOURL = idp.SSOURL
+	tenant.IdPCertificates = nil
+	for _, cert := range idp.Certificates {
+		tenant.IdPCertificates = append(tenant.IdPCertificates, base64.StdEncoding.EncodeToString(cert.Raw))
+	}
+	return nil
+}
+
+func (s *samlService) fetchMetadata(ctx context.Context, metadataURL string) ([]byte, error) {
+	u, err := url.Parse(metadataURL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("metadata url must be an https URL")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", res.Status)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, maxMetadataSize))
+}
+
+// DeleteTenant deletes a tenant. Its users keep their accounts.
+func (s *samlService) DeleteTenant(ctx context.Context, id string) error {
+	return s.samlRepository.DeleteTenant(ctx, id)
+}
+
+func normalizeDomains(domains []string) ([]string, error) {
+	if len(domains) == 0 {
+		return nil, ErrInvalidDomains
+	}
+	normalized := make([]string, 0, len(domains))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSpace(d))
+		if !domainPattern.MatchString(d) {
+			return nil, ErrInvalidDomains
+		}
+		if !slices.Contains(normalized, d) {
+			normalized = append(normalized, d)
+		}
+	}
+	return normalized, nil
+}
@@ -0,0 +1,469 @@
+package saml
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"sambhav/internal/audit"
+	"sambhav/internal/repository"
+	"sambhav/pkg/database"
+	"sambhav/pkg/events"
+	samlpkg "sambhav/pkg/saml"
+	"sambhav/pkg/saml/samltest"
+
+	"github.com/aarondl/authboss/v3"
+)
+
+// memRepository keeps the tenants and requests of SAMLRepository in
+// memory, for tests only. The methods the tests do not call are left
+// unimplemented.
+type memRepository struct {
+	repository.SAMLRepository
+
+	mu       sync.Mutex
+	tenants  map[string]database.SAMLTenant
+	requests map[string]database.SAMLRequest
+}
+
+func (r *memRepository) CreateTenant(_ context.Context, tenant *database.SAMLTenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.tenants[tenant.ID]; ok {
+		return database.ErrSAMLTenantExists
+	}
+	if r.domainTaken(tenant) {
+		return database.ErrSAMLDomainTaken
+	}
+	r.tenants[tenant.ID] = *tenant
+	return nil
+}
+
+// domainTaken tells whether another tenant has a domain of tenant, as the
+// unique index on domains would.
+func (r *memRepository) domainTaken(tenant *database.SAMLTenant) bool {
+	for _, other := range r.tenants {
+		if other.ID == tenant.ID {
+			continue
+		}
+		for _, d := range tenant.Domains {
+			if slices.Contains(other.Domains, d) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r *memRepository) GetTenant(_ context.Context, id string) (*database.SAMLTenant, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	tenant, ok := r.tenants[id]
+	if !ok {
+		return nil, database.ErrSAMLTenantNotFound
+	}
+	return &tenant, nil
+}
+
+func (r *memRepository) UpdateTenant(_ context.Context, tenant *database.SAMLTenant) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.domainTaken(tenant) {
+		return database.ErrSAMLDomainTaken
+	}
+	r.tenants[tenant.ID] = *tenant
+	return nil
+}
+
+func (r *memRepository) CreateRequest(_ context.Context, req *database.SAMLRequest) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.requests[req.ID] = *req
+	return nil
+}
+
+func (r *memRepository) UseRequest(_ context.Context, id string) (*database.SAMLRequest, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	req, ok := r.requests[id]
+	delete(r.requests, id)
+	if !ok || !req.ExpiresAt.After(time.Now()) {
+		return nil, database.ErrSAMLRequestNotFound
+	}
+	return &req, nil
+}
+
+// memUsers is an in-memory UserStore, for tests only.
+type memUsers struct {
+	mu    sync.Mutex
+	users map[string]database.User
+}
+
+func (u *memUsers) Load(_ context.Context, key string) (authboss.User, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	user, ok := u.users[key]
+	if !ok {
+		return nil, authboss.ErrUserNotFound
+	}
+	return &user, nil
+}
+
+func (u *memUsers) New(context.Context) authboss.User { return &database.User{} }
+
+func (u *memUsers) Create(_ context.Context, user authboss.User) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	du := user.(*database.User)
+	if _, ok := u.users[du.Email]; ok {
+		return authboss.ErrUserFound
+	}
+	u.users[du.Email] = *du
+	return nil
+}
+
+func (u *memUsers) Save(_ context.Context, user authboss.User) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	du := user.(*database.User)
+	u.users[du.Email] = *du
+	return nil
+}
+
+// memAudit keeps the audit entries recorded, for tests only.
+type memAudit struct {
+	audit.AuditService
+
+	mu      sync.Mutex
+	entries []database.AuditEntry
+}
+
+func (a *memAudit) Record(_ context.Context, entry database.AuditEntry) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.entries = append(a.entries, entry)
+	return nil
+}
+
+func (a *memAudit) last() database.AuditEntry {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.entries[len(a.entries)-1]
+}
+
+type txKey struct{}
+
+// memTx runs functions in a pretend transaction, which its context tells.
+type memTx struct{}
+
+func (memTx) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	return fn(context.WithValue(ctx, txKey{}, true))
+}
+
+type memPublisher struct {
+	mu     sync.Mutex
+	events []events.Event
+	// inTx tells, by event name, whether it was published in a transaction.
+	inTx map[string]bool
+}
+
+func (p *memPublisher) Publish(ctx context.Context, e events.Event) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = append(p.events, e)
+	p.inTx[e.EventName()] = ctx.Value(txKey{}) != nil
+	return nil
+}
+
+type fixture struct {
+	service *samlService
+	users   *memUsers
+	audit   *memAudit
+	events  *memPublisher
+	idp     *samltest.IdP
+}
+
+// newFixture returns a service with the tenant acme, whose identity
+// provider signs in alice@acme.example.
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	key, cert, err := samlpkg.GenerateKeyPair("sp.example.com")
+	if err != nil {
+		t.Fatalf("GenerateKeyPair: %v", err)
+	}
+	idp, err := samltest.New("https://idp.example.com/metadata", "alice@acme.example")
+	if err != nil {
+		t.Fatalf("samltest.New: %v", err)
+	}
+	idp.Attributes["displayName"] = []string{"Alice"}
+
+	f := &fixture{
+		users:  &memUsers{users: map[string]database.User{}},
+		audit:  &memAudit{},
+		events: &memPublisher{inTx: map[string]bool{}},
+		idp:    idp,
+	}
+	repo := &memRepository{tenants: map[string]database.SAMLTenant{}, requests: map[string]database.SAMLRequest{}}
+	f.service = NewSAMLService(repo, f.users, memTx{}, Config{
+		BaseURL:     "https://sp.example.com",
+		RootURL:     "https://app.example.com",
+		Key:         key,
+		Certificate: cert,
+	}, f.audit, f.events, nil, slog.New(slog.NewTextHandler(io.Discard, nil))).(*samlService)
+
+	_, err = f.service.CreateTenant(context.Background(), "admin@example.com", TenantInput{
+		ID:               "acme",
+		Name:             "Acme",
+		Metadata:         string(idp.Metadata("https://idp.example.com/sso")),
+		AttributeMapping: database.SAMLAttributeMapping{Name: "displayName"},
+		Domains:          []string{"acme.example"},
+		JITProvisioning:  true,
+	})
+	if err != nil {
+		t.Fatalf("CreateTenant: %v", err)
+	}
+	return f
+}
+
+// login starts a login and returns the ID of its request.
+func (f *fixture) login(t *testing.T) string {
+	t.Helper()
+	_, id, err := f.service.Login(context.Background(), "acme", "/settings")
+	if err != nil {
+		t.Fatalf("Login: %v", err)
+	}
+	return id
+}
+
+func (f *fixture) response(t *testing.T, requestID string) string {
+	t.Helper()
+	sp := f.service.serviceProvider("acme")
+	res, err := f.idp.Response(sp.EntityID, sp.ACSURL, requestID)
+	if err != nil {
+		t.Fatalf("Response: %v", err)
+	}
+	return res
+}
+
+func TestACS(t *testing.T) {
+	f := newFixture(t)
+	id := f.login(t)
+
+	login, err := f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: f.response(t, id), RequestID: id})
+	if err != nil {
+		t.Fatalf("ACS: %v", err)
+	}
+	if login.PID != "alice@acme.example" || login.RedirectTo != "https://app.example.com/settings" {
+		t.Errorf("got login %+v", login)
+	}
+
+	user, err := f.users.Load(context.Background(), "alice@acme.example")
+	if err != nil {
+		t.Fatalf("user was not provisioned: %v", err)
+	}
+	if u := user.(*database.User); u.Name != "Alice" || !u.Confirmed {
+		t.Errorf("provisioned user %+v", u)
+	}
+	if entry := f.audit.last(); entry.Action != database.AuditLogin || entry.Outcome != database.AuditSuccess {
+		t.Errorf("audited %s %s", entry.Action, entry.Outcome)
+	}
+	if len(f.events.events) != 2 {
+		t.Errorf("published %d events, want user.registered and user.logged_in", len(f.events.events))
+	}
+	if !f.events.inTx["user.registered"] {
+		t.Error("user.registered was not published in the transaction creating the user")
+	}
+}
+
+func TestACSRejectsReplay(t *testing.T) {
+	f := newFixture(t)
+	id := f.login(t)
+	req := ACSRequest{SAMLResponse: f.response(t, id), RequestID: id}
+
+	if _, err := f.service.ACS(context.Background(), "acme", req); err != nil {
+		t.Fatalf("ACS: %v", err)
+	}
+	if _, err := f.service.ACS(context.Background(), "acme", req); !errors.Is(err, ErrRequestMismatch) {
+		t.Errorf("replayed response: got %v, want %v", err, ErrRequestMismatch)
+	}
+	if entry := f.audit.last(); entry.Action != database.AuditLogin || entry.Outcome != database.AuditFailure {
+		t.Errorf("replay audited as %s %s", entry.Action, entry.Outcome)
+	}
+}
+
+func TestACSRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// acs posts a response for the login started with request ID id.
+		acs  func(t *testing.T, f *fixture, id string) error
+		want error
+	}{
+		{
+			name: "response to another login",
+			acs: func(t *testing.T, f *fixture, id string) error {
+				other := f.login(t)
+				_, err := f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: f.response(t, other), RequestID: id})
+				return err
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "no login in the browser",
+			acs: func(t *testing.T, f *fixture, id string) error {
+				_, err := f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: f.response(t, id)})
+				return err
+			},
+			want: ErrRequestMismatch,
+		},
+		{
+			name: "login of another tenant",
+			acs: func(t *testing.T, f *fixture, id string) error {
+				other := f.service.samlRepository.(*memRepository)
+				tenant, _ := other.GetTenant(context.Background(), "acme")
+				tenant.ID, tenant.Domains = "globex", []string{"globex.example"}
+				other.CreateTenant(context.Background(), tenant)
+				_, err := f.service.ACS(context.Background(), "globex", ACSRequest{SAMLResponse: f.response(t, id), RequestID: id})
+				return err
+			},
+			want: ErrRequestMismatch,
+		},
+		{
+			name: "expired conditions",
+			acs: func(t *testing.T, f *fixture, id string) error {
+				f.idp.Now = func() time.Time { return time.Now().Add(-time.Hour) }
+				_, err := f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: f.response(t, id), RequestID: id})
+				return err
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "wrong audience",
+			acs: func(t *testing.T, f *fixture, id string) error {
+				res, err := f.idp.Response("https://sp.example.com/saml/globex/metadata", "https://sp.example.com/saml/acme/acs", id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: res, RequestID: id})
+				return err
+			},
+			want: ErrInvalidResponse,
+		},
+		{
+			name: "user of another domain",
+			acs: func(t *testing.T, f *fixture, id string) error {
+				f.idp.NameID = "eve@globex.example"
+				_, err := f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: f.response(t, id), RequestID: id})
+				return err
+			},
+			want: ErrDomainNotAllowed,
+		},
+		{
+			name: "unknown user without provisioning",
+			acs: func(t *testing.T, f *fixture, id string) error {
+				jit := false
+				if _, err := f.service.UpdateTenant(context.Background(), "acme", TenantUpdate{JITProvisioning: &jit}); err != nil {
+					t.Fatal(err)
+				}
+				_, err := f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: f.response(t, id), RequestID: id})
+				return err
+			},
+			want: ErrNoAccount,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFixture(t)
+			if err := tc.acs(t, f, f.login(t)); !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+			if _, err := f.users.Load(context.Background(), f.idp.NameID); err == nil {
+				t.Error("user was provisioned")
+			}
+			if entry := f.audit.last(); entry.Action != database.AuditLogin || entry.Outcome != database.AuditFailure {
+				t.Errorf("audited %s %s", entry.Action, entry.Outcome)
+			}
+		})
+	}
+}
+
+func TestACSRefusesLockedAndTwoFactorUsers(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		user database.User
+		want error
+	}{
+		{"locked", database.User{Locked: time.Now().Add(time.Hour)}, ErrAccountLocked},
+		{"totp", database.User{TOTPSecretKey: "secret"}, ErrSecondFactorRequired},
+		{"sms", database.User{SMSPhoneNumber: "+15550100"}, ErrSecondFactorRequired},
+		{"lock expired", database.User{Locked: time.Now().Add(-time.Hour)}, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			f := newFixture(t)
+			tc.user.Email = "alice@acme.example"
+			f.users.users[tc.user.Email] = tc.user
+			id := f.login(t)
+
+			_, err := f.service.ACS(context.Background(), "acme", ACSRequest{SAMLResponse: f.response(t, id), RequestID: id})
+			if !errors.Is(err, tc.want) {
+				t.Fatalf("got %v, want %v", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestTenantDomainsAreUnique(t *testing.T) {
+	f := newFixture(t)
+	in := TenantInput{
+		ID:       "globex",
+		Name:     "Globex",
+		Metadata: string(f.idp.Metadata("https://idp.example.com/sso")),
+		Domains:  []string{"globex.example", "ACME.example"},
+	}
+	if _, err := f.service.CreateTenant(context.Background(), "admin@example.com", in); !errors.Is(err, database.ErrSAMLDomainTaken) {
+		t.Fatalf("CreateTenant: got %v, want %v", err, database.ErrSAMLDomainTaken)
+	}
+
+	in.Domains = []string{"globex.example"}
+	if _, err := f.service.CreateTenant(context.Background(), "admin@example.com", in); err != nil {
+		t.Fatalf("CreateTenant: %v", err)
+	}
+	if _, err := f.service.UpdateTenant(context.Background(), "globex", TenantUpdate{Domains: []string{"acme.example"}}); !errors.Is(err, database.ErrSAMLDomainTaken) {
+		t.Errorf("UpdateTenant: got %v, want %v", err, database.ErrSAMLDomainTaken)
+	}
+}
+
+func TestMetadataURLMustBeHTTPS(t *testing.T) {
+	f := newFixture(t)
+	idp := httptest.NewTLSServer(f.idp.Handler())
+	defer idp.Close()
+	plain := httptest.NewServer(f.idp.Handler())
+	defer plain.Close()
+	redirect := httptest.NewTLSServer(http.RedirectHandler(plain.URL+"/metadata", http.StatusFound))
+	defer redirect.Close()
+	f.service.client.Transport = idp.Client().Transport
+
+	for _, tc := range []struct {
+		url  string
+		want error
+	}{
+		{idp.URL + "/metadata", nil},
+		{plain.URL + "/metadata", ErrInvalidMetadata},
+		{redirect.URL, ErrInvalidMetadata},
+	} {
+		_, err := f.service.CreateTenant(context.Background(), "admin@example.com", TenantInput{
+			ID:          "initech",
+			Name:        "Initech",
+			MetadataURL: tc.url,
+			Domains:     []string{"initech.example"},
+		})
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.url, err, tc.want)
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package user
 
 import (
+	"errors"
 	"net/http"
+	"sambhav/pkg/database"
 
 	"github.com/gin-gonic/gin"
 )
@@ -10,6 +12,8 @@ type UserHandler interface {
 	RegisterUser(c *gin.Context)
 	GetUserByID(c *gin.Context)
 	GetAllUsers(c *gin.Context)
+	UpdateUser(c *gin.Context)
+	DeleteUser(c *gin.Context)
 }
 
 type userHandler struct {
@@ -37,7 +41,10 @@ func (h *userHandler) RegisterUser(c *gin.Context) {
 
 	// Call the RegisterUser method from the use case layer
 	err := h.userService.RegisterUser(c.Request.Context(), req.Name, req.Email)
-	if err != nil {
+	if errors.Is(err, database.ErrUserExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "User already exists"})
+		return
+	} else if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
 		return
 	}
@@ -78,3 +85,46 @@ func (h *userHandler) GetAllUsers(c *gin.Context) {
 	// Respond with the user data in JSON format
 	c.JSON(http.StatusOK, users)
 }
+
+// UpdateUser handles HTTP requests to change a user's name or bio.
+func (h *userHandler) UpdateUser(c *gin.Context) {
+	type UpdateUserRequest struct {
+		Name *string `json:"name"`
+		Bio  *string `json:"bio"`
+	}
+
+	var req UpdateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+	if req.Name != nil && *req.Name == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be empty"})
+		return
+	}
+
+	user, err := h.userService.UpdateUser(c.Request.Context(), c.Param("userID"), req.Name, req.Bio)
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+// DeleteUser handles HTTP requests to delete a user.
+func (h *userHandler) DeleteUser(c *gin.Context) {
+	err := h.userService.DeleteUser(c.Request.Context(), c.Param("userID"))
+	if errors.Is(err, database.ErrUserNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -1,13 +1,18 @@
 package user
 
 import (
-	"database/sql"
 	"errors"
-	"fmt"
+	"log/slog"
+	"sambhav/internal/audit"
 	"sambhav/internal/repository"
 	"sambhav/pkg/database"
+	"sambhav/pkg/events"
+	"sambhav/pkg/metrics"
+	"sambhav/pkg/tracing"
+	"strings"
 
-	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 )
 
@@ -15,24 +20,50 @@ type UserService interface {
 	RegisterUser(ctx context.Context, name, email string) error
 	GetAllUsers(ctx context.Context) ([]*database.User, error)
 	GetUserByID(ctx context.Context, userID string) (*database.User, error)
+	UpdateUser(ctx context.Context, userID string, name, bio *string) (*database.User, error)
+	DeleteUser(ctx context.Context, userID string) error
 }
 
 type userService struct {
 	userRepository repository.UserService
+	tx             database.Transactor
+	metrics        *metrics.Metrics
+	tracer         trace.Tracer
+	logger         *slog.Logger
+	audit          audit.AuditService
+	events         events.Publisher
 }
 
-func NewUserService(userRepo repository.UserService) UserService {
-	return &userService{userRepository: userRepo}
+// NewUserService returns the user service. Users are changed in a
+// transaction of tx together with the events published about them, so that
+// an event is delivered if and only if its change was saved.
+func NewUserService(userRepo repository.UserService, tx database.Transactor, m *metrics.Metrics, logger *slog.Logger, auditService audit.AuditService, publisher events.Publisher) UserService {
+	return &userService{
+		userRepository: userRepo,
+		tx:             tx,
+		metrics:        m,
+		logger:         logger,
+		audit:          auditService,
+		events:         publisher,
+		tracer:         otel.Tracer("sambhav/internal/user"),
+	}
 }
 
 // RegisterUser registers a new user in the system.
-func (u *userService) RegisterUser(ctx context.Context, name, email string) error {
+func (u *userService) RegisterUser(ctx context.Context, name, email string) (err error) {
+	ctx, span := u.tracer.Start(ctx, "userService.RegisterUser")
+	defer tracing.End(span, &err)
+
 	// Check if the user already exists based on email
-	existingUser, err := u.userRepository.GetUserByEmail(ctx, email)
-	if err != nil && errors.Is(err, sql.ErrNoRows) {
-		// Create a new user in the schema
-		_, err = u.userRepository.CreateUser(ctx, &database.User{
-			ID:    primitive.NewObjectID(),
+	if _, err := u.userRepository.GetUserByEmail(ctx, email); err == nil {
+		return database.ErrUserExists
+	} else if !errors.Is(err, database.ErrUserNotFound) {
+		return err
+	}
+
+	// Create a new user in the schema
+	err = u.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		_, err := u.userRepository.CreateUser(ctx, &database.User{
 			Email: email,
 			Name:  name,
 			Bio:   nil, // Assuming empty bio for new user
@@ -40,23 +71,40 @@ func (u *userService) RegisterUser(ctx context.Context, name, email string) erro
 		if err != nil {
 			return err
 		}
-	} else if existingUser != nil {
-		return errors.New("user already exists")
-	} else {
+		return u.events.Publish(ctx, events.UserRegistered{PID: email, Name: name, Source: "api"})
+	})
+	// users sign themselves up, so they are the actor of their creation
+	if err != nil {
+		u.audit.Record(ctx, database.AuditEntry{
+			Action:  database.AuditUserCreate,
+			Outcome: database.AuditFailure,
+			Actor:   email,
+			Target:  email,
+		})
 		return err
 	}
+	u.audit.Record(ctx, database.AuditEntry{
+		Action:  database.AuditUserCreate,
+		Outcome: database.AuditSuccess,
+		Actor:   email,
+		Target:  email,
+		Details: map[string]string{"source": "api"},
+	})
+	u.metrics.UserRegistered("api")
+	u.logger.InfoContext(ctx, "user registered", "email", email)
 
 	return nil
 }
 
 // GetUserByID retrieves a user by their ID.
-func (u *userService) GetAllUsers(ctx context.Context) ([]*database.User, error) {
+func (u *userService) GetAllUsers(ctx context.Context) (_ []*database.User, err error) {
+	ctx, span := u.tracer.Start(ctx, "userService.GetAllUsers")
+	defer tracing.End(span, &err)
 
 	// Get the user by ID from the schema
 	users, err := u.userRepository.ListAllUsers(ctx)
-	fmt.Println(users, err)
-
 	if err != nil {
+		u.logger.ErrorContext(ctx, "failed to list users", "error", err)
 		return nil, err
 	}
 
@@ -64,12 +112,91 @@ func (u *userService) GetAllUsers(ctx context.Context) ([]*database.User, error)
 }
 
 // GetUserByID retrieves a user by their ID.
-func (u *userService) GetUserByID(ctx context.Context, userID string) (*database.User, error) {
+func (u *userService) GetUserByID(ctx context.Context, userID string) (_ *database.User, err error) {
+	ctx, span := u.tracer.Start(ctx, "userService.GetUserByID")
+	defer tracing.End(span, &err)
+
 	// Get the user by ID from the schema
 	user, err := u.userRepository.GetUserById(ctx, userID)
 	if err != nil {
 		return nil, err
 	}
+	if user == nil {
+		return nil, database.ErrUserNotFound
+	}
 
 	return user, nil
 }
+
+// UpdateUser changes the name and/or bio of a user. Nil fields are left
+// unchanged.
+func (u *userService) UpdateUser(ctx context.Context, userID string, name, bio *string) (_ *database.User, err error) {
+	ctx, span := u.tracer.Start(ctx, "userService.UpdateUser")
+	defer tracing.End(span, &err)
+
+	user, err := u.GetUserByID(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []string
+	if name != nil && *name != user.Name {
+		user.Name = *name
+		fields = append(fields, "name")
+	}
+	if bio != nil && (user.Bio == nil || *bio != *user.Bio) {
+		user.Bio = bio
+		fields = append(fields, "bio")
+	}
+	if len(fields) == 0 {
+		return user, nil
+	}
+
+	entry := database.AuditEntry{
+		Action:  database.AuditUserUpdate,
+		Target:  user.Email,
+		Details: map[string]string{"fields": strings.Join(fields, ",")},
+	}
+	err = u.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := u.userRepository.UpdateUser(ctx, user); err != nil {
+			return err
+		}
+		return u.events.Publish(ctx, events.UserUpdated{PID: user.Email, Fields: fields})
+	})
+	if err != nil {
+		entry.Outcome = database.AuditFailure
+		u.audit.Record(ctx, entry)
+		return nil, err
+	}
+	entry.Outcome = database.AuditSuccess
+	u.audit.Record(ctx, entry)
+	return user, nil
+}
+
+// DeleteUser deletes a user.
+func (u *userService) DeleteUser(ctx context.Context, userID string) (err error) {
+	ctx, span := u.tracer.Start(ctx, "userService.DeleteUser")
+	defer tracing.End(span, &err)
+
+	user, err := u.GetUserByID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	entry := database.AuditEntry{Action: database.AuditUserDelete, Target: user.Email}
+	err = u.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		if err := u.userRepository.DeleteUser(ctx, user); err != nil {
+			return err
+		}
+		return u.events.Publish(ctx, events.UserDeleted{PID: user.Email})
+	})
+	if err != nil {
+		entry.Outcome = database.AuditFailure
+		u.audit.Record(ctx, entry)
+		return err
+	}
+	entry.Outcome = database.AuditSuccess
+	u.audit.Record(ctx, entry)
+	u.logger.InfoContext(ctx, "user deleted", "email", user.Email)
+	return nil
+}
@@ -0,0 +1,209 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"sambhav/internal/repository"
+	"sambhav/pkg/database"
+)
+
+const (
+	defaultDispatchInterval = time.Second
+	defaultDispatchBatch    = 20
+	// dispatchLease is how long a dispatcher owns a delivery it claimed.
+	// Deliveries are claimed one at a time, right before they are sent, so
+	// it must exceed the client timeout of a single request.
+	dispatchLease = time.Minute
+	// DisableAfter is the number of failed attempts in a row, across
+	// deliveries, after which a subscription is disabled.
+	DisableAfter = 15
+	userAgent    = "sambhav-webhooks/1"
+)
+
+// retrySchedule is the delay before each retry of a delivery. A delivery
+// fails for good once it ran out of retries.
+var retrySchedule = []time.Duration{
+	10 * time.Second,
+	30 * time.Second,
+	2 * time.Minute,
+	10 * time.Minute,
+	30 * time.Minute,
+	time.Hour,
+	3 * time.Hour,
+}
+
+// MaxAttempts is the number of times a delivery is attempted before it is
+// marked failed.
+var MaxAttempts = len(retrySchedule) + 1
+
+// Dispatcher sends queued deliveries. Several dispatchers may share a
+// repository; each delivery is claimed by one of them at a time.
+type Dispatcher struct {
+	webhookRepository repository.WebhookRepository
+	client            *http.Client
+	logger            *slog.Logger
+	interval          time.Duration
+}
+
+// NewDispatcher creates a dispatcher polling every interval and sending
+// requests with client. A zero interval polls every second and a nil client
+// uses one with a ten second timeout.
+func NewDispatcher(webhookRepo repository.WebhookRepository, client *http.Client, logger *slog.Logger, interval time.Duration) *Dispatcher {
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if interval <= 0 {
+		interval = defaultDispatchInterval
+	}
+	return &Dispatcher{webhookRepository: webhookRepo, client: client, logger: logger, interval: interval}
+}
+
+// Run sends due deliveries until ctx is done.
+func (d *Dispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		for {
+			n, err := d.Flush(ctx)
+			if err != nil {
+				d.logger.ErrorContext(ctx, "failed to dispatch webhooks", "error", err)
+			}
+			if err != nil || n < defaultDispatchBatch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush sends up to one batch of due deliveries, claiming each one just
+// before it is sent, so that a slow endpoint cannot hold the rest of the
+// batch past its lease. A delivery that fails to be recorded does not stop
+// the others; the errors are returned together. It returns the number of
+// deliveries claimed.
+func (d *Dispatcher) Flush(ctx context.Context) (int, error) {
+	var (
+		claimed int
+		errs    []error
+	)
+	for claimed < defaultDispatchBatch {
+		batch, err := d.webhookRepository.ClaimWebhookDeliveries(ctx, 1, dispatchLease)
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if len(batch) == 0 {
+			break
+		}
+
+		claimed++
+		if err := d.dispatch(ctx, batch[0]); err != nil {
+			errs = append(errs, fmt.Errorf("delivery %s: %w", batch[0].ID, err))
+		}
+	}
+	return claimed, errors.Join(errs...)
+}
+
+func (d *Dispatcher) dispatch(ctx context.Context, delivery *database.WebhookDelivery) error {
+	sub, err := d.webhookRepository.GetWebhookSubscription(ctx, delivery.SubscriptionID)
+	if errors.Is(err, database.ErrWebhookNotFound) {
+		sub = nil
+	} else if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	if sub == nil || !sub.Active {
+		// not an attempt at the endpoint, so the subscription is not
+		// charged with a failure; the delivery can be replayed once the
+		// subscription is enabled again
+		attempt := database.WebhookAttempt{At: now, Error: "subscription disabled"}
+		return d.webhookRepository.SaveWebhookAttempt(ctx, delivery.ID, attempt, database.WebhookFailed, now)
+	}
+
+	attempt := d.send(ctx, sub, delivery, now)
+	logger := d.logger.With(
+		"subscription_id", sub.ID,
+		"delivery_id", delivery.ID,
+		"event", delivery.EventName,
+		"attempt", delivery.Attempt+1,
+	)
+
+	if attempt.Error == "" {
+		if err := d.webhookRepository.SaveWebhookAttempt(ctx, delivery.ID, attempt, database.WebhookSucceeded, now); err != nil {
+			return err
+		}
+		if sub.ConsecutiveFailures > 0 {
+			return d.webhookRepository.RecordWebhookSuccess(ctx, sub.ID)
+		}
+		return nil
+	}
+
+	status, next := database.WebhookPending, now
+	if delivery.Attempt+1 >= MaxAttempts {
+		status = database.WebhookFailed
+		logger.WarnContext(ctx, "webhook delivery failed", "error", attempt.Error)
+	} else {
+		next = now.Add(retrySchedule[delivery.Attempt])
+		logger.InfoContext(ctx, "webhook delivery attempt failed", "retry_at", next, "error", attempt.Error)
+	}
+	if err := d.webhookRepository.SaveWebhookAttempt(ctx, delivery.ID, attempt, status, next); err != nil {
+		return err
+	}
+
+	disabled, err := d.webhookRepository.RecordWebhookFailure(ctx, sub.ID, DisableAfter)
+	if err != nil && !errors.Is(err, database.ErrWebhookNotFound) {
+		return err
+	}
+	if disabled {
+		logger.WarnContext(ctx, "webhook subscription disabled after repeated failures", "url", sub.URL)
+	}
+	return nil
+}
+
+// send makes one attempt at delivering to sub. Any response outside the
+// 2xx range is a failure.
+func (d *Dispatcher) send(ctx context.Context, sub *database.WebhookSubscription, delivery *database.WebhookDelivery, now time.Time) database.WebhookAttempt {
+	attempt := database.WebhookAttempt{At: now}
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(IDHeader, delivery.ID)
+	req.Header.Set(EventHeader, delivery.EventName)
+	req.Header.Set(SignatureHeader, Sign(sub.Secret, now, body))
+
+	resp, err := d.client.Do(req)
+	attempt.Duration = time.Since(now)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	defer resp.Body.Close()
+	// drain a little of the body so the connection can be reused
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = fmt.Sprintf("endpoint responded %s", resp.Status)
+	}
+	return attempt
+}
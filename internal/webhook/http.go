@@ -0,0 +1,177 @@
+package webhook
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultDeliveryLimit = 50
+	maxDeliveryLimit     = 200
+)
+
+type WebhookHandler interface {
+	CreateSubscription(c *gin.Context)
+	ListSubscriptions(c *gin.Context)
+	GetSubscription(c *gin.Context)
+	UpdateSubscription(c *gin.Context)
+	DeleteSubscription(c *gin.Context)
+	RotateSecret(c *gin.Context)
+	ListDeliveries(c *gin.Context)
+	ReplayDelivery(c *gin.Context)
+}
+
+type webhookHandler struct {
+	webhookService WebhookService
+}
+
+func NewWebhookHandler(webhookService WebhookService) WebhookHandler {
+	return &webhookHandler{webhookService: webhookService}
+}
+
+type subscriptionRequest struct {
+	URL         *string  `json:"url"`
+	Events      []string `json:"events"`
+	Description *string  `json:"description"`
+	Active      *bool    `json:"active"`
+}
+
+func (r subscriptionRequest) input() SubscriptionInput {
+	return SubscriptionInput{URL: r.URL, Events: r.Events, Description: r.Description, Active: r.Active}
+}
+
+// CreateSubscription registers an endpoint. The signing secret is only
+// returned in this response.
+func (h *webhookHandler) CreateSubscription(c *gin.Context) {
+	var req subscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	sub, secret, err := h.webhookService.CreateSubscription(c.Request.Context(), c.GetString(abpkg.ContextKeyPID), req.input())
+	if err != nil {
+		writeError(c, err, "Failed to create webhook subscription")
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{"subscription": sub, "secret": secret})
+}
+
+func (h *webhookHandler) ListSubscriptions(c *gin.Context) {
+	subs, err := h.webhookService.ListSubscriptions(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list webhook subscriptions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"subscriptions": subs})
+}
+
+func (h *webhookHandler) GetSubscription(c *gin.Context) {
+	sub, err := h.webhookService.GetSubscription(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to get webhook subscription")
+		return
+	}
+
+	c.JSON(http.StatusOK, sub)
+}
+
+// UpdateSubscription changes the fields present in the request. Setting
+// active to true enables a subscription that was disabled after repeated
+// failures.
+func (h *webhookHandler) UpdateSubscription(c *gin.Context) {
+	var req subscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		return
+	}
+
+	sub, err := h.webhookService.UpdateSubscription(c.Request.Context(), c.Param("id"), req.input())
+	if err != nil {
+		writeError(c, err, "Failed to update webhook subscription")
+		return
+	}
+
+	c.JSON(http.StatusOK, sub)
+}
+
+func (h *webhookHandler) DeleteSubscription(c *gin.Context) {
+	if err := h.webhookService.DeleteSubscription(c.Request.Context(), c.Param("id")); err != nil {
+		writeError(c, err, "Failed to delete webhook subscription")
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// RotateSecret replaces the signing secret of a subscription and returns
+// the new one. Requests are signed with the new secret right away.
+func (h *webhookHandler) RotateSecret(c *gin.Context) {
+	secret, err := h.webhookService.RotateSecret(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		writeError(c, err, "Failed to rotate webhook secret")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"secret": secret})
+}
+
+// ListDeliveries returns the most recent deliveries of a subscription with
+// their attempt log, newest first.
+func (h *webhookHandler) ListDeliveries(c *gin.Context) {
+	limit := int64(defaultDeliveryLimit)
+	if s := c.Query("limit"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid limit parameter"})
+			return
+		}
+		limit = min(n, maxDeliveryLimit)
+	}
+
+	deliveries, err := h.webhookService.ListDeliveries(c.Request.Context(), c.Param("id"), limit)
+	if err != nil {
+		writeError(c, err, "Failed to list webhook deliveries")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"deliveries": deliveries})
+}
+
+// ReplayDelivery queues a succeeded or failed delivery to be sent again.
+func (h *webhookHandler) ReplayDelivery(c *gin.Context) {
+	delivery, err := h.webhookService.Replay(c.Request.Context(), c.Param("id"), c.Param("deliveryID"))
+	if err != nil {
+		writeError(c, err, "Failed to replay webhook delivery")
+		return
+	}
+
+	c.JSON(http.StatusAccepted, delivery)
+}
+
+func writeError(c *gin.Context, err error, fallback string) {
+	switch {
+	case errors.Is(err, database.ErrWebhookNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook subscription not found"})
+	case errors.Is(err, database.ErrWebhookDeliveryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook delivery not found"})
+	case errors.Is(err, ErrInvalidURL):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "URL must be an absolute http or https URL"})
+	case errors.Is(err, ErrInvalidEvents):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Events must name known events or \"*\""})
+	case errors.Is(err, ErrSubscriptionPaused):
+		c.JSON(http.StatusConflict, gin.H{"error": "Webhook subscription is disabled"})
+	case errors.Is(err, ErrDeliveryPending):
+		c.JSON(http.StatusConflict, gin.H{"error": "Webhook delivery is still pending"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": fallback})
+	}
+}
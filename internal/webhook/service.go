@@ -0,0 +1,246 @@
+// Package webhook delivers domain events to HTTP endpoints registered by
+// administrators, signed with a per-subscription secret and retried with
+// backoff.
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/url"
+	"time"
+
+	"sambhav/internal/repository"
+	"sambhav/pkg/database"
+	"sambhav/pkg/events"
+	"sambhav/pkg/security"
+)
+
+var (
+	ErrInvalidURL         = errors.New("webhook: URL must be an absolute http or https URL")
+	ErrInvalidEvents      = errors.New("webhook: events must name known events or \"*\"")
+	ErrSubscriptionPaused = errors.New("webhook: subscription is disabled")
+	ErrDeliveryPending    = errors.New("webhook: delivery is still pending")
+)
+
+// SubscriptionInput holds the fields of a subscription set by its owner.
+// Nil fields are left unchanged on update.
+type SubscriptionInput struct {
+	URL         *string
+	Events      []string
+	Description *string
+	Active      *bool
+}
+
+type WebhookService interface {
+	// CreateSubscription registers an endpoint and returns it along with
+	// its signing secret, which is not shown again.
+	CreateSubscription(ctx context.Context, createdBy string, in SubscriptionInput) (*database.WebhookSubscription, string, error)
+	ListSubscriptions(ctx context.Context) ([]*database.WebhookSubscription, error)
+	GetSubscription(ctx context.Context, id string) (*database.WebhookSubscription, error)
+	// UpdateSubscription changes a subscription. Re-activating a disabled
+	// subscription resets its failure count.
+	UpdateSubscription(ctx context.Context, id string, in SubscriptionInput) (*database.WebhookSubscription, error)
+	DeleteSubscription(ctx context.Context, id string) error
+	RotateSecret(ctx context.Context, id string) (string, error)
+	ListDeliveries(ctx context.Context, subscriptionID string, limit int64) ([]*database.WebhookDelivery, error)
+	// Replay queues a finished delivery again with a fresh retry budget.
+	Replay(ctx context.Context, subscriptionID, deliveryID string) (*database.WebhookDelivery, error)
+	// Enqueue queues msg for every active subscription to it. It is meant
+	// to be subscribed asynchronously on the event bus.
+	Enqueue(ctx context.Context, msg events.Message) error
+}
+
+type webhookService struct {
+	webhookRepository repository.WebhookRepository
+	logger            *slog.Logger
+}
+
+func NewWebhookService(webhookRepo repository.WebhookRepository, logger *slog.Logger) WebhookService {
+	return &webhookService{webhookRepository: webhookRepo, logger: logger}
+}
+
+func (s *webhookService) CreateSubscription(ctx context.Context, createdBy string, in SubscriptionInput) (*database.WebhookSubscription, string, error) {
+	if in.URL == nil {
+		return nil, "", ErrInvalidURL
+	}
+	if in.Events == nil {
+		return nil, "", ErrInvalidEvents
+	}
+
+	now := time.Now().UTC()
+	sub := &database.WebhookSubscription{
+		ID:        security.RandomHex(12),
+		Secret:    newSecret(),
+		Active:    true,
+		CreatedBy: createdBy,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if err := apply(sub, in); err != nil {
+		return nil, "", err
+	}
+
+	if err := s.webhookRepository.CreateWebhookSubscription(ctx, sub); err != nil {
+		return nil, "", err
+	}
+	s.logger.InfoContext(ctx, "webhook subscription created", "subscription_id", sub.ID, "events", sub.Events)
+	return sub, sub.Secret, nil
+}
+
+func (s *webhookService) ListSubscriptions(ctx context.Context) ([]*database.WebhookSubscription, error) {
+	return s.webhookRepository.ListWebhookSubscriptions(ctx)
+}
+
+func (s *webhookService) GetSubscription(ctx context.Context, id string) (*database.WebhookSubscription, error) {
+	return s.webhookRepository.GetWebhookSubscription(ctx, id)
+}
+
+func (s *webhookService) UpdateSubscription(ctx context.Context, id string, in SubscriptionInput) (*database.WebhookSubscription, error) {
+	sub, err := s.webhookRepository.GetWebhookSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	wasActive := sub.Active
+	if err := apply(sub, in); err != nil {
+		return nil, err
+	}
+	if sub.Active && !wasActive {
+		sub.ConsecutiveFailures = 0
+		sub.DisabledAt = nil
+		sub.DisabledReason = ""
+	}
+	sub.UpdatedAt = time.Now().UTC()
+
+	if err := s.webhookRepository.UpdateWebhookSubscription(ctx, sub); err != nil {
+		return nil, err
+	}
+	return sub, nil
+}
+
+func (s *webhookService) DeleteSubscription(ctx context.Context, id string) error {
+	if err := s.webhookRepository.DeleteWebhookSubscription(ctx, id); err != nil {
+		return err
+	}
+	s.logger.InfoContext(ctx, "webhook subscription deleted", "subscription_id", id)
+	return nil
+}
+
+func (s *webhookService) RotateSecret(ctx context.Context, id string) (string, error) {
+	sub, err := s.webhookRepository.GetWebhookSubscription(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	sub.Secret = newSecret()
+	sub.UpdatedAt = time.Now().UTC()
+	if err := s.webhookRepository.UpdateWebhookSubscription(ctx, sub); err != nil {
+		return "", err
+	}
+	return sub.Secret, nil
+}
+
+func (s *webhookService) ListDeliveries(ctx context.Context, subscriptionID string, limit int64) ([]*database.WebhookDelivery, error) {
+	if _, err := s.webhookRepository.GetWebhookSubscription(ctx, subscriptionID); err != nil {
+		return nil, err
+	}
+	return s.webhookRepository.ListWebhookDeliveries(ctx, subscriptionID, limit)
+}
+
+func (s *webhookService) Replay(ctx context.Context, subscriptionID, deliveryID string) (*database.WebhookDelivery, error) {
+	sub, err := s.webhookRepository.GetWebhookSubscription(ctx, subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+	if !sub.Active {
+		return nil, ErrSubscriptionPaused
+	}
+
+	delivery, err := s.webhookRepository.GetWebhookDelivery(ctx, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	if delivery.SubscriptionID != sub.ID {
+		return nil, database.ErrWebhookDeliveryNotFound
+	}
+	if delivery.Status == database.WebhookPending {
+		return nil, ErrDeliveryPending
+	}
+
+	if err := s.webhookRepository.ResetWebhookDelivery(ctx, delivery.ID); err != nil {
+		return nil, err
+	}
+	s.logger.InfoContext(ctx, "webhook delivery replayed", "subscription_id", sub.ID, "delivery_id", delivery.ID)
+	return s.webhookRepository.GetWebhookDelivery(ctx, delivery.ID)
+}
+
+func (s *webhookService) Enqueue(ctx context.Context, msg events.Message) error {
+	subs, err := s.webhookRepository.ListActiveWebhookSubscriptions(ctx, msg.Name)
+	if err != nil {
+		return err
+	}
+	if len(subs) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for _, sub := range subs {
+		// the ID is derived from the event so that an event handed to
+		// Enqueue again, as the outbox relay may do, is queued only once
+		err := s.webhookRepository.AddWebhookDelivery(ctx, &database.WebhookDelivery{
+			ID:             msg.ID + "." + sub.ID,
+			SubscriptionID: sub.ID,
+			EventID:        msg.ID,
+			EventName:      msg.Name,
+			Payload:        string(payload),
+			Status:         database.WebhookPending,
+			Attempts:       []database.WebhookAttempt{},
+			NextAttemptAt:  now,
+			CreatedAt:      now,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply validates in and copies its fields onto sub.
+func apply(sub *database.WebhookSubscription, in SubscriptionInput) error {
+	if in.URL != nil {
+		u, err := url.Parse(*in.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return ErrInvalidURL
+		}
+		sub.URL = u.String()
+	}
+	if in.Events != nil {
+		if len(in.Events) == 0 {
+			return ErrInvalidEvents
+		}
+		for _, name := range in.Events {
+			if name != "*" && !events.Known(name) {
+				return ErrInvalidEvents
+			}
+		}
+		sub.Events = in.Events
+	}
+	if in.Description != nil {
+		sub.Description = *in.Description
+	}
+	if in.Active != nil {
+		sub.Active = *in.Active
+	}
+	return nil
+}
+
+func newSecret() string {
+	return "whsec_" + security.RandomHex(32)
+}
@@ -0,0 +1,78 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Headers sent with every webhook request.
+const (
+	SignatureHeader = "X-Webhook-Signature"
+	IDHeader        = "X-Webhook-Id"
+	EventHeader     = "X-Webhook-Event"
+)
+
+var (
+	ErrInvalidSignature = errors.New("webhook: invalid signature")
+	ErrSignatureExpired = errors.New("webhook: signature timestamp outside tolerance")
+)
+
+// Sign returns the signature header value for body sent at t. It has the
+// form "t=<unix seconds>,v1=<hex HMAC-SHA256 of "<unix seconds>.<body>">",
+// so receivers can reject replayed requests by their timestamp.
+func Sign(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return "t=" + ts + ",v1=" + hex.EncodeToString(mac(secret, ts, body))
+}
+
+// Verify checks a signature header produced by Sign. Signatures older or
+// newer than tolerance are rejected; a zero tolerance skips that check.
+func Verify(secret, header string, body []byte, tolerance time.Duration) error {
+	var ts string
+	var sigs [][]byte
+	for _, part := range strings.Split(header, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "t":
+			ts = value
+		case "v1":
+			if sig, err := hex.DecodeString(value); err == nil {
+				sigs = append(sigs, sig)
+			}
+		}
+	}
+
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil || len(sigs) == 0 {
+		return ErrInvalidSignature
+	}
+	if tolerance > 0 {
+		if age := time.Since(time.Unix(unix, 0)); age > tolerance || age < -tolerance {
+			return ErrSignatureExpired
+		}
+	}
+
+	expected := mac(secret, ts, body)
+	for _, sig := range sigs {
+		if hmac.Equal(sig, expected) {
+			return nil
+		}
+	}
+	return ErrInvalidSignature
+}
+
+func mac(secret, ts string, body []byte) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(ts))
+	h.Write([]byte("."))
+	h.Write(body)
+	return h.Sum(nil)
+}
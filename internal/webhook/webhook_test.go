@@ -0,0 +1,521 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"sambhav/pkg/database"
+	"sambhav/pkg/events"
+	"sambhav/pkg/security"
+)
+
+// memRepository is an in-memory WebhookRepository, for tests only.
+type memRepository struct {
+	mu            sync.Mutex
+	subscriptions map[string]database.WebhookSubscription
+	deliveries    map[string]database.WebhookDelivery
+}
+
+func newMemRepository() *memRepository {
+	return &memRepository{
+		subscriptions: map[string]database.WebhookSubscription{},
+		deliveries:    map[string]database.WebhookDelivery{},
+	}
+}
+
+func (r *memRepository) CreateWebhookSubscription(_ context.Context, sub *database.WebhookSubscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.subscriptions[sub.ID] = *sub
+	return nil
+}
+
+func (r *memRepository) GetWebhookSubscription(_ context.Context, id string) (*database.WebhookSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.subscriptions[id]
+	if !ok {
+		return nil, database.ErrWebhookNotFound
+	}
+	return &sub, nil
+}
+
+func (r *memRepository) ListWebhookSubscriptions(context.Context) ([]*database.WebhookSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	subs := []*database.WebhookSubscription{}
+	for _, sub := range r.subscriptions {
+		subs = append(subs, &sub)
+	}
+	return subs, nil
+}
+
+func (r *memRepository) ListActiveWebhookSubscriptions(_ context.Context, eventName string) ([]*database.WebhookSubscription, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	subs := []*database.WebhookSubscription{}
+	for _, sub := range r.subscriptions {
+		if sub.Active && sub.Subscribes(eventName) {
+			subs = append(subs, &sub)
+		}
+	}
+	return subs, nil
+}
+
+func (r *memRepository) UpdateWebhookSubscription(_ context.Context, sub *database.WebhookSubscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subscriptions[sub.ID]; !ok {
+		return database.ErrWebhookNotFound
+	}
+	r.subscriptions[sub.ID] = *sub
+	return nil
+}
+
+func (r *memRepository) DeleteWebhookSubscription(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.subscriptions[id]; !ok {
+		return database.ErrWebhookNotFound
+	}
+	delete(r.subscriptions, id)
+	return nil
+}
+
+func (r *memRepository) RecordWebhookSuccess(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub := r.subscriptions[id]
+	sub.ConsecutiveFailures = 0
+	r.subscriptions[id] = sub
+	return nil
+}
+
+func (r *memRepository) RecordWebhookFailure(_ context.Context, id string, disableAfter int) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sub, ok := r.subscriptions[id]
+	if !ok {
+		return false, database.ErrWebhookNotFound
+	}
+	sub.ConsecutiveFailures++
+	disabled := sub.Active && disableAfter > 0 && sub.ConsecutiveFailures >= disableAfter
+	if disabled {
+		now := time.Now().UTC()
+		sub.Active = false
+		sub.DisabledAt = &now
+		sub.DisabledReason = "too many consecutive failures"
+	}
+	r.subscriptions[id] = sub
+	return disabled, nil
+}
+
+func (r *memRepository) AddWebhookDelivery(_ context.Context, delivery *database.WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.deliveries[delivery.ID]; !ok {
+		r.deliveries[delivery.ID] = *delivery
+	}
+	return nil
+}
+
+func (r *memRepository) GetWebhookDelivery(_ context.Context, id string) (*database.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delivery, ok := r.deliveries[id]
+	if !ok {
+		return nil, database.ErrWebhookDeliveryNotFound
+	}
+	return &delivery, nil
+}
+
+func (r *memRepository) ListWebhookDeliveries(_ context.Context, subscriptionID string, limit int64) ([]*database.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	deliveries := []*database.WebhookDelivery{}
+	for _, delivery := range r.deliveries {
+		if delivery.SubscriptionID == subscriptionID && int64(len(deliveries)) < limit {
+			deliveries = append(deliveries, &delivery)
+		}
+	}
+	return deliveries, nil
+}
+
+func (r *memRepository) ClaimWebhookDeliveries(_ context.Context, limit int, lease time.Duration) ([]*database.WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now().UTC()
+	var claimed []*database.WebhookDelivery
+	for id, delivery := range r.deliveries {
+		if len(claimed) == limit {
+			break
+		}
+		if delivery.Status != database.WebhookPending || delivery.NextAttemptAt.After(now) || delivery.LockedUntil.After(now) {
+			continue
+		}
+		delivery.LockedUntil = now.Add(lease)
+		r.deliveries[id] = delivery
+		claimed = append(claimed, &delivery)
+	}
+	return claimed, nil
+}
+
+func (r *memRepository) SaveWebhookAttempt(_ context.Context, id string, attempt database.WebhookAttempt, status string, nextAttempt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delivery := r.deliveries[id]
+	delivery.Status = status
+	delivery.NextAttemptAt = nextAttempt.UTC()
+	delivery.LockedUntil = time.Time{}
+	delivery.Attempt++
+	delivery.Attempts = append(delivery.Attempts, attempt)
+	if status == database.WebhookSucceeded {
+		at := attempt.At.UTC()
+		delivery.DeliveredAt = &at
+	}
+	r.deliveries[id] = delivery
+	return nil
+}
+
+func (r *memRepository) ResetWebhookDelivery(_ context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delivery, ok := r.deliveries[id]
+	if !ok {
+		return database.ErrWebhookDeliveryNotFound
+	}
+	delivery.Status = database.WebhookPending
+	delivery.Attempt = 0
+	delivery.NextAttemptAt = time.Now().UTC()
+	delivery.LockedUntil = time.Time{}
+	delivery.DeliveredAt = nil
+	r.deliveries[id] = delivery
+	return nil
+}
+
+// due makes the delivery due now, as if its retry delay had passed.
+func (r *memRepository) due(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delivery := r.deliveries[id]
+	delivery.NextAttemptAt = time.Now().UTC()
+	r.deliveries[id] = delivery
+}
+
+// endpoint is a local stand-in for a webhook receiver, answering with the
+// status codes it is given in turn and the last one from then on.
+type endpoint struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []received
+}
+
+type received struct {
+	header http.Header
+	body   []byte
+}
+
+func newEndpoint(t *testing.T, statuses ...int) *endpoint {
+	t.Helper()
+	e := &endpoint{statuses: statuses}
+	e.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		e.mu.Lock()
+		e.requests = append(e.requests, received{header: r.Header.Clone(), body: body})
+		status := e.statuses[0]
+		if len(e.statuses) > 1 {
+			e.statuses = e.statuses[1:]
+		}
+		e.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(e.Close)
+	return e
+}
+
+func (e *endpoint) received() []received {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return slices.Clone(e.requests)
+}
+
+type fixture struct {
+	repo       *memRepository
+	service    WebhookService
+	dispatcher *Dispatcher
+}
+
+func newFixture() *fixture {
+	repo := newMemRepository()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	return &fixture{
+		repo:       repo,
+		service:    NewWebhookService(repo, logger),
+		dispatcher: NewDispatcher(repo, nil, logger, 0),
+	}
+}
+
+func (f *fixture) subscribe(t *testing.T, url string) (*database.WebhookSubscription, string) {
+	t.Helper()
+	sub, secret, err := f.service.CreateSubscription(context.Background(), "admin@example.com", SubscriptionInput{
+		URL:    &url,
+		Events: []string{"user.registered"},
+	})
+	if err != nil {
+		t.Fatalf("CreateSubscription: %v", err)
+	}
+	return sub, secret
+}
+
+// publish enqueues a user.registered event and returns the ID of its
+// delivery to sub.
+func (f *fixture) publish(t *testing.T, sub *database.WebhookSubscription, pid string) string {
+	t.Helper()
+	msg := events.Message{
+		ID:         security.RandomHex(8),
+		Name:       "user.registered",
+		OccurredAt: time.Now().UTC(),
+		Event:      events.UserRegistered{PID: pid, Source: "api"},
+	}
+	if err := f.service.Enqueue(context.Background(), msg); err != nil {
+		t.Fatalf("Enqueue: %v", err)
+	}
+	return msg.ID + "." + sub.ID
+}
+
+func (f *fixture) flush(t *testing.T) int {
+	t.Helper()
+	n, err := f.dispatcher.Flush(context.Background())
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	return n
+}
+
+func (f *fixture) delivery(t *testing.T, id string) *database.WebhookDelivery {
+	t.Helper()
+	delivery, err := f.repo.GetWebhookDelivery(context.Background(), id)
+	if err != nil {
+		t.Fatalf("GetWebhookDelivery: %v", err)
+	}
+	return delivery
+}
+
+func TestDeliverySignature(t *testing.T) {
+	f := newFixture()
+	e := newEndpoint(t, http.StatusNoContent)
+	sub, secret := f.subscribe(t, e.URL)
+	id := f.publish(t, sub, "alice@example.com")
+
+	if n := f.flush(t); n != 1 {
+		t.Fatalf("flushed %d deliveries, want 1", n)
+	}
+
+	reqs := e.received()
+	if len(reqs) != 1 {
+		t.Fatalf("endpoint received %d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if got := req.header.Get(IDHeader); got != id {
+		t.Errorf("%s = %q, want %q", IDHeader, got, id)
+	}
+	if got := req.header.Get(EventHeader); got != "user.registered" {
+		t.Errorf("%s = %q, want user.registered", EventHeader, got)
+	}
+	if got := req.header.Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+
+	signature := req.header.Get(SignatureHeader)
+	if err := Verify(secret, signature, req.body, 5*time.Minute); err != nil {
+		t.Errorf("Verify: %v", err)
+	}
+	tampered := append(slices.Clone(req.body), ' ')
+	if err := Verify(secret, signature, tampered, 5*time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify of a tampered body: got %v, want %v", err, ErrInvalidSignature)
+	}
+	if err := Verify("whsec_other", signature, req.body, 5*time.Minute); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Verify with another secret: got %v, want %v", err, ErrInvalidSignature)
+	}
+	old := Sign(secret, time.Now().Add(-time.Hour), req.body)
+	if err := Verify(secret, old, req.body, 5*time.Minute); !errors.Is(err, ErrSignatureExpired) {
+		t.Errorf("Verify of an old signature: got %v, want %v", err, ErrSignatureExpired)
+	}
+
+	if d := f.delivery(t, id); d.Status != database.WebhookSucceeded || d.DeliveredAt == nil {
+		t.Errorf("delivery is %s, want %s", d.Status, database.WebhookSucceeded)
+	}
+}
+
+func TestDeliveryRetriesWithBackoff(t *testing.T) {
+	f := newFixture()
+	e := newEndpoint(t, http.StatusInternalServerError, http.StatusBadGateway, http.StatusOK)
+	sub, _ := f.subscribe(t, e.URL)
+	id := f.publish(t, sub, "alice@example.com")
+
+	for attempt, delay := range retrySchedule[:2] {
+		start := time.Now()
+		f.flush(t)
+		d := f.delivery(t, id)
+		if d.Status != database.WebhookPending || d.Attempt != attempt+1 {
+			t.Fatalf("after attempt %d: delivery is %s after %d attempts", attempt+1, d.Status, d.Attempt)
+		}
+		if wait := d.NextAttemptAt.Sub(start); wait < delay || wait > delay+time.Second {
+			t.Errorf("after attempt %d: retried in %s, want %s", attempt+1, wait, delay)
+		}
+		if n := f.flush(t); n != 0 {
+			t.Fatalf("after attempt %d: delivery retried before its backoff", attempt+1)
+		}
+		f.repo.due(id)
+	}
+
+	f.flush(t)
+	d := f.delivery(t, id)
+	if d.Status != database.WebhookSucceeded || d.Attempt != 3 || len(d.Attempts) != 3 {
+		t.Fatalf("delivery is %s after %d attempts, want %s after 3", d.Status, d.Attempt, database.WebhookSucceeded)
+	}
+	if d.Attempts[0].StatusCode != http.StatusInternalServerError || d.Attempts[0].Error == "" {
+		t.Errorf("first attempt logged as %+v", d.Attempts[0])
+	}
+	if sub, _ := f.service.GetSubscription(context.Background(), sub.ID); sub.ConsecutiveFailures != 0 {
+		t.Errorf("subscription has %d consecutive failures after a success", sub.ConsecutiveFailures)
+	}
+}
+
+func TestDeliveryFailsAfterMaxAttempts(t *testing.T) {
+	f := newFixture()
+	e := newEndpoint(t, http.StatusInternalServerError)
+	sub, _ := f.subscribe(t, e.URL)
+	id := f.publish(t, sub, "alice@example.com")
+
+	for range MaxAttempts {
+		f.repo.due(id)
+		f.flush(t)
+	}
+	if d := f.delivery(t, id); d.Status != database.WebhookFailed || d.Attempt != MaxAttempts {
+		t.Fatalf("delivery is %s after %d attempts, want %s after %d", d.Status, d.Attempt, database.WebhookFailed, MaxAttempts)
+	}
+	f.repo.due(id)
+	if n := f.flush(t); n != 0 {
+		t.Errorf("failed delivery was attempted again")
+	}
+}
+
+func TestFailingEndpointIsDisabled(t *testing.T) {
+	f := newFixture()
+	e := newEndpoint(t, http.StatusServiceUnavailable)
+	sub, _ := f.subscribe(t, e.URL)
+
+	var ids []string
+	for i := range DisableAfter {
+		ids = append(ids, f.publish(t, sub, security.RandomHex(4)+"@example.com"))
+		f.flush(t)
+		got, _ := f.service.GetSubscription(context.Background(), sub.ID)
+		if wantActive := i+1 < DisableAfter; got.Active != wantActive {
+			t.Fatalf("after %d failures: subscription active is %t", i+1, got.Active)
+		}
+	}
+
+	got, _ := f.service.GetSubscription(context.Background(), sub.ID)
+	if got.DisabledAt == nil || got.DisabledReason == "" {
+		t.Errorf("disabled subscription has no disabled time or reason")
+	}
+
+	// pending deliveries are not sent to a disabled endpoint, nor are new
+	// events queued for it
+	requests := len(e.received())
+	f.repo.due(ids[0])
+	f.flush(t)
+	if len(e.received()) != requests {
+		t.Errorf("a disabled endpoint was called")
+	}
+	if d := f.delivery(t, ids[0]); d.Status != database.WebhookFailed {
+		t.Errorf("delivery to a disabled endpoint is %s, want %s", d.Status, database.WebhookFailed)
+	}
+	f.publish(t, sub, "late@example.com")
+	if n := f.flush(t); n != 0 {
+		t.Errorf("an event was queued for a disabled endpoint")
+	}
+
+	// enabling it again resets its failure count
+	active := true
+	got, err := f.service.UpdateSubscription(context.Background(), sub.ID, SubscriptionInput{Active: &active})
+	if err != nil {
+		t.Fatalf("UpdateSubscription: %v", err)
+	}
+	if got.ConsecutiveFailures != 0 || got.DisabledAt != nil {
+		t.Errorf("enabled subscription kept %d failures", got.ConsecutiveFailures)
+	}
+}
+
+func TestReplay(t *testing.T) {
+	f := newFixture()
+	e := newEndpoint(t, http.StatusInternalServerError)
+	sub, secret := f.subscribe(t, e.URL)
+	id := f.publish(t, sub, "alice@example.com")
+
+	ctx := context.Background()
+	f.flush(t)
+	if _, err := f.service.Replay(ctx, sub.ID, id); !errors.Is(err, ErrDeliveryPending) {
+		t.Fatalf("Replay of a pending delivery: got %v, want %v", err, ErrDeliveryPending)
+	}
+	for range MaxAttempts - 1 {
+		f.repo.due(id)
+		f.flush(t)
+	}
+	if d := f.delivery(t, id); d.Status != database.WebhookFailed {
+		t.Fatalf("delivery is %s, want %s", d.Status, database.WebhookFailed)
+	}
+
+	if _, err := f.service.Replay(ctx, sub.ID, "unknown"); !errors.Is(err, database.ErrWebhookDeliveryNotFound) {
+		t.Errorf("Replay of an unknown delivery: got %v, want %v", err, database.ErrWebhookDeliveryNotFound)
+	}
+	other, _ := f.subscribe(t, e.URL)
+	if _, err := f.service.Replay(ctx, other.ID, id); !errors.Is(err, database.ErrWebhookDeliveryNotFound) {
+		t.Errorf("Replay through another subscription: got %v, want %v", err, database.ErrWebhookDeliveryNotFound)
+	}
+
+	// the endpoint is fixed and the delivery replayed with a fresh budget
+	e.mu.Lock()
+	e.statuses = []int{http.StatusOK}
+	e.mu.Unlock()
+	replayed, err := f.service.Replay(ctx, sub.ID, id)
+	if err != nil {
+		t.Fatalf("Replay: %v", err)
+	}
+	if replayed.Status != database.WebhookPending || replayed.Attempt != 0 {
+		t.Errorf("replayed delivery is %s after %d attempts", replayed.Status, replayed.Attempt)
+	}
+	f.flush(t)
+
+	d := f.delivery(t, id)
+	if d.Status != database.WebhookSucceeded || len(d.Attempts) != MaxAttempts+1 {
+		t.Errorf("replayed delivery is %s with %d attempts logged", d.Status, len(d.Attempts))
+	}
+	reqs := e.received()
+	last := reqs[len(reqs)-1]
+	if string(last.body) != string(reqs[0].body) || last.header.Get(IDHeader) != id {
+		t.Errorf("replay sent another payload than the original delivery")
+	}
+	if err := Verify(secret, last.header.Get(SignatureHeader), last.body, 5*time.Minute); err != nil {
+		t.Errorf("replay is not signed freshly: %v", err)
+	}
+
+	disabled := false
+	if _, err := f.service.UpdateSubscription(ctx, sub.ID, SubscriptionInput{Active: &disabled}); err != nil {
+		t.Fatalf("UpdateSubscription: %v", err)
+	}
+	if _, err := f.service.Replay(ctx, sub.ID, id); !errors.Is(err, ErrSubscriptionPaused) {
+		t.Errorf("Replay on a disabled subscription: got %v, want %v", err, ErrSubscriptionPaused)
+	}
+}
@@ -2,23 +2,43 @@ package authboss
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"log/slog"
 
 	"sambhav/pkg/database"
+	"sambhav/pkg/events"
 
 	"github.com/aarondl/authboss/v3"
+	aboauth "github.com/aarondl/authboss/v3/oauth2"
 	"github.com/aarondl/authboss/v3/otp/twofactor/totp2fa"
-	"github.com/friendsofgo/errors"
 )
 
-// MemStorer stores users in memory
-type MemStorer struct {
-	Users  map[string]database.User
-	Tokens map[string][]string
+// UserRepository persists users and their remember me tokens.
+type UserRepository interface {
+	GetUserByEmail(ctx context.Context, email string) (*database.User, error)
+	GetUserByConfirmSelector(ctx context.Context, selector string) (*database.User, error)
+	GetUserByRecoverSelector(ctx context.Context, selector string) (*database.User, error)
+	GetUserByOAuth2(ctx context.Context, provider, uid string) (*database.User, error)
+	CreateUser(ctx context.Context, user *database.User) (*database.User, error)
+	ReplaceUser(ctx context.Context, user *database.User) (*database.User, error)
+
+	AddRememberToken(ctx context.Context, pid, token string) error
+	DeleteRememberTokens(ctx context.Context, pid string) error
+	UseRememberToken(ctx context.Context, pid, token string) (bool, error)
+}
+
+// UserStorer stores the users of authboss in a UserRepository.
+type UserStorer struct {
+	users  UserRepository
+	tx     database.Transactor
+	logger *slog.Logger
+	events events.Publisher
 }
 
 var (
 	assertUser   = &database.User{}
-	assertStorer = &MemStorer{}
+	assertStorer = &UserStorer{}
 
 	_ authboss.User            = assertUser
 	_ authboss.AuthableUser    = assertUser
@@ -29,172 +49,173 @@ var (
 
 	_ totp2fa.User = assertUser
 
-	_ authboss.CreatingServerStorer    = assertStorer
-	_ authboss.ConfirmingServerStorer  = assertStorer
-	_ authboss.RecoveringServerStorer  = assertStorer
-	_ authboss.RememberingServerStorer = assertStorer
+	_ Storer = assertStorer
 )
 
-// NewMemStorer constructor
-func NewMemStorer() *MemStorer {
-	return &MemStorer{
-		Users: map[string]database.User{
-			"rick@councilofricks.com": {
-				ID:                 1,
-				Name:               "Rick",
-				Password:           "$2a$10$XtW/BrS5HeYIuOCXYe8DFuInetDMdaarMUJEOg/VA/JAIDgw3l4aG", // pass = 1234
-				Email:              "rick@councilofricks.com",
-				Confirmed:          true,
-				SMSSeedPhoneNumber: "(777)-123-4567",
-			},
-		},
-		Tokens: make(map[string][]string),
-	}
+// NewUserStorer constructor. When publisher is not nil, a user.confirmed
+// event is published when a user is saved as confirmed for the first time,
+// in a transaction of tx together with the user.
+func NewUserStorer(users UserRepository, tx database.Transactor, logger *slog.Logger, publisher events.Publisher) *UserStorer {
+	return &UserStorer{users: users, tx: tx, logger: logger, events: publisher}
 }
 
 // Save the user
-func (m MemStorer) Save(_ context.Context, user authboss.User) error {
+func (s *UserStorer) Save(ctx context.Context, user authboss.User) error {
 	u := user.(*database.User)
-	m.Users[u.Email] = *u
+	err := s.tx.WithTransaction(ctx, func(ctx context.Context) error {
+		prev, err := s.users.ReplaceUser(ctx, u)
+		if err != nil {
+			return err
+		}
+		if s.events != nil && !prev.Confirmed && u.Confirmed {
+			return s.events.Publish(ctx, events.UserConfirmed{PID: u.Email})
+		}
+		return nil
+	})
+	if err != nil {
+		return storeError(err)
+	}
 
-	debugln("Saved user:", u.Name)
+	s.logger.DebugContext(ctx, "saved user", "name", u.Name)
 	return nil
 }
 
 // Load the user
-func (m MemStorer) Load(_ context.Context, key string) (user authboss.User, err error) {
+func (s *UserStorer) Load(ctx context.Context, key string) (authboss.User, error) {
 	// Check to see if our key is actually an oauth2 pid
-	provider, uid, err := authboss.ParseOAuth2PID(key)
-	if err == nil {
-		for _, u := range m.Users {
-			if u.OAuth2Provider == provider && u.OAuth2UID == uid {
-				debugln("Loaded OAuth2 user:", u.Email)
-				return &u, nil
-			}
-		}
-
-		return nil, authboss.Errdatabase.UserNotFound
+	var (
+		u   *database.User
+		err error
+	)
+	if provider, uid, perr := authboss.ParseOAuth2PID(key); perr == nil {
+		u, err = s.users.GetUserByOAuth2(ctx, provider, uid)
+	} else {
+		u, err = s.users.GetUserByEmail(ctx, key)
 	}
-
-	u, ok := m.database.Users[key]
-	if !ok {
-		return nil, authboss.Errdatabase.UserNotFound
+	if err != nil {
+		return nil, storeError(err)
 	}
 
-	debugln("Loaded user:", u.Name)
-	return &u, nil
+	s.logger.DebugContext(ctx, "loaded user", "name", u.Name)
+	return u, nil
 }
 
 // New user creation
-func (m MemStorer) New(_ context.Context) database.User {
+func (s *UserStorer) New(_ context.Context) authboss.User {
 	return &database.User{}
 }
 
 // Create the user
-func (m MemStorer) Create(_ context.Context, user database.User) error {
+func (s *UserStorer) Create(ctx context.Context, user authboss.User) error {
 	u := user.(*database.User)
-
-	if _, ok := m.database.Users[u.Email]; ok {
-		return authboss.Errdatabase.UserFound
+	if _, err := s.users.CreateUser(ctx, u); err != nil {
+		return storeError(err)
 	}
 
-	debugln("Created new user:", u.Name)
-	m.database.Users[u.Email] = *u
+	s.logger.DebugContext(ctx, "created new user", "name", u.Name)
 	return nil
 }
 
 // LoadByConfirmSelector looks a user up by confirmation token
-func (m MemStorer) LoadByConfirmSelector(_ context.Context, selector string) (user authboss.ConfirmableUser, err error) {
-	for _, v := range m.database.Users {
-		if v.ConfirmSelector == selector {
-			debugln("Loaded user by confirm selector:", selector, v.Name)
-			return &v, nil
-		}
+func (s *UserStorer) LoadByConfirmSelector(ctx context.Context, selector string) (authboss.ConfirmableUser, error) {
+	u, err := s.users.GetUserByConfirmSelector(ctx, selector)
+	if err != nil {
+		return nil, storeError(err)
 	}
 
-	return nil, authboss.Errdatabase.UserNotFound
+	s.logger.DebugContext(ctx, "loaded user by confirm selector", "name", u.Name)
+	return u, nil
 }
 
-// LoadByRecoverSelector looks a user up by confirmation selector
-func (m MemStorer) LoadByRecoverSelector(_ context.Context, selector string) (user authboss.RecoverableUser, err error) {
-	for _, v := range m.database.Users {
-		if v.RecoverSelector == selector {
-			debugln("Loaded user by recover selector:", selector, v.Name)
-			return &v, nil
-		}
+// LoadByRecoverSelector looks a user up by recover selector
+func (s *UserStorer) LoadByRecoverSelector(ctx context.Context, selector string) (authboss.RecoverableUser, error) {
+	u, err := s.users.GetUserByRecoverSelector(ctx, selector)
+	if err != nil {
+		return nil, storeError(err)
 	}
 
-	return nil, authboss.Errdatabase.UserNotFound
+	s.logger.DebugContext(ctx, "loaded user by recover selector", "name", u.Name)
+	return u, nil
 }
 
 // AddRememberToken to a user
-func (m MemStorer) AddRememberToken(_ context.Context, pid, token string) error {
-	m.Tokens[pid] = append(m.Tokens[pid], token)
-	debugf("Adding rm token to %s: %s\n", pid, token)
-	spew.Dump(m.Tokens)
+func (s *UserStorer) AddRememberToken(ctx context.Context, pid, token string) error {
+	if err := s.users.AddRememberToken(ctx, pid, token); err != nil {
+		return err
+	}
+	s.logger.DebugContext(ctx, "added remember token", "pid", pid)
 	return nil
 }
 
 // DelRememberTokens removes all tokens for the given pid
-func (m MemStorer) DelRememberTokens(_ context.Context, pid string) error {
-	delete(m.Tokens, pid)
-	debugln("Deleting rm tokens from:", pid)
-	spew.Dump(m.Tokens)
+func (s *UserStorer) DelRememberTokens(ctx context.Context, pid string) error {
+	if err := s.users.DeleteRememberTokens(ctx, pid); err != nil {
+		return err
+	}
+	s.logger.DebugContext(ctx, "deleted remember tokens", "pid", pid)
 	return nil
 }
 
 // UseRememberToken finds the pid-token pair and deletes it.
 // If the token could not be found return ErrTokenNotFound
-func (m MemStorer) UseRememberToken(_ context.Context, pid, token string) error {
-	tokens, ok := m.Tokens[pid]
-	if !ok {
-		debugln("Failed to find rm tokens for:", pid)
-		return authboss.ErrTokenNotFound
+func (s *UserStorer) UseRememberToken(ctx context.Context, pid, token string) error {
+	used, err := s.users.UseRememberToken(ctx, pid, token)
+	if err != nil {
+		return err
 	}
-
-	for i, tok := range tokens {
-		if tok == token {
-			tokens[len(tokens)-1] = tokens[i]
-			m.Tokens[pid] = tokens[:len(tokens)-1]
-			debugf("Used remember for %s: %s\n", pid, token)
-			return nil
-		}
+	if !used {
+		return authboss.ErrTokenNotFound
 	}
-
-	return authboss.ErrTokenNotFound
+	s.logger.DebugContext(ctx, "used remember token", "pid", pid)
+	return nil
 }
 
 // NewFromOAuth2 creates an oauth2 user (but not in the database, just a blank one to be saved later)
-func (m MemStorer) NewFromOAuth2(_ context.Context, provider string, details map[string]string) (authboss.OAuth2User, error) {
+func (s *UserStorer) NewFromOAuth2(ctx context.Context, provider string, details map[string]string) (authboss.OAuth2User, error) {
 	switch provider {
 	case "google":
 		email := details[aboauth.OAuth2Email]
 
-		var user *database.User
-		if u, ok := m.database.Users[email]; ok {
-			user = &u
-		} else {
+		user, err := s.users.GetUserByEmail(ctx, email)
+		if errors.Is(err, database.ErrUserNotFound) {
 			user = &database.User{}
+		} else if err != nil {
+			return nil, err
 		}
 
 		// Google OAuth2 doesn't allow us to fetch real name without more complicated API calls
-		// in order to do this properly in your own app, look at replacing the authboss oauth2.Googledatabase.UserDetails
+		// in order to do this properly in your own app, look at replacing the authboss oauth2.GoogleUserDetails
 		// method with something more thorough.
 		user.Name = "Unknown"
-		user.Email = details[aboauth.OAuth2Email]
+		user.Email = email
 		user.OAuth2UID = details[aboauth.OAuth2UID]
 		user.Confirmed = true
 
 		return user, nil
 	}
 
-	return nil, errors.Errorf("unknown provider %s", provider)
+	return nil, fmt.Errorf("unknown provider %s", provider)
 }
 
-// SaveOAuth2 user
-func (m MemStorer) SaveOAuth2(_ context.Context, user authboss.OAuth2User) error {
+// SaveOAuth2 user, creating it when it is new
+func (s *UserStorer) SaveOAuth2(ctx context.Context, user authboss.OAuth2User) error {
 	u := user.(*database.User)
-	m.database.Users[u.Email] = *u
+	if u.ID.IsZero() {
+		_, err := s.users.CreateUser(ctx, u)
+		return storeError(err)
+	}
+	_, err := s.users.ReplaceUser(ctx, u)
+	return storeError(err)
+}
 
-	return nil
+// storeError maps the errors of the user repository to those authboss
+// expects from a storer.
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, database.ErrUserNotFound):
+		return authboss.ErrUserNotFound
+	case errors.Is(err, database.ErrUserExists):
+		return authboss.ErrUserFound
+	}
+	return err
 }
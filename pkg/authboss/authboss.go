@@ -1,13 +1,19 @@
 package authboss
 
 import (
-	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/smtp"
 	"regexp"
-	"sambhav/pkg/env"
-	"time"
+
+	"sambhav/pkg/logger"
 
 	"github.com/aarondl/authboss/v3"
 	_ "github.com/aarondl/authboss/v3/auth"
+	_ "github.com/aarondl/authboss/v3/confirm"
 	"github.com/aarondl/authboss/v3/defaults"
 	_ "github.com/aarondl/authboss/v3/logout"
 	aboauth "github.com/aarondl/authboss/v3/oauth2"
@@ -15,58 +21,197 @@ import (
 	"github.com/aarondl/authboss/v3/otp/twofactor/totp2fa"
 	_ "github.com/aarondl/authboss/v3/recover"
 	_ "github.com/aarondl/authboss/v3/register"
-	"github.com/gorilla/schema"
 	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 
-	abclientstate "github.com/aarondl/authboss-clientstate"
-
-	"net/http"
-
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 )
 
-var (
-	ab        = authboss.New()
-	abstore   = NewMemStorer()
-	schemaDec = schema.NewDecoder()
-
-	sessionStore abclientstate.SessionStorer
-	cookieStore  abclientstate.CookieStorer
-)
-
 const (
 	sessionCookieName = "ab_blog"
 )
 
-func setupAuthboss() {
-	ab.Config.Paths.RootURL = "http://localhost:3000"
-	ab.Config.Storage.Server = abstore
-	ab.Config.Storage.SessionState = sessionStore
-	ab.Config.Storage.CookieState = cookieStore
-	ab.Config.Core.ViewRenderer = defaults.JSONRenderer{}
+// Config holds the settings an Authboss instance is built from.
+type Config struct {
+	// RootURL is the scheme, host and port the application is served from,
+	// eg. https://sambhav.example.com. It is used to build absolute URLs such
+	// as the oauth2 callback.
+	RootURL string
+	// MountPath is the path the authboss routes are mounted at, eg. /authboss.
+	MountPath string
+
+	// Production enables the secure defaults, such as Secure cookies, and
+	// makes signing keys mandatory.
+	Production bool
+	// Keys sign and encrypt cookie and session state, newest first. Outside
+	// of production a random key is generated when none are given, which
+	// means sessions do not survive a restart.
+	Keys   []KeyPair
+	Cookie CookieConfig
+
+	GoogleClientID     string
+	GoogleClientSecret string
+
+	Mail MailConfig
+}
+
+// MailConfig configures the e-mails authboss sends, such as password reset
+// links. Without an SMTP address they are written to stdout.
+type MailConfig struct {
+	From     string
+	FromName string
+	// SMTPAddr is the host:port of the SMTP server.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+}
+
+// Storer is the server side storage an Authboss instance needs for the
+// modules that are enabled in this package.
+type Storer interface {
+	authboss.CreatingServerStorer
+	authboss.ConfirmingServerStorer
+	authboss.RecoveringServerStorer
+	authboss.RememberingServerStorer
+	authboss.OAuth2ServerStorer
+}
+
+// Option customises an Authboss instance before it is initialised.
+type Option func(*Authboss)
+
+// WithSessionState replaces the default cookie backed session state store.
+func WithSessionState(store authboss.ClientStateReadWriter) Option {
+	return func(a *Authboss) {
+		a.Config.Storage.SessionState = store
+	}
+}
+
+// WithLogger sets the logger used by authboss and the session stores. The
+// default logger is slog.Default().
+func WithLogger(l *slog.Logger) Option {
+	return func(a *Authboss) {
+		a.logger = l
+	}
+}
+
+// WithCookieState replaces the default cookie state store.
+func WithCookieState(store authboss.ClientStateReadWriter) Option {
+	return func(a *Authboss) {
+		a.Config.Storage.CookieState = store
+	}
+}
+
+// Authboss is a configured and initialised authboss instance. Each instance
+// owns its router, storage and client state, so several can live side by
+// side (eg. in tests).
+type Authboss struct {
+	*authboss.Authboss
 
-	// We render mail with the authboss-renderer but we use a LogMailer
-	// which simply sends the e-mail to stdout.
-	// ab.Config.Core.MailRenderer = abrenderer.NewEmail("/auth", "ab_views")
+	logger       *slog.Logger
+	sessionStore SessionStore
+	sessions     *ServerSessionStorer
+	apiKeys      APIKeyAuthenticator
+
+	cookieOpts sessions.Options
+	csrfCodecs []securecookie.Codec
+}
+
+// New builds and initialises an Authboss instance from cfg, persisting users
+// with storer. Options are applied before the modules are initialised.
+func New(cfg Config, storer Storer, opts ...Option) (*Authboss, error) {
+	if cfg.RootURL == "" {
+		return nil, errors.New("authboss: root url is required")
+	}
+	if storer == nil {
+		return nil, errors.New("authboss: storer is required")
+	}
+
+	a := &Authboss{Authboss: authboss.New(), logger: slog.Default()}
+	a.Config.Paths.RootURL = cfg.RootURL
+	a.Config.Paths.Mount = cfg.MountPath
+	a.Config.Storage.Server = storer
+
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	keys := cfg.Keys
+	if len(keys) == 0 {
+		if cfg.Production {
+			return nil, errors.New("authboss: signing keys are required in production")
+		}
+		a.logger.Warn("no authboss signing keys configured, generating a temporary key")
+		keys = []KeyPair{GenerateKey()}
+	}
+	pairs, err := keyPairs(keys)
+	if err != nil {
+		return nil, fmt.Errorf("authboss: %w", err)
+	}
+	a.cookieOpts = cfg.Cookie.cookieOptions(cfg.Production)
+	a.csrfCodecs = securecookie.CodecsFromPairs(pairs...)
+
+	if a.sessionStore != nil && a.Config.Storage.SessionState == nil {
+		a.sessions = NewServerSessionStorer(sessionCookieName, a.sessionStore, a.cookieOpts, a.logger)
+		a.Config.Storage.SessionState = a.sessions
+	}
+
+	if a.Config.Storage.CookieState == nil || a.Config.Storage.SessionState == nil {
+		cookieStore, sessionStore := newClientState(pairs, a.cookieOpts)
+		if a.Config.Storage.CookieState == nil {
+			a.Config.Storage.CookieState = cookieStore
+		}
+		if a.Config.Storage.SessionState == nil {
+			a.Config.Storage.SessionState = sessionStore
+		}
+	}
+
+	if err := a.setup(cfg); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *Authboss) setup(cfg Config) error {
+	a.Config.Core.ViewRenderer = defaults.JSONRenderer{}
+
+	// Mail is rendered as JSON and, unless an SMTP server is configured,
+	// sent through a LogMailer which simply writes the e-mail to stdout.
+	a.Config.Core.MailRenderer = defaults.JSONRenderer{}
 
 	// The preserve fields are things we don't want to
 	// lose when we're doing user registration (prevents having
 	// to type them again)
-	ab.Config.Modules.RegisterPreserveFields = []string{"email", "name"}
+	a.Config.Modules.RegisterPreserveFields = []string{"email", "name"}
 
 	// TOTP2FAIssuer is the name of the issuer we use for totp 2fa
-	ab.Config.Modules.TOTP2FAIssuer = "sambhav-app"
-	ab.Config.Modules.ResponseOnUnauthed = authboss.RespondRedirect
+	a.Config.Modules.TOTP2FAIssuer = "sambhav-app"
+	a.Config.Modules.ResponseOnUnauthed = authboss.RespondRedirect
+
+	// New users confirm their e-mail address before they can log in. Like
+	// recover_end, the token from the e-mail is posted as JSON ({"cnf": ...}).
+	a.Config.Modules.ConfirmMethod = http.MethodPost
 
 	// Turn on e-mail authentication required
-	ab.Config.Modules.TwoFactorEmailAuthRequired = true
+	a.Config.Modules.TwoFactorEmailAuthRequired = true
 
 	// This instantiates and uses every default implementation
 	// in the Config.Core area that exist in the defaults package.
 	// Just a convenient helper if you don't want to do anything fancy.
-	defaults.SetCore(&ab.Config, true, false)
+	defaults.SetCore(&a.Config, true, false)
+	a.Config.Core.Logger = logger.NewAuthboss(a.logger)
+
+	a.Config.Mail.From = cfg.Mail.From
+	a.Config.Mail.FromName = cfg.Mail.FromName
+	if cfg.Mail.SMTPAddr != "" {
+		var auth smtp.Auth
+		if cfg.Mail.SMTPUsername != "" {
+			host, _, _ := net.SplitHostPort(cfg.Mail.SMTPAddr)
+			auth = smtp.PlainAuth("", cfg.Mail.SMTPUsername, cfg.Mail.SMTPPassword, host)
+		}
+		a.Config.Core.Mailer = defaults.NewSMTPMailer(cfg.Mail.SMTPAddr, auth)
+	}
 
 	// Here we initialize the bodyreader as something customized in order to accept a name
 	// parameter for our user as well as the standard e-mail and password.
@@ -90,7 +235,7 @@ func setupAuthboss() {
 		MaxLength: 100,
 	}
 
-	ab.Config.Core.BodyReader = defaults.HTTPBodyReader{
+	a.Config.Core.BodyReader = defaults.HTTPBodyReader{
 		ReadJSON: true,
 		Rulesets: map[string][]defaults.Rules{
 			"register":    {emailRule, passwordRule, nameRule},
@@ -105,25 +250,28 @@ func setupAuthboss() {
 		},
 	}
 
+	// Logins with an unknown e-mail address fire EventAuthFail like those
+	// with a wrong password, so that they are audited and counted too.
+	a.Config.Core.BodyReader = loginBodyReader{BodyReader: a.Config.Core.BodyReader}
+	a.Config.Core.Responder = loginFailResponder{HTTPResponder: a.Config.Core.Responder, events: a.Events}
+
 	// Set up 2fa
-	twofaRecovery := &twofactor.Recovery{Authboss: ab}
+	twofaRecovery := &twofactor.Recovery{Authboss: a.Authboss}
 	if err := twofaRecovery.Setup(); err != nil {
-		panic(err)
+		return fmt.Errorf("authboss: setting up 2fa recovery: %w", err)
 	}
 
-	totp := &totp2fa.TOTP{Authboss: ab}
+	totp := &totp2fa.TOTP{Authboss: a.Authboss}
 	if err := totp.Setup(); err != nil {
-		panic(err)
+		return fmt.Errorf("authboss: setting up totp: %w", err)
 	}
 
-	// Set up Google OAuth2 if we have credentials in the
-	// file oauth2.toml for it.
-	env, _ := env.EnvVars()
-	ab.Config.Modules.OAuth2Providers = map[string]authboss.OAuth2Provider{
+	// Set up Google OAuth2 with the configured credentials.
+	a.Config.Modules.OAuth2Providers = map[string]authboss.OAuth2Provider{
 		"google": {
 			OAuth2Config: &oauth2.Config{
-				ClientID:     env.GoogleClientID,
-				ClientSecret: env.GoogleClientSecret,
+				ClientID:     cfg.GoogleClientID,
+				ClientSecret: cfg.GoogleClientSecret,
 				Scopes:       []string{`profile`, `email`},
 				Endpoint:     google.Endpoint,
 			},
@@ -132,35 +280,21 @@ func setupAuthboss() {
 	}
 
 	// Initialize authboss (instantiate modules etc.)
-	if err := ab.Init(); err != nil {
-		panic(err)
+	if err := a.Init(); err != nil {
+		return fmt.Errorf("authboss: init: %w", err)
 	}
-}
-
-func setupAuth() {
-	cookieStoreKey, _ := base64.StdEncoding.DecodeString(base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(64)))
-	sessionStoreKey, _ := base64.StdEncoding.DecodeString(base64.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(64)))
-	cookieStore = abclientstate.NewCookieStorer(cookieStoreKey, nil)
-	cookieStore.HTTPOnly = false
-	cookieStore.Secure = false
-	sessionStore = abclientstate.NewSessionStorer(sessionCookieName, sessionStoreKey, nil)
-	cstore := sessionStore.Store.(*sessions.CookieStore)
-	cstore.Options.HttpOnly = false
-	cstore.Options.Secure = false
-	cstore.MaxAge(int((30 * 24 * time.Hour) / time.Second))
-
-	setupAuthboss()
-	schemaDec.IgnoreUnknownKeys(true)
 
+	return nil
 }
 
-// Router exposes the internal authboss router so other packages can proxy
-// requests into authboss (useful for JSON/api-based flows).
-func Router() http.Handler {
-	return ab.Config.Core.Router
+// Sessions returns the server side session storer, or nil when sessions
+// are kept in cookies.
+func (a *Authboss) Sessions() *ServerSessionStorer {
+	return a.sessions
 }
 
-func init() {
-	// Initialize authboss on package load so Router() is ready to use.
-	setupAuth()
+// Router exposes the instance's authboss router so other packages can serve
+// requests with authboss (useful for JSON/api-based flows).
+func (a *Authboss) Router() http.Handler {
+	return a.Config.Core.Router
 }
@@ -0,0 +1,290 @@
+package authboss
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sambhav/pkg/database"
+
+	"github.com/aarondl/authboss/v3"
+	"github.com/gin-gonic/gin"
+)
+
+// testStorer keeps users in memory, for tests only.
+type testStorer struct {
+	mu    sync.Mutex
+	users map[string]database.User
+}
+
+func newTestStorer() *testStorer {
+	return &testStorer{users: map[string]database.User{}}
+}
+
+func (s *testStorer) user(pid string) (database.User, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u, ok := s.users[pid]
+	return u, ok
+}
+
+func (s *testStorer) Load(_ context.Context, key string) (authboss.User, error) {
+	u, ok := s.user(key)
+	if !ok {
+		return nil, authboss.ErrUserNotFound
+	}
+	return &u, nil
+}
+
+func (s *testStorer) Save(_ context.Context, user authboss.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := user.(*database.User)
+	s.users[u.Email] = *u
+	return nil
+}
+
+func (s *testStorer) New(context.Context) authboss.User { return &database.User{} }
+
+func (s *testStorer) Create(_ context.Context, user authboss.User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	u := user.(*database.User)
+	if _, ok := s.users[u.Email]; ok {
+		return authboss.ErrUserFound
+	}
+	s.users[u.Email] = *u
+	return nil
+}
+
+func (s *testStorer) LoadByConfirmSelector(_ context.Context, selector string) (authboss.ConfirmableUser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, u := range s.users {
+		if u.ConfirmSelector == selector {
+			return &u, nil
+		}
+	}
+	return nil, authboss.ErrUserNotFound
+}
+
+func (s *testStorer) LoadByRecoverSelector(context.Context, string) (authboss.RecoverableUser, error) {
+	return nil, authboss.ErrUserNotFound
+}
+
+func (s *testStorer) AddRememberToken(context.Context, string, string) error { return nil }
+func (s *testStorer) DelRememberTokens(context.Context, string) error        { return nil }
+func (s *testStorer) UseRememberToken(context.Context, string, string) error {
+	return authboss.ErrTokenNotFound
+}
+
+func (s *testStorer) NewFromOAuth2(context.Context, string, map[string]string) (authboss.OAuth2User, error) {
+	return &database.User{}, nil
+}
+
+func (s *testStorer) SaveOAuth2(ctx context.Context, user authboss.OAuth2User) error {
+	return s.Save(ctx, user)
+}
+
+func newTestAuthboss(t *testing.T) (*Authboss, *testStorer) {
+	t.Helper()
+	storer := newTestStorer()
+	ab, err := New(Config{RootURL: "http://localhost", MountPath: "/authboss"}, storer,
+		WithLogger(slog.New(slog.NewTextHandler(io.Discard, nil))))
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return ab, storer
+}
+
+// testRouter serves a login that signs in pid, the authboss routes and a
+// route requiring authentication which answers with the PID.
+func testRouter(ab *Authboss, pid string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/login", func(c *gin.Context) {
+		if err := ab.LogIn(c, pid, "/me"); err != nil {
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+	})
+	router.GET("/me", ab.RequireAuth(), func(c *gin.Context) {
+		c.String(http.StatusOK, c.GetString(ContextKeyPID))
+	})
+	ab.Mount(router.Group("/authboss"))
+	return router
+}
+
+func serve(router http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestInstancesShareNoState(t *testing.T) {
+	a, storerA := newTestAuthboss(t)
+	b, storerB := newTestAuthboss(t)
+
+	if a.Router() == b.Router() {
+		t.Error("instances share a router")
+	}
+	if a.Config.Storage.SessionState == b.Config.Storage.SessionState {
+		t.Error("instances share a session store")
+	}
+	if a.Config.Storage.Server == b.Config.Storage.Server {
+		t.Error("instances share a storer")
+	}
+
+	routerA, routerB := testRouter(a, "alice@example.com"), testRouter(b, "bob@example.com")
+
+	// a session of one instance is not accepted by the other, as each has
+	// its own keys
+	login := serve(routerA, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if login.Code != http.StatusSeeOther {
+		t.Fatalf("login: got status %d, want %d", login.Code, http.StatusSeeOther)
+	}
+	cookies := login.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatal("login set no session cookie")
+	}
+
+	me := func(router http.Handler) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		return serve(router, req)
+	}
+	if w := me(routerA); w.Code != http.StatusOK || w.Body.String() != "alice@example.com" {
+		t.Errorf("instance a: got %d %q, want 200 alice@example.com", w.Code, w.Body.String())
+	}
+	if w := me(routerB); w.Code != http.StatusUnauthorized {
+		t.Errorf("instance b accepted the session of instance a: got status %d", w.Code)
+	}
+
+	// users registered through one instance are stored by its storer only
+	req := httptest.NewRequest(http.MethodPost, "/authboss/register",
+		strings.NewReader(`{"email":"carol@example.com","name":"Carol","password":"hunter22","confirm_password":"hunter22"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if w := serve(routerA, req); w.Code >= http.StatusBadRequest {
+		t.Fatalf("register: got status %d: %s", w.Code, w.Body.String())
+	}
+	if _, ok := storerA.user("carol@example.com"); !ok {
+		t.Error("user registered through instance a is missing from its storer")
+	}
+	if _, ok := storerB.user("carol@example.com"); ok {
+		t.Error("user registered through instance a is in the storer of instance b")
+	}
+}
+
+// testMailer hands the e-mails sent through it to a channel.
+type testMailer struct {
+	mails chan authboss.Email
+}
+
+func (m testMailer) Send(_ context.Context, mail authboss.Email) error {
+	m.mails <- mail
+	return nil
+}
+
+func TestRegistrationRequiresConfirmation(t *testing.T) {
+	ab, storer := newTestAuthboss(t)
+	mails := testMailer{mails: make(chan authboss.Email, 1)}
+	ab.Config.Core.Mailer = mails
+	router := testRouter(ab, "carol@example.com")
+
+	post := func(path, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return serve(router, req)
+	}
+
+	if w := post("/authboss/register", `{"email":"carol@example.com","name":"Carol","password":"hunter22","confirm_password":"hunter22"}`); w.Code >= http.StatusBadRequest {
+		t.Fatalf("register: got status %d: %s", w.Code, w.Body.String())
+	}
+	if u, _ := storer.user("carol@example.com"); u.Confirmed || u.ConfirmSelector == "" {
+		t.Fatalf("registered user is confirmed %t with selector %q", u.Confirmed, u.ConfirmSelector)
+	}
+
+	// logging in is refused until the e-mail address is confirmed
+	login := func() int {
+		w := post("/authboss/login", `{"email":"carol@example.com","password":"hunter22"}`)
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		for _, c := range w.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		return serve(router, req).Code
+	}
+	if code := login(); code != http.StatusUnauthorized {
+		t.Errorf("unconfirmed user: got status %d, want %d", code, http.StatusUnauthorized)
+	}
+
+	var mail authboss.Email
+	select {
+	case mail = <-mails.mails:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no confirmation e-mail was sent")
+	}
+	if len(mail.To) != 1 || mail.To[0] != "carol@example.com" {
+		t.Fatalf("confirmation e-mail sent to %v", mail.To)
+	}
+	var data struct {
+		URL string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(mail.TextBody), &data); err != nil {
+		t.Fatalf("confirmation e-mail: %v", err)
+	}
+	link, err := url.Parse(data.URL)
+	if err != nil || link.Path != "/authboss/confirm" {
+		t.Fatalf("confirmation e-mail links to %q", data.URL)
+	}
+
+	token, _ := json.Marshal(map[string]string{"cnf": link.Query().Get("cnf")})
+	if w := post("/authboss/confirm", string(token)); w.Code >= http.StatusBadRequest {
+		t.Fatalf("confirm: got status %d: %s", w.Code, w.Body.String())
+	}
+	if u, _ := storer.user("carol@example.com"); !u.Confirmed || u.ConfirmSelector != "" {
+		t.Errorf("user is confirmed %t after confirming", u.Confirmed)
+	}
+	if code := login(); code != http.StatusOK {
+		t.Errorf("confirmed user: got status %d, want %d", code, http.StatusOK)
+	}
+}
+
+func TestLoginWithUnknownEmailFiresAuthFail(t *testing.T) {
+	ab, storer := newTestAuthboss(t)
+	if err := storer.Create(context.Background(), &database.User{Email: "dave@example.com", Password: "not a hash", Confirmed: true}); err != nil {
+		t.Fatal(err)
+	}
+	var failed []string
+	ab.Events.After(authboss.EventAuthFail, func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		if user, ok := r.Context().Value(authboss.CTXKeyUser).(authboss.User); ok {
+			failed = append(failed, "known:"+user.GetPID())
+		} else {
+			failed = append(failed, "unknown:"+AttemptedPID(r))
+		}
+		return handled, nil
+	})
+	router := testRouter(ab, "")
+
+	for _, email := range []string{"dave@example.com", "mallory@example.com"} {
+		req := httptest.NewRequest(http.MethodPost, "/authboss/login", strings.NewReader(`{"email":"`+email+`","password":"hunter22"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if w := serve(router, req); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Invalid Credentials") {
+			t.Errorf("%s: got status %d: %s", email, w.Code, w.Body.String())
+		}
+	}
+
+	want := []string{"known:dave@example.com", "unknown:mallory@example.com"}
+	if !slices.Equal(failed, want) {
+		t.Errorf("EventAuthFail fired for %v, want %v", failed, want)
+	}
+}
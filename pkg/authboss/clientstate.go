@@ -0,0 +1,172 @@
+package authboss
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/aarondl/authboss/v3"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+
+	abclientstate "github.com/aarondl/authboss-clientstate"
+)
+
+const (
+	defaultSessionMaxAge = 30 * 24 * time.Hour
+	defaultCookieMaxAge  = 730 * time.Hour
+)
+
+// CookieConfig controls the attributes of the session and remember-me
+// cookies. Unset flags fall back to secure defaults: cookies are always
+// HttpOnly and SameSite=Lax, and are Secure in production.
+type CookieConfig struct {
+	Domain   string
+	Secure   *bool
+	HTTPOnly *bool
+	SameSite http.SameSite
+	// SessionMaxAge is how long a session cookie lives, 30 days by default.
+	SessionMaxAge time.Duration
+}
+
+// ParseSameSite converts "lax", "strict", "none" or "default" to an
+// http.SameSite. An empty string leaves the mode unset.
+func ParseSameSite(s string) (http.SameSite, error) {
+	switch strings.ToLower(s) {
+	case "":
+		return 0, nil
+	case "default":
+		return http.SameSiteDefaultMode, nil
+	case "lax":
+		return http.SameSiteLaxMode, nil
+	case "strict":
+		return http.SameSiteStrictMode, nil
+	case "none":
+		return http.SameSiteNoneMode, nil
+	}
+	return 0, fmt.Errorf("invalid same site mode %q", s)
+}
+
+// cookieOptions resolves the configured cookie flags against the defaults
+// for the current mode.
+func (c CookieConfig) cookieOptions(production bool) sessions.Options {
+	opts := sessions.Options{
+		Path:     "/",
+		Domain:   c.Domain,
+		MaxAge:   int(c.SessionMaxAge / time.Second),
+		Secure:   production,
+		HttpOnly: true,
+		SameSite: c.SameSite,
+	}
+	if c.Secure != nil {
+		opts.Secure = *c.Secure
+	}
+	if c.HTTPOnly != nil {
+		opts.HttpOnly = *c.HTTPOnly
+	}
+	if opts.SameSite == 0 {
+		opts.SameSite = http.SameSiteLaxMode
+	}
+	if opts.MaxAge == 0 {
+		opts.MaxAge = int(defaultSessionMaxAge / time.Second)
+	}
+
+	return opts
+}
+
+// newClientState creates the cookie and session stores from the flattened
+// key pairs. Both sign with the first pair and accept values signed with any
+// of them.
+func newClientState(pairs [][]byte, opts sessions.Options) (authboss.ClientStateReadWriter, abclientstate.SessionStorer) {
+	cookieStore := newCookieStorer(securecookie.CodecsFromPairs(pairs...), opts)
+
+	sessionStore := abclientstate.NewSessionStorer(sessionCookieName, pairs...)
+	cstore := sessionStore.Store.(*sessions.CookieStore)
+	cstore.Options = &opts
+	cstore.MaxAge(opts.MaxAge)
+
+	return cookieStore, sessionStore
+}
+
+// cookieStorer mirrors abclientstate.CookieStorer but encodes with a list of
+// codecs rather than a single one, which allows keys to be rotated.
+type cookieStorer struct {
+	cookies []string
+	codecs  []securecookie.Codec
+	opts    sessions.Options
+}
+
+func newCookieStorer(codecs []securecookie.Codec, opts sessions.Options) cookieStorer {
+	opts.MaxAge = int(defaultCookieMaxAge / time.Second)
+	for _, codec := range codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(opts.MaxAge)
+		}
+	}
+
+	return cookieStorer{
+		cookies: []string{authboss.CookieRemember},
+		codecs:  codecs,
+		opts:    opts,
+	}
+}
+
+// ReadState from the request
+func (c cookieStorer) ReadState(r *http.Request) (authboss.ClientState, error) {
+	cs := make(abclientstate.CookieState)
+
+	for _, cookie := range r.Cookies() {
+		for _, n := range c.cookies {
+			if n != cookie.Name {
+				continue
+			}
+
+			var str string
+			if err := securecookie.DecodeMulti(n, cookie.Value, &str, c.codecs...); err != nil {
+				if e, ok := err.(securecookie.Error); ok && e.IsDecode() {
+					continue
+				}
+				return nil, err
+			}
+
+			cs[n] = str
+		}
+	}
+
+	return cs, nil
+}
+
+// WriteState to the responsewriter
+func (c cookieStorer) WriteState(w http.ResponseWriter, state authboss.ClientState, ev []authboss.ClientStateEvent) error {
+	for _, ev := range ev {
+		switch ev.Kind {
+		case authboss.ClientStateEventPut:
+			encoded, err := securecookie.EncodeMulti(ev.Key, ev.Value, c.codecs...)
+			if err != nil {
+				return fmt.Errorf("failed to encode cookie: %w", err)
+			}
+
+			http.SetCookie(w, &http.Cookie{
+				Expires:  time.Now().UTC().Add(time.Duration(c.opts.MaxAge) * time.Second),
+				Name:     ev.Key,
+				Value:    encoded,
+				Domain:   c.opts.Domain,
+				Path:     c.opts.Path,
+				MaxAge:   c.opts.MaxAge,
+				HttpOnly: c.opts.HttpOnly,
+				Secure:   c.opts.Secure,
+				SameSite: c.opts.SameSite,
+			})
+		case authboss.ClientStateEventDel:
+			http.SetCookie(w, &http.Cookie{
+				MaxAge: -1,
+				Name:   ev.Key,
+				Domain: c.opts.Domain,
+				Path:   c.opts.Path,
+			})
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package authboss
+
+import (
+	"net/http"
+	"path"
+	"strings"
+
+	"sambhav/pkg/events"
+
+	"github.com/aarondl/authboss/v3"
+)
+
+// EventPID returns the PID of the user an authboss event is about: the user
+// authboss put in the request context, the PID a login was attempted with,
+// or else the logged in user.
+func EventPID(r *http.Request) string {
+	if user, ok := r.Context().Value(authboss.CTXKeyUser).(authboss.User); ok {
+		return user.GetPID()
+	}
+	if pid := AttemptedPID(r); pid != "" {
+		return pid
+	}
+	pid, _ := authboss.GetSession(r, authboss.SessionKey)
+	return pid
+}
+
+// OAuth2Provider returns the provider of an OAuth2 event, which authboss
+// serves the callbacks of at /oauth2/callback/<provider>.
+func OAuth2Provider(r *http.Request) string {
+	return strings.ToLower(path.Base(r.URL.Path))
+}
+
+// PublishEvents publishes the logins, logouts, registrations, password
+// resets and 2FA changes handled by authboss. A failure to publish is logged
+// but does not fail the request.
+func (a *Authboss) PublishEvents(p events.Publisher) {
+	a.Events.After(authboss.EventAuth, a.publish(p, func(r *http.Request, pid string) events.Event {
+		return events.UserLoggedIn{PID: pid, Method: "password"}
+	}))
+	a.Events.After(authboss.EventOAuth2, a.publish(p, func(r *http.Request, pid string) events.Event {
+		return events.UserLoggedIn{PID: pid, Method: "oauth2:" + OAuth2Provider(r)}
+	}))
+	a.Events.After(authboss.EventLogout, a.publish(p, func(r *http.Request, pid string) events.Event {
+		return events.UserLoggedOut{PID: pid}
+	}))
+	a.Events.After(authboss.EventRegister, a.publish(p, func(r *http.Request, pid string) events.Event {
+		e := events.UserRegistered{PID: pid, Source: "authboss"}
+		if user, ok := r.Context().Value(authboss.CTXKeyUser).(authboss.ArbitraryUser); ok {
+			e.Name = user.GetArbitrary()["name"]
+		}
+		return e
+	}))
+	a.Events.After(authboss.EventRecoverEnd, a.publish(p, func(r *http.Request, pid string) events.Event {
+		return events.PasswordChanged{PID: pid}
+	}))
+	a.Events.After(authboss.EventTwoFactorAdded, a.publish(p, func(r *http.Request, pid string) events.Event {
+		return events.TwoFactorChanged{PID: pid, Enabled: true}
+	}))
+	a.Events.After(authboss.EventTwoFactorRemoved, a.publish(p, func(r *http.Request, pid string) events.Event {
+		return events.TwoFactorChanged{PID: pid, Enabled: false}
+	}))
+}
+
+func (a *Authboss) publish(p events.Publisher, build func(r *http.Request, pid string) events.Event) authboss.EventHandler {
+	return func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		e := build(r, EventPID(r))
+		if err := p.Publish(r.Context(), e); err != nil {
+			a.logger.ErrorContext(r.Context(), "failed to publish event", "event", e.EventName(), "error", err)
+		}
+		return handled, nil
+	}
+}
@@ -0,0 +1,149 @@
+package authboss
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aarondl/authboss/v3"
+	"github.com/gin-gonic/gin"
+)
+
+// ContextKeyPID is the Gin context key RequireAuth stores the logged in
+// user's PID under.
+const ContextKeyPID = "authboss_pid"
+
+type pidContextKey struct{}
+
+// PIDFromContext returns the PID RequireAuth authenticated the request of
+// ctx as, for code below the HTTP layer, or "" when there is none.
+func PIDFromContext(ctx context.Context) string {
+	pid, _ := ctx.Value(pidContextKey{}).(string)
+	return pid
+}
+
+// setPID stores the authenticated pid in the Gin context and in the
+// context of the request.
+func setPID(c *gin.Context, pid string) {
+	c.Set(ContextKeyPID, pid)
+	c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), pidContextKey{}, pid))
+}
+
+// Handler returns the authboss router wrapped with the client state
+// middleware so session and cookie state are loaded before any module runs
+// and written back on the first write to the response.
+func (a *Authboss) Handler() http.Handler {
+	return withLoginAttempt(a.LoadClientStateMiddleware(a.Config.Core.Router))
+}
+
+// Mount registers every authboss route below the given Gin group. With a
+// group at "/authboss" the login module is reachable at "/authboss/login".
+func (a *Authboss) Mount(group *gin.RouterGroup) {
+	group.Any("/*path", func(c *gin.Context) {
+		a.Serve(c, c.Request.Method, c.Param("path"), nil)
+	})
+}
+
+// Forward returns a Gin handler that serves the incoming request through the
+// authboss route at path using method, whatever path it arrived on.
+func (a *Authboss) Forward(method, path string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		a.Serve(c, method, path, nil)
+	}
+}
+
+// Serve dispatches the live request held by c to the authboss route at path
+// using method. Any query values are merged into the request's query string.
+//
+// The request keeps its context, headers and body, and the response is
+// written straight to the Gin writer, so cancellation and streaming work as
+// they would for any other handler.
+func (a *Authboss) Serve(c *gin.Context, method, path string, query url.Values) {
+	r := c.Request.Clone(c.Request.Context())
+	r.Method = method
+	r.URL.Path = path
+	r.URL.RawPath = ""
+
+	if len(query) > 0 {
+		q := r.URL.Query()
+		for k, vals := range query {
+			q[k] = vals
+		}
+		r.URL.RawQuery = q.Encode()
+	}
+
+	a.Handler().ServeHTTP(c.Writer, r)
+	c.Abort()
+}
+
+// RequireAuth aborts with 401 unless the request belongs to a fully
+// authenticated user. On success the user's PID is stored in the Gin context
+// under ContextKeyPID and in the request context, where PIDFromContext reads
+// it, and the loaded client state is attached to the request.
+//
+// With WithAPIKeys, requests carrying an API key are authenticated by the
+// key alone, and the scopes of the key are stored under ContextKeyScopes.
+func (a *Authboss) RequireAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := APIKey(c.Request); key != "" && a.apiKeys != nil {
+			if a.authenticateAPIKey(c, key) {
+				c.Next()
+			}
+			return
+		}
+
+		r, err := a.LoadClientState(a.NewResponse(c.Writer), c.Request)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Failed to load session"})
+			return
+		}
+
+		pid, ok := authboss.GetSession(r, authboss.SessionKey)
+		if !ok || pid == "" || !authboss.IsFullyAuthed(r) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+
+		c.Request = r
+		setPID(c, pid)
+		c.Next()
+	}
+}
+
+// RequireAdmin rejects requests from users whose PID is not in admins. It
+// must run after RequireAuth.
+func RequireAdmin(admins []string) gin.HandlerFunc {
+	allowed := make(map[string]bool, len(admins))
+	for _, pid := range admins {
+		allowed[strings.ToLower(pid)] = true
+	}
+
+	return func(c *gin.Context) {
+		if !allowed[strings.ToLower(c.GetString(ContextKeyPID))] {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin access required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// LogIn signs pid in for the client of c and redirects it to redirectTo,
+// for logins that happen outside of authboss such as SAML single sign-on.
+// Any half authenticated session is upgraded, and the session ID is rotated
+// by the server session storer as the PID changes.
+func (a *Authboss) LogIn(c *gin.Context, pid, redirectTo string) error {
+	w := a.NewResponse(c.Writer)
+	r, err := a.LoadClientState(w, c.Request)
+	if err != nil {
+		return err
+	}
+
+	authboss.PutSession(w, authboss.SessionKey, pid)
+	authboss.DelSession(w, authboss.SessionHalfAuthKey)
+
+	// the session is written back on the first write through w
+	http.Redirect(w, r, redirectTo, http.StatusSeeOther)
+	c.Abort()
+	return nil
+}
@@ -0,0 +1,127 @@
+package authboss
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gorilla/securecookie"
+)
+
+const (
+	minHashKeyLength = 32
+)
+
+// KeyPair is a secret used to protect cookie and session state. Hash signs
+// values and is required; Block, when set, also encrypts them and must be
+// 16, 24 or 32 bytes long.
+type KeyPair struct {
+	Hash  []byte
+	Block []byte
+}
+
+// ParseKeys parses key entries in the form "<hash>" or "<hash>:<block>",
+// each part standard base64 encoded. Entries are ordered newest first: the
+// first key signs new values while the rest are only used for verifying, so
+// an old key can stay listed until every value it signed has expired.
+func ParseKeys(entries []string) ([]KeyPair, error) {
+	keys := make([]KeyPair, 0, len(entries))
+	for i, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		hash, block, _ := strings.Cut(entry, ":")
+		var (
+			key KeyPair
+			err error
+		)
+		if key.Hash, err = base64.StdEncoding.DecodeString(hash); err != nil {
+			return nil, fmt.Errorf("key %d: decoding hash key: %w", i, err)
+		}
+		if len(key.Hash) < minHashKeyLength {
+			return nil, fmt.Errorf("key %d: hash key must be at least %d bytes", i, minHashKeyLength)
+		}
+		if block != "" {
+			if key.Block, err = base64.StdEncoding.DecodeString(block); err != nil {
+				return nil, fmt.Errorf("key %d: decoding block key: %w", i, err)
+			}
+			switch len(key.Block) {
+			case 16, 24, 32:
+			default:
+				return nil, fmt.Errorf("key %d: block key must be 16, 24 or 32 bytes", i)
+			}
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// LoadKeyFile reads key entries from path, one per line, newest first.
+// Blank lines and lines starting with # are ignored.
+func LoadKeyFile(path string) ([]KeyPair, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return ParseKeys(entries)
+}
+
+// LoadKeys combines the inline key entries with those in keyFile, if one is
+// given. Inline keys come first and so take precedence for signing.
+func LoadKeys(entries []string, keyFile string) ([]KeyPair, error) {
+	keys, err := ParseKeys(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	if keyFile != "" {
+		fileKeys, err := LoadKeyFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading key file: %w", err)
+		}
+		keys = append(keys, fileKeys...)
+	}
+
+	return keys, nil
+}
+
+// GenerateKey creates a random key pair suitable for development use.
+func GenerateKey() KeyPair {
+	return KeyPair{Hash: securecookie.GenerateRandomKey(64)}
+}
+
+// keyPairs flattens keys into the hash/block pairs gorilla expects.
+func keyPairs(keys []KeyPair) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no keys configured")
+	}
+
+	pairs := make([][]byte, 0, 2*len(keys))
+	for _, key := range keys {
+		pairs = append(pairs, key.Hash, key.Block)
+	}
+
+	return pairs, nil
+}
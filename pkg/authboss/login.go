@@ -0,0 +1,73 @@
+package authboss
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/aarondl/authboss/v3"
+	"github.com/aarondl/authboss/v3/auth"
+)
+
+// loginAttempt carries the PID a login was attempted with from the body
+// reader, which sees it, to the responder, which authboss does not pass it
+// to.
+type loginAttempt struct {
+	pid string
+}
+
+type loginAttemptKey struct{}
+
+// withLoginAttempt gives every request a loginAttempt for the body reader to
+// fill in.
+func withLoginAttempt(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := context.WithValue(r.Context(), loginAttemptKey{}, &loginAttempt{})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// AttemptedPID returns the PID a login served by authboss was attempted
+// with, or "" when r is not a login.
+func AttemptedPID(r *http.Request) string {
+	if attempt, ok := r.Context().Value(loginAttemptKey{}).(*loginAttempt); ok {
+		return attempt.pid
+	}
+	return ""
+}
+
+// loginBodyReader records the PID of login attempts.
+type loginBodyReader struct {
+	authboss.BodyReader
+}
+
+func (b loginBodyReader) Read(page string, r *http.Request) (authboss.Validator, error) {
+	v, err := b.BodyReader.Read(page, r)
+	if err != nil || page != auth.PageLogin {
+		return v, err
+	}
+	attempt, ok := r.Context().Value(loginAttemptKey{}).(*loginAttempt)
+	if user, isUser := v.(authboss.UserValuer); ok && isUser {
+		attempt.pid = user.GetPID()
+	}
+	return v, nil
+}
+
+// loginFailResponder fires EventAuthFail for logins with an unknown PID,
+// which authboss answers without firing it, so that they are observed like
+// logins with a wrong password. The user is not put in the request context,
+// as there is none; AttemptedPID tells the PID.
+type loginFailResponder struct {
+	authboss.HTTPResponder
+	events *authboss.Events
+}
+
+func (res loginFailResponder) Respond(w http.ResponseWriter, r *http.Request, code int, page string, data authboss.HTMLData) error {
+	_, known := r.Context().Value(authboss.CTXKeyUser).(authboss.User)
+	if page == auth.PageLogin && data[authboss.DataErr] != nil && !known && AttemptedPID(r) != "" {
+		handled, err := res.events.FireAfter(authboss.EventAuthFail, w, r)
+		if err != nil || handled {
+			return err
+		}
+	}
+	return res.HTTPResponder.Respond(w, r, code, page, data)
+}
@@ -0,0 +1,302 @@
+package authboss
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"sambhav/pkg/database"
+	"sambhav/pkg/security"
+
+	"github.com/aarondl/authboss/v3"
+	"github.com/gorilla/sessions"
+)
+
+const (
+	// sessionTouchInterval limits how often reading a session bumps its last
+	// seen time, so that not every request results in a write.
+	sessionTouchInterval = time.Minute
+)
+
+// SessionStore persists server side sessions.
+type SessionStore interface {
+	GetSession(ctx context.Context, id string) (*database.Session, error)
+	SaveSession(ctx context.Context, session *database.Session) error
+	DeleteSession(ctx context.Context, id string) error
+	DeleteSessionByHandle(ctx context.Context, pid, handle string) error
+	ListSessionsByPID(ctx context.Context, pid string) ([]*database.Session, error)
+	DeleteSessionsByPID(ctx context.Context, pid string, exceptID string) (int64, error)
+}
+
+// WithServerSessions keeps session state in store instead of in the session
+// cookie. The cookie then only carries an opaque session token.
+func WithServerSessions(store SessionStore) Option {
+	return func(a *Authboss) {
+		a.sessionStore = store
+	}
+}
+
+// ServerSessionStorer is an authboss.ClientStateReadWriter that keeps
+// session values server side, along with metadata about the client that
+// owns the session.
+type ServerSessionStorer struct {
+	name   string
+	store  SessionStore
+	opts   sessions.Options
+	logger *slog.Logger
+}
+
+// NewServerSessionStorer creates a session storer that saves sessions in
+// store and identifies them with a cookie built from opts.
+func NewServerSessionStorer(name string, store SessionStore, opts sessions.Options, logger *slog.Logger) *ServerSessionStorer {
+	return &ServerSessionStorer{name: name, store: store, opts: opts, logger: logger}
+}
+
+type serverSessionState struct {
+	ctx     context.Context
+	session *database.Session
+	// token is held by the client, only its hash is stored as the ID of
+	// the session.
+	token string
+}
+
+// Get a value from the session
+func (s *serverSessionState) Get(key string) (string, bool) {
+	value, ok := s.session.Values[key]
+	return value, ok
+}
+
+// SessionID returns the ID of the session carried by r, if any.
+func (s *ServerSessionStorer) SessionID(r *http.Request) string {
+	cookie, err := r.Cookie(s.name)
+	if err != nil || cookie.Value == "" {
+		return ""
+	}
+	return hashSessionToken(cookie.Value)
+}
+
+// ReadState loads the session identified by the request's cookie, or starts
+// a new one that is only persisted once something is written to it.
+func (s *ServerSessionStorer) ReadState(r *http.Request) (authboss.ClientState, error) {
+	ctx := r.Context()
+	now := time.Now().UTC()
+
+	var (
+		session *database.Session
+		token   string
+	)
+	if cookie, err := r.Cookie(s.name); err == nil && cookie.Value != "" {
+		session, err = s.store.GetSession(ctx, hashSessionToken(cookie.Value))
+		if err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+			return nil, err
+		}
+		token = cookie.Value
+	}
+
+	if session == nil {
+		userAgent := r.UserAgent()
+		session = &database.Session{
+			IP:        security.ClientIP(r),
+			UserAgent: userAgent,
+			Device:    deviceFromUserAgent(userAgent),
+		}
+	} else if now.Sub(session.LastSeenAt) > sessionTouchInterval {
+		session.IP = security.ClientIP(r)
+		session.LastSeenAt = now
+		session.ExpiresAt = now.Add(s.maxAge())
+		if err := s.store.SaveSession(ctx, session); err != nil {
+			s.logger.ErrorContext(ctx, "failed to refresh session", "error", err)
+		}
+	}
+	if session.Values == nil {
+		session.Values = make(map[string]string)
+	}
+
+	if session.ID == "" {
+		token = ""
+	}
+
+	return &serverSessionState{ctx: ctx, session: session, token: token}, nil
+}
+
+// WriteState applies the events to the session, persists it and sets the
+// session cookie. A session left without values is deleted.
+func (s *ServerSessionStorer) WriteState(w http.ResponseWriter, state authboss.ClientState, ev []authboss.ClientStateEvent) error {
+	st := state.(*serverSessionState)
+	session := st.session
+	prevPID := session.PID
+
+	destroy := false
+	for _, ev := range ev {
+		switch ev.Kind {
+		case authboss.ClientStateEventPut:
+			session.Values[ev.Key] = ev.Value
+		case authboss.ClientStateEventDel:
+			delete(session.Values, ev.Key)
+		case authboss.ClientStateEventDelAll:
+			if len(ev.Key) == 0 {
+				destroy = true
+				continue
+			}
+
+			whitelist := strings.Split(ev.Key, ",")
+			for key := range session.Values {
+				keep := false
+				for _, w := range whitelist {
+					if w == key {
+						keep = true
+						break
+					}
+				}
+				if !keep {
+					delete(session.Values, key)
+				}
+			}
+		}
+	}
+
+	if destroy || len(session.Values) == 0 {
+		if session.ID != "" {
+			if err := s.store.DeleteSession(st.ctx, session.ID); err != nil {
+				return fmt.Errorf("failed to delete session: %w", err)
+			}
+		}
+		s.setCookie(w, "", -1)
+		return nil
+	}
+
+	now := time.Now().UTC()
+	session.PID = session.Values[authboss.SessionKey]
+
+	// Issue a fresh token whenever the user behind the session changes so a
+	// session token planted before login cannot be reused afterwards.
+	if session.ID != "" && session.PID != prevPID {
+		if err := s.store.DeleteSession(st.ctx, session.ID); err != nil {
+			return fmt.Errorf("failed to delete session: %w", err)
+		}
+		session.ID = ""
+	}
+	if session.ID == "" {
+		token, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		handle, err := newSessionToken()
+		if err != nil {
+			return err
+		}
+		st.token = token
+		session.ID = hashSessionToken(token)
+		session.Handle = handle
+		session.CreatedAt = now
+	}
+	session.LastSeenAt = now
+	session.ExpiresAt = now.Add(s.maxAge())
+
+	if err := s.store.SaveSession(st.ctx, session); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+
+	s.setCookie(w, st.token, s.opts.MaxAge)
+	return nil
+}
+
+// List returns the active sessions of the user identified by pid.
+func (s *ServerSessionStorer) List(ctx context.Context, pid string) ([]*database.Session, error) {
+	return s.store.ListSessionsByPID(ctx, pid)
+}
+
+// Revoke deletes the session with handle if it belongs to the user
+// identified by pid.
+func (s *ServerSessionStorer) Revoke(ctx context.Context, pid, handle string) error {
+	return s.store.DeleteSessionByHandle(ctx, pid, handle)
+}
+
+// RevokeOthers deletes every session of the user identified by pid except
+// currentID and reports how many were removed. It returns
+// ErrSessionNotFound, and deletes nothing, unless currentID is a session of
+// that user.
+func (s *ServerSessionStorer) RevokeOthers(ctx context.Context, pid, currentID string) (int64, error) {
+	if currentID == "" {
+		return 0, database.ErrSessionNotFound
+	}
+	current, err := s.store.GetSession(ctx, currentID)
+	if err != nil {
+		return 0, err
+	}
+	if current.PID != pid {
+		return 0, database.ErrSessionNotFound
+	}
+
+	return s.store.DeleteSessionsByPID(ctx, pid, currentID)
+}
+
+// Check reports whether the session store can be queried, for use as a
+// health check.
+func (s *ServerSessionStorer) Check(ctx context.Context) error {
+	_, err := s.store.GetSession(ctx, "healthcheck")
+	if errors.Is(err, database.ErrSessionNotFound) {
+		return nil
+	}
+	return err
+}
+
+func (s *ServerSessionStorer) maxAge() time.Duration {
+	return time.Duration(s.opts.MaxAge) * time.Second
+}
+
+func (s *ServerSessionStorer) setCookie(w http.ResponseWriter, value string, maxAge int) {
+	cookie := &http.Cookie{
+		Name:     s.name,
+		Value:    value,
+		Path:     s.opts.Path,
+		Domain:   s.opts.Domain,
+		MaxAge:   maxAge,
+		Secure:   s.opts.Secure,
+		HttpOnly: s.opts.HttpOnly,
+		SameSite: s.opts.SameSite,
+	}
+	if maxAge > 0 {
+		cookie.Expires = time.Now().UTC().Add(time.Duration(maxAge) * time.Second)
+	}
+	http.SetCookie(w, cookie)
+}
+
+func newSessionToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate session token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashSessionToken returns the ID under which the session of token is
+// stored. Tokens are random, so an unsalted hash is enough.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// deviceFromUserAgent makes a coarse guess at the kind of device a user
+// agent belongs to, good enough to tell sessions apart in a listing.
+func deviceFromUserAgent(ua string) string {
+	ua = strings.ToLower(ua)
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "ipad") || strings.Contains(ua, "tablet"):
+		return "tablet"
+	case strings.Contains(ua, "mobile") || strings.Contains(ua, "android") || strings.Contains(ua, "iphone"):
+		return "mobile"
+	case strings.Contains(ua, "bot") || strings.Contains(ua, "curl") || strings.Contains(ua, "http"):
+		return "client"
+	}
+	return "desktop"
+}
@@ -0,0 +1,120 @@
+// Package certs builds the TLS configuration of the servers: certificates
+// read from files and reloaded when they change, or obtained from an ACME
+// CA, and client CAs for verifying the certificates of internal callers.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// Config configures a server's TLS.
+type Config struct {
+	// MinVersion is the lowest TLS version accepted, tls.VersionTLS12 when
+	// zero.
+	MinVersion uint16
+	// GetCertificate returns the certificate presented to clients.
+	GetCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+	// ClientCAs, when set, makes the server require a client certificate
+	// signed by one of the CAs it returns. It is called on every
+	// handshake, so that a reloaded pool applies to new connections.
+	ClientCAs func() *x509.CertPool
+	// NextProtos are negotiated in addition to HTTP/2 and HTTP/1.1.
+	NextProtos []string
+}
+
+// ServerConfig returns the TLS configuration of an HTTP server, which
+// negotiates HTTP/2.
+func ServerConfig(cfg Config) *tls.Config {
+	base := &tls.Config{
+		MinVersion:     cfg.MinVersion,
+		GetCertificate: cfg.GetCertificate,
+		NextProtos:     append([]string{"h2", "http/1.1"}, cfg.NextProtos...),
+	}
+	if base.MinVersion == 0 {
+		base.MinVersion = tls.VersionTLS12
+	}
+	if cfg.ClientCAs == nil {
+		return base
+	}
+
+	base.ClientAuth = tls.RequireAndVerifyClientCert
+	// set up the session ticket keys before cloning, so that every clone
+	// shares them; see https://github.com/golang/go/issues/60506
+	_, _ = base.DecryptTicket(nil, tls.ConnectionState{})
+	server := base.Clone()
+	server.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		conn := base.Clone()
+		conn.ClientCAs = cfg.ClientCAs()
+		return conn, nil
+	}
+	return server
+}
+
+// ParseVersion parses a TLS version such as 1.2 or 1.3.
+func ParseVersion(version string) (uint16, error) {
+	switch version {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("certs: unsupported TLS version %q", version)
+}
+
+// ACMEConfig configures certificates obtained from an ACME CA.
+type ACMEConfig struct {
+	Domains  []string
+	Email    string
+	CacheDir string
+	// DirectoryURL defaults to the Let's Encrypt production directory.
+	DirectoryURL string
+}
+
+// NewACME returns a manager obtaining and renewing certificates for the
+// domains of cfg. Its GetCertificate serves them, and its HTTPHandler
+// answers HTTP challenges. Servers using it must negotiate acme.ALPNProto
+// for TLS-ALPN challenges.
+func NewACME(cfg ACMEConfig) *autocert.Manager {
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		Cache:      autocert.DirCache(cfg.CacheDir),
+		HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		Email:      cfg.Email,
+	}
+	if cfg.DirectoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: cfg.DirectoryURL}
+	}
+	return m
+}
+
+// RedirectHandler redirects every request to the same URL over HTTPS, on
+// httpsPort.
+func RedirectHandler(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		} else {
+			host = strings.Trim(host, "[]")
+		}
+		if host == "" {
+			http.Error(w, "Host header required", http.StatusBadRequest)
+			return
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,158 @@
+package certs
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce groups the bursts of file events produced when
+// certificates are renewed into a single reload.
+const reloadDebounce = 250 * time.Millisecond
+
+// Reloader holds a certificate and a pool of client CAs read from files,
+// and reads them again when the files change. Connections already
+// established keep the certificate they were set up with.
+type Reloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	logger       *slog.Logger
+
+	cert      atomic.Pointer[tls.Certificate]
+	clientCAs atomic.Pointer[x509.CertPool]
+}
+
+// NewReloader reads the certificate and key pair in certFile and keyFile
+// and the PEM encoded CAs in clientCAFile. Either may be left empty.
+func NewReloader(certFile, keyFile, clientCAFile string, logger *slog.Logger) (*Reloader, error) {
+	r := &Reloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		logger:       logger,
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload reads the files again. When one cannot be read, the previous
+// certificate and pool are kept.
+func (r *Reloader) Reload() error {
+	var cert *tls.Certificate
+	if r.certFile != "" {
+		c, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+		if err != nil {
+			return fmt.Errorf("certs: loading certificate: %w", err)
+		}
+		cert = &c
+	}
+
+	var pool *x509.CertPool
+	if r.clientCAFile != "" {
+		data, err := os.ReadFile(r.clientCAFile)
+		if err != nil {
+			return fmt.Errorf("certs: loading client CAs: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("certs: no certificate found in %s", r.clientCAFile)
+		}
+	}
+
+	if cert != nil {
+		r.cert.Store(cert)
+	}
+	if pool != nil {
+		r.clientCAs.Store(pool)
+	}
+	return nil
+}
+
+// GetCertificate returns the current certificate, for tls.Config.
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := r.cert.Load()
+	if cert == nil {
+		return nil, errors.New("certs: no certificate configured")
+	}
+	return cert, nil
+}
+
+// ClientCAs returns the current pool of client CAs.
+func (r *Reloader) ClientCAs() *x509.CertPool {
+	return r.clientCAs.Load()
+}
+
+// Watch reloads the files whenever they change, until ctx is done.
+func (r *Reloader) Watch(ctx context.Context) error {
+	var files []string
+	for _, f := range []string{r.certFile, r.keyFile, r.clientCAFile} {
+		if f != "" {
+			abs, err := filepath.Abs(f)
+			if err != nil {
+				return err
+			}
+			files = append(files, abs)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// the directories are watched rather than the files, so that files
+	// replaced by a rename, as cert-manager and Kubernetes do, are followed
+	var dirs []string
+	for _, f := range files {
+		if dir := filepath.Dir(f); !slices.Contains(dirs, dir) {
+			if err := watcher.Add(dir); err != nil {
+				return err
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case e := <-watcher.Events:
+			// Kubernetes swaps the ..data symlink of mounted secrets
+			if slices.Contains(files, e.Name) || filepath.Base(e.Name) == "..data" {
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			if err := r.Reload(); err != nil {
+				r.logger.Error("error reloading certificates, keeping the previous ones", "error", err)
+				continue
+			}
+			r.logger.Info("certificates reloaded")
+		case err := <-watcher.Errors:
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				debounce.Reset(reloadDebounce)
+			} else {
+				r.logger.Error("error watching certificates", "error", err)
+			}
+		}
+	}
+}
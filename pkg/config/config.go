@@ -0,0 +1,563 @@
+// Package config defines the application configuration and loads it from
+// defaults, an optional YAML or TOML file, the environment and command line
+// flags, each overriding the previous one.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Config is the complete application configuration.
+//
+// Every setting has a dotted key made of its yaml tags, eg. server.port,
+// which is also its name in a config file and its command line flag, and
+// an environment variable named by its env tag. Settings tagged secret are
+// masked when the configuration is printed redacted, and settings tagged
+// reload, or in a section tagged reload, are applied by Manager.Reload
+// without a restart.
+type Config struct {
+	Environment   string              `yaml:"environment" env:"APP_ENV"`
+	Server        ServerConfig        `yaml:"server"`
+	Database      DatabaseConfig      `yaml:"database"`
+	Auth          AuthConfig          `yaml:"auth"`
+	Mail          MailConfig          `yaml:"mail"`
+	Observability ObservabilityConfig `yaml:"observability"`
+	Events        EventsConfig        `yaml:"events"`
+	CORS          CORSConfig          `yaml:"cors" reload:"true"`
+	RateLimit     RateLimitConfig     `yaml:"rate_limit"`
+	Idempotency   IdempotencyConfig   `yaml:"idempotency"`
+	OAuth         OAuthConfig         `yaml:"oauth"`
+	SAML          SAMLConfig          `yaml:"saml"`
+	Audit         AuditConfig         `yaml:"audit"`
+	// Features switches optional behaviour on or off by name, eg.
+	// registration_closed.
+	Features map[string]bool `yaml:"features" env:"FEATURES" reload:"true"`
+
+	file string
+}
+
+type ServerConfig struct {
+	// Port serves the public API.
+	Port int `yaml:"port" env:"SERVER_PORT"`
+	// InternalPort serves the health probes, metrics, profiling and admin
+	// endpoints, and must not be exposed publicly.
+	InternalPort int `yaml:"internal_port" env:"SERVER_INTERNAL_PORT"`
+	// RootURL is the scheme, host and port the application is reached at.
+	RootURL string `yaml:"root_url" env:"ROOT_URL"`
+	// ReadTimeout, ReadHeaderTimeout, WriteTimeout and IdleTimeout bound
+	// the matching phases of a request on the HTTP servers. Zero means no
+	// timeout.
+	ReadTimeout       time.Duration `yaml:"read_timeout" env:"SERVER_READ_TIMEOUT"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout" env:"SERVER_READ_HEADER_TIMEOUT"`
+	WriteTimeout      time.Duration `yaml:"write_timeout" env:"SERVER_WRITE_TIMEOUT"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout" env:"SERVER_IDLE_TIMEOUT"`
+	// DrainDelay is how long the service keeps serving after reporting
+	// itself not ready on shutdown, so that load balancers stop routing
+	// to it before its listeners close.
+	DrainDelay time.Duration `yaml:"drain_delay" env:"SERVER_DRAIN_DELAY"`
+	// ShutdownTimeout bounds the whole shutdown, drain delay included.
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" env:"SERVER_SHUTDOWN_TIMEOUT"`
+	TLS             TLSConfig     `yaml:"tls"`
+	// TrustedProxies are the IPs and CIDRs of the load balancers and
+	// proxies in front of the servers, whose X-Forwarded-For and
+	// X-Real-IP headers are trusted for the client IP. Empty trusts none.
+	TrustedProxies []string `yaml:"trusted_proxies" env:"SERVER_TRUSTED_PROXIES"`
+	// MaxBodySize bounds request bodies, in bytes.
+	MaxBodySize int           `yaml:"max_body_size" env:"SERVER_MAX_BODY_SIZE"`
+	Headers     HeadersConfig `yaml:"headers"`
+}
+
+// HeadersConfig configures the security headers set on every response.
+// An empty value leaves its header out.
+type HeadersConfig struct {
+	// HSTSMaxAge is the max-age of Strict-Transport-Security. Zero leaves
+	// the header out.
+	HSTSMaxAge            time.Duration `yaml:"hsts_max_age" env:"HEADERS_HSTS_MAX_AGE"`
+	HSTSIncludeSubdomains bool          `yaml:"hsts_include_subdomains" env:"HEADERS_HSTS_INCLUDE_SUBDOMAINS"`
+	HSTSPreload           bool          `yaml:"hsts_preload" env:"HEADERS_HSTS_PRELOAD"`
+	ContentSecurityPolicy string        `yaml:"content_security_policy" env:"HEADERS_CONTENT_SECURITY_POLICY"`
+	ReferrerPolicy        string        `yaml:"referrer_policy" env:"HEADERS_REFERRER_POLICY"`
+	// FrameOptions is DENY or SAMEORIGIN.
+	FrameOptions string `yaml:"frame_options" env:"HEADERS_FRAME_OPTIONS"`
+}
+
+// TLSConfig enables HTTPS, with HTTP/2, on the servers. The certificate is
+// read from CertFile and KeyFile, which are read again whenever they
+// change, or obtained from an ACME CA for ACME.Domains.
+type TLSConfig struct {
+	CertFile string     `yaml:"cert_file" env:"TLS_CERT_FILE"`
+	KeyFile  string     `yaml:"key_file" env:"TLS_KEY_FILE"`
+	ACME     ACMEConfig `yaml:"acme"`
+	// MinVersion is 1.2 or 1.3.
+	MinVersion string `yaml:"min_version" env:"TLS_MIN_VERSION"`
+	// ClientCAFile holds the CAs that sign the client certificates of
+	// internal callers. When set, the internal port requires a client
+	// certificate signed by one of them. It is read again when it changes.
+	ClientCAFile string `yaml:"client_ca_file" env:"TLS_CLIENT_CA_FILE"`
+	// RedirectPort, when set, is a plain HTTP port redirecting to HTTPS,
+	// which also answers ACME HTTP challenges.
+	RedirectPort int `yaml:"redirect_port" env:"TLS_REDIRECT_PORT"`
+	// HTTP3 also serves HTTP/3 over QUIC, on the UDP port of server.port.
+	HTTP3 bool `yaml:"http3" env:"TLS_HTTP3"`
+}
+
+// ACMEConfig obtains and renews certificates automatically from an ACME
+// CA such as Let's Encrypt. The CA must reach the server on port 443, or
+// on port 80 when redirect_port is 80.
+type ACMEConfig struct {
+	Domains []string `yaml:"domains" env:"TLS_ACME_DOMAINS"`
+	Email   string   `yaml:"email" env:"TLS_ACME_EMAIL"`
+	// CacheDir stores the account key and certificates across restarts.
+	CacheDir string `yaml:"cache_dir" env:"TLS_ACME_CACHE_DIR"`
+	// DirectoryURL defaults to the Let's Encrypt production directory.
+	DirectoryURL string `yaml:"directory_url" env:"TLS_ACME_DIRECTORY_URL"`
+}
+
+// Enabled reports whether the servers serve HTTPS.
+func (c TLSConfig) Enabled() bool {
+	return c.CertFile != "" || len(c.ACME.Domains) > 0
+}
+
+type DatabaseConfig struct {
+	Host     string `yaml:"host" env:"DATABASE_HOST"`
+	Name     string `yaml:"name" env:"DATABASE_NAME"`
+	AppName  string `yaml:"app_name" env:"DATABASE_APP_NAME"`
+	User     string `yaml:"user" env:"DATABASE_USER"`
+	Password string `yaml:"password" env:"DATABASE_PASSWORD" secret:"true"`
+	// SlowQueryThreshold is the duration after which a command is logged
+	// as slow. Zero disables slow query logging.
+	SlowQueryThreshold time.Duration `yaml:"slow_query_threshold" env:"DATABASE_SLOW_QUERY_THRESHOLD"`
+}
+
+type AuthConfig struct {
+	// Keys are inline signing keys, newest first; see authboss.ParseKeys.
+	Keys         []string     `yaml:"keys" env:"AUTH_KEYS" secret:"true"`
+	KeyFile      string       `yaml:"key_file" env:"AUTH_KEY_FILE"`
+	SessionStore string       `yaml:"session_store" env:"AUTH_SESSION_STORE"`
+	Cookie       CookieConfig `yaml:"cookie"`
+	// AdminEmails are the PIDs of the users allowed on the admin routes.
+	AdminEmails []string     `yaml:"admin_emails" env:"ADMIN_EMAILS"`
+	Google      GoogleConfig `yaml:"google"`
+}
+
+type CookieConfig struct {
+	Domain string `yaml:"domain" env:"AUTH_COOKIE_DOMAIN"`
+	// Secure and HTTPOnly default to the mode specific defaults when unset.
+	Secure   *bool  `yaml:"secure" env:"AUTH_COOKIE_SECURE"`
+	HTTPOnly *bool  `yaml:"http_only" env:"AUTH_COOKIE_HTTP_ONLY"`
+	SameSite string `yaml:"same_site" env:"AUTH_COOKIE_SAME_SITE"`
+}
+
+type GoogleConfig struct {
+	ClientID     string `yaml:"client_id" env:"GOOGLE_CLIENT_ID"`
+	ClientSecret string `yaml:"client_secret" env:"GOOGLE_CLIENT_SECRET" secret:"true"`
+}
+
+// MailConfig configures outgoing e-mail. Without an SMTP host, e-mails are
+// written to the log instead.
+type MailConfig struct {
+	From         string `yaml:"from" env:"MAIL_FROM"`
+	FromName     string `yaml:"from_name" env:"MAIL_FROM_NAME"`
+	SMTPHost     string `yaml:"smtp_host" env:"SMTP_HOST"`
+	SMTPPort     int    `yaml:"smtp_port" env:"SMTP_PORT"`
+	SMTPUsername string `yaml:"smtp_username" env:"SMTP_USERNAME"`
+	SMTPPassword string `yaml:"smtp_password" env:"SMTP_PASSWORD" secret:"true"`
+}
+
+type ObservabilityConfig struct {
+	ServiceName string        `yaml:"service_name" env:"OTEL_SERVICE_NAME"`
+	Log         LogConfig     `yaml:"log"`
+	Tracing     TracingConfig `yaml:"tracing"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level" env:"LOG_LEVEL" reload:"true"`
+	// Format is json or text. It defaults to json in production and text
+	// otherwise.
+	Format string `yaml:"format" env:"LOG_FORMAT"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `yaml:"exporter" env:"TRACING_EXPORTER"`
+	Endpoint    string  `yaml:"endpoint" env:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	Insecure    bool    `yaml:"insecure" env:"OTEL_EXPORTER_OTLP_INSECURE"`
+	SampleRatio float64 `yaml:"sample_ratio" env:"TRACING_SAMPLE_RATIO"`
+}
+
+// CORSConfig lets browser clients on other origins call the API. With no
+// allowed origins, cross-origin requests are not allowed.
+type CORSConfig struct {
+	// AllowedOrigins are origins such as https://app.example.com, patterns
+	// such as https://*.example.com matching their subdomains, or *.
+	AllowedOrigins []string `yaml:"allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	AllowedMethods []string `yaml:"allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	AllowedHeaders []string `yaml:"allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	ExposedHeaders []string `yaml:"exposed_headers" env:"CORS_EXPOSED_HEADERS"`
+	// AllowCredentials lets browsers send cookies, which the session and
+	// CSRF cookies need.
+	AllowCredentials bool `yaml:"allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	// MaxAge is how long browsers may cache the result of a preflight.
+	MaxAge time.Duration `yaml:"max_age" env:"CORS_MAX_AGE"`
+	Groups CORSGroups    `yaml:"groups"`
+}
+
+// CORSGroups override the allowed origins of a route group when set.
+type CORSGroups struct {
+	// Auth covers /api/auth, /authboss, /oauth and /.well-known.
+	Auth []string `yaml:"auth" env:"CORS_AUTH_ALLOWED_ORIGINS"`
+	// User covers /user.
+	User []string `yaml:"user" env:"CORS_USER_ALLOWED_ORIGINS"`
+	// Admin covers /admin, on the internal port.
+	Admin []string `yaml:"admin" env:"CORS_ADMIN_ALLOWED_ORIGINS"`
+}
+
+// RateLimitConfig sets quotas on the public API. Each rule allows
+// requests per period to every client, told apart by its key; clients
+// over quota get 429 Too Many Requests. A rule with no requests is off.
+type RateLimitConfig struct {
+	Enabled bool `yaml:"enabled" env:"RATE_LIMIT_ENABLED" reload:"true"`
+	// Store is memory, which keeps counts per replica, or mongo, which
+	// shares them between replicas.
+	Store string `yaml:"store" env:"RATE_LIMIT_STORE"`
+	// Default applies to every request to the public API.
+	Default RateLimitRule `yaml:"default" envPrefix:"RATE_LIMIT_DEFAULT_" reload:"true"`
+	// Register applies to user registrations.
+	Register RateLimitRule `yaml:"register" envPrefix:"RATE_LIMIT_REGISTER_" reload:"true"`
+	// Login applies to password logins.
+	Login RateLimitRule `yaml:"login" envPrefix:"RATE_LIMIT_LOGIN_" reload:"true"`
+	// Recover applies to password recovery.
+	Recover RateLimitRule `yaml:"recover" envPrefix:"RATE_LIMIT_RECOVER_" reload:"true"`
+	// OAuth applies to OAuth2 and SAML logins and callbacks.
+	OAuth RateLimitRule `yaml:"oauth" envPrefix:"RATE_LIMIT_OAUTH_" reload:"true"`
+}
+
+// RateLimitRule is a quota of requests per period. Its env tags are
+// prefixed by the rule, eg. RATE_LIMIT_LOGIN_REQUESTS.
+type RateLimitRule struct {
+	Requests int           `yaml:"requests" env:"REQUESTS"`
+	Period   time.Duration `yaml:"period" env:"PERIOD"`
+	// Algorithm is token_bucket, which allows bursts of up to Burst
+	// requests, or sliding_window, which smooths the quota over the
+	// period.
+	Algorithm string `yaml:"algorithm" env:"ALGORITHM"`
+	// Burst defaults to Requests.
+	Burst int `yaml:"burst" env:"BURST"`
+	// Key is what clients are told apart by: ip, user, api_key or route.
+	// Requests are told apart by IP unless their user or API key was
+	// authenticated before the rule applies, which is not the case for
+	// the rules of the public endpoints.
+	Key string `yaml:"key" env:"KEY"`
+}
+
+// IdempotencyConfig configures the Idempotency-Key support of the POST
+// endpoints that create things.
+type IdempotencyConfig struct {
+	// TTL is how long the response to a key is replayed to its retries.
+	TTL time.Duration `yaml:"ttl" env:"IDEMPOTENCY_TTL"`
+	// LockTimeout is how long a request may take before it is presumed
+	// lost and a retry with the same key is handled in its place.
+	LockTimeout time.Duration `yaml:"lock_timeout" env:"IDEMPOTENCY_LOCK_TIMEOUT"`
+	// Secret keys the fingerprints of the request bodies stored with the
+	// keys, so that the records do not reveal what was sent. It must be at
+	// least 32 bytes long. Without it a temporary one is generated, except
+	// in production where it is required.
+	Secret string `yaml:"secret" env:"IDEMPOTENCY_SECRET" secret:"true"`
+}
+
+// OAuthConfig configures the OAuth2 authorization server and OpenID
+// Connect provider that other apps sign users in with.
+type OAuthConfig struct {
+	Enabled bool `yaml:"enabled" env:"OAUTH_ENABLED"`
+	// Issuer is the URL of the public API the authorization server is
+	// reached at, which tokens name as their issuer.
+	Issuer string `yaml:"issuer" env:"OAUTH_ISSUER"`
+	// KeyFile holds the PEM encoded RSA keys tokens are signed with,
+	// newest first. Without it, a temporary key is generated, except in
+	// production where it is required.
+	KeyFile string `yaml:"key_file" env:"OAUTH_KEY_FILE"`
+	// ConsentURL is the page of the frontend that asks users to sign in
+	// and consent; it is passed the authorization request as ?request=.
+	ConsentURL      string        `yaml:"consent_url" env:"OAUTH_CONSENT_URL"`
+	AccessTokenTTL  time.Duration `yaml:"access_token_ttl" env:"OAUTH_ACCESS_TOKEN_TTL"`
+	RefreshTokenTTL time.Duration `yaml:"refresh_token_ttl" env:"OAUTH_REFRESH_TOKEN_TTL"`
+	CodeTTL         time.Duration `yaml:"code_ttl" env:"OAUTH_CODE_TTL"`
+}
+
+// SAMLConfig configures the SAML 2.0 service provider enterprise tenants
+// sign in through.
+type SAMLConfig struct {
+	Enabled bool `yaml:"enabled" env:"SAML_ENABLED"`
+	// BaseURL is the URL of the public API the SAML endpoints are reached
+	// at, which the entity IDs of the tenants are built from.
+	BaseURL string `yaml:"base_url" env:"SAML_BASE_URL"`
+	// CertFile and KeyFile hold the PEM encoded certificate and RSA key
+	// authentication requests are signed with. Without them, a temporary
+	// pair is generated, except in production where they are required.
+	CertFile string `yaml:"cert_file" env:"SAML_CERT_FILE"`
+	KeyFile  string `yaml:"key_file" env:"SAML_KEY_FILE"`
+}
+
+// AuditConfig configures the audit log.
+type AuditConfig struct {
+	// Key keys the hash chain of the log, so that entries cannot be
+	// rewritten by someone with access to the database alone. It must be
+	// at least 32 bytes long. Without it a temporary one is generated, and
+	// the chain no longer verifies after a restart, except in production
+	// where it is required.
+	Key string `yaml:"key" env:"AUDIT_KEY" secret:"true"`
+}
+
+type EventsConfig struct {
+	// Outbox persists events for asynchronous subscribers until they are
+	// delivered.
+	Outbox bool `yaml:"outbox" env:"EVENTS_OUTBOX"`
+}
+
+// Default returns the configuration used for settings that are not set
+// anywhere else.
+func Default() Config {
+	return Config{
+		Environment: "development",
+		Server: ServerConfig{
+			Port:              8080,
+			InternalPort:      9090,
+			RootURL:           "http://localhost:3000",
+			ReadTimeout:       15 * time.Second,
+			ReadHeaderTimeout: 5 * time.Second,
+			WriteTimeout:      30 * time.Second,
+			IdleTimeout:       120 * time.Second,
+			ShutdownTimeout:   30 * time.Second,
+			TLS:               TLSConfig{MinVersion: "1.2"},
+			MaxBodySize:       1 << 20,
+			Headers: HeadersConfig{
+				HSTSMaxAge: 365 * 24 * time.Hour,
+				// the API only serves JSON, nothing needs to load or frame it
+				ContentSecurityPolicy: "default-src 'none'; frame-ancestors 'none'",
+				ReferrerPolicy:        "no-referrer",
+				FrameOptions:          "DENY",
+			},
+		},
+		Database: DatabaseConfig{
+			SlowQueryThreshold: 200 * time.Millisecond,
+		},
+		Auth: AuthConfig{
+			SessionStore: "cookie",
+			Cookie:       CookieConfig{SameSite: "lax"},
+		},
+		Mail: MailConfig{
+			SMTPPort: 587,
+		},
+		Observability: ObservabilityConfig{
+			ServiceName: "sambhav",
+			Log:         LogConfig{Level: "info"},
+			Tracing:     TracingConfig{Exporter: "none", SampleRatio: 1},
+		},
+		Events: EventsConfig{
+			Outbox: true,
+		},
+		CORS: CORSConfig{
+			AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+			AllowedHeaders: []string{"Content-Type", "Authorization", "X-CSRF-Token", "X-Request-Id", "X-API-Key", "Idempotency-Key"},
+			ExposedHeaders: []string{"X-Request-Id", "Idempotent-Replayed"},
+			MaxAge:         10 * time.Minute,
+		},
+		Idempotency: IdempotencyConfig{
+			TTL:         24 * time.Hour,
+			LockTimeout: time.Minute,
+		},
+		OAuth: OAuthConfig{
+			Issuer:          "http://localhost:8080",
+			ConsentURL:      "http://localhost:3000/oauth/consent",
+			AccessTokenTTL:  15 * time.Minute,
+			RefreshTokenTTL: 30 * 24 * time.Hour,
+			CodeTTL:         time.Minute,
+		},
+		SAML: SAMLConfig{
+			BaseURL: "http://localhost:8080",
+		},
+		RateLimit: RateLimitConfig{
+			Enabled:  true,
+			Store:    "memory",
+			Default:  RateLimitRule{Requests: 300, Period: time.Minute, Algorithm: "token_bucket", Burst: 60, Key: "ip"},
+			Register: RateLimitRule{Requests: 10, Period: time.Hour, Algorithm: "sliding_window", Key: "ip"},
+			Login:    RateLimitRule{Requests: 10, Period: 5 * time.Minute, Algorithm: "sliding_window", Key: "ip"},
+			Recover:  RateLimitRule{Requests: 5, Period: time.Hour, Algorithm: "sliding_window", Key: "ip"},
+			OAuth:    RateLimitRule{Requests: 30, Period: 5 * time.Minute, Algorithm: "sliding_window", Key: "ip"},
+		},
+	}
+}
+
+// File returns the path of the config file the configuration was loaded
+// from, or "" when there was none.
+func (c *Config) File() string {
+	return c.file
+}
+
+// Feature reports whether the feature flag name is on.
+func (c *Config) Feature(name string) bool {
+	return c.Features[name]
+}
+
+// IsProduction reports whether the application runs in production mode.
+func (c *Config) IsProduction() bool {
+	return c.Environment == "production"
+}
+
+// Validate checks that required settings are present and that values are
+// in range. All problems are reported at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, key, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: "+format, append([]any{key}, args...)...))
+		}
+	}
+	oneOf := func(key, value string, allowed ...string) {
+		check(slices.Contains(allowed, strings.ToLower(value)), key, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+	}
+	port := func(key string, value int, optional bool) {
+		if optional && value == 0 {
+			return
+		}
+		check(value >= 1 && value <= 65535, key, "must be between 1 and 65535, got %d", value)
+	}
+
+	oneOf("environment", c.Environment, "development", "test", "staging", "production")
+
+	port("server.port", c.Server.Port, false)
+	port("server.internal_port", c.Server.InternalPort, false)
+	check(c.Server.InternalPort != c.Server.Port, "server.internal_port", "must differ from server.port")
+	u, err := url.Parse(c.Server.RootURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "server.root_url", "must be an absolute http or https URL")
+	check(c.Server.ReadTimeout >= 0, "server.read_timeout", "must not be negative")
+	check(c.Server.ReadHeaderTimeout >= 0, "server.read_header_timeout", "must not be negative")
+	check(c.Server.WriteTimeout >= 0, "server.write_timeout", "must not be negative")
+	check(c.Server.IdleTimeout >= 0, "server.idle_timeout", "must not be negative")
+	check(c.Server.DrainDelay >= 0, "server.drain_delay", "must not be negative")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdown_timeout", "must be positive")
+	check(c.Server.DrainDelay < c.Server.ShutdownTimeout, "server.drain_delay", "must be shorter than server.shutdown_timeout")
+
+	tlsCfg := c.Server.TLS
+	check((tlsCfg.CertFile == "") == (tlsCfg.KeyFile == ""), "server.tls", "cert_file and key_file must be set together")
+	check(tlsCfg.CertFile == "" || len(tlsCfg.ACME.Domains) == 0, "server.tls", "cert_file and acme.domains are mutually exclusive")
+	check(len(tlsCfg.ACME.Domains) == 0 || tlsCfg.ACME.CacheDir != "", "server.tls.acme.cache_dir", "is required when server.tls.acme.domains is set")
+	oneOf("server.tls.min_version", tlsCfg.MinVersion, "1.2", "1.3")
+	if !tlsCfg.Enabled() {
+		const msg = "requires server.tls.cert_file or server.tls.acme.domains"
+		check(tlsCfg.ClientCAFile == "", "server.tls.client_ca_file", msg)
+		check(tlsCfg.RedirectPort == 0, "server.tls.redirect_port", msg)
+		check(!tlsCfg.HTTP3, "server.tls.http3", msg)
+	}
+	port("server.tls.redirect_port", tlsCfg.RedirectPort, true)
+	check(tlsCfg.RedirectPort == 0 || (tlsCfg.RedirectPort != c.Server.Port && tlsCfg.RedirectPort != c.Server.InternalPort), "server.tls.redirect_port", "must differ from server.port and server.internal_port")
+
+	for i, proxy := range c.Server.TrustedProxies {
+		_, _, cidrErr := net.ParseCIDR(proxy)
+		check(cidrErr == nil || net.ParseIP(proxy) != nil, fmt.Sprintf("server.trusted_proxies[%d]", i), "must be an IP or a CIDR, got %q", proxy)
+	}
+	check(c.Server.MaxBodySize > 0, "server.max_body_size", "must be positive")
+	check(c.Server.Headers.HSTSMaxAge >= 0, "server.headers.hsts_max_age", "must not be negative")
+	oneOf("server.headers.frame_options", c.Server.Headers.FrameOptions, "", "deny", "sameorigin")
+
+	check(c.Database.Host != "", "database.host", "is required")
+	check(c.Database.Name != "", "database.name", "is required")
+	check(c.Database.SlowQueryThreshold >= 0, "database.slow_query_threshold", "must not be negative")
+
+	if c.IsProduction() {
+		check(len(c.Auth.Keys) > 0 || c.Auth.KeyFile != "", "auth.keys", "or auth.key_file is required in production")
+	}
+	oneOf("auth.session_store", c.Auth.SessionStore, "cookie", "server")
+	oneOf("auth.cookie.same_site", c.Auth.Cookie.SameSite, "", "default", "lax", "strict", "none")
+	check((c.Auth.Google.ClientID == "") == (c.Auth.Google.ClientSecret == ""), "auth.google", "client_id and client_secret must be set together")
+
+	if c.Mail.SMTPHost != "" {
+		port("mail.smtp_port", c.Mail.SMTPPort, false)
+		check(c.Mail.From != "", "mail.from", "is required when mail.smtp_host is set")
+	}
+
+	check(c.Observability.ServiceName != "", "observability.service_name", "is required")
+	oneOf("observability.log.level", c.Observability.Log.Level, "debug", "info", "warn", "warning", "error")
+	oneOf("observability.log.format", c.Observability.Log.Format, "", "json", "text")
+	oneOf("observability.tracing.exporter", c.Observability.Tracing.Exporter, "none", "stdout", "otlp")
+	ratio := c.Observability.Tracing.SampleRatio
+	check(ratio >= 0 && ratio <= 1, "observability.tracing.sample_ratio", "must be between 0 and 1, got %v", ratio)
+
+	origins := func(key string, values []string) {
+		for i, origin := range values {
+			key := fmt.Sprintf("%s[%d]", key, i)
+			check(origin == "*" || validOrigin(origin), key, "must be *, an origin such as https://example.com or a pattern such as https://*.example.com, got %q", origin)
+			check(origin != "*" || !c.CORS.AllowCredentials, key, "must not be * when cors.allow_credentials is set")
+		}
+	}
+	origins("cors.allowed_origins", c.CORS.AllowedOrigins)
+	origins("cors.groups.auth", c.CORS.Groups.Auth)
+	origins("cors.groups.user", c.CORS.Groups.User)
+	origins("cors.groups.admin", c.CORS.Groups.Admin)
+	check(c.CORS.MaxAge >= 0, "cors.max_age", "must not be negative")
+
+	oneOf("rate_limit.store", c.RateLimit.Store, "memory", "mongo")
+	rule := func(key string, r RateLimitRule) {
+		check(r.Requests >= 0, key+".requests", "must not be negative")
+		if r.Requests == 0 {
+			return
+		}
+		check(r.Period >= time.Millisecond, key+".period", "must be at least 1ms")
+		check(r.Burst >= 0, key+".burst", "must not be negative")
+		oneOf(key+".algorithm", r.Algorithm, "token_bucket", "sliding_window")
+		oneOf(key+".key", r.Key, "ip", "user", "api_key", "route")
+	}
+	rule("rate_limit.default", c.RateLimit.Default)
+	rule("rate_limit.register", c.RateLimit.Register)
+	rule("rate_limit.login", c.RateLimit.Login)
+	rule("rate_limit.recover", c.RateLimit.Recover)
+	rule("rate_limit.oauth", c.RateLimit.OAuth)
+
+	check(c.Idempotency.TTL > 0, "idempotency.ttl", "must be positive")
+	check(c.Idempotency.LockTimeout > c.Server.WriteTimeout, "idempotency.lock_timeout", "must be longer than server.write_timeout")
+	check(c.Idempotency.LockTimeout <= c.Idempotency.TTL, "idempotency.lock_timeout", "must not be longer than idempotency.ttl")
+	check(c.Idempotency.Secret == "" || len(c.Idempotency.Secret) >= 32, "idempotency.secret", "must be at least 32 bytes long")
+	check(c.Idempotency.Secret != "" || !c.IsProduction(), "idempotency.secret", "is required in production")
+
+	check(c.Audit.Key == "" || len(c.Audit.Key) >= 32, "audit.key", "must be at least 32 bytes long")
+	check(c.Audit.Key != "" || !c.IsProduction(), "audit.key", "is required in production")
+
+	if c.OAuth.Enabled {
+		u, err := url.Parse(c.OAuth.Issuer)
+		check(err == nil && (u.Scheme == "https" || (u.Scheme == "http" && !c.IsProduction())) && u.Host != "" && u.RawQuery == "" && u.Fragment == "",
+			"oauth.issuer", "must be an https URL, or http outside production, without a query or fragment")
+		u, err = url.Parse(c.OAuth.ConsentURL)
+		check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "oauth.consent_url", "must be an absolute http or https URL")
+		if c.IsProduction() {
+			check(c.OAuth.KeyFile != "", "oauth.key_file", "is required in production")
+		}
+		check(c.OAuth.AccessTokenTTL > 0, "oauth.access_token_ttl", "must be positive")
+		check(c.OAuth.RefreshTokenTTL > 0, "oauth.refresh_token_ttl", "must be positive")
+		check(c.OAuth.CodeTTL > 0 && c.OAuth.CodeTTL <= 10*time.Minute, "oauth.code_ttl", "must be positive and at most 10m")
+	}
+
+	if c.SAML.Enabled {
+		u, err := url.Parse(c.SAML.BaseURL)
+		check(err == nil && (u.Scheme == "https" || (u.Scheme == "http" && !c.IsProduction())) && u.Host != "" && u.RawQuery == "" && u.Fragment == "",
+			"saml.base_url", "must be an https URL, or http outside production, without a query or fragment")
+		check((c.SAML.CertFile == "") == (c.SAML.KeyFile == ""), "saml.cert_file", "must be set along with saml.key_file")
+		if c.IsProduction() {
+			check(c.SAML.CertFile != "", "saml.cert_file", "is required in production")
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validOrigin reports whether origin is a scheme and host, with an optional
+// port and an optional *. prefix on the host.
+func validOrigin(origin string) bool {
+	u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+	return err == nil && u.Scheme != "" && u.Host != "" && u.User == nil &&
+		u.Path == "" && u.RawQuery == "" && u.Fragment == "" && !strings.Contains(u.Host, "*")
+}
@@ -0,0 +1,265 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/caarlos0/env/v11"
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// FileEnv names the environment variable holding the path of the config
+// file, for when the -config flag is not given.
+const FileEnv = "CONFIG_FILE"
+
+// Load builds the configuration from the defaults, the config file, the
+// environment and args, in that order. It registers -config and one flag
+// per setting, named by its key, on fs before parsing args into it, so
+// callers can add flags of their own.
+//
+// An environment variable NAME_FILE, for any setting read from NAME, reads
+// the value from the file it points to, so that secrets can be mounted as
+// files. Setting both NAME and NAME_FILE is an error.
+//
+// The result is not validated; see Validate.
+func Load(fs *flag.FlagSet, args []string) (*Config, error) {
+	cfg := Default()
+	settings := fields(reflect.ValueOf(&cfg).Elem(), "")
+
+	configFile := fs.String("config", os.Getenv(FileEnv), "path to a YAML or TOML config file")
+	type override struct{ key, value string }
+	var overrides []override
+	for _, s := range settings {
+		set := func(value string) error {
+			overrides = append(overrides, override{s.key, value})
+			return nil
+		}
+		if s.isBool() {
+			fs.BoolFunc(s.key, s.usage(), set)
+		} else {
+			fs.Func(s.key, s.usage(), set)
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *configFile != "" {
+		if err := loadFile(&cfg, *configFile); err != nil {
+			return nil, err
+		}
+		cfg.file = *configFile
+	}
+
+	environ, err := environment(settings)
+	if err != nil {
+		return nil, err
+	}
+	if err := env.ParseWithOptions(&cfg, env.Options{Environment: environ}); err != nil {
+		return nil, fmt.Errorf("config: %w", err)
+	}
+
+	byKey := make(map[string]setting, len(settings))
+	for _, s := range settings {
+		byKey[s.key] = s
+	}
+	for _, o := range overrides {
+		if err := byKey[o.key].set(o.value); err != nil {
+			return nil, fmt.Errorf("config: invalid value %q for flag -%s: %w", o.value, o.key, err)
+		}
+	}
+
+	return &cfg, nil
+}
+
+// loadFile overlays the settings in a YAML or TOML file, told apart by its
+// extension, on cfg.
+func loadFile(cfg *Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config: %w", err)
+	}
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+	case ".toml":
+		// TOML is converted to YAML so that both are decoded the same way,
+		// durations included
+		var doc map[string]any
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+		if data, err = yaml.Marshal(doc); err != nil {
+			return fmt.Errorf("config: %s: %w", path, err)
+		}
+	default:
+		return fmt.Errorf("config: %s: unsupported file type, use .yaml, .yml or .toml", path)
+	}
+
+	if err := yaml.UnmarshalWithOptions(data, cfg, yaml.Strict()); err != nil {
+		return fmt.Errorf("config: %s: %w", path, err)
+	}
+	return nil
+}
+
+// environment returns the process environment with the NAME_FILE variables
+// of the settings resolved to NAME.
+func environment(settings []setting) (map[string]string, error) {
+	environ := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			environ[k] = v
+		}
+	}
+
+	for _, s := range settings {
+		path, ok := environ[s.env+"_FILE"]
+		if s.env == "" || !ok {
+			continue
+		}
+		if _, ok := environ[s.env]; ok {
+			return nil, fmt.Errorf("config: both %s and %s_FILE are set", s.env, s.env)
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("config: %s_FILE: %w", s.env, err)
+		}
+		environ[s.env] = strings.TrimRight(string(data), "\r\n")
+	}
+
+	return environ, nil
+}
+
+// setting is a single configuration value.
+type setting struct {
+	key    string
+	env    string
+	secret bool
+	reload bool
+	value  reflect.Value
+}
+
+// fields lists the settings in the struct v, depth first.
+func fields(v reflect.Value, prefix string) []setting {
+	return walk(v, prefix, "", false)
+}
+
+// walk lists the settings in v. Structs tagged envPrefix prefix the env
+// tags of their fields, as they do for env.Parse.
+func walk(v reflect.Value, prefix, envPrefix string, reload bool) []setting {
+	var settings []setting
+	t := v.Type()
+	for i := range t.NumField() {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		key := prefix + name
+		reload := reload || f.Tag.Get("reload") == "true"
+
+		if f.Type.Kind() == reflect.Struct {
+			settings = append(settings, walk(v.Field(i), key+".", envPrefix+f.Tag.Get("envPrefix"), reload)...)
+			continue
+		}
+		envName := f.Tag.Get("env")
+		if envName != "" {
+			envName = envPrefix + envName
+		}
+		settings = append(settings, setting{
+			key:    key,
+			env:    envName,
+			secret: f.Tag.Get("secret") == "true",
+			reload: reload,
+			value:  v.Field(i),
+		})
+	}
+	return settings
+}
+
+func (s setting) isBool() bool {
+	t := s.value.Type()
+	return t.Kind() == reflect.Bool || (t.Kind() == reflect.Pointer && t.Elem().Kind() == reflect.Bool)
+}
+
+func (s setting) usage() string {
+	if s.env == "" {
+		return "see the config file documentation"
+	}
+	return "overrides $" + s.env
+}
+
+// set parses value into the setting. Lists are comma separated and maps
+// are comma separated key:value pairs.
+func (s setting) set(value string) error {
+	v := s.value
+	if v.Kind() == reflect.Pointer {
+		p := reflect.New(v.Type().Elem())
+		v.Set(p)
+		v = p.Elem()
+	}
+
+	switch {
+	case v.Type() == reflect.TypeOf(time.Duration(0)):
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(value)
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.String:
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		v.Set(reflect.ValueOf(items))
+	case v.Kind() == reflect.Map && v.Type() == reflect.TypeOf(map[string]bool(nil)):
+		m := make(map[string]bool)
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item == "" {
+				continue
+			}
+			k, raw, ok := strings.Cut(item, ":")
+			if !ok {
+				return fmt.Errorf("%q is not a key:value pair", item)
+			}
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return err
+			}
+			m[k] = b
+		}
+		v.Set(reflect.ValueOf(m))
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package config
+
+import (
+	"io"
+	"reflect"
+
+	"github.com/goccy/go-yaml"
+)
+
+const redacted = "[REDACTED]"
+
+// Redacted returns a copy of c with the secret settings that are set
+// replaced by a placeholder.
+func (c *Config) Redacted() *Config {
+	out := *c
+	for _, s := range fields(reflect.ValueOf(&out).Elem(), "") {
+		if !s.secret {
+			continue
+		}
+		switch s.value.Kind() {
+		case reflect.String:
+			if s.value.String() != "" {
+				s.value.SetString(redacted)
+			}
+		case reflect.Slice:
+			if s.value.Len() == 0 {
+				continue
+			}
+			// a new slice, so that c keeps its values
+			masked := make([]string, s.value.Len())
+			for i := range masked {
+				masked[i] = redacted
+			}
+			s.value.Set(reflect.ValueOf(masked))
+		}
+	}
+	return &out
+}
+
+// Write writes c to w as YAML, in the format Load reads.
+func (c *Config) Write(w io.Writer) error {
+	data, err := yaml.MarshalWithOptions(c, yaml.UseLiteralStyleIfMultiline(true))
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
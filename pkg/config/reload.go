@@ -0,0 +1,182 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce groups the bursts of file events editors and config
+// management tools produce when saving a file into a single reload.
+const reloadDebounce = 250 * time.Millisecond
+
+// Manager holds the current configuration and reloads its reloadable
+// settings. The configuration returned by Current is never modified; a
+// reload swaps in a new one.
+type Manager struct {
+	current atomic.Pointer[Config]
+	load    func() (*Config, error)
+	logger  *slog.Logger
+
+	// mu serialises reloads and guards the callbacks.
+	mu          sync.Mutex
+	subscribers []func(*Config)
+	observers   []func(error)
+}
+
+// NewManager creates a manager starting from cfg. load reads the
+// configuration again, from the same sources cfg was loaded from.
+func NewManager(cfg *Config, load func() (*Config, error), logger *slog.Logger) *Manager {
+	m := &Manager{load: load, logger: logger}
+	m.current.Store(cfg)
+	return m
+}
+
+// Current returns the current configuration.
+func (m *Manager) Current() *Config {
+	return m.current.Load()
+}
+
+// Subscribe calls fn with the new configuration after every reload that
+// changed a reloadable setting. Subscribers run one at a time, in the order
+// they subscribed, and must not call Reload.
+func (m *Manager) Subscribe(fn func(cfg *Config)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subscribers = append(m.subscribers, fn)
+}
+
+// OnReload calls fn with the outcome of every reload, for reporting.
+func (m *Manager) OnReload(fn func(err error)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.observers = append(m.observers, fn)
+}
+
+// Reload reads the configuration again and applies the reloadable settings
+// that changed. Changes to other settings are logged and ignored until the
+// next restart. An invalid configuration is rejected as a whole.
+func (m *Manager) Reload() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.reload()
+	if err != nil {
+		m.logger.Error("configuration reload failed", "error", err)
+	}
+	for _, fn := range m.observers {
+		fn(err)
+	}
+	return err
+}
+
+func (m *Manager) reload() error {
+	next, err := m.load()
+	if err != nil {
+		return err
+	}
+	if err := next.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	cur := m.current.Load()
+	merged := *cur
+	curSettings := fields(reflect.ValueOf(cur).Elem(), "")
+	nextSettings := fields(reflect.ValueOf(next).Elem(), "")
+	mergedSettings := fields(reflect.ValueOf(&merged).Elem(), "")
+
+	var changed, ignored []string
+	for i, s := range mergedSettings {
+		if reflect.DeepEqual(curSettings[i].value.Interface(), nextSettings[i].value.Interface()) {
+			continue
+		}
+		if !s.reload {
+			ignored = append(ignored, s.key)
+			continue
+		}
+		s.value.Set(nextSettings[i].value)
+		changed = append(changed, s.key)
+	}
+
+	if len(ignored) > 0 {
+		m.logger.Warn("configuration changes need a restart to take effect", "keys", ignored)
+	}
+	if len(changed) == 0 {
+		m.logger.Info("configuration reloaded, nothing to apply")
+		return nil
+	}
+
+	m.current.Store(&merged)
+	for _, fn := range m.subscribers {
+		fn(&merged)
+	}
+	m.logger.Info("configuration reloaded", "keys", changed)
+	return nil
+}
+
+// Watch reloads the configuration on SIGHUP and, when the configuration
+// was loaded from a file, whenever that file changes. It returns when ctx
+// is done.
+func (m *Manager) Watch(ctx context.Context) error {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var fileEvents <-chan fsnotify.Event
+	var fileErrors <-chan error
+	file := m.Current().File()
+	if file != "" {
+		watcher, err := fsnotify.NewWatcher()
+		if err != nil {
+			return err
+		}
+		defer watcher.Close()
+
+		// the directory is watched rather than the file, so that files
+		// replaced by a rename, as editors and Kubernetes do, are followed
+		file, _ = filepath.Abs(file)
+		if err := watcher.Add(filepath.Dir(file)); err != nil {
+			return err
+		}
+		fileEvents, fileErrors = watcher.Events, watcher.Errors
+	}
+
+	debounce := time.NewTimer(time.Hour)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-hup:
+			m.logger.Info("reloading configuration on SIGHUP")
+			m.Reload()
+		case e := <-fileEvents:
+			// Kubernetes swaps the ..data symlink of mounted ConfigMaps
+			if e.Name == file || filepath.Base(e.Name) == "..data" {
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			m.logger.Info("reloading configuration after file change", "file", file)
+			m.Reload()
+		case err := <-fileErrors:
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				// events were lost, one of them may have been a change
+				debounce.Reset(reloadDebounce)
+			} else {
+				m.logger.Error("error watching config file", "file", file, "error", err)
+			}
+		}
+	}
+}
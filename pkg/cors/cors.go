@@ -0,0 +1,282 @@
+// Package cors implements Cross-Origin Resource Sharing, letting browser
+// clients on other origins call the API.
+package cors
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Policy says which cross-origin requests are allowed.
+type Policy struct {
+	// AllowedOrigins are origins such as https://app.example.com, patterns
+	// such as https://*.example.com matching any subdomain of
+	// example.com, or * for every origin.
+	AllowedOrigins []string
+	// AllowedMethods and AllowedHeaders may contain *, allowing any.
+	AllowedMethods []string
+	AllowedHeaders []string
+	// ExposedHeaders are the response headers scripts may read.
+	ExposedHeaders []string
+	// AllowCredentials lets browsers send cookies and read the responses
+	// to such requests. It cannot be combined with the * origin.
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache the result of a preflight.
+	// Zero leaves it to the browser.
+	MaxAge time.Duration
+}
+
+// CORS applies a policy, which can be replaced while it is in use. The
+// zero CORS allows no cross-origin request.
+type CORS struct {
+	policy atomic.Pointer[policy]
+}
+
+func New(p Policy) (*CORS, error) {
+	c := &CORS{}
+	if err := c.Update(p); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Update replaces the policy. Requests already being handled keep the
+// previous one.
+func (c *CORS) Update(p Policy) error {
+	compiled, err := compile(p)
+	if err != nil {
+		return err
+	}
+	c.policy.Store(compiled)
+	return nil
+}
+
+// Middleware adds the CORS headers to the responses to allowed origins and
+// answers preflight requests. It must run before authentication, as
+// browsers send preflights without credentials.
+//
+// Preflights are OPTIONS requests, which only reach a middleware for
+// routes that handle OPTIONS; see Preflight.
+func (c *CORS) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		p := c.policy.Load()
+		if !p.enabled() {
+			ctx.Next()
+			return
+		}
+
+		h := ctx.Writer.Header()
+		origin := ctx.GetHeader("Origin")
+		preflight := ctx.Request.Method == http.MethodOptions && ctx.GetHeader("Access-Control-Request-Method") != ""
+		if preflight {
+			h.Add("Vary", "Origin, Access-Control-Request-Method, Access-Control-Request-Headers")
+		} else {
+			h.Add("Vary", "Origin")
+		}
+		if origin == "" {
+			ctx.Next()
+			return
+		}
+
+		allowed := p.allowOrigin(origin)
+		if !preflight {
+			if allowed {
+				p.setOrigin(h, origin)
+				if len(p.exposedHeaders) > 0 {
+					h.Set("Access-Control-Expose-Headers", strings.Join(p.exposedHeaders, ", "))
+				}
+			}
+			ctx.Next()
+			return
+		}
+
+		if !allowed {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Origin not allowed"})
+			return
+		}
+		method := ctx.GetHeader("Access-Control-Request-Method")
+		if !p.allowMethod(method) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Method not allowed"})
+			return
+		}
+		headers := requestedHeaders(ctx.GetHeader("Access-Control-Request-Headers"))
+		if !p.allowHeaders(headers) {
+			ctx.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Header not allowed"})
+			return
+		}
+
+		p.setOrigin(h, origin)
+		// echo what was asked for, a literal * is not honoured by browsers
+		// on credentialed requests
+		h.Set("Access-Control-Allow-Methods", method)
+		if len(headers) > 0 {
+			h.Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+		}
+		if p.maxAge > 0 {
+			h.Set("Access-Control-Max-Age", strconv.Itoa(int(p.maxAge.Seconds())))
+		}
+		ctx.AbortWithStatus(http.StatusNoContent)
+	}
+}
+
+// Preflight registers an OPTIONS route for every path below group, so that
+// preflight requests reach the middleware of the group. Groups whose
+// routes already handle OPTIONS, such as catch-all routes registered with
+// Any, do not need it.
+func Preflight(group *gin.RouterGroup) {
+	group.OPTIONS("/*path", func(ctx *gin.Context) {
+		ctx.Status(http.StatusNoContent)
+	})
+}
+
+// policy is a Policy prepared for matching.
+type policy struct {
+	anyOrigin        bool
+	origins          []string
+	patterns         []pattern
+	anyMethod        bool
+	methods          []string
+	anyHeader        bool
+	headers          []string
+	exposedHeaders   []string
+	allowCredentials bool
+	maxAge           time.Duration
+}
+
+// pattern matches the origins of the subdomains of host.
+type pattern struct {
+	scheme string
+	// suffix is the host prefixed with a dot.
+	suffix string
+	port   string
+}
+
+func compile(p Policy) (*policy, error) {
+	c := &policy{
+		exposedHeaders:   p.ExposedHeaders,
+		allowCredentials: p.AllowCredentials,
+		maxAge:           p.MaxAge,
+	}
+
+	for _, origin := range p.AllowedOrigins {
+		if origin == "*" {
+			if p.AllowCredentials {
+				return nil, errors.New("cors: the * origin cannot be combined with credentials")
+			}
+			c.anyOrigin = true
+			continue
+		}
+		wildcard := strings.Contains(origin, "://*.")
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || strings.Contains(u.Host, "*") {
+			return nil, fmt.Errorf("cors: invalid origin %q", origin)
+		}
+		if !wildcard {
+			c.origins = append(c.origins, strings.ToLower(u.Scheme+"://"+u.Host))
+			continue
+		}
+		c.patterns = append(c.patterns, pattern{
+			scheme: strings.ToLower(u.Scheme),
+			suffix: "." + strings.ToLower(u.Hostname()),
+			port:   u.Port(),
+		})
+	}
+
+	for _, method := range p.AllowedMethods {
+		if method == "*" {
+			c.anyMethod = true
+		}
+		c.methods = append(c.methods, strings.ToUpper(method))
+	}
+	for _, header := range p.AllowedHeaders {
+		if header == "*" {
+			c.anyHeader = true
+		}
+		c.headers = append(c.headers, strings.ToLower(header))
+	}
+	return c, nil
+}
+
+func (p *policy) enabled() bool {
+	return p != nil && (p.anyOrigin || len(p.origins) > 0 || len(p.patterns) > 0)
+}
+
+func (p *policy) allowOrigin(origin string) bool {
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if slices.Contains(p.origins, origin) {
+		return true
+	}
+	if len(p.patterns) == 0 {
+		return false
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	host := u.Hostname()
+	for _, pat := range p.patterns {
+		if u.Scheme == pat.scheme && u.Port() == pat.port &&
+			len(host) > len(pat.suffix) && strings.HasSuffix(host, pat.suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowMethod reports whether method is allowed. The CORS-safelisted
+// methods always are.
+func (p *policy) allowMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+		return true
+	}
+	return p.anyMethod || slices.Contains(p.methods, strings.ToUpper(method))
+}
+
+func (p *policy) allowHeaders(headers []string) bool {
+	if p.anyHeader {
+		return true
+	}
+	for _, header := range headers {
+		if !slices.Contains(p.headers, header) {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin allows origin to read the response.
+func (p *policy) setOrigin(h http.Header, origin string) {
+	if p.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	if p.allowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// requestedHeaders parses the Access-Control-Request-Headers header, a
+// comma separated list of lower case header names.
+func requestedHeaders(value string) []string {
+	var headers []string
+	for _, header := range strings.Split(value, ",") {
+		if header = strings.TrimSpace(header); header != "" {
+			headers = append(headers, strings.ToLower(header))
+		}
+	}
+	return headers
+}
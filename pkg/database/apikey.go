@@ -0,0 +1,73 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"time"
+)
+
+var (
+	ErrServiceAccountNotFound = errors.New("service account not found")
+	ErrAPIKeyNotFound         = errors.New("api key not found")
+)
+
+// ServiceAccountDomain is the e-mail domain of the PIDs of service
+// accounts. It is reserved, so no human user can have such an address.
+const ServiceAccountDomain = "service-accounts.invalid"
+
+// API key scopes. Keys only reach the routes their scopes allow, while
+// session users are not restricted by scope.
+const (
+	// ScopeUsersRead reads users on /user.
+	ScopeUsersRead = "users:read"
+	// ScopeAdmin reaches the admin API, for service accounts whose PID is
+	// also an admin.
+	ScopeAdmin = "admin"
+)
+
+// Scopes are the scopes API keys can be granted.
+var Scopes = []string{ScopeUsersRead, ScopeAdmin}
+
+// ServiceAccount is a user for machine clients, such as backend jobs. It
+// cannot log in and authenticates with its API keys instead.
+type ServiceAccount struct {
+	ID          string    `bson:"_id" json:"id"`
+	Name        string    `bson:"name" json:"name"`
+	Description string    `bson:"description,omitempty" json:"description,omitempty"`
+	CreatedBy   string    `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt   time.Time `bson:"created_at" json:"created_at"`
+}
+
+// PID identifies the service account wherever a user's PID is expected.
+func (s *ServiceAccount) PID() string {
+	return s.ID + "@" + ServiceAccountDomain
+}
+
+// APIKey authenticates a service account. Only a hash of the key is
+// stored; its prefix is kept to find it and to tell keys apart in
+// listings.
+type APIKey struct {
+	ID               string   `bson:"_id" json:"id"`
+	ServiceAccountID string   `bson:"service_account_id" json:"service_account_id"`
+	Name             string   `bson:"name" json:"name"`
+	Prefix           string   `bson:"prefix" json:"prefix"`
+	Hash             string   `bson:"hash" json:"-"`
+	Scopes           []string `bson:"scopes" json:"scopes"`
+	CreatedBy        string   `bson:"created_by,omitempty" json:"created_by,omitempty"`
+
+	CreatedAt  time.Time  `bson:"created_at" json:"created_at"`
+	ExpiresAt  *time.Time `bson:"expires_at,omitempty" json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `bson:"last_used_at,omitempty" json:"last_used_at,omitempty"`
+	LastUsedIP string     `bson:"last_used_ip,omitempty" json:"last_used_ip,omitempty"`
+	RevokedAt  *time.Time `bson:"revoked_at,omitempty" json:"revoked_at,omitempty"`
+}
+
+// Active reports whether the key is neither revoked nor expired at now.
+func (k *APIKey) Active(now time.Time) bool {
+	return k.RevokedAt == nil && (k.ExpiresAt == nil || now.Before(*k.ExpiresAt))
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	return slices.Contains(k.Scopes, scope)
+}
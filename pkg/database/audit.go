@@ -0,0 +1,84 @@
+package database
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// ErrAuditChainBroken is returned when an audit entry does not match its
+// hash or does not link to the entry before it.
+var ErrAuditChainBroken = errors.New("audit chain broken")
+
+// Audited actions.
+const (
+	AuditLogin           = "login"
+	AuditLogout          = "logout"
+	AuditPasswordChange  = "password_change"
+	AuditTwoFactorAdd    = "2fa_enroll"
+	AuditTwoFactorRemove = "2fa_remove"
+	AuditOAuth2Link      = "oauth2_link"
+	AuditRoleChange      = "role_change"
+	AuditUserCreate      = "user_create"
+	AuditUserUpdate      = "user_update"
+	AuditUserDelete      = "user_delete"
+)
+
+// Outcomes of an audited action.
+const (
+	AuditSuccess = "success"
+	AuditFailure = "failure"
+)
+
+// AuditEntry is a record of a security relevant action. Entries are
+// numbered consecutively and each one carries the hash of the entry before
+// it, so that removing or altering an entry breaks the chain. The hashes are
+// keyed, so that only holders of the key can rebuild the chain.
+type AuditEntry struct {
+	Seq       int64             `bson:"_id" json:"seq"`
+	Time      time.Time         `bson:"time" json:"time"`
+	Action    string            `bson:"action" json:"action"`
+	Outcome   string            `bson:"outcome" json:"outcome"`
+	Actor     string            `bson:"actor,omitempty" json:"actor,omitempty"`
+	Target    string            `bson:"target,omitempty" json:"target,omitempty"`
+	IP        string            `bson:"ip,omitempty" json:"ip,omitempty"`
+	UserAgent string            `bson:"user_agent,omitempty" json:"user_agent,omitempty"`
+	RequestID string            `bson:"request_id,omitempty" json:"request_id,omitempty"`
+	Details   map[string]string `bson:"details,omitempty" json:"details,omitempty"`
+	PrevHash  string            `bson:"prev_hash" json:"prev_hash"`
+	Hash      string            `bson:"hash" json:"hash"`
+}
+
+// ComputeHash returns the HMAC keyed with key of every field of the entry
+// but Hash itself, PrevHash included.
+func (e *AuditEntry) ComputeHash(key []byte) string {
+	unhashed := *e
+	unhashed.Hash = ""
+	// Only keep what survives a round trip through the database, so that a
+	// stored entry hashes the same as it did when it was written.
+	unhashed.Time = unhashed.Time.UTC().Truncate(time.Millisecond)
+
+	// Marshalling a struct is deterministic: fields keep their order and map
+	// keys are sorted.
+	b, _ := json.Marshal(unhashed)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AuditFilter selects audit entries. Zero fields match everything.
+type AuditFilter struct {
+	Actor   string
+	Target  string
+	Action  string
+	Outcome string
+	From    time.Time
+	To      time.Time
+	// BeforeSeq pages backwards through the log: only entries older than it
+	// are returned.
+	BeforeSeq int64
+	Limit     int64
+}
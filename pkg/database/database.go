@@ -2,7 +2,7 @@ package database
 
 import (
 	"fmt"
-	"log"
+	"log/slog"
 	"time"
 
 	_ "github.com/joho/godotenv/autoload"
@@ -12,6 +12,14 @@ import (
 	"golang.org/x/net/context"
 )
 
+// Transactor runs functions in transactions, so that services can change
+// several collections, such as a user and the event outbox, atomically.
+type Transactor interface {
+	// WithTransaction runs fn in a transaction, committing it when fn
+	// succeeds. Writes must use the context passed to fn to take part.
+	WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error
+}
+
 // Service represents a service that interacts with a database.
 type Database interface {
 
@@ -20,38 +28,45 @@ type Database interface {
 	// Health returns a map of health status information.
 	// The keys and values in the map are service-specific.
 	Health() map[string]string
-
-	// Close terminates the database connection.
+	// Ping checks that the database is reachable.
+	Ping(ctx context.Context) error
+	// Stats returns connection pool and command statistics.
+	Stats() Stats
+	Transactor
+
+	// Close terminates the database connection, waiting for in use
+	// connections to be returned to the pool until ctx is done.
 	// It returns an error if the connection cannot be closed.
-	Close()
+	Close(ctx context.Context) error
 }
 
 type mongoDatabase struct {
-	client *mongo.Client
-	db     *mongo.Database
+	client  *mongo.Client
+	db      *mongo.Database
+	monitor *mongoMonitor
+	logger  *slog.Logger
 }
 
-var (
-	dbInstance *mongoDatabase
-)
-
-func NewDatabaseMongo(username, password, host, name, appName string) Database {
-	if dbInstance != nil {
-		return dbInstance
-	}
+// NewDatabaseMongo connects to MongoDB. Commands taking longer than
+// slowQuery are logged; a zero slowQuery disables slow query logging.
+func NewDatabaseMongo(username, password, host, name, appName string, slowQuery time.Duration, logger *slog.Logger) (Database, error) {
 	connStr := fmt.Sprintf("mongodb+srv://%s:%s@%s/?appName=%s", username, password, host, appName)
 	serverAPI := options.ServerAPI(options.ServerAPIVersion1)
-	opts := options.Client().ApplyURI(connStr).SetServerAPIOptions(serverAPI)
+	monitor := newMongoMonitor(slowQuery, logger)
+	opts := options.Client().ApplyURI(connStr).SetServerAPIOptions(serverAPI).
+		SetPoolMonitor(monitor.poolMonitor()).
+		SetMonitor(monitor.commandMonitor())
 
 	client, err := mongo.Connect(opts)
 	if err != nil {
-		panic(err)
-	}
-	dbInstance = &mongoDatabase{
-		client: client,
-		db:     client.Database(name),
+		return nil, fmt.Errorf("connecting to mongodb: %w", err)
 	}
-	return dbInstance
+	return &mongoDatabase{
+		client:  client,
+		db:      client.Database(name),
+		monitor: monitor,
+		logger:  logger,
+	}, nil
 }
 
 func (s *mongoDatabase) Connection() *mongo.Database {
@@ -67,10 +82,10 @@ func (s *mongoDatabase) Health() map[string]string {
 	stats := make(map[string]string)
 
 	// Ping the database
-	if err := s.client.Ping(ctx, readpref.Primary()); err != nil {
+	if err := s.Ping(ctx); err != nil {
 		stats["status"] = "down"
 		stats["message"] = fmt.Sprintf("db down: %v", err)
-		log.Fatalf("db down: %v", err) // Log the error and terminate the program
+		s.logger.Error("database is down", "error", err)
 		return stats
 	}
 
@@ -81,12 +96,36 @@ func (s *mongoDatabase) Health() map[string]string {
 	return stats
 }
 
+// Ping checks that the primary is reachable.
+func (s *mongoDatabase) Ping(ctx context.Context) error {
+	return s.client.Ping(ctx, readpref.Primary())
+}
+
+// Stats returns the pool and command statistics gathered from the driver.
+func (s *mongoDatabase) Stats() Stats {
+	return s.monitor.stats()
+}
+
+// WithTransaction runs fn in a transaction on a new session. The driver
+// retries fn on transient transaction errors, so fn may run more than once.
+func (s *mongoDatabase) WithTransaction(ctx context.Context, fn func(ctx context.Context) error) error {
+	session, err := s.client.StartSession()
+	if err != nil {
+		return err
+	}
+	defer session.EndSession(ctx)
+
+	_, err = session.WithTransaction(ctx, func(ctx context.Context) (any, error) {
+		return nil, fn(ctx)
+	})
+	return err
+}
+
 // Close closes the database connection.
-func (s *mongoDatabase) Close() {
-	defer func() {
-		if err := s.client.Disconnect(context.Background()); err != nil {
-			panic(err)
-		}
-	}()
-	log.Printf("Disconnected from database")
+func (s *mongoDatabase) Close(ctx context.Context) error {
+	if err := s.client.Disconnect(ctx); err != nil {
+		return fmt.Errorf("disconnecting from database: %w", err)
+	}
+	s.logger.Info("disconnected from database")
+	return nil
 }
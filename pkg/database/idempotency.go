@@ -0,0 +1,32 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrIdempotencyKeyNotFound is returned when an idempotency key is not
+// reserved, or its reservation was taken over.
+var ErrIdempotencyKeyNotFound = errors.New("idempotency key not found")
+
+// IdempotencyRecord is the outcome of the first request made with an
+// idempotency key, replayed to the retries of that request.
+type IdempotencyRecord struct {
+	// ID is a hash of the key, the user and the route it was used on.
+	ID string `bson:"_id" json:"id"`
+	// RequestHash fingerprints the request, so that a key reused for a
+	// different request is told apart from a retry.
+	RequestHash string `bson:"request_hash" json:"request_hash"`
+	// Completed is false while the first request is being handled.
+	Completed bool `bson:"completed" json:"completed"`
+
+	StatusCode int                 `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Header     map[string][]string `bson:"header,omitempty" json:"-"`
+	Body       []byte              `bson:"body,omitempty" json:"-"`
+
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	// LockedUntil is when a request that is still not completed is
+	// presumed lost, letting a retry take the key over.
+	LockedUntil time.Time `bson:"locked_until" json:"locked_until"`
+	ExpiresAt   time.Time `bson:"expires_at" json:"expires_at"`
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrOAuthClientNotFound  = errors.New("oauth client not found")
+	ErrOAuthRequestNotFound = errors.New("oauth authorization request not found")
+	ErrOAuthCodeNotFound    = errors.New("oauth authorization code not found")
+	ErrOAuthGrantNotFound   = errors.New("oauth grant not found")
+	ErrOAuthTokenNotFound   = errors.New("oauth refresh token not found")
+	ErrOAuthConsentNotFound = errors.New("oauth consent not found")
+)
+
+// OAuth grant types clients can be registered for.
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+)
+
+// OAuth client authentication methods at the token endpoint. Public
+// clients, such as single page and native apps, cannot keep a secret and
+// use none.
+const (
+	AuthMethodSecretBasic = "client_secret_basic"
+	AuthMethodSecretPost  = "client_secret_post"
+	AuthMethodNone        = "none"
+)
+
+// OpenID Connect scopes. Clients may also be registered for scopes of
+// their own, which are passed on in access tokens for the services that
+// accept them.
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+)
+
+// OAuthClient is an application that signs users in through the OAuth2
+// authorization server. Only a hash of its secret is stored.
+type OAuthClient struct {
+	ID           string   `bson:"_id" json:"client_id"`
+	Name         string   `bson:"name" json:"client_name"`
+	SecretHash   string   `bson:"secret_hash,omitempty" json:"-"`
+	RedirectURIs []string `bson:"redirect_uris" json:"redirect_uris"`
+	GrantTypes   []string `bson:"grant_types" json:"grant_types"`
+	AuthMethod   string   `bson:"auth_method" json:"token_endpoint_auth_method"`
+	Scopes       []string `bson:"scopes" json:"scopes"`
+	// FirstParty clients are our own apps, which users are not asked to
+	// consent to.
+	FirstParty bool      `bson:"first_party" json:"first_party"`
+	CreatedBy  string    `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+}
+
+// Public reports whether the client has no secret.
+func (c *OAuthClient) Public() bool {
+	return c.AuthMethod == AuthMethodNone
+}
+
+// OAuthAuthorizationRequest is an authorization request waiting for the
+// user to sign in and consent.
+type OAuthAuthorizationRequest struct {
+	ID            string    `bson:"_id" json:"id"`
+	ClientID      string    `bson:"client_id" json:"client_id"`
+	RedirectURI   string    `bson:"redirect_uri" json:"redirect_uri"`
+	Scopes        []string  `bson:"scopes" json:"scopes"`
+	State         string    `bson:"state,omitempty" json:"-"`
+	Nonce         string    `bson:"nonce,omitempty" json:"-"`
+	CodeChallenge string    `bson:"code_challenge" json:"-"`
+	CreatedAt     time.Time `bson:"created_at" json:"created_at"`
+	ExpiresAt     time.Time `bson:"expires_at" json:"expires_at"`
+}
+
+// OAuthAuthorizationCode is an authorization code, stored by its hash. Its
+// grant is created when it is exchanged; exchanging it twice revokes the
+// grant.
+type OAuthAuthorizationCode struct {
+	Hash          string     `bson:"_id"`
+	GrantID       string     `bson:"grant_id"`
+	ClientID      string     `bson:"client_id"`
+	PID           string     `bson:"pid"`
+	RedirectURI   string     `bson:"redirect_uri"`
+	Scopes        []string   `bson:"scopes"`
+	Nonce         string     `bson:"nonce,omitempty"`
+	CodeChallenge string     `bson:"code_challenge"`
+	ExpiresAt     time.Time  `bson:"expires_at"`
+	UsedAt        *time.Time `bson:"used_at,omitempty"`
+}
+
+// OAuthGrant is an authorization given to a client, which the tokens
+// issued from it share. Revoking it revokes them all. Grants of the client
+// credentials grant have no PID.
+type OAuthGrant struct {
+	ID        string     `bson:"_id"`
+	ClientID  string     `bson:"client_id"`
+	PID       string     `bson:"pid,omitempty"`
+	Scopes    []string   `bson:"scopes"`
+	CreatedAt time.Time  `bson:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	RevokedAt *time.Time `bson:"revoked_at,omitempty"`
+}
+
+// Active reports whether the grant is neither revoked nor expired at now.
+func (g *OAuthGrant) Active(now time.Time) bool {
+	return g.RevokedAt == nil && now.Before(g.ExpiresAt)
+}
+
+// OAuthRefreshToken is a refresh token, stored by its hash. Refresh tokens
+// are rotated: each can be used once, and using one twice revokes its
+// grant.
+type OAuthRefreshToken struct {
+	Hash      string     `bson:"_id"`
+	GrantID   string     `bson:"grant_id"`
+	ClientID  string     `bson:"client_id"`
+	CreatedAt time.Time  `bson:"created_at"`
+	ExpiresAt time.Time  `bson:"expires_at"`
+	UsedAt    *time.Time `bson:"used_at,omitempty"`
+}
+
+// OAuthConsent records the scopes a user consented to give a client, so
+// that they are not asked again.
+type OAuthConsent struct {
+	PID       string    `bson:"pid" json:"-"`
+	ClientID  string    `bson:"client_id" json:"client_id"`
+	Scopes    []string  `bson:"scopes" json:"scopes"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
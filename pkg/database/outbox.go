@@ -0,0 +1,20 @@
+package database
+
+import "time"
+
+// OutboxEvent is an event waiting to be delivered to asynchronous
+// subscribers. It is written in the same transaction as the change that
+// caused it, so that the event is never lost nor sent for a change that was
+// rolled back.
+type OutboxEvent struct {
+	ID         string    `bson:"_id" json:"id"`
+	Name       string    `bson:"name" json:"name"`
+	Payload    string    `bson:"payload" json:"payload"`
+	OccurredAt time.Time `bson:"occurred_at" json:"occurred_at"`
+	// Attempts counts failed deliveries.
+	Attempts      int        `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time  `bson:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil   time.Time  `bson:"locked_until" json:"locked_until"`
+	DeliveredAt   *time.Time `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+	LastError     string     `bson:"last_error,omitempty" json:"last_error,omitempty"`
+}
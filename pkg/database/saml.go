@@ -0,0 +1,63 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrSAMLTenantNotFound  = errors.New("saml tenant not found")
+	ErrSAMLTenantExists    = errors.New("saml tenant already exists")
+	ErrSAMLRequestNotFound = errors.New("saml authentication request not found")
+	// ErrSAMLDomainTaken is returned for tenants claiming a domain another
+	// tenant has.
+	ErrSAMLDomainTaken = errors.New("saml domain belongs to another tenant")
+)
+
+// SAMLTenant is an organisation whose users sign in through its own SAML
+// identity provider. Its ID names it in the URLs of the service provider,
+// eg. /saml/<id>/acs.
+type SAMLTenant struct {
+	ID   string `bson:"_id" json:"id"`
+	Name string `bson:"name" json:"name"`
+
+	// The identity provider, as imported from its metadata.
+	IdPEntityID     string   `bson:"idp_entity_id" json:"idp_entity_id"`
+	IdPSSOURL       string   `bson:"idp_sso_url" json:"idp_sso_url"`
+	IdPCertificates []string `bson:"idp_certificates" json:"idp_certificates"`
+	// MetadataURL is where the metadata was fetched from, if it was, so it
+	// can be fetched again when the identity provider rotates its keys.
+	MetadataURL string `bson:"metadata_url,omitempty" json:"metadata_url,omitempty"`
+
+	AttributeMapping SAMLAttributeMapping `bson:"attribute_mapping" json:"attribute_mapping"`
+	// Domains are the e-mail domains the identity provider may sign users
+	// in for, so that it cannot sign in users of other organisations. Each
+	// domain belongs to one tenant.
+	Domains []string `bson:"domains" json:"domains"`
+	// JITProvisioning creates users the first time they sign in.
+	JITProvisioning bool `bson:"jit_provisioning" json:"jit_provisioning"`
+
+	CreatedBy string    `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	CreatedAt time.Time `bson:"created_at" json:"created_at"`
+	UpdatedAt time.Time `bson:"updated_at" json:"updated_at"`
+}
+
+// SAMLAttributeMapping names the assertion attributes User fields are
+// read from. Without an Email attribute the e-mail address is the NameID;
+// without a Name attribute the name is built from FirstName and LastName.
+type SAMLAttributeMapping struct {
+	Email     string `bson:"email,omitempty" json:"email,omitempty"`
+	Name      string `bson:"name,omitempty" json:"name,omitempty"`
+	FirstName string `bson:"first_name,omitempty" json:"first_name,omitempty"`
+	LastName  string `bson:"last_name,omitempty" json:"last_name,omitempty"`
+}
+
+// SAMLRequest is an authentication request sent to the identity provider
+// of a tenant, waiting for its response. It is used once.
+type SAMLRequest struct {
+	ID         string    `bson:"_id"`
+	TenantID   string    `bson:"tenant_id"`
+	RedirectTo string    `bson:"redirect_to"`
+	CreatedAt  time.Time `bson:"created_at"`
+	ExpiresAt  time.Time `bson:"expires_at"`
+}
@@ -0,0 +1,29 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrSessionNotFound is returned when a session does not exist or has
+// expired.
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is a server side session. The client holds a token whose hash is
+// the ID of the session, so that the stored sessions cannot be used to sign
+// in. Sessions are listed and revoked by their handle, which is random and
+// grants nothing.
+type Session struct {
+	ID     string            `bson:"_id" json:"-"`
+	Handle string            `bson:"handle" json:"id"`
+	PID    string            `bson:"pid,omitempty" json:"-"`
+	Values map[string]string `bson:"values" json:"-"`
+
+	IP        string `bson:"ip" json:"ip"`
+	UserAgent string `bson:"user_agent" json:"user_agent"`
+	Device    string `bson:"device" json:"device"`
+
+	CreatedAt  time.Time `bson:"created_at" json:"created_at"`
+	LastSeenAt time.Time `bson:"last_seen_at" json:"last_seen_at"`
+	ExpiresAt  time.Time `bson:"expires_at" json:"expires_at"`
+}
@@ -0,0 +1,239 @@
+package database
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/event"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// PoolStats describes the state of a connection pool. It has the same shape
+// for every backend so health and metrics consumers need not care which one
+// is in use.
+type PoolStats struct {
+	Open  int `json:"open"`
+	InUse int `json:"in_use"`
+	Idle  int `json:"idle"`
+	// WaitCount counts connection requests that had to wait because no
+	// idle connection was available, and WaitDuration is the total time
+	// they waited.
+	WaitCount    int64         `json:"wait_count"`
+	WaitDuration time.Duration `json:"wait_duration"`
+	// CheckoutFailures counts connection requests that could not be served.
+	CheckoutFailures int64 `json:"checkout_failures"`
+}
+
+// CommandStats aggregates the commands run against one collection with one
+// operation.
+type CommandStats struct {
+	Collection    string        `json:"collection"`
+	Operation     string        `json:"operation"`
+	Count         int64         `json:"count"`
+	Failures      int64         `json:"failures"`
+	TotalDuration time.Duration `json:"total_duration"`
+	MaxDuration   time.Duration `json:"max_duration"`
+	SlowCount     int64         `json:"slow_count"`
+}
+
+// Stats is a snapshot of the driver metrics of a database.
+type Stats struct {
+	Pool     PoolStats      `json:"pool"`
+	Commands []CommandStats `json:"commands"`
+}
+
+type commandKey struct {
+	collection string
+	operation  string
+}
+
+type startedCommand struct {
+	commandKey
+	span trace.Span
+}
+
+// mongoMonitor collects pool and command events from the Mongo driver and
+// traces every command as a client span.
+type mongoMonitor struct {
+	slowQuery time.Duration
+	tracer    trace.Tracer
+	logger    *slog.Logger
+
+	mu   sync.Mutex
+	pool PoolStats
+	// waiting counts the checkouts that started without an idle
+	// connection and have not completed yet.
+	waiting  int
+	started  map[int64]startedCommand
+	commands map[commandKey]*CommandStats
+}
+
+func newMongoMonitor(slowQuery time.Duration, logger *slog.Logger) *mongoMonitor {
+	return &mongoMonitor{
+		slowQuery: slowQuery,
+		tracer:    otel.Tracer("sambhav/pkg/database"),
+		logger:    logger,
+		started:   make(map[int64]startedCommand),
+		commands:  make(map[commandKey]*CommandStats),
+	}
+}
+
+func (m *mongoMonitor) poolMonitor() *event.PoolMonitor {
+	return &event.PoolMonitor{Event: m.poolEvent}
+}
+
+func (m *mongoMonitor) commandMonitor() *event.CommandMonitor {
+	return &event.CommandMonitor{
+		Started: m.commandStarted,
+		Succeeded: func(ctx context.Context, e *event.CommandSucceededEvent) {
+			m.commandFinished(ctx, e.CommandFinishedEvent, nil)
+		},
+		Failed: func(ctx context.Context, e *event.CommandFailedEvent) {
+			m.commandFinished(ctx, e.CommandFinishedEvent, e.Failure)
+		},
+	}
+}
+
+func (m *mongoMonitor) poolEvent(e *event.PoolEvent) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	switch e.Type {
+	case event.ConnectionCreated:
+		m.pool.Open++
+		m.pool.Idle++
+	case event.ConnectionClosed:
+		m.pool.Open--
+		m.pool.Idle--
+	case event.ConnectionCheckOutStarted:
+		// Without an idle connection the checkout blocks until one is
+		// created or checked in.
+		if m.pool.Idle <= 0 {
+			m.waiting++
+			m.pool.WaitCount++
+		}
+	case event.ConnectionCheckedOut:
+		m.pool.InUse++
+		m.pool.Idle--
+		m.waited(e.Duration)
+	case event.ConnectionCheckedIn:
+		m.pool.InUse--
+		m.pool.Idle++
+	case event.ConnectionCheckOutFailed:
+		m.pool.CheckoutFailures++
+		m.waited(e.Duration)
+	}
+	// A connection checked out before the pool noticed it being created or
+	// closed can briefly make the idle count negative.
+	if m.pool.Idle < 0 {
+		m.pool.Idle = 0
+	}
+}
+
+// waited adds the duration of a completed checkout to the wait duration
+// while checkouts that had to wait are outstanding. The driver does not tie
+// the completion to its start, so with several checkouts in flight the
+// duration of another one may be counted.
+func (m *mongoMonitor) waited(d time.Duration) {
+	if m.waiting == 0 {
+		return
+	}
+	m.waiting--
+	m.pool.WaitDuration += d
+}
+
+func (m *mongoMonitor) commandStarted(ctx context.Context, e *event.CommandStartedEvent) {
+	collection := ""
+	if elems, err := e.Command.Elements(); err == nil && len(elems) > 0 {
+		if name, ok := elems[0].Value().StringValueOK(); ok {
+			collection = name
+		}
+	}
+
+	// The command document is left out of the span as it may hold user data.
+	_, span := m.tracer.Start(ctx, e.CommandName+" "+collection,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.DBSystemNameMongoDB,
+			semconv.DBNamespace(e.DatabaseName),
+			semconv.DBCollectionName(collection),
+			semconv.DBOperationName(e.CommandName),
+		),
+	)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.started[e.RequestID] = startedCommand{
+		commandKey: commandKey{collection: collection, operation: e.CommandName},
+		span:       span,
+	}
+}
+
+func (m *mongoMonitor) commandFinished(ctx context.Context, e event.CommandFinishedEvent, failure error) {
+	m.mu.Lock()
+	started, ok := m.started[e.RequestID]
+	delete(m.started, e.RequestID)
+	if !ok {
+		started.operation = e.CommandName
+	}
+
+	stats, ok := m.commands[started.commandKey]
+	if !ok {
+		stats = &CommandStats{Collection: started.collection, Operation: started.operation}
+		m.commands[started.commandKey] = stats
+	}
+	stats.Count++
+	stats.TotalDuration += e.Duration
+	if e.Duration > stats.MaxDuration {
+		stats.MaxDuration = e.Duration
+	}
+	if failure != nil {
+		stats.Failures++
+	}
+	slow := m.slowQuery > 0 && e.Duration >= m.slowQuery
+	if slow {
+		stats.SlowCount++
+	}
+	m.mu.Unlock()
+
+	if started.span != nil {
+		if failure != nil {
+			started.span.RecordError(failure)
+			started.span.SetStatus(codes.Error, failure.Error())
+		}
+		started.span.End()
+	}
+
+	if slow {
+		m.logger.WarnContext(ctx, "slow query",
+			"database", e.DatabaseName,
+			"collection", started.collection,
+			"operation", started.operation,
+			"duration", e.Duration,
+		)
+	}
+}
+
+func (m *mongoMonitor) stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	commands := make([]CommandStats, 0, len(m.commands))
+	for _, c := range m.commands {
+		commands = append(commands, *c)
+	}
+	sort.Slice(commands, func(i, j int) bool {
+		if commands[i].Collection != commands[j].Collection {
+			return commands[i].Collection < commands[j].Collection
+		}
+		return commands[i].Operation < commands[j].Operation
+	})
+
+	return Stats{Pool: m.pool, Commands: commands}
+}
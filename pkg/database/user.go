@@ -1,10 +1,194 @@
 package database
 
-import "go.mongodb.org/mongo-driver/bson/primitive"
+import (
+	"errors"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+var (
+	ErrUserNotFound = errors.New("user not found")
+	ErrUserExists   = errors.New("user already exists")
+)
 
 type User struct {
-	ID    primitive.ObjectID `bson:"_id,omitempty"` // MongoDB's _id field
-	Name  string             `bson:"name" json:"name"`
-	Email string             `bson:"email" json:"email"`
-	Bio   *string            `bson:"bio" json:"bio"`
+	ID    bson.ObjectID `bson:"_id,omitempty" json:"id"` // MongoDB's _id field
+	Name  string        `bson:"name" json:"name"`
+	Email string        `bson:"email" json:"email"`
+	Bio   *string       `bson:"bio" json:"bio"`
+
+	// Auth
+	Password string `bson:"password" json:"-"`
+
+	// Confirm
+	ConfirmSelector string `bson:"confirm_selector,omitempty" json:"-"`
+	ConfirmVerifier string `bson:"confirm_verifier,omitempty" json:"-"`
+	Confirmed       bool   `bson:"confirmed" json:"confirmed"`
+
+	// Lock
+	AttemptCount int       `bson:"attempt_count" json:"-"`
+	LastAttempt  time.Time `bson:"last_attempt,omitempty" json:"-"`
+	Locked       time.Time `bson:"locked,omitempty" json:"-"`
+
+	// Recover
+	RecoverSelector    string    `bson:"recover_selector,omitempty" json:"-"`
+	RecoverVerifier    string    `bson:"recover_verifier,omitempty" json:"-"`
+	RecoverTokenExpiry time.Time `bson:"recover_token_expiry,omitempty" json:"-"`
+
+	// OAuth2
+	OAuth2UID          string    `bson:"oauth2_uid,omitempty" json:"-"`
+	OAuth2Provider     string    `bson:"oauth2_provider,omitempty" json:"-"`
+	OAuth2AccessToken  string    `bson:"oauth2_access_token,omitempty" json:"-"`
+	OAuth2RefreshToken string    `bson:"oauth2_refresh_token,omitempty" json:"-"`
+	OAuth2Expiry       time.Time `bson:"oauth2_expiry,omitempty" json:"-"`
+
+	// 2fa
+	TOTPSecretKey      string `bson:"totp_secret_key,omitempty" json:"-"`
+	SMSPhoneNumber     string `bson:"sms_phone_number,omitempty" json:"-"`
+	SMSSeedPhoneNumber string `bson:"sms_seed_phone_number,omitempty" json:"-"`
+	RecoveryCodes      string `bson:"recovery_codes,omitempty" json:"-"`
+}
+
+// The accessors below satisfy the authboss user interfaces. The e-mail
+// address doubles as the primary identifier (PID) for authboss.
+
+// PutPID into user
+func (u *User) PutPID(pid string) { u.Email = pid }
+
+// PutPassword into user
+func (u *User) PutPassword(password string) { u.Password = password }
+
+// PutEmail into user
+func (u *User) PutEmail(email string) { u.Email = email }
+
+// PutConfirmed into user
+func (u *User) PutConfirmed(confirmed bool) { u.Confirmed = confirmed }
+
+// PutConfirmSelector into user
+func (u *User) PutConfirmSelector(confirmSelector string) { u.ConfirmSelector = confirmSelector }
+
+// PutConfirmVerifier into user
+func (u *User) PutConfirmVerifier(confirmVerifier string) { u.ConfirmVerifier = confirmVerifier }
+
+// PutLocked into user
+func (u *User) PutLocked(locked time.Time) { u.Locked = locked }
+
+// PutAttemptCount into user
+func (u *User) PutAttemptCount(attempts int) { u.AttemptCount = attempts }
+
+// PutLastAttempt into user
+func (u *User) PutLastAttempt(last time.Time) { u.LastAttempt = last }
+
+// PutOAuth2UID into user
+func (u *User) PutOAuth2UID(uid string) { u.OAuth2UID = uid }
+
+// PutOAuth2Provider into user
+func (u *User) PutOAuth2Provider(provider string) { u.OAuth2Provider = provider }
+
+// PutOAuth2AccessToken into user
+func (u *User) PutOAuth2AccessToken(token string) { u.OAuth2AccessToken = token }
+
+// PutOAuth2RefreshToken into user
+func (u *User) PutOAuth2RefreshToken(refreshToken string) { u.OAuth2RefreshToken = refreshToken }
+
+// PutOAuth2Expiry into user
+func (u *User) PutOAuth2Expiry(expiry time.Time) { u.OAuth2Expiry = expiry }
+
+// PutRecoverSelector into user
+func (u *User) PutRecoverSelector(token string) { u.RecoverSelector = token }
+
+// PutRecoverVerifier into user
+func (u *User) PutRecoverVerifier(token string) { u.RecoverVerifier = token }
+
+// PutRecoverExpiry into user
+func (u *User) PutRecoverExpiry(expiry time.Time) { u.RecoverTokenExpiry = expiry }
+
+// PutTOTPSecretKey into user
+func (u *User) PutTOTPSecretKey(key string) { u.TOTPSecretKey = key }
+
+// PutSMSPhoneNumber into user
+func (u *User) PutSMSPhoneNumber(key string) { u.SMSPhoneNumber = key }
+
+// PutRecoveryCodes into user
+func (u *User) PutRecoveryCodes(key string) { u.RecoveryCodes = key }
+
+// PutArbitrary into user
+func (u *User) PutArbitrary(values map[string]string) {
+	if n, ok := values["name"]; ok {
+		u.Name = n
+	}
+}
+
+// GetPID from user
+func (u User) GetPID() string { return u.Email }
+
+// GetPassword from user
+func (u User) GetPassword() string { return u.Password }
+
+// GetEmail from user
+func (u User) GetEmail() string { return u.Email }
+
+// GetConfirmed from user
+func (u User) GetConfirmed() bool { return u.Confirmed }
+
+// GetConfirmSelector from user
+func (u User) GetConfirmSelector() string { return u.ConfirmSelector }
+
+// GetConfirmVerifier from user
+func (u User) GetConfirmVerifier() string { return u.ConfirmVerifier }
+
+// GetLocked from user
+func (u User) GetLocked() time.Time { return u.Locked }
+
+// GetAttemptCount from user
+func (u User) GetAttemptCount() int { return u.AttemptCount }
+
+// GetLastAttempt from user
+func (u User) GetLastAttempt() time.Time { return u.LastAttempt }
+
+// GetRecoverSelector from user
+func (u User) GetRecoverSelector() string { return u.RecoverSelector }
+
+// GetRecoverVerifier from user
+func (u User) GetRecoverVerifier() string { return u.RecoverVerifier }
+
+// GetRecoverExpiry from user
+func (u User) GetRecoverExpiry() time.Time { return u.RecoverTokenExpiry }
+
+// IsOAuth2User returns true if the user was created with oauth2
+func (u User) IsOAuth2User() bool { return len(u.OAuth2UID) != 0 }
+
+// GetOAuth2UID from user
+func (u User) GetOAuth2UID() string { return u.OAuth2UID }
+
+// GetOAuth2Provider from user
+func (u User) GetOAuth2Provider() string { return u.OAuth2Provider }
+
+// GetOAuth2AccessToken from user
+func (u User) GetOAuth2AccessToken() string { return u.OAuth2AccessToken }
+
+// GetOAuth2RefreshToken from user
+func (u User) GetOAuth2RefreshToken() string { return u.OAuth2RefreshToken }
+
+// GetOAuth2Expiry from user
+func (u User) GetOAuth2Expiry() time.Time { return u.OAuth2Expiry }
+
+// GetTOTPSecretKey from user
+func (u User) GetTOTPSecretKey() string { return u.TOTPSecretKey }
+
+// GetSMSPhoneNumber from user
+func (u User) GetSMSPhoneNumber() string { return u.SMSPhoneNumber }
+
+// GetSMSPhoneNumberSeed from user
+func (u User) GetSMSPhoneNumberSeed() string { return u.SMSSeedPhoneNumber }
+
+// GetRecoveryCodes from user
+func (u User) GetRecoveryCodes() string { return u.RecoveryCodes }
+
+// GetArbitrary from user
+func (u User) GetArbitrary() map[string]string {
+	return map[string]string{
+		"name": u.Name,
+	}
 }
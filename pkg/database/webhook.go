@@ -0,0 +1,74 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook subscription not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+)
+
+// Webhook delivery states.
+const (
+	WebhookPending   = "pending"
+	WebhookSucceeded = "succeeded"
+	WebhookFailed    = "failed"
+)
+
+// WebhookSubscription is an endpoint that receives the events it subscribed
+// to. Endpoints that keep failing are disabled automatically.
+type WebhookSubscription struct {
+	ID          string   `bson:"_id" json:"id"`
+	URL         string   `bson:"url" json:"url"`
+	Secret      string   `bson:"secret" json:"-"`
+	Events      []string `bson:"events" json:"events"`
+	Description string   `bson:"description,omitempty" json:"description,omitempty"`
+	Active      bool     `bson:"active" json:"active"`
+	CreatedBy   string   `bson:"created_by,omitempty" json:"created_by,omitempty"`
+	// ConsecutiveFailures counts failed attempts since the last successful
+	// one, across deliveries.
+	ConsecutiveFailures int        `bson:"consecutive_failures" json:"consecutive_failures"`
+	DisabledAt          *time.Time `bson:"disabled_at,omitempty" json:"disabled_at,omitempty"`
+	DisabledReason      string     `bson:"disabled_reason,omitempty" json:"disabled_reason,omitempty"`
+	CreatedAt           time.Time  `bson:"created_at" json:"created_at"`
+	UpdatedAt           time.Time  `bson:"updated_at" json:"updated_at"`
+}
+
+// Subscribes reports whether the subscription wants events named name.
+func (s *WebhookSubscription) Subscribes(name string) bool {
+	for _, e := range s.Events {
+		if e == name || e == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookAttempt is one try at delivering a webhook.
+type WebhookAttempt struct {
+	At         time.Time     `bson:"at" json:"at"`
+	StatusCode int           `bson:"status_code,omitempty" json:"status_code,omitempty"`
+	Error      string        `bson:"error,omitempty" json:"error,omitempty"`
+	Duration   time.Duration `bson:"duration" json:"duration"`
+}
+
+// WebhookDelivery is an event queued for, or delivered to, one
+// subscription, along with the log of its attempts.
+type WebhookDelivery struct {
+	ID             string `bson:"_id" json:"id"`
+	SubscriptionID string `bson:"subscription_id" json:"subscription_id"`
+	EventID        string `bson:"event_id" json:"event_id"`
+	EventName      string `bson:"event_name" json:"event_name"`
+	Payload        string `bson:"payload" json:"payload"`
+	Status         string `bson:"status" json:"status"`
+	// Attempt counts the attempts since the delivery was queued or last
+	// replayed; Attempts logs the most recent ones.
+	Attempt       int              `bson:"attempt" json:"attempt"`
+	Attempts      []WebhookAttempt `bson:"attempts" json:"attempts"`
+	NextAttemptAt time.Time        `bson:"next_attempt_at" json:"next_attempt_at"`
+	LockedUntil   time.Time        `bson:"locked_until" json:"-"`
+	CreatedAt     time.Time        `bson:"created_at" json:"created_at"`
+	DeliveredAt   *time.Time       `bson:"delivered_at,omitempty" json:"delivered_at,omitempty"`
+}
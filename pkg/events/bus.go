@@ -0,0 +1,275 @@
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"sambhav/pkg/database"
+)
+
+const (
+	defaultWorkers   = 4
+	defaultQueueSize = 256
+)
+
+// ErrClosed is returned when publishing to a closed bus.
+var ErrClosed = errors.New("events: bus closed")
+
+// Handler handles a published message.
+type Handler func(ctx context.Context, msg Message) error
+
+// Publisher publishes events. It is the interface producers should depend
+// on.
+type Publisher interface {
+	Publish(ctx context.Context, e Event) error
+}
+
+// OutboxStore persists events until they have been delivered.
+type OutboxStore interface {
+	AddOutboxEvent(ctx context.Context, event *database.OutboxEvent) error
+	ClaimOutboxEvents(ctx context.Context, limit int, lease time.Duration) ([]*database.OutboxEvent, error)
+	MarkOutboxEventDelivered(ctx context.Context, id string) error
+	MarkOutboxEventFailed(ctx context.Context, id string, nextAttempt time.Time, lastErr string) error
+	CountPendingOutboxEvents(ctx context.Context) (int64, error)
+}
+
+type subscription struct {
+	name    string
+	handler Handler
+}
+
+func (s subscription) matches(name string) bool {
+	return s.name == "" || s.name == name
+}
+
+type queued struct {
+	ctx context.Context
+	msg Message
+}
+
+// Option configures a Bus.
+type Option func(*Bus)
+
+// WithOutbox hands events for asynchronous subscribers to store instead of
+// an in-memory queue. A Relay delivers them from there, retrying until every
+// asynchronous subscriber succeeded.
+func WithOutbox(store OutboxStore) Option {
+	return func(b *Bus) {
+		b.outbox = store
+	}
+}
+
+// WithWorkers sets how many goroutines run asynchronous subscribers when no
+// outbox is used.
+func WithWorkers(n int) Option {
+	return func(b *Bus) {
+		b.workers = n
+	}
+}
+
+// Bus dispatches published events to subscribers. Synchronous subscribers
+// run before Publish returns and their errors are returned to the
+// publisher. Asynchronous subscribers run later, from an in-memory queue or
+// from the outbox, and their errors are only logged (or retried, with an
+// outbox).
+type Bus struct {
+	logger  *slog.Logger
+	outbox  OutboxStore
+	workers int
+
+	mu     sync.RWMutex
+	sync   []subscription
+	async  []subscription
+	closed bool
+
+	queue chan queued
+	wg    sync.WaitGroup
+}
+
+// New creates a bus and starts its workers.
+func New(logger *slog.Logger, opts ...Option) *Bus {
+	b := &Bus{logger: logger, workers: defaultWorkers}
+	for _, opt := range opts {
+		opt(b)
+	}
+
+	if b.outbox == nil {
+		b.queue = make(chan queued, defaultQueueSize)
+		for i := 0; i < b.workers; i++ {
+			b.wg.Add(1)
+			go b.work()
+		}
+	}
+
+	return b
+}
+
+// Subscribe runs h synchronously for every event named name, or for every
+// event when name is empty.
+func (b *Bus) Subscribe(name string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sync = append(b.sync, subscription{name: name, handler: h})
+}
+
+// SubscribeAsync runs h asynchronously for every event named name, or for
+// every event when name is empty.
+func (b *Bus) SubscribeAsync(name string, h Handler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.async = append(b.async, subscription{name: name, handler: h})
+}
+
+// Subscribe runs h synchronously for every event of type E.
+func Subscribe[E Event](b *Bus, h func(ctx context.Context, e E) error) {
+	var e E
+	b.Subscribe(e.EventName(), typed(h))
+}
+
+// SubscribeAsync runs h asynchronously for every event of type E.
+func SubscribeAsync[E Event](b *Bus, h func(ctx context.Context, e E) error) {
+	var e E
+	b.SubscribeAsync(e.EventName(), typed(h))
+}
+
+func typed[E Event](h func(ctx context.Context, e E) error) Handler {
+	return func(ctx context.Context, msg Message) error {
+		e, ok := msg.Event.(E)
+		if !ok {
+			return fmt.Errorf("events: unexpected event type %T", msg.Event)
+		}
+		return h(ctx, e)
+	}
+}
+
+// Publish dispatches e to the synchronous subscribers and queues it for the
+// asynchronous ones. With an outbox, the event is written with ctx, so it
+// joins any transaction ctx carries and is only delivered if that
+// transaction commits.
+func (b *Bus) Publish(ctx context.Context, e Event) error {
+	msg := Message{ID: newMessageID(), Name: e.EventName(), OccurredAt: time.Now().UTC(), Event: e}
+
+	b.mu.RLock()
+	closed := b.closed
+	syncSubs := b.sync
+	b.mu.RUnlock()
+	if closed {
+		return ErrClosed
+	}
+
+	var errs []error
+	for _, s := range syncSubs {
+		if !s.matches(msg.Name) {
+			continue
+		}
+		if err := s.handler(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := b.enqueue(ctx, msg); err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Deliver runs the asynchronous subscribers of msg in turn and returns their
+// errors. It is called by the workers and by the outbox relay.
+func (b *Bus) Deliver(ctx context.Context, msg Message) error {
+	b.mu.RLock()
+	asyncSubs := b.async
+	b.mu.RUnlock()
+
+	var errs []error
+	for _, s := range asyncSubs {
+		if !s.matches(msg.Name) {
+			continue
+		}
+		if err := s.handler(ctx, msg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close stops accepting events and waits for queued ones to be handled,
+// until ctx is done.
+func (b *Bus) Close(ctx context.Context) error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	if b.queue != nil {
+		close(b.queue)
+	}
+	b.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *Bus) enqueue(ctx context.Context, msg Message) error {
+	if b.outbox != nil {
+		payload, err := json.Marshal(msg.Event)
+		if err != nil {
+			return fmt.Errorf("events: failed to encode %q: %w", msg.Name, err)
+		}
+		return b.outbox.AddOutboxEvent(ctx, &database.OutboxEvent{
+			ID:            msg.ID,
+			Name:          msg.Name,
+			Payload:       string(payload),
+			OccurredAt:    msg.OccurredAt,
+			NextAttemptAt: msg.OccurredAt,
+		})
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if b.closed {
+		return ErrClosed
+	}
+
+	// Asynchronous subscribers keep the values of the publisher's context,
+	// such as the request and trace IDs, but not its cancellation.
+	select {
+	case b.queue <- queued{ctx: context.WithoutCancel(ctx), msg: msg}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *Bus) work() {
+	defer b.wg.Done()
+	for q := range b.queue {
+		if err := b.Deliver(q.ctx, q.msg); err != nil {
+			b.logger.ErrorContext(q.ctx, "event subscriber failed", "event", q.msg.Name, "event_id", q.msg.ID, "error", err)
+		}
+	}
+}
+
+func newMessageID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,113 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+const (
+	defaultRelayInterval = time.Second
+	defaultRelayBatch    = 50
+	// relayLease is how long a relay owns the events it claimed. An event
+	// whose delivery takes longer may be picked up by another relay.
+	relayLease      = time.Minute
+	relayMinBackoff = time.Second
+	relayMaxBackoff = time.Hour
+)
+
+// Relay delivers events from an outbox to the asynchronous subscribers of a
+// bus. Several relays may share an outbox; each event is claimed by one of
+// them at a time. An event is retried with exponential backoff until every
+// asynchronous subscriber handled it, so subscribers must tolerate
+// duplicates.
+type Relay struct {
+	bus      *Bus
+	store    OutboxStore
+	logger   *slog.Logger
+	interval time.Duration
+}
+
+// NewRelay creates a relay polling store every interval. A zero interval
+// polls every second.
+func NewRelay(bus *Bus, store OutboxStore, logger *slog.Logger, interval time.Duration) *Relay {
+	if interval <= 0 {
+		interval = defaultRelayInterval
+	}
+	return &Relay{bus: bus, store: store, logger: logger, interval: interval}
+}
+
+// Run delivers pending events until ctx is done.
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		// Keep going while full batches come back, so that a backlog is
+		// drained without waiting for the ticker.
+		for {
+			n, err := r.Flush(ctx)
+			if err != nil {
+				r.logger.ErrorContext(ctx, "failed to read outbox", "error", err)
+			}
+			if err != nil || n < defaultRelayBatch {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Flush claims one batch of due events and delivers them. It returns the
+// number of events claimed.
+func (r *Relay) Flush(ctx context.Context) (int, error) {
+	batch, err := r.store.ClaimOutboxEvents(ctx, defaultRelayBatch, relayLease)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, record := range batch {
+		e, err := Decode(record.Name, []byte(record.Payload))
+		if err == nil {
+			msg := Message{ID: record.ID, Name: record.Name, OccurredAt: record.OccurredAt, Event: e}
+			err = r.bus.Deliver(ctx, msg)
+		}
+
+		if err != nil {
+			next := time.Now().Add(backoff(record.Attempts + 1))
+			r.logger.WarnContext(ctx, "event delivery failed",
+				"event", record.Name, "event_id", record.ID, "attempt", record.Attempts+1, "retry_at", next, "error", err)
+			if markErr := r.store.MarkOutboxEventFailed(ctx, record.ID, next, err.Error()); markErr != nil {
+				return len(batch), markErr
+			}
+			continue
+		}
+
+		if err := r.store.MarkOutboxEventDelivered(ctx, record.ID); err != nil {
+			return len(batch), err
+		}
+	}
+
+	return len(batch), nil
+}
+
+// Pending returns the number of events waiting for delivery, for use as
+// health check details.
+func (r *Relay) Pending(ctx context.Context) (int64, error) {
+	return r.store.CountPendingOutboxEvents(ctx)
+}
+
+// backoff doubles the delay before each retry, starting at one second and
+// capped at an hour.
+func backoff(attempt int) time.Duration {
+	d := relayMinBackoff
+	for i := 1; i < attempt && d < relayMaxBackoff; i++ {
+		d *= 2
+	}
+	return min(d, relayMaxBackoff)
+}
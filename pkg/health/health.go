@@ -0,0 +1,202 @@
+package health
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultTimeout  = 2 * time.Second
+	defaultCacheTTL = 2 * time.Second
+)
+
+// Status of a single check or of a whole report.
+type Status string
+
+const (
+	StatusUp       Status = "up"
+	StatusDegraded Status = "degraded"
+	StatusDown     Status = "down"
+)
+
+// CheckFunc reports whether a dependency is healthy. It should honour ctx,
+// which carries the check's timeout.
+type CheckFunc func(ctx context.Context) error
+
+// CheckOption customises a registered check.
+type CheckOption func(*check)
+
+// WithTimeout bounds how long the check may run before it is reported down.
+func WithTimeout(d time.Duration) CheckOption {
+	return func(c *check) { c.timeout = d }
+}
+
+// WithCacheTTL controls how long a result is reused before the check runs
+// again. Probes hitting the endpoints often then do not hammer dependencies.
+func WithCacheTTL(d time.Duration) CheckOption {
+	return func(c *check) { c.cacheTTL = d }
+}
+
+// WithDetails attaches the value returned by fn to every result of the
+// check, eg. connection pool statistics.
+func WithDetails(fn func() any) CheckOption {
+	return func(c *check) { c.details = fn }
+}
+
+// NonCritical marks a check whose failure degrades the service without
+// making it unready.
+func NonCritical() CheckOption {
+	return func(c *check) { c.critical = false }
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Status    Status    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	Latency   string    `json:"latency"`
+	Critical  bool      `json:"critical"`
+	CheckedAt time.Time `json:"checked_at"`
+	Details   any       `json:"details,omitempty"`
+}
+
+// Report is the outcome of every registered check.
+type Report struct {
+	Status Status            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+type check struct {
+	name     string
+	fn       CheckFunc
+	timeout  time.Duration
+	cacheTTL time.Duration
+	critical bool
+	details  func() any
+
+	mu     sync.Mutex
+	last   Result
+	expiry time.Time
+}
+
+// Registry holds the health checks of the application's dependencies.
+type Registry struct {
+	mu     sync.RWMutex
+	checks []*check
+	ready  atomic.Bool
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// SetReady marks the service as ready to receive traffic or not, whatever
+// its checks report. A registry starts not ready, so that traffic is only
+// routed once everything has started, and is set not ready again before
+// the service drains on shutdown.
+func (r *Registry) SetReady(ready bool) {
+	r.ready.Store(ready)
+}
+
+// Ready reports whether the service was marked ready with SetReady.
+func (r *Registry) Ready() bool {
+	return r.ready.Load()
+}
+
+// Register adds a check under name. Checks are critical by default.
+func (r *Registry) Register(name string, fn CheckFunc, opts ...CheckOption) {
+	c := &check{
+		name:     name,
+		fn:       fn,
+		timeout:  defaultTimeout,
+		cacheTTL: defaultCacheTTL,
+		critical: true,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.checks = append(r.checks, c)
+	sort.Slice(r.checks, func(i, j int) bool { return r.checks[i].name < r.checks[j].name })
+}
+
+// Run executes every check concurrently, reusing cached results that are
+// still fresh. The report is down when a critical check fails and degraded
+// when only non-critical checks do.
+func (r *Registry) Run(ctx context.Context) Report {
+	r.mu.RLock()
+	checks := append([]*check(nil), r.checks...)
+	r.mu.RUnlock()
+
+	results := make([]Result, len(checks))
+	var wg sync.WaitGroup
+	for i, c := range checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = c.run(ctx)
+		}()
+	}
+	wg.Wait()
+
+	report := Report{Status: StatusUp, Checks: make(map[string]Result, len(checks))}
+	for i, c := range checks {
+		res := results[i]
+		report.Checks[c.name] = res
+		if res.Status == StatusUp {
+			continue
+		}
+		if res.Critical {
+			report.Status = StatusDown
+		} else if report.Status == StatusUp {
+			report.Status = StatusDegraded
+		}
+	}
+
+	return report
+}
+
+func (c *check) run(ctx context.Context) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if now.Before(c.expiry) {
+		return c.last
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+
+	errc := make(chan error, 1)
+	go func() { errc <- c.fn(ctx) }()
+
+	var err error
+	select {
+	case err = <-errc:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	res := Result{
+		Status:    StatusUp,
+		Latency:   time.Since(now).String(),
+		Critical:  c.critical,
+		CheckedAt: now.UTC(),
+	}
+	if err != nil {
+		res.Status = StatusDown
+		res.Error = err.Error()
+	}
+	if c.details != nil {
+		res.Details = c.details()
+	}
+
+	c.last = res
+	c.expiry = now.Add(c.cacheTTL)
+	return res
+}
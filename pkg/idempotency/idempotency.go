@@ -0,0 +1,258 @@
+// Package idempotency makes retried requests safe: a request sent with an
+// Idempotency-Key header is handled once, and its retries get the response
+// of the first one.
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	abpkg "sambhav/pkg/authboss"
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// Header carries the idempotency key chosen by the client.
+	Header = "Idempotency-Key"
+	// ReplayedHeader is set on responses replayed from a previous request.
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// maxKeyLength bounds the keys clients may send.
+	maxKeyLength = 255
+	// maxResponseSize bounds the responses that are stored. Requests with
+	// larger responses can be retried instead of replayed.
+	maxResponseSize = 256 << 10
+)
+
+// Store persists the records of idempotency keys.
+type Store interface {
+	// ReserveIdempotencyKey stores record unless a live record with the
+	// same ID exists, and returns that record instead.
+	ReserveIdempotencyKey(ctx context.Context, record *database.IdempotencyRecord) (*database.IdempotencyRecord, error)
+	SaveIdempotencyResponse(ctx context.Context, record *database.IdempotencyRecord) error
+	DeleteIdempotencyKey(ctx context.Context, record *database.IdempotencyRecord) error
+}
+
+// Config sets how long records are kept.
+type Config struct {
+	// TTL is how long a response is replayed for.
+	TTL time.Duration
+	// LockTimeout is how long a request may take before it is presumed
+	// lost and a retry is handled in its place. It must be longer than
+	// the write timeout of the server.
+	LockTimeout time.Duration
+	// Secret keys the fingerprints of requests, which would otherwise
+	// reveal guessable bodies such as passwords.
+	Secret []byte
+}
+
+type Idempotency struct {
+	store  Store
+	cfg    Config
+	logger *slog.Logger
+}
+
+func New(store Store, cfg Config, logger *slog.Logger) *Idempotency {
+	return &Idempotency{store: store, cfg: cfg, logger: logger}
+}
+
+// Middleware handles the requests carrying an Idempotency-Key header once
+// per key, client and route, clients being the authenticated user or else
+// the client IP:
+//   - a retry gets the response of the first request, with the
+//     Idempotent-Replayed header
+//   - a retry sent while the first request is still being handled gets
+//     409 Conflict
+//   - a key reused for a request with a different body gets 422
+//
+// Server errors are not stored, so that requests failing with one can be
+// retried. Cookies are not stored either, as they may carry credentials, so
+// a replayed login does not sign the client in again. Requests without the
+// header are handled as usual. It must run after the body is limited, as
+// the body is read to fingerprint the request.
+func (i *Idempotency) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(Header)
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxKeyLength || !printable(key) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid Idempotency-Key header"})
+			return
+		}
+
+		requestHash, err := fingerprint(i.cfg.Secret, c.Request)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+
+		ctx := c.Request.Context()
+		now := time.Now().UTC()
+		record := &database.IdempotencyRecord{
+			ID:          recordID(key, client(c), c.Request.Method+" "+c.FullPath()),
+			RequestHash: requestHash,
+			CreatedAt:   now,
+			LockedUntil: now.Add(i.cfg.LockTimeout),
+			ExpiresAt:   now.Add(i.cfg.TTL),
+		}
+		existing, err := i.store.ReserveIdempotencyKey(ctx, record)
+		if err != nil {
+			i.logger.ErrorContext(ctx, "failed to reserve idempotency key", "error", err)
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to process Idempotency-Key"})
+			return
+		}
+		if existing != nil {
+			replay(c, existing, requestHash)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: c.Writer}
+		c.Writer = rec
+		before := c.Writer.Header().Clone()
+		completed := false
+		defer func() {
+			// the request panicked or its response was not stored, let a
+			// retry handle it again
+			if !completed {
+				if err := i.store.DeleteIdempotencyKey(context.WithoutCancel(ctx), record); err != nil {
+					i.logger.ErrorContext(ctx, "failed to release idempotency key", "error", err)
+				}
+			}
+		}()
+
+		c.Next()
+		c.Writer = rec.ResponseWriter
+
+		status := rec.Status()
+		if status >= http.StatusInternalServerError || rec.overflow {
+			return
+		}
+		record.Completed = true
+		record.StatusCode = status
+		record.Header = handlerHeaders(before, rec.Header())
+		record.Body = rec.body.Bytes()
+		if err := i.store.SaveIdempotencyResponse(context.WithoutCancel(ctx), record); err != nil {
+			i.logger.ErrorContext(ctx, "failed to save idempotent response", "error", err)
+			return
+		}
+		completed = true
+	}
+}
+
+// replay answers a request whose key has a record.
+func replay(c *gin.Context, record *database.IdempotencyRecord, requestHash string) {
+	switch {
+	case record.RequestHash != requestHash:
+		c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was used for a different request"})
+	case !record.Completed:
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "A request with this Idempotency-Key is in progress"})
+	default:
+		h := c.Writer.Header()
+		for name, values := range record.Header {
+			h[name] = values
+		}
+		h.Set(ReplayedHeader, "true")
+		c.Status(record.StatusCode)
+		_, _ = c.Writer.Write(record.Body)
+		c.Abort()
+	}
+}
+
+// recorder keeps a copy of the response body as it is written.
+type recorder struct {
+	gin.ResponseWriter
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (r *recorder) Write(b []byte) (int, error) {
+	r.capture(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *recorder) WriteString(s string) (int, error) {
+	r.capture([]byte(s))
+	return r.ResponseWriter.WriteString(s)
+}
+
+func (r *recorder) capture(b []byte) {
+	if r.overflow {
+		return
+	}
+	if r.body.Len()+len(b) > maxResponseSize {
+		r.overflow = true
+		r.body.Reset()
+		return
+	}
+	r.body.Write(b)
+}
+
+// handlerHeaders returns the headers of after that were added or changed
+// since before, leaving out those set by the middleware in front of the
+// handler, such as the request ID and rate limit headers, which must be
+// fresh on a replay. Cookies are left out, as they may carry credentials.
+func handlerHeaders(before, after http.Header) map[string][]string {
+	headers := make(map[string][]string)
+	for name, values := range after {
+		if name == "Set-Cookie" {
+			continue
+		}
+		if !slices.Equal(before[name], values) {
+			headers[name] = values
+		}
+	}
+	return headers
+}
+
+// fingerprint computes the HMAC of the method, path and body of r keyed
+// with secret, leaving the body for the handler to read.
+func fingerprint(secret []byte, r *http.Request) (string, error) {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\x00"))
+	if r.Body != nil && r.Body != http.NoBody {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		h.Write(body)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// recordID identifies the record of key for a client and route.
+func recordID(key, client, route string) string {
+	sum := sha256.Sum256([]byte(key + "\x00" + client + "\x00" + route))
+	return hex.EncodeToString(sum[:])
+}
+
+// client tells apart the clients of c: by user once authenticated, and by
+// IP before, so that anonymous clients choosing the same key do not get
+// each other's responses.
+func client(c *gin.Context) string {
+	if pid := c.GetString(abpkg.ContextKeyPID); pid != "" {
+		return "user:" + pid
+	}
+	return "ip:" + c.ClientIP()
+}
+
+func printable(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 || s[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,226 @@
+package idempotency
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"sambhav/pkg/database"
+
+	"github.com/gin-gonic/gin"
+)
+
+// memStore keeps idempotency records in memory, for tests only.
+type memStore struct {
+	mu      sync.Mutex
+	records map[string]database.IdempotencyRecord
+}
+
+func (s *memStore) ReserveIdempotencyKey(_ context.Context, record *database.IdempotencyRecord) (*database.IdempotencyRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := record.CreatedAt
+	if existing, ok := s.records[record.ID]; ok && now.Before(existing.ExpiresAt) && (existing.Completed || now.Before(existing.LockedUntil)) {
+		return &existing, nil
+	}
+	s.records[record.ID] = *record
+	return nil, nil
+}
+
+func (s *memStore) SaveIdempotencyResponse(_ context.Context, record *database.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[record.ID] = *record
+	return nil
+}
+
+func (s *memStore) DeleteIdempotencyKey(_ context.Context, record *database.IdempotencyRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, record.ID)
+	return nil
+}
+
+// server counts the requests its handlers serve. /items creates an item,
+// answering with its number, a header and a cookie; /fail fails with a
+// server error.
+type server struct {
+	router *gin.Engine
+	mu     sync.Mutex
+	served int
+	// block, when set, holds requests until it is closed, after telling
+	// started.
+	block   chan struct{}
+	started chan struct{}
+}
+
+func newServer() *server {
+	gin.SetMode(gin.TestMode)
+	s := &server{router: gin.New()}
+	i := New(&memStore{records: map[string]database.IdempotencyRecord{}}, Config{
+		TTL:         time.Hour,
+		LockTimeout: time.Minute,
+		Secret:      []byte("secret"),
+	}, slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	s.router.Use(i.Middleware())
+	s.router.POST("/items", func(c *gin.Context) {
+		n := s.serve()
+		c.Header("X-Item", strconv.Itoa(n))
+		c.SetCookie("session", "secret", 0, "/", "", false, true)
+		c.JSON(http.StatusCreated, gin.H{"item": n})
+	})
+	s.router.POST("/fail", func(c *gin.Context) {
+		s.serve()
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed"})
+	})
+	return s
+}
+
+func (s *server) serve() int {
+	if s.block != nil {
+		s.started <- struct{}{}
+		<-s.block
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.served++
+	return s.served
+}
+
+func (s *server) post(path, key, body, ip string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	req.Header.Set(Header, key)
+	req.RemoteAddr = ip + ":1234"
+	w := httptest.NewRecorder()
+	s.router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	const (
+		ip    = "192.0.2.1"
+		body  = `{"name":"widget"}`
+		first = `{"item":1}`
+	)
+	for _, tc := range []struct {
+		name string
+		// retry is sent after a first request to /items with key k, body
+		// and ip.
+		retry      func(s *server) *httptest.ResponseRecorder
+		wantStatus int
+		wantBody   string
+		replayed   bool
+		served     int
+	}{
+		{
+			name:       "retry is replayed",
+			retry:      func(s *server) *httptest.ResponseRecorder { return s.post("/items", "k", body, ip) },
+			wantStatus: http.StatusCreated,
+			wantBody:   first,
+			replayed:   true,
+			served:     1,
+		},
+		{
+			name:       "same key with a different body",
+			retry:      func(s *server) *httptest.ResponseRecorder { return s.post("/items", "k", `{"name":"gadget"}`, ip) },
+			wantStatus: http.StatusUnprocessableEntity,
+			served:     1,
+		},
+		{
+			name:       "another key",
+			retry:      func(s *server) *httptest.ResponseRecorder { return s.post("/items", "other", body, ip) },
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"item":2}`,
+			served:     2,
+		},
+		{
+			name:       "same key from another anonymous client",
+			retry:      func(s *server) *httptest.ResponseRecorder { return s.post("/items", "k", body, "198.51.100.7") },
+			wantStatus: http.StatusCreated,
+			wantBody:   `{"item":2}`,
+			served:     2,
+		},
+		{
+			name:       "invalid key",
+			retry:      func(s *server) *httptest.ResponseRecorder { return s.post("/items", "k\x01", body, ip) },
+			wantStatus: http.StatusBadRequest,
+			served:     1,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newServer()
+			if w := s.post("/items", "k", body, ip); w.Code != http.StatusCreated || w.Body.String() != first {
+				t.Fatalf("first request: got %d %s", w.Code, w.Body.String())
+			}
+
+			w := tc.retry(s)
+			if w.Code != tc.wantStatus {
+				t.Errorf("got status %d, want %d: %s", w.Code, tc.wantStatus, w.Body.String())
+			}
+			if tc.wantBody != "" && w.Body.String() != tc.wantBody {
+				t.Errorf("got body %s, want %s", w.Body.String(), tc.wantBody)
+			}
+			if replayed := w.Header().Get(ReplayedHeader) == "true"; replayed != tc.replayed {
+				t.Errorf("replayed %t, want %t", replayed, tc.replayed)
+			}
+			if tc.replayed {
+				if got := w.Header().Get("X-Item"); got != "1" {
+					t.Errorf("replayed X-Item %q, want 1", got)
+				}
+				if cookie := w.Header().Get("Set-Cookie"); cookie != "" {
+					t.Errorf("replayed a cookie: %s", cookie)
+				}
+			}
+			if s.served != tc.served {
+				t.Errorf("handler served %d requests, want %d", s.served, tc.served)
+			}
+		})
+	}
+}
+
+func TestServerErrorsAreNotReplayed(t *testing.T) {
+	s := newServer()
+	for range 2 {
+		if w := s.post("/fail", "k", "", "192.0.2.1"); w.Code != http.StatusInternalServerError || w.Header().Get(ReplayedHeader) != "" {
+			t.Fatalf("got %d, replayed %q", w.Code, w.Header().Get(ReplayedHeader))
+		}
+	}
+	if s.served != 2 {
+		t.Errorf("handler served %d requests, want 2", s.served)
+	}
+}
+
+func TestConcurrentRequestsWithOneKey(t *testing.T) {
+	s := newServer()
+	s.block, s.started = make(chan struct{}), make(chan struct{})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- s.post("/items", "k", "{}", "192.0.2.1") }()
+	<-s.started
+
+	// the first request is still being handled
+	for range 3 {
+		if w := s.post("/items", "k", "{}", "192.0.2.1"); w.Code != http.StatusConflict {
+			t.Errorf("in-flight retry: got %d, want %d", w.Code, http.StatusConflict)
+		}
+	}
+
+	close(s.block)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Fatalf("first request: got %d", w.Code)
+	}
+	if w := s.post("/items", "k", "{}", "192.0.2.1"); w.Code != http.StatusCreated || w.Header().Get(ReplayedHeader) != "true" {
+		t.Errorf("retry after completion: got %d, replayed %q", w.Code, w.Header().Get(ReplayedHeader))
+	}
+	if s.served != 1 {
+		t.Errorf("handler served %d requests, want 1", s.served)
+	}
+}
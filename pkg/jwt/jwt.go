@@ -0,0 +1,260 @@
+// Package jwt signs and verifies RS256 JSON Web Tokens and publishes the
+// keys they are verified with as a JSON Web Key Set.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+)
+
+// algorithm is the only signing algorithm supported, so that tokens
+// cannot pick a weaker one.
+const algorithm = "RS256"
+
+// minKeyBits is the smallest RSA key accepted.
+const minKeyBits = 2048
+
+// ErrInvalidToken is returned by Verify for tokens that are malformed, are
+// not signed by a known key or are of another type.
+var ErrInvalidToken = errors.New("jwt: invalid token")
+
+// Key is an RSA signing key. ID is its RFC 7638 thumbprint, which tokens
+// name as their kid.
+type Key struct {
+	ID      string
+	Private *rsa.PrivateKey
+}
+
+// GenerateKey returns a new random 2048 bit key.
+func GenerateKey() (Key, error) {
+	private, err := rsa.GenerateKey(rand.Reader, minKeyBits)
+	if err != nil {
+		return Key{}, err
+	}
+	return newKey(private), nil
+}
+
+// ParseKeys parses the PEM encoded RSA private keys in data, in PKCS #1 or
+// PKCS #8 form. Keys are ordered newest first: the first key signs new
+// tokens while the rest are only used for verifying, so an old key can stay
+// listed until every token it signed has expired.
+func ParseKeys(data []byte) ([]Key, error) {
+	var keys []Key
+	for i := 0; ; i++ {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		var private *rsa.PrivateKey
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			k, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", i, err)
+			}
+			private = k
+		case "PRIVATE KEY":
+			k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("key %d: %w", i, err)
+			}
+			rsaKey, ok := k.(*rsa.PrivateKey)
+			if !ok {
+				return nil, fmt.Errorf("key %d: not an RSA key", i)
+			}
+			private = rsaKey
+		default:
+			return nil, fmt.Errorf("key %d: unexpected PEM block %q", i, block.Type)
+		}
+		if private.N.BitLen() < minKeyBits {
+			return nil, fmt.Errorf("key %d: must be at least %d bits", i, minKeyBits)
+		}
+		keys = append(keys, newKey(private))
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("no PEM encoded keys found")
+	}
+	return keys, nil
+}
+
+// LoadKeyFile reads PEM encoded keys from path, newest first.
+func LoadKeyFile(path string) ([]Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ParseKeys(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return keys, nil
+}
+
+func newKey(private *rsa.PrivateKey) Key {
+	jwk := publicJWK(&private.PublicKey)
+	// the thumbprint hashes the required members in lexicographic order
+	thumbprint, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{jwk.E, jwk.Kty, jwk.N})
+	sum := sha256.Sum256(thumbprint)
+	return Key{ID: encode(sum[:]), Private: private}
+}
+
+// JWK is the public half of a signing key.
+type JWK struct {
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func publicJWK(public *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Use: "sig",
+		Alg: algorithm,
+		N:   encode(public.N.Bytes()),
+		E:   encode(big.NewInt(int64(public.E)).Bytes()),
+	}
+}
+
+// Signer signs tokens with the first of its keys and verifies them with
+// any of them.
+type Signer struct {
+	keys []Key
+}
+
+func NewSigner(keys []Key) (*Signer, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: at least one key is required")
+	}
+	return &Signer{keys: keys}, nil
+}
+
+type header struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// Sign returns claims, which must marshal to a JSON object, as a token of
+// type typ, eg. JWT or at+jwt.
+func (s *Signer) Sign(typ string, claims any) (string, error) {
+	key := s.keys[0]
+	h, err := json.Marshal(header{Alg: algorithm, Typ: typ, Kid: key.ID})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := encode(h) + "." + encode(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key.Private, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + encode(signature), nil
+}
+
+// Verify checks that token is of type typ and signed by one of the keys,
+// and decodes its claims into claims. It does not check any claim, such as
+// the expiry, which is left to the caller.
+func (s *Signer) Verify(token, typ string, claims any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+	rawHeader, err := decode(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil || h.Alg != algorithm || !sameType(h.Typ, typ) {
+		return ErrInvalidToken
+	}
+
+	var key *Key
+	for i := range s.keys {
+		if s.keys[i].ID == h.Kid {
+			key = &s.keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return ErrInvalidToken
+	}
+	signature, err := decode(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(&key.Private.PublicKey, crypto.SHA256, digest[:], signature) != nil {
+		return ErrInvalidToken
+	}
+
+	payload, err := decode(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	if err := dec.Decode(claims); err != nil {
+		return ErrInvalidToken
+	}
+	return nil
+}
+
+// JWKS returns the public keys tokens are verified with.
+func (s *Signer) JWKS() JWKS {
+	set := JWKS{Keys: make([]JWK, 0, len(s.keys))}
+	for _, key := range s.keys {
+		jwk := publicJWK(&key.Private.PublicKey)
+		jwk.Kid = key.ID
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+// sameType compares media types the way RFC 7515 allows them to be
+// written: case-insensitively, and with or without application/.
+func sameType(got, want string) bool {
+	trim := func(t string) string {
+		t = strings.ToLower(t)
+		return strings.TrimPrefix(t, "application/")
+	}
+	return trim(got) == trim(want)
+}
+
+func encode(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decode(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(s)
+}
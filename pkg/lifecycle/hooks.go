@@ -0,0 +1,85 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+)
+
+// Server returns a hook serving srv, over TLS when srv.TLSConfig is set.
+// The listener is opened on start, so that an address already in use fails
+// the start, and the server is shut down gracefully on stop: it stops
+// accepting connections and waits for the requests in flight to complete.
+// An error serving is reported with Fail.
+func (l *Lifecycle) Server(name string, srv *http.Server) Hook {
+	return Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			var lc net.ListenConfig
+			ln, err := lc.Listen(ctx, "tcp", srv.Addr)
+			if err != nil {
+				return err
+			}
+			l.logger.Info("server listening", "server", name, "addr", ln.Addr().String(), "tls", srv.TLSConfig != nil)
+			go func() {
+				serve := srv.Serve
+				if srv.TLSConfig != nil {
+					// the certificates come from srv.TLSConfig
+					serve = func(ln net.Listener) error { return srv.ServeTLS(ln, "", "") }
+				}
+				if err := serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+					l.Fail(name, err)
+				}
+			}()
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			if err := srv.Shutdown(ctx); err != nil {
+				// drop the connections still open
+				srv.Close()
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// Workers returns a hook running each of fns in its own goroutine until
+// stop, which cancels their context and waits for them to return.
+func Workers(name string, fns ...func(ctx context.Context)) Hook {
+	var (
+		wg     sync.WaitGroup
+		cancel context.CancelFunc
+	)
+	return Hook{
+		Name: name,
+		OnStart: func(ctx context.Context) error {
+			var workersCtx context.Context
+			workersCtx, cancel = context.WithCancel(context.WithoutCancel(ctx))
+			for _, fn := range fns {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					fn(workersCtx)
+				}()
+			}
+			return nil
+		},
+		OnStop: func(ctx context.Context) error {
+			cancel()
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		},
+	}
+}
@@ -0,0 +1,160 @@
+// Package lifecycle starts and stops the components of the application in
+// order: components are started in the order they were appended and
+// stopped in reverse, so that a component is only stopped once everything
+// that depends on it has been.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const defaultStopTimeout = 30 * time.Second
+
+// ErrStopTimeout is returned by Stop when the components did not stop within
+// the stop timeout.
+var ErrStopTimeout = errors.New("lifecycle: stop timed out")
+
+// Hook starts and stops a component. Either function may be nil.
+type Hook struct {
+	Name string
+	// OnStart must return once the component is running; long running
+	// work belongs in a goroutine. A component that fails after it started
+	// reports it with Lifecycle.Fail.
+	OnStart func(ctx context.Context) error
+	// OnStop must honour ctx, which carries what is left of the stop
+	// timeout.
+	OnStop func(ctx context.Context) error
+}
+
+// Option configures a Lifecycle.
+type Option func(*Lifecycle)
+
+// WithStopTimeout bounds how long Stop waits for the components to stop.
+// The default is 30 seconds.
+func WithStopTimeout(d time.Duration) Option {
+	return func(l *Lifecycle) {
+		l.stopTimeout = d
+	}
+}
+
+// Lifecycle holds the hooks of the components of the application.
+type Lifecycle struct {
+	logger      *slog.Logger
+	stopTimeout time.Duration
+
+	mu      sync.Mutex
+	hooks   []Hook
+	started int
+
+	failed   chan struct{}
+	failOnce sync.Once
+	failName string
+	failErr  error
+}
+
+func New(logger *slog.Logger, opts ...Option) *Lifecycle {
+	l := &Lifecycle{
+		logger:      logger,
+		stopTimeout: defaultStopTimeout,
+		failed:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	return l
+}
+
+// Append adds a component. Components must be appended before Start.
+func (l *Lifecycle) Append(h Hook) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hooks = append(l.hooks, h)
+}
+
+// Start starts the components in order. When one fails to start, those
+// already started are stopped and the error is returned.
+func (l *Lifecycle) Start(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, h := range l.hooks[l.started:] {
+		if h.OnStart != nil {
+			l.logger.Debug("starting component", "component", h.Name)
+			if err := h.OnStart(ctx); err != nil {
+				err = fmt.Errorf("starting %s: %w", h.Name, err)
+				if stopErr := l.stop(context.WithoutCancel(ctx)); stopErr != nil {
+					err = errors.Join(err, stopErr)
+				}
+				return err
+			}
+		}
+		l.started++
+	}
+	return nil
+}
+
+// Wait blocks until SIGINT or SIGTERM is received, ctx is done or a
+// component fails, returning the failure in the latter case. Once it
+// returns, a second signal kills the process.
+func (l *Lifecycle) Wait(ctx context.Context) error {
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	select {
+	case <-ctx.Done():
+		l.logger.Info("shutting down gracefully, press Ctrl+C again to force")
+		return nil
+	case <-l.failed:
+		l.logger.Error("component failed, shutting down", "component", l.failName, "error", l.failErr)
+		return l.failErr
+	}
+}
+
+// Stop stops the started components in reverse order, within the stop
+// timeout. Every component is stopped even when some fail; their errors
+// are joined, along with ErrStopTimeout when the timeout was reached.
+func (l *Lifecycle) Stop(ctx context.Context) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stop(ctx)
+}
+
+func (l *Lifecycle) stop(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, l.stopTimeout)
+	defer cancel()
+
+	var errs []error
+	for ; l.started > 0; l.started-- {
+		h := l.hooks[l.started-1]
+		if h.OnStop == nil {
+			continue
+		}
+		l.logger.Debug("stopping component", "component", h.Name)
+		if err := h.OnStop(ctx); err != nil {
+			l.logger.Error("error stopping component", "component", h.Name, "error", err)
+			errs = append(errs, fmt.Errorf("stopping %s: %w", h.Name, err))
+		}
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		errs = append(errs, ErrStopTimeout)
+	}
+	return errors.Join(errs...)
+}
+
+// Fail reports that the running component name failed, which makes Wait
+// return. Only the first failure is kept.
+func (l *Lifecycle) Fail(name string, err error) {
+	l.failOnce.Do(func() {
+		l.failName = name
+		l.failErr = fmt.Errorf("%s: %w", name, err)
+		close(l.failed)
+	})
+}
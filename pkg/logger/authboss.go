@@ -0,0 +1,48 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+
+	"github.com/aarondl/authboss/v3"
+)
+
+// Authboss adapts a logger to the authboss logging interfaces. Records
+// written through a request or its context carry that request's IDs.
+type Authboss struct {
+	logger *slog.Logger
+	ctx    context.Context
+}
+
+var (
+	_ authboss.Logger        = (*Authboss)(nil)
+	_ authboss.ContextLogger = (*Authboss)(nil)
+	_ authboss.RequestLogger = (*Authboss)(nil)
+)
+
+// NewAuthboss wraps l for use as the authboss core logger.
+func NewAuthboss(l *slog.Logger) *Authboss {
+	return &Authboss{logger: l.With("component", "authboss"), ctx: context.Background()}
+}
+
+// Info logs msg at the info level.
+func (a *Authboss) Info(msg string) {
+	a.logger.InfoContext(a.ctx, msg)
+}
+
+// Error logs msg at the error level.
+func (a *Authboss) Error(msg string) {
+	a.logger.ErrorContext(a.ctx, msg)
+}
+
+// FromContext returns a logger that attaches ctx to its records.
+func (a *Authboss) FromContext(ctx context.Context) authboss.Logger {
+	return &Authboss{logger: a.logger, ctx: ctx}
+}
+
+// FromRequest returns a logger that attaches the request context to its
+// records.
+func (a *Authboss) FromRequest(r *http.Request) authboss.Logger {
+	return a.FromContext(r.Context())
+}
@@ -0,0 +1,77 @@
+// Package logger builds the structured logger used throughout the
+// application. Records are enriched with the request and trace IDs found in
+// their context, and emails, tokens and passwords are redacted before they
+// are written.
+package logger
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// Output formats.
+const (
+	FormatJSON = "json"
+	FormatText = "text"
+)
+
+// Config configures the level and format of a logger.
+type Config struct {
+	// Level is one of debug, info, warn or error.
+	Level string
+	// Format is FormatJSON or FormatText.
+	Format string
+	// LevelVar, when set, is set to Level and used as the minimum level,
+	// so that the level can be changed while the logger is in use.
+	LevelVar *slog.LevelVar
+}
+
+// New creates a logger writing to w.
+func New(w io.Writer, cfg Config) (*slog.Logger, error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	var leveler slog.Leveler = level
+	if cfg.LevelVar != nil {
+		cfg.LevelVar.Set(level)
+		leveler = cfg.LevelVar
+	}
+	opts := &slog.HandlerOptions{Level: leveler, ReplaceAttr: redactAttr}
+
+	var handler slog.Handler
+	switch cfg.Format {
+	case FormatJSON:
+		handler = slog.NewJSONHandler(w, opts)
+	case "", FormatText:
+		handler = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("logger: unknown format %q", cfg.Format)
+	}
+
+	return slog.New(&contextHandler{Handler: handler}), nil
+}
+
+// ParseLevel parses a level name. An empty name is the info level.
+func ParseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("logger: unknown level %q", name)
+}
+
+// Discard returns a logger that drops every record, for callers that were
+// not given one.
+func Discard() *slog.Logger {
+	return slog.New(slog.DiscardHandler)
+}
@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// sensitiveKeys are the substrings of attribute keys whose values are never
+// logged.
+var sensitiveKeys = []string{
+	"password",
+	"secret",
+	"token",
+	"authorization",
+	"cookie",
+	"api_key",
+	"apikey",
+	"recovery_code",
+}
+
+var emailPattern = regexp.MustCompile(`[A-Za-z0-9._%+\-]+@[A-Za-z0-9.\-]+\.[A-Za-z]{2,}`)
+
+// redactAttr hides the values of sensitive attributes and masks every email
+// address found in string or error values.
+func redactAttr(_ []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+	for _, s := range sensitiveKeys {
+		if strings.Contains(key, s) {
+			return slog.String(a.Key, redacted)
+		}
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, redactEmails(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, redactEmails(err.Error()))
+		}
+	}
+	return a
+}
+
+// redactEmails masks the local part of every email address in s, keeping its
+// first character and the domain so that logs stay useful for debugging.
+func redactEmails(s string) string {
+	if !strings.Contains(s, "@") {
+		return s
+	}
+	return emailPattern.ReplaceAllStringFunc(s, func(email string) string {
+		at := strings.LastIndexByte(email, '@')
+		return email[:1] + "***" + email[at:]
+	})
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"net/http"
+
+	abpkg "sambhav/pkg/authboss"
+
+	"github.com/aarondl/authboss/v3"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ObserveAuthboss counts logins, 2FA challenges, OAuth2 callbacks and
+// registrations handled by authboss. It must be called after the authboss
+// modules are initialised, so that the 2FA hijack hook it relies on runs
+// before its own.
+func (m *Metrics) ObserveAuthboss(events *authboss.Events) {
+	if m == nil {
+		return
+	}
+
+	events.After(authboss.EventAuth, countEvent(m.logins))
+	events.After(authboss.EventAuthFail, countEvent(m.loginFailures))
+	events.After(authboss.EventRegister, func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		m.UserRegistered("authboss")
+		return handled, nil
+	})
+
+	// The TOTP and SMS modules hijack the login before this hook runs and
+	// report it as handled when they ask the user for a second factor.
+	events.Before(authboss.EventAuthHijack, func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		if handled {
+			m.twoFactorChecks.Inc()
+		}
+		return handled, nil
+	})
+
+	events.After(authboss.EventOAuth2, m.countOAuth2("success"))
+	events.After(authboss.EventOAuth2Fail, m.countOAuth2("failure"))
+}
+
+func countEvent(counter prometheus.Counter) authboss.EventHandler {
+	return func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		counter.Inc()
+		return handled, nil
+	}
+}
+
+func (m *Metrics) countOAuth2(result string) authboss.EventHandler {
+	return func(w http.ResponseWriter, r *http.Request, handled bool) (bool, error) {
+		m.oauth2Callbacks.WithLabelValues(abpkg.OAuth2Provider(r), result).Inc()
+		return handled, nil
+	}
+}
@@ -0,0 +1,59 @@
+package metrics
+
+import (
+	"sambhav/pkg/database"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolCollector exports the connection pool statistics of a database,
+// read when the metrics are scraped.
+type poolCollector struct {
+	stats func() database.PoolStats
+
+	open             *prometheus.Desc
+	inUse            *prometheus.Desc
+	idle             *prometheus.Desc
+	waits            *prometheus.Desc
+	waitDuration     *prometheus.Desc
+	checkoutFailures *prometheus.Desc
+}
+
+// ObserveDatabasePool exports the connection pool statistics returned by
+// stats.
+func (m *Metrics) ObserveDatabasePool(stats func() database.PoolStats) {
+	if m == nil {
+		return
+	}
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(namespace, "db_pool", name), help, nil, nil)
+	}
+	m.registry.MustRegister(&poolCollector{
+		stats:            stats,
+		open:             desc("open_connections", "Open connections in the database pool."),
+		inUse:            desc("in_use_connections", "Database connections checked out of the pool."),
+		idle:             desc("idle_connections", "Idle connections in the database pool."),
+		waits:            desc("waits_total", "Connection requests that waited for a connection."),
+		waitDuration:     desc("wait_seconds_total", "Total time connection requests waited for a connection."),
+		checkoutFailures: desc("checkout_failures_total", "Connection requests the pool could not serve."),
+	})
+}
+
+func (c *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.open
+	ch <- c.inUse
+	ch <- c.idle
+	ch <- c.waits
+	ch <- c.waitDuration
+	ch <- c.checkoutFailures
+}
+
+func (c *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	s := c.stats()
+	ch <- prometheus.MustNewConstMetric(c.open, prometheus.GaugeValue, float64(s.Open))
+	ch <- prometheus.MustNewConstMetric(c.inUse, prometheus.GaugeValue, float64(s.InUse))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(s.Idle))
+	ch <- prometheus.MustNewConstMetric(c.waits, prometheus.CounterValue, float64(s.WaitCount))
+	ch <- prometheus.MustNewConstMetric(c.waitDuration, prometheus.CounterValue, s.WaitDuration.Seconds())
+	ch <- prometheus.MustNewConstMetric(c.checkoutFailures, prometheus.CounterValue, float64(s.CheckoutFailures))
+}
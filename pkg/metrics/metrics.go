@@ -0,0 +1,283 @@
+// Package metrics exposes application metrics in the Prometheus format.
+//
+// Metric names are part of the public interface of the service: dashboards
+// and alerts depend on them, so they must not be renamed. The full set is:
+//
+//	sambhav_http_requests_total{method,route,status}
+//	    HTTP requests served, by Gin route template.
+//	sambhav_http_request_errors_total{method,route}
+//	    HTTP requests that ended with a 5xx status.
+//	sambhav_http_request_duration_seconds{method,route}
+//	    Histogram of HTTP request latencies.
+//	sambhav_http_rate_limited_total{rule}
+//	    HTTP requests rejected for exceeding the quota of a rate limit rule.
+//	sambhav_auth_logins_total
+//	    Successful logins, including those completed with a second factor.
+//	sambhav_auth_login_failures_total
+//	    Login attempts rejected because of bad credentials.
+//	sambhav_auth_2fa_challenges_total
+//	    Logins that were held back to ask for a second factor.
+//	sambhav_auth_oauth2_callbacks_total{provider,result}
+//	    OAuth2 callbacks handled, with result "success" or "failure".
+//	sambhav_auth_saml_responses_total{tenant,result}
+//	    SAML responses of the identity providers of known tenants, with
+//	    result "success" or "failure".
+//	sambhav_oauth_tokens_issued_total{grant_type}
+//	    Tokens issued by the OAuth2 authorization server, by grant type.
+//	sambhav_user_registrations_total{source}
+//	    Users registered, with source "api", "authboss" or "saml".
+//	sambhav_db_pool_open_connections
+//	sambhav_db_pool_in_use_connections
+//	sambhav_db_pool_idle_connections
+//	    Connections of the database pool, by state.
+//	sambhav_db_pool_waits_total
+//	    Connection requests that waited for a connection to be created or
+//	    returned to the pool.
+//	sambhav_db_pool_wait_seconds_total
+//	    Total time connection requests waited for a connection.
+//	sambhav_db_pool_checkout_failures_total
+//	    Connection requests the pool could not serve.
+//	sambhav_config_reloads_total{result}
+//	    Configuration reloads, with result "success" or "failure".
+//	sambhav_config_last_reload_success_timestamp_seconds
+//	    Unix time of the last successful configuration reload.
+//
+// Go runtime (go_*) and process (process_*) metrics are exported as well.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "sambhav"
+
+// unmatchedRoute labels requests that did not match any route, so that
+// arbitrary paths cannot blow up the label cardinality.
+const unmatchedRoute = "unmatched"
+
+// Metrics holds the collectors of the application and the registry they are
+// exported from. A nil *Metrics is valid and records nothing.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpErrors   *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+	rateLimited  *prometheus.CounterVec
+
+	logins          prometheus.Counter
+	loginFailures   prometheus.Counter
+	twoFactorChecks prometheus.Counter
+	oauth2Callbacks *prometheus.CounterVec
+	samlResponses   *prometheus.CounterVec
+
+	oauthTokens *prometheus.CounterVec
+
+	registrations *prometheus.CounterVec
+
+	configReloads     *prometheus.CounterVec
+	configLastSuccess prometheus.Gauge
+}
+
+// New creates the application metrics on a registry of their own.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "requests_total",
+			Help:      "HTTP requests served, by route template.",
+		}, []string{"method", "route", "status"}),
+		httpErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_errors_total",
+			Help:      "HTTP requests that ended with a server error.",
+		}, []string{"method", "route"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "HTTP request latencies in seconds.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		rateLimited: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "rate_limited_total",
+			Help:      "HTTP requests rejected by a rate limit, by rule.",
+		}, []string{"rule"}),
+		logins: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "logins_total",
+			Help:      "Successful logins.",
+		}),
+		loginFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "login_failures_total",
+			Help:      "Login attempts rejected because of bad credentials.",
+		}),
+		twoFactorChecks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "2fa_challenges_total",
+			Help:      "Logins held back to ask for a second factor.",
+		}),
+		oauth2Callbacks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "oauth2_callbacks_total",
+			Help:      "OAuth2 callbacks handled, by provider and result.",
+		}, []string{"provider", "result"}),
+		samlResponses: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "auth",
+			Name:      "saml_responses_total",
+			Help:      "SAML responses handled, by tenant and result.",
+		}, []string{"tenant", "result"}),
+		oauthTokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "oauth",
+			Name:      "tokens_issued_total",
+			Help:      "Tokens issued by the authorization server, by grant type.",
+		}, []string{"grant_type"}),
+		registrations: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "user",
+			Name:      "registrations_total",
+			Help:      "Users registered, by source.",
+		}, []string{"source"}),
+		configReloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: "config",
+			Name:      "reloads_total",
+			Help:      "Configuration reloads, by result.",
+		}, []string{"result"}),
+		configLastSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: "config",
+			Name:      "last_reload_success_timestamp_seconds",
+			Help:      "Unix time of the last successful configuration reload.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpErrors,
+		m.httpDuration,
+		m.rateLimited,
+		m.logins,
+		m.loginFailures,
+		m.twoFactorChecks,
+		m.oauth2Callbacks,
+		m.samlResponses,
+		m.oauthTokens,
+		m.registrations,
+		m.configReloads,
+		m.configLastSuccess,
+	)
+
+	return m
+}
+
+// Registry returns the registry the metrics are exported from, so other
+// packages can add collectors of their own.
+func (m *Metrics) Registry() *prometheus.Registry {
+	return m.registry
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{Registry: m.registry})
+}
+
+// Middleware records the rate, errors and duration of the requests handled
+// by a Gin engine, labelled with the route template rather than the raw
+// path.
+func (m *Metrics) Middleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if m == nil {
+			c.Next()
+			return
+		}
+
+		start := time.Now()
+		c.Next()
+
+		route := c.FullPath()
+		if route == "" {
+			route = unmatchedRoute
+		}
+		method := c.Request.Method
+		status := c.Writer.Status()
+
+		m.httpRequests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+		m.httpDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+		if status >= http.StatusInternalServerError {
+			m.httpErrors.WithLabelValues(method, route).Inc()
+		}
+	}
+}
+
+// RateLimited counts a request rejected by the rate limit rule.
+func (m *Metrics) RateLimited(rule string) {
+	if m == nil {
+		return
+	}
+	m.rateLimited.WithLabelValues(rule).Inc()
+}
+
+// SAMLResponse counts a SAML response of the identity provider of tenant
+// that ended with err.
+func (m *Metrics) SAMLResponse(tenant string, err error) {
+	if m == nil {
+		return
+	}
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.samlResponses.WithLabelValues(tenant, result).Inc()
+}
+
+// OAuthTokenIssued counts a token response of the authorization server
+// for grantType.
+func (m *Metrics) OAuthTokenIssued(grantType string) {
+	if m == nil {
+		return
+	}
+	m.oauthTokens.WithLabelValues(grantType).Inc()
+}
+
+// UserRegistered counts a user registration coming from source.
+func (m *Metrics) UserRegistered(source string) {
+	if m == nil {
+		return
+	}
+	m.registrations.WithLabelValues(source).Inc()
+}
+
+// ConfigReloaded counts a configuration reload that ended with err.
+func (m *Metrics) ConfigReloaded(err error) {
+	if m == nil {
+		return
+	}
+	if err != nil {
+		m.configReloads.WithLabelValues("failure").Inc()
+		return
+	}
+	m.configReloads.WithLabelValues("success").Inc()
+	m.configLastSuccess.SetToCurrentTime()
+}
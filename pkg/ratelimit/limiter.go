@@ -0,0 +1,135 @@
+package ratelimit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	abpkg "sambhav/pkg/authboss"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Limiter applies named rules to requests. The rules can be replaced while
+// it is in use.
+type Limiter struct {
+	store    Store
+	logger   *slog.Logger
+	rules    atomic.Pointer[map[string]Rule]
+	onReject func(rule string)
+}
+
+func New(store Store, logger *slog.Logger) *Limiter {
+	return &Limiter{store: store, logger: logger}
+}
+
+// Update replaces the rules, or keeps the previous ones when one is
+// invalid. Rules that are missing or have no requests limit nothing.
+func (l *Limiter) Update(rules map[string]Rule) error {
+	for name, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("ratelimit: rule %s: %w", name, err)
+		}
+	}
+	l.rules.Store(&rules)
+	return nil
+}
+
+// OnReject registers fn to be called with the name of the rule whenever a
+// request is rejected.
+func (l *Limiter) OnReject(fn func(rule string)) {
+	l.onReject = fn
+}
+
+// Middleware applies the rule name to the requests it handles.
+func (l *Limiter) Middleware(name string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !l.Allow(c, name) {
+			return
+		}
+		c.Next()
+	}
+}
+
+// Allow checks the request against the rule name and sets the RateLimit
+// headers of the response. When the request is over quota, it aborts it
+// with 429 Too Many Requests and returns false.
+//
+// When the store fails, the request is let through: a rate limiter that
+// is down must not take the API down with it.
+func (l *Limiter) Allow(c *gin.Context, name string) bool {
+	var rule Rule
+	if rules := l.rules.Load(); rules != nil {
+		rule = (*rules)[name]
+	}
+	// preflights are answered by the CORS middleware and cost nothing
+	if !rule.enabled() || c.Request.Method == http.MethodOptions {
+		return true
+	}
+
+	ctx := c.Request.Context()
+	res, err := take(ctx, l.store, storeKey(name, rule, c), rule, time.Now())
+	if err != nil {
+		l.logger.ErrorContext(ctx, "rate limit check failed, allowing request", "rule", name, "error", err)
+		return true
+	}
+
+	setHeaders(c.Writer.Header(), rule, res)
+	if res.Allowed {
+		return true
+	}
+	if l.onReject != nil {
+		l.onReject(name)
+	}
+	c.Header("Retry-After", strconv.Itoa(int(res.RetryAfter.Seconds())))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": "Too many requests"})
+	return false
+}
+
+// setHeaders sets the RateLimit-Policy, RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, with the reset in
+// seconds. When several rules apply to a request, the headers describe the
+// one with the least remaining.
+func setHeaders(h http.Header, rule Rule, res Result) {
+	if prev := h.Get("RateLimit-Remaining"); prev != "" {
+		if n, err := strconv.Atoi(prev); err == nil && n < res.Remaining {
+			return
+		}
+	}
+	h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rule.Requests, int(rule.Period.Seconds())))
+	h.Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+	h.Set("RateLimit-Reset", strconv.Itoa(int(res.Reset.Seconds())))
+}
+
+// storeKey names the state of the client of c under the rule name. Client
+// identifiers are hashed so that the store holds no addresses, e-mails or
+// credentials.
+func storeKey(name string, rule Rule, c *gin.Context) string {
+	kind, id := clientKey(rule.Key, c)
+	sum := sha256.Sum256([]byte(kind + "\x00" + id))
+	return name + ":" + hex.EncodeToString(sum[:16])
+}
+
+// clientKey returns what the client of c is told apart by under key. Users
+// and API keys are only trusted once RequireAuth has authenticated them.
+func clientKey(key Key, c *gin.Context) (kind, id string) {
+	switch key {
+	case KeyUser:
+		if pid := c.GetString(abpkg.ContextKeyPID); pid != "" {
+			return "user", pid
+		}
+	case KeyAPIKey:
+		if _, ok := c.Get(abpkg.ContextKeyScopes); ok {
+			return "api_key", abpkg.APIKey(c.Request)
+		}
+	case KeyRoute:
+		return "route", c.Request.Method + " " + c.FullPath()
+	}
+	return "ip", c.ClientIP()
+}
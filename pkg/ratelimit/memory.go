@@ -0,0 +1,113 @@
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often the memory store forgets the state of clients
+// that have not been seen for long enough.
+const sweepInterval = time.Minute
+
+// MemoryStore keeps the state of the rules in memory. Each replica has its
+// own, so the quotas apply per replica.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens    float64
+	updatedAt time.Time
+	expiresAt time.Time
+}
+
+type window struct {
+	start     time.Time
+	previous  int
+	current   int
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		buckets: make(map[string]*bucket),
+		windows: make(map[string]*window),
+	}
+}
+
+// TakeToken implements Store.
+func (s *MemoryStore) TakeToken(_ context.Context, key string, rule Rule, now time.Time) (bool, float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	capacity := float64(rule.Capacity())
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, updatedAt: now}
+		s.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.updatedAt).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(capacity, b.tokens+elapsed*rule.Rate())
+		b.updatedAt = now
+	}
+
+	taken := b.tokens >= 1
+	if taken {
+		b.tokens--
+	}
+	// a full bucket is the same as none
+	b.expiresAt = now.Add(rule.FillTime())
+	return taken, b.tokens, nil
+}
+
+// CountRequest implements Store.
+func (s *MemoryStore) CountRequest(_ context.Context, key string, rule Rule, now time.Time) (bool, int, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sweep(now)
+
+	start := rule.Window(now)
+	w, ok := s.windows[key]
+	switch {
+	case !ok:
+		w = &window{start: start}
+		s.windows[key] = w
+	case w.start.Equal(start):
+	case w.start.Add(rule.Period).Equal(start):
+		w.start, w.previous, w.current = start, w.current, 0
+	default:
+		w.start, w.previous, w.current = start, 0, 0
+	}
+
+	counted := Estimate(rule, now, w.previous, w.current)+1 <= float64(rule.Requests)
+	if counted {
+		w.current++
+	}
+	// once the next window is over, the current one no longer counts
+	w.expiresAt = start.Add(2 * rule.Period)
+	return counted, w.previous, w.current, nil
+}
+
+// sweep forgets the expired state, at most once per sweepInterval.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if now.After(b.expiresAt) {
+			delete(s.buckets, key)
+		}
+	}
+	for key, w := range s.windows {
+		if now.After(w.expiresAt) {
+			delete(s.windows, key)
+		}
+	}
+}
@@ -0,0 +1,209 @@
+// Package ratelimit enforces request quotas, with the token bucket and
+// sliding window algorithms, on state kept in memory or in a store shared
+// by every replica.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Algorithm is the way a rule counts requests.
+type Algorithm string
+
+const (
+	// TokenBucket allows bursts of up to Burst requests, and refills at
+	// Requests per Period.
+	TokenBucket Algorithm = "token_bucket"
+	// SlidingWindow allows Requests over any Period, estimated from the
+	// counts of the current and previous fixed windows.
+	SlidingWindow Algorithm = "sliding_window"
+)
+
+// Key is what clients are told apart by.
+type Key string
+
+const (
+	KeyIP Key = "ip"
+	// KeyUser is the user authenticated by RequireAuth, or the IP for
+	// requests that were not authenticated before the rule applies.
+	KeyUser Key = "user"
+	// KeyAPIKey is the API key RequireAuth authenticated the request with,
+	// or the IP for requests that were not. Keys that were merely sent
+	// are not trusted, as a client could send a new one with every
+	// request.
+	KeyAPIKey Key = "api_key"
+	// KeyRoute shares the quota between every client of a route.
+	KeyRoute Key = "route"
+)
+
+// Rule is a quota of Requests per Period for every key.
+type Rule struct {
+	Requests  int
+	Period    time.Duration
+	Algorithm Algorithm
+	// Burst is the size of the token bucket, Requests when zero.
+	Burst int
+	Key   Key
+}
+
+// enabled reports whether the rule limits anything.
+func (r Rule) enabled() bool {
+	return r.Requests > 0
+}
+
+func (r Rule) validate() error {
+	if !r.enabled() {
+		return nil
+	}
+	// windows are counted in whole milliseconds
+	if r.Period < time.Millisecond {
+		return errors.New("period must be at least 1ms")
+	}
+	if r.Burst < 0 {
+		return errors.New("burst must not be negative")
+	}
+	switch r.Algorithm {
+	case TokenBucket, SlidingWindow:
+	default:
+		return fmt.Errorf("unknown algorithm %q", r.Algorithm)
+	}
+	switch r.Key {
+	case KeyIP, KeyUser, KeyAPIKey, KeyRoute:
+	default:
+		return fmt.Errorf("unknown key %q", r.Key)
+	}
+	return nil
+}
+
+// Capacity is the size of the token bucket of the rule.
+func (r Rule) Capacity() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Requests
+}
+
+// Rate is how many tokens per second refill the token bucket of the rule.
+func (r Rule) Rate() float64 {
+	return float64(r.Requests) / r.Period.Seconds()
+}
+
+// FillTime is how long an empty token bucket takes to fill up, after which
+// its state can be forgotten.
+func (r Rule) FillTime() time.Duration {
+	return time.Duration(float64(r.Capacity()) / r.Rate() * float64(time.Second))
+}
+
+// Window returns the start of the fixed window of the rule now falls in.
+// Windows are aligned on the Unix epoch, so that every replica agrees on
+// them. The period of the rule must be at least a millisecond.
+func (r Rule) Window(now time.Time) time.Time {
+	period := r.Period.Milliseconds()
+	return time.UnixMilli(now.UnixMilli() / period * period)
+}
+
+// Store keeps the state of the rules under keys naming a rule and a
+// client. Its methods must be atomic, as concurrent requests from a client
+// may be handled by different replicas.
+type Store interface {
+	// TakeToken takes a token from the bucket key of rule, refilled up to
+	// now, and reports whether there was one and how many are left.
+	TakeToken(ctx context.Context, key string, rule Rule, now time.Time) (taken bool, tokens float64, err error)
+	// CountRequest counts a request in the window key of rule, unless the
+	// rule is already exhausted, and returns the counts of the previous
+	// and current windows afterwards.
+	CountRequest(ctx context.Context, key string, rule Rule, now time.Time) (counted bool, previous, current int, err error)
+}
+
+// Result is the outcome of checking a request against a rule.
+type Result struct {
+	Allowed bool
+	// Limit is the quota of the rule and Remaining what is left of it.
+	Limit     int
+	Remaining int
+	// Reset is how long until the quota is restored in full.
+	Reset time.Duration
+	// RetryAfter is how long a rejected client must wait.
+	RetryAfter time.Duration
+}
+
+// take checks a request from the client key against rule.
+func take(ctx context.Context, store Store, key string, rule Rule, now time.Time) (Result, error) {
+	if rule.Algorithm == TokenBucket {
+		taken, tokens, err := store.TakeToken(ctx, key, rule, now)
+		if err != nil {
+			return Result{}, err
+		}
+		return bucketResult(rule, taken, tokens), nil
+	}
+	counted, previous, current, err := store.CountRequest(ctx, key, rule, now)
+	if err != nil {
+		return Result{}, err
+	}
+	return windowResult(rule, now, counted, previous, current), nil
+}
+
+func bucketResult(rule Rule, taken bool, tokens float64) Result {
+	capacity := rule.Capacity()
+	res := Result{
+		Allowed:   taken,
+		Limit:     capacity,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     seconds((float64(capacity) - tokens) / rule.Rate()),
+	}
+	if !taken {
+		res.RetryAfter = max(time.Second, seconds((1-tokens)/rule.Rate()))
+	}
+	return res
+}
+
+// windowResult reports the state of a sliding window, where the requests of
+// the previous window count less and less as the current one goes by.
+func windowResult(rule Rule, now time.Time, counted bool, previous, current int) Result {
+	period := rule.Period.Seconds()
+	elapsed := now.Sub(rule.Window(now)).Seconds()
+	estimate := Estimate(rule, now, previous, current)
+	res := Result{
+		Allowed:   counted,
+		Limit:     rule.Requests,
+		Remaining: max(0, rule.Requests-int(math.Ceil(estimate))),
+		// by the end of the next window, the current one no longer counts
+		Reset: seconds(2*period - elapsed),
+	}
+	if current == 0 {
+		res.Reset = seconds(period - elapsed)
+	}
+	if counted {
+		return res
+	}
+
+	// room for one more request
+	room := float64(rule.Requests - 1)
+	if current < rule.Requests && previous > 0 {
+		// the previous window fades out enough within the current one
+		res.RetryAfter = seconds(period*(1-(room-float64(current))/float64(previous)) - elapsed)
+	} else {
+		// the current window has to fade out within the next one
+		res.RetryAfter = seconds(period - elapsed + period*(1-room/float64(current)))
+	}
+	res.RetryAfter = max(time.Second, res.RetryAfter)
+	return res
+}
+
+// Estimate is the number of requests over the last period of a sliding
+// window, given the counts of its previous and current fixed windows. A
+// request is counted when one more fits in the quota.
+func Estimate(rule Rule, now time.Time, previous, current int) float64 {
+	elapsed := now.Sub(rule.Window(now))
+	weight := 1 - float64(elapsed)/float64(rule.Period)
+	return float64(previous)*weight + float64(current)
+}
+
+// seconds converts s to a duration of whole seconds, rounded up.
+func seconds(s float64) time.Duration {
+	return time.Duration(max(0, math.Ceil(s))) * time.Second
+}
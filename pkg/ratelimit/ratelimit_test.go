@@ -0,0 +1,120 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// epoch is a time on a boundary of every window of the tests.
+var epoch = time.UnixMilli(1_699_999_980_000)
+
+func at(seconds float64) time.Time {
+	return epoch.Add(time.Duration(seconds * float64(time.Second)))
+}
+
+func TestRuleValidate(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		rule Rule
+		ok   bool
+	}{
+		{"disabled", Rule{}, true},
+		{"sliding window", Rule{Requests: 10, Period: time.Minute, Algorithm: SlidingWindow, Key: KeyIP}, true},
+		{"token bucket", Rule{Requests: 10, Period: time.Second, Algorithm: TokenBucket, Burst: 20, Key: KeyUser}, true},
+		{"millisecond period", Rule{Requests: 1, Period: time.Millisecond, Algorithm: SlidingWindow, Key: KeyRoute}, true},
+		{"sub-millisecond period", Rule{Requests: 1, Period: time.Millisecond - 1, Algorithm: SlidingWindow, Key: KeyIP}, false},
+		{"zero period", Rule{Requests: 1, Algorithm: TokenBucket, Key: KeyIP}, false},
+		{"negative burst", Rule{Requests: 1, Period: time.Second, Algorithm: TokenBucket, Burst: -1, Key: KeyIP}, false},
+		{"unknown algorithm", Rule{Requests: 1, Period: time.Second, Algorithm: "leaky_bucket", Key: KeyIP}, false},
+		{"unknown key", Rule{Requests: 1, Period: time.Second, Algorithm: TokenBucket, Key: "header"}, false},
+	} {
+		if err := tc.rule.validate(); (err == nil) != tc.ok {
+			t.Errorf("%s: got %v, want ok %t", tc.name, err, tc.ok)
+		}
+	}
+}
+
+func TestWindow(t *testing.T) {
+	for _, tc := range []struct {
+		period time.Duration
+		now    time.Time
+		want   time.Time
+	}{
+		{time.Minute, epoch, epoch},
+		{time.Minute, at(59.999), epoch},
+		// the boundary starts the next window
+		{time.Minute, at(60), at(60)},
+		{time.Minute, at(-0.001), at(-60)},
+		{1500 * time.Millisecond, at(2.999), at(1.5)},
+		{1500 * time.Millisecond, at(3), at(3)},
+		{time.Millisecond, at(1.2345), at(1.234)},
+	} {
+		rule := Rule{Requests: 1, Period: tc.period}
+		if got := rule.Window(tc.now); !got.Equal(tc.want) {
+			t.Errorf("period %s at %s: got %s, want %s", tc.period, tc.now.Sub(epoch), got.Sub(epoch), tc.want.Sub(epoch))
+		}
+	}
+}
+
+// step is a request at a time and the result it should get.
+type step struct {
+	at         float64
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+}
+
+func run(t *testing.T, rule Rule, steps []step) {
+	t.Helper()
+	store := NewMemoryStore()
+	for i, s := range steps {
+		res, err := take(context.Background(), store, "client", rule, at(s.at))
+		if err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		if res.Allowed != s.allowed || res.Remaining != s.remaining || res.Reset != s.reset || res.RetryAfter != s.retryAfter {
+			t.Errorf("step %d at %gs: got allowed %t, remaining %d, reset %s, retry after %s; want %t, %d, %s, %s",
+				i, s.at, res.Allowed, res.Remaining, res.Reset, res.RetryAfter, s.allowed, s.remaining, s.reset, s.retryAfter)
+		}
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	// bursts of 3, refilled at one token per second
+	rule := Rule{Requests: 1, Period: time.Second, Algorithm: TokenBucket, Burst: 3, Key: KeyIP}
+	run(t, rule, []step{
+		{at: 0, allowed: true, remaining: 2, reset: time.Second},
+		{at: 0, allowed: true, remaining: 1, reset: 2 * time.Second},
+		{at: 0, allowed: true, remaining: 0, reset: 3 * time.Second},
+		{at: 0, allowed: false, remaining: 0, reset: 3 * time.Second, retryAfter: time.Second},
+		// half a token is not enough, and retries are at least a second
+		{at: 0.5, allowed: false, remaining: 0, reset: 3 * time.Second, retryAfter: time.Second},
+		{at: 1, allowed: true, remaining: 0, reset: 3 * time.Second},
+		{at: 2.5, allowed: true, remaining: 0, reset: 3 * time.Second},
+		// the bucket fills up to its size, no further
+		{at: 100, allowed: true, remaining: 2, reset: time.Second},
+	})
+}
+
+func TestSlidingWindow(t *testing.T) {
+	// 4 requests per 10s
+	rule := Rule{Requests: 4, Period: 10 * time.Second, Algorithm: SlidingWindow, Key: KeyIP}
+	run(t, rule, []step{
+		{at: 1, allowed: true, remaining: 3, reset: 19 * time.Second},
+		{at: 2, allowed: true, remaining: 2, reset: 18 * time.Second},
+		{at: 3, allowed: true, remaining: 1, reset: 17 * time.Second},
+		{at: 4, allowed: true, remaining: 0, reset: 16 * time.Second},
+		// the current window fades out enough 2.5s into the next one
+		{at: 5, allowed: false, remaining: 0, reset: 15 * time.Second, retryAfter: 8 * time.Second},
+		// on rollover the previous window still counts in full
+		{at: 10, allowed: false, remaining: 0, reset: 10 * time.Second, retryAfter: 3 * time.Second},
+		{at: 12.5, allowed: true, remaining: 0, reset: 18 * time.Second},
+		{at: 15, allowed: true, remaining: 0, reset: 15 * time.Second},
+		// retries are at least a second, though one fits at 17.5s
+		{at: 17, allowed: false, remaining: 0, reset: 13 * time.Second, retryAfter: time.Second},
+		// windows older than the previous one do not count
+		{at: 30, allowed: true, remaining: 3, reset: 20 * time.Second},
+	})
+}
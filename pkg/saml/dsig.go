@@ -0,0 +1,214 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+)
+
+// XML Signature namespaces and algorithms. Only exclusive canonicalization
+// and RSA with SHA-256 or SHA-512 are accepted.
+const (
+	nsDSig = "http://www.w3.org/2000/09/xmldsig#"
+
+	algExcC14N    = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped  = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algRSASHA256  = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algRSASHA512  = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	algDigest256  = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algDigest512  = "http://www.w3.org/2001/04/xmlenc#sha512"
+	signatureHash = crypto.SHA256
+)
+
+var (
+	errNoSignature = errors.New("not signed")
+
+	signatureAlgorithms = map[string]crypto.Hash{algRSASHA256: crypto.SHA256, algRSASHA512: crypto.SHA512}
+	digestAlgorithms    = map[string]crypto.Hash{algDigest256: crypto.SHA256, algDigest512: crypto.SHA512}
+)
+
+// verifySignature verifies the enveloped signature of el against certs. The
+// signature must be a child of el and reference el by its ID, so that what
+// was signed is what the caller goes on to read. It returns errNoSignature
+// when el has no signature.
+func verifySignature(el *element, certs []*x509.Certificate) error {
+	sigs := el.all(nsDSig, "Signature")
+	switch {
+	case len(sigs) == 0:
+		return errNoSignature
+	case len(sigs) > 1:
+		return errors.New("more than one signature")
+	}
+	sig := sigs[0]
+
+	si := sig.child(nsDSig, "SignedInfo")
+	if si == nil {
+		return errors.New("signature has no SignedInfo")
+	}
+	cm := si.child(nsDSig, "CanonicalizationMethod")
+	if cm == nil || cm.attr("Algorithm") != algExcC14N {
+		return errors.New("unsupported canonicalization method")
+	}
+	sm := si.child(nsDSig, "SignatureMethod")
+	if sm == nil {
+		return errors.New("signature has no SignatureMethod")
+	}
+	sigHash, ok := signatureAlgorithms[sm.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported signature method %q", sm.attr("Algorithm"))
+	}
+
+	refs := si.all(nsDSig, "Reference")
+	if len(refs) != 1 {
+		return errors.New("signature must have exactly one reference")
+	}
+	ref := refs[0]
+	if id := el.attr("ID"); id == "" || ref.attr("URI") != "#"+id {
+		return errors.New("signature does not reference the signed element")
+	}
+
+	var prefixes []string
+	var enveloped, exclusive bool
+	if transforms := ref.child(nsDSig, "Transforms"); transforms != nil {
+		for _, t := range transforms.all(nsDSig, "Transform") {
+			switch t.attr("Algorithm") {
+			case algEnveloped:
+				enveloped = true
+			case algExcC14N:
+				exclusive = true
+				prefixes = inclusivePrefixes(t)
+			default:
+				return fmt.Errorf("unsupported transform %q", t.attr("Algorithm"))
+			}
+		}
+	}
+	if !enveloped || !exclusive {
+		return errors.New("signature must use the enveloped signature and exclusive canonicalization transforms")
+	}
+
+	dm := ref.child(nsDSig, "DigestMethod")
+	if dm == nil {
+		return errors.New("reference has no DigestMethod")
+	}
+	digestHash, ok := digestAlgorithms[dm.attr("Algorithm")]
+	if !ok {
+		return fmt.Errorf("unsupported digest method %q", dm.attr("Algorithm"))
+	}
+	dv := ref.child(nsDSig, "DigestValue")
+	if dv == nil {
+		return errors.New("reference has no DigestValue")
+	}
+	want, err := decodeBase64(dv.text())
+	if err != nil {
+		return fmt.Errorf("decode digest: %w", err)
+	}
+	h := digestHash.New()
+	h.Write(canonicalize(el, prefixes, sig))
+	if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+		return errors.New("digest mismatch")
+	}
+
+	sv := sig.child(nsDSig, "SignatureValue")
+	if sv == nil {
+		return errors.New("signature has no SignatureValue")
+	}
+	value, err := decodeBase64(sv.text())
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	h = sigHash.New()
+	h.Write(canonicalize(si, inclusivePrefixes(cm), nil))
+	sum := h.Sum(nil)
+	for _, cert := range certs {
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && rsa.VerifyPKCS1v15(pub, sigHash, sum, value) == nil {
+			return nil
+		}
+	}
+	return errors.New("signature not made by a trusted certificate")
+}
+
+// inclusivePrefixes returns the PrefixList of the InclusiveNamespaces of an
+// exclusive canonicalization method or transform.
+func inclusivePrefixes(el *element) []string {
+	if in := el.child(algExcC14N, "InclusiveNamespaces"); in != nil {
+		return strings.Fields(in.attr("PrefixList"))
+	}
+	return nil
+}
+
+func decodeBase64(s string) ([]byte, error) {
+	return base64.StdEncoding.DecodeString(strings.Join(strings.Fields(s), ""))
+}
+
+// Sign adds an enveloped signature to the element of doc with the given ID,
+// and returns the document in canonical form. It signs with RSA-SHA256 and
+// exclusive canonicalization, as identity providers do, and is what the
+// mock identity provider of samltest signs its responses with. Sign the
+// innermost element first when signing more than one.
+func Sign(doc []byte, id string, key *rsa.PrivateKey, cert *x509.Certificate) ([]byte, error) {
+	root, err := parseXML(doc)
+	if err != nil {
+		return nil, err
+	}
+	var el *element
+	root.walk(func(e *element) {
+		if el == nil && e.attr("ID") == id {
+			el = e
+		}
+	})
+	if el == nil {
+		return nil, fmt.Errorf("no element with ID %q", id)
+	}
+
+	h := signatureHash.New()
+	h.Write(canonicalize(el, nil, nil))
+	signedInfo := `<ds:SignedInfo xmlns:ds="` + nsDSig + `">` +
+		`<ds:CanonicalizationMethod Algorithm="` + algExcC14N + `"></ds:CanonicalizationMethod>` +
+		`<ds:SignatureMethod Algorithm="` + algRSASHA256 + `"></ds:SignatureMethod>` +
+		`<ds:Reference URI="#` + escape(id) + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="` + algEnveloped + `"></ds:Transform>` +
+		`<ds:Transform Algorithm="` + algExcC14N + `"></ds:Transform>` +
+		`</ds:Transforms><ds:DigestMethod Algorithm="` + algDigest256 + `"></ds:DigestMethod>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(h.Sum(nil)) + `</ds:DigestValue>` +
+		`</ds:Reference></ds:SignedInfo>`
+	si, err := parseXML([]byte(signedInfo))
+	if err != nil {
+		return nil, err
+	}
+	h = signatureHash.New()
+	h.Write(canonicalize(si, nil, nil))
+	value, err := rsa.SignPKCS1v15(nil, key, signatureHash, h.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("sign: %w", err)
+	}
+
+	sig, err := parseXML([]byte(`<ds:Signature xmlns:ds="` + nsDSig + `">` + signedInfo +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(value) + `</ds:SignatureValue>` +
+		`<ds:KeyInfo><ds:X509Data><ds:X509Certificate>` + base64.StdEncoding.EncodeToString(cert.Raw) +
+		`</ds:X509Certificate></ds:X509Data></ds:KeyInfo></ds:Signature>`))
+	if err != nil {
+		return nil, err
+	}
+
+	// the schema puts the signature right after the Issuer
+	at := 0
+	for i, c := range el.children {
+		if first, ok := c.(*element); ok {
+			if first.is(nsAssertion, "Issuer") {
+				at = i + 1
+			}
+			break
+		}
+	}
+	sig.parent = el
+	el.children = append(el.children[:at], append([]any{sig}, el.children[at:]...)...)
+	return canonicalize(root, nil, nil), nil
+}
@@ -0,0 +1,459 @@
+// Package saml implements the service provider side of SAML 2.0 Web Browser
+// SSO: metadata, authentication requests sent with the HTTP-Redirect
+// binding, and the validation of the signed responses identity providers
+// send back with the HTTP-POST binding.
+//
+// XML signatures are verified on a DOM of the package's own, against the
+// certificates of the identity provider's metadata only, and the values of
+// a response are read from the very elements whose signature was verified,
+// so that signature wrapping cannot smuggle in unsigned assertions.
+// Encrypted assertions are not supported.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// SAML namespaces, bindings and the status and confirmation methods a
+// response must carry.
+const (
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	BindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	BindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	statusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	confirmationBearer = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// clockSkew is how far the clocks of the identity provider and ours may
+// drift apart.
+const clockSkew = 2 * time.Minute
+
+var (
+	// ErrInvalidMetadata is returned for identity provider metadata that
+	// cannot be used.
+	ErrInvalidMetadata = errors.New("saml: invalid metadata")
+	// ErrInvalidResponse is returned for responses that fail validation. It
+	// is wrapped with the reason, which is for logs rather than users.
+	ErrInvalidResponse = errors.New("saml: invalid response")
+)
+
+// IdentityProvider is what the service provider knows of an identity
+// provider, from its metadata.
+type IdentityProvider struct {
+	EntityID string
+	// SSOURL is its single sign-on service for the HTTP-Redirect binding.
+	SSOURL string
+	// Certificates are those its responses may be signed with.
+	Certificates []*x509.Certificate
+}
+
+// ParseMetadata reads an identity provider from its metadata, an
+// EntityDescriptor or the first identity provider of an
+// EntitiesDescriptor. Its signature, if any, is not verified: metadata is
+// trusted as imported by an administrator.
+func ParseMetadata(data []byte) (*IdentityProvider, error) {
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+	}
+
+	var entity, desc *element
+	root.walk(func(e *element) {
+		if desc == nil && e.is(nsMetadata, "EntityDescriptor") {
+			if d := e.child(nsMetadata, "IDPSSODescriptor"); d != nil &&
+				strings.Contains(d.attr("protocolSupportEnumeration"), nsProtocol) {
+				entity, desc = e, d
+			}
+		}
+	})
+	if desc == nil {
+		return nil, fmt.Errorf("%w: no SAML 2.0 identity provider", ErrInvalidMetadata)
+	}
+
+	idp := &IdentityProvider{EntityID: entity.attr("entityID")}
+	if idp.EntityID == "" {
+		return nil, fmt.Errorf("%w: no entity ID", ErrInvalidMetadata)
+	}
+	for _, sso := range desc.all(nsMetadata, "SingleSignOnService") {
+		if sso.attr("Binding") == BindingRedirect {
+			idp.SSOURL = sso.attr("Location")
+			break
+		}
+	}
+	if u, err := url.Parse(idp.SSOURL); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("%w: no single sign-on service for the HTTP-Redirect binding", ErrInvalidMetadata)
+	}
+
+	for _, kd := range desc.all(nsMetadata, "KeyDescriptor") {
+		if use := kd.attr("use"); use != "" && use != "signing" {
+			continue
+		}
+		ki := kd.child(nsDSig, "KeyInfo")
+		if ki == nil {
+			continue
+		}
+		for _, data := range ki.all(nsDSig, "X509Data") {
+			for _, c := range data.all(nsDSig, "X509Certificate") {
+				cert, err := ParseCertificate(c.text())
+				if err != nil {
+					return nil, fmt.Errorf("%w: %w", ErrInvalidMetadata, err)
+				}
+				idp.Certificates = append(idp.Certificates, cert)
+			}
+		}
+	}
+	if len(idp.Certificates) == 0 {
+		return nil, fmt.Errorf("%w: no signing certificate", ErrInvalidMetadata)
+	}
+	return idp, nil
+}
+
+// ParseCertificate parses an RSA certificate, PEM encoded or as the bare
+// base64 of its DER form that metadata carries. Its validity period is not
+// checked, as identity providers commonly sign with expired self-signed
+// certificates; it is trusted for being configured.
+func ParseCertificate(s string) (*x509.Certificate, error) {
+	der, err := decodeBase64(s)
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		der, err = block.Bytes, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("decode certificate: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := cert.PublicKey.(*rsa.PublicKey); !ok {
+		return nil, errors.New("certificate does not have an RSA key")
+	}
+	return cert, nil
+}
+
+// ServiceProvider is us, as seen by an identity provider.
+type ServiceProvider struct {
+	EntityID string
+	// ACSURL is the assertion consumer service, which responses are posted
+	// to.
+	ACSURL string
+	// Key and Certificate sign authentication requests.
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// Metadata returns the EntityDescriptor of the service provider.
+func (sp *ServiceProvider) Metadata() []byte {
+	return []byte(`<?xml version="1.0" encoding="UTF-8"?>` + "\n" +
+		`<md:EntityDescriptor xmlns:md="` + nsMetadata + `" xmlns:ds="` + nsDSig + `" entityID="` + escape(sp.EntityID) + `">` +
+		`<md:SPSSODescriptor AuthnRequestsSigned="true" WantAssertionsSigned="true" protocolSupportEnumeration="` + nsProtocol + `">` +
+		`<md:KeyDescriptor use="signing"><ds:KeyInfo><ds:X509Data><ds:X509Certificate>` +
+		base64.StdEncoding.EncodeToString(sp.Certificate.Raw) +
+		`</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>` +
+		`<md:AssertionConsumerService Binding="` + BindingPOST + `" Location="` + escape(sp.ACSURL) + `" index="0" isDefault="true"/>` +
+		`</md:SPSSODescriptor></md:EntityDescriptor>` + "\n")
+}
+
+// AuthnRequest returns the URL that sends the user agent to the identity
+// provider with a signed authentication request, and the ID of the
+// request, which its response must be in response to. relayState comes
+// back with the response.
+func (sp *ServiceProvider) AuthnRequest(idp *IdentityProvider, relayState string, now time.Time) (redirectTo, id string, err error) {
+	id, err = newID()
+	if err != nil {
+		return "", "", err
+	}
+
+	req := `<samlp:AuthnRequest xmlns:samlp="` + nsProtocol + `" xmlns:saml="` + nsAssertion + `"` +
+		` ID="` + id + `" Version="2.0" IssueInstant="` + now.UTC().Format(time.RFC3339) + `"` +
+		` Destination="` + escape(idp.SSOURL) + `" AssertionConsumerServiceURL="` + escape(sp.ACSURL) + `"` +
+		` ProtocolBinding="` + BindingPOST + `">` +
+		`<saml:Issuer>` + escape(sp.EntityID) + `</saml:Issuer>` +
+		`<samlp:NameIDPolicy AllowCreate="true"/></samlp:AuthnRequest>`
+
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.BestCompression)
+	if err != nil {
+		return "", "", err
+	}
+	if _, err := w.Write([]byte(req)); err != nil {
+		return "", "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+
+	// the signature is over the query as sent, in this order
+	query := "SAMLRequest=" + url.QueryEscape(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(algRSASHA256)
+	h := signatureHash.New()
+	h.Write([]byte(query))
+	sig, err := rsa.SignPKCS1v15(nil, sp.Key, signatureHash, h.Sum(nil))
+	if err != nil {
+		return "", "", fmt.Errorf("sign request: %w", err)
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(sig))
+
+	sep := "?"
+	if strings.Contains(idp.SSOURL, "?") {
+		sep = "&"
+	}
+	return idp.SSOURL + sep + query, id, nil
+}
+
+// Assertion is what an identity provider asserted about the user in a
+// response.
+type Assertion struct {
+	ID           string
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	// Attributes are keyed by name, and by friendly name where given.
+	Attributes map[string][]string
+}
+
+// Attribute returns the first value of the named attribute.
+func (a *Assertion) Attribute(name string) string {
+	if vals := a.Attributes[name]; len(vals) > 0 {
+		return vals[0]
+	}
+	return ""
+}
+
+// ParseResponse validates the base64 encoded SAMLResponse of the HTTP-POST
+// binding, which must be in response to the request with ID requestID, and
+// returns its assertion. The response or the assertion must be signed by
+// the identity provider; a signature on either must be valid.
+func (sp *ServiceProvider) ParseResponse(idp *IdentityProvider, samlResponse, requestID string, now time.Time) (*Assertion, error) {
+	a, err := sp.parseResponse(idp, samlResponse, requestID, now)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidResponse, err)
+	}
+	return a, nil
+}
+
+func (sp *ServiceProvider) parseResponse(idp *IdentityProvider, samlResponse, requestID string, now time.Time) (*Assertion, error) {
+	data, err := decodeBase64(samlResponse)
+	if err != nil {
+		return nil, err
+	}
+	res, err := parseXML(data)
+	if err != nil {
+		return nil, err
+	}
+	if !res.is(nsProtocol, "Response") || res.attr("Version") != "2.0" {
+		return nil, errors.New("not a SAML 2.0 response")
+	}
+
+	// IDs must be unique for references to them to be meaningful
+	ids := map[string]bool{}
+	var dup bool
+	res.walk(func(e *element) {
+		if e.hasAttr("ID") {
+			dup = dup || ids[e.attr("ID")]
+			ids[e.attr("ID")] = true
+		}
+	})
+	if dup {
+		return nil, errors.New("duplicate IDs")
+	}
+
+	if requestID == "" || res.attr("InResponseTo") != requestID {
+		return nil, errors.New("not in response to the request")
+	}
+	if res.hasAttr("Destination") && res.attr("Destination") != sp.ACSURL {
+		return nil, errors.New("wrong destination")
+	}
+	if iss := res.child(nsAssertion, "Issuer"); iss != nil && iss.text() != idp.EntityID {
+		return nil, errors.New("wrong issuer")
+	}
+
+	status := res.child(nsProtocol, "Status")
+	if status == nil {
+		return nil, errors.New("no status")
+	}
+	code := status.child(nsProtocol, "StatusCode")
+	if code == nil {
+		return nil, errors.New("no status code")
+	}
+	if code.attr("Value") != statusSuccess {
+		reason := code.attr("Value")
+		if sub := code.child(nsProtocol, "StatusCode"); sub != nil {
+			reason += " " + sub.attr("Value")
+		}
+		return nil, fmt.Errorf("status %s", reason)
+	}
+
+	responseSigned := false
+	switch err := verifySignature(res, idp.Certificates); {
+	case err == nil:
+		responseSigned = true
+	case !errors.Is(err, errNoSignature):
+		return nil, fmt.Errorf("response signature: %w", err)
+	}
+
+	if res.child(nsAssertion, "EncryptedAssertion") != nil {
+		return nil, errors.New("encrypted assertions are not supported")
+	}
+	assertions := res.all(nsAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, errors.New("response must have exactly one assertion")
+	}
+	as := assertions[0]
+	switch err := verifySignature(as, idp.Certificates); {
+	case errors.Is(err, errNoSignature):
+		if !responseSigned {
+			return nil, errors.New("neither the response nor the assertion is signed")
+		}
+	case err != nil:
+		return nil, fmt.Errorf("assertion signature: %w", err)
+	}
+
+	if as.attr("Version") != "2.0" {
+		return nil, errors.New("not a SAML 2.0 assertion")
+	}
+	if iss := as.child(nsAssertion, "Issuer"); iss == nil || iss.text() != idp.EntityID {
+		return nil, errors.New("wrong assertion issuer")
+	}
+	if err := sp.checkConditions(as, now); err != nil {
+		return nil, err
+	}
+
+	subject := as.child(nsAssertion, "Subject")
+	if subject == nil {
+		return nil, errors.New("no subject")
+	}
+	nameID := subject.child(nsAssertion, "NameID")
+	if nameID == nil || nameID.text() == "" {
+		return nil, errors.New("no name ID")
+	}
+	if err := sp.checkConfirmation(subject, requestID, now); err != nil {
+		return nil, err
+	}
+
+	a := &Assertion{
+		ID:           as.attr("ID"),
+		NameID:       nameID.text(),
+		NameIDFormat: nameID.attr("Format"),
+		Attributes:   map[string][]string{},
+	}
+	if authn := as.child(nsAssertion, "AuthnStatement"); authn != nil {
+		a.SessionIndex = authn.attr("SessionIndex")
+		if t, ok, err := timeAttr(authn, "SessionNotOnOrAfter"); err != nil {
+			return nil, err
+		} else if ok && !now.Add(-clockSkew).Before(t) {
+			return nil, errors.New("session expired")
+		}
+	}
+	for _, st := range as.all(nsAssertion, "AttributeStatement") {
+		for _, at := range st.all(nsAssertion, "Attribute") {
+			var vals []string
+			for _, v := range at.all(nsAssertion, "AttributeValue") {
+				vals = append(vals, v.text())
+			}
+			a.Attributes[at.attr("Name")] = append(a.Attributes[at.attr("Name")], vals...)
+			if fn := at.attr("FriendlyName"); fn != "" && fn != at.attr("Name") {
+				a.Attributes[fn] = append(a.Attributes[fn], vals...)
+			}
+		}
+	}
+	return a, nil
+}
+
+// checkConditions checks the validity period and the audience of an
+// assertion.
+func (sp *ServiceProvider) checkConditions(as *element, now time.Time) error {
+	cond := as.child(nsAssertion, "Conditions")
+	if cond == nil {
+		return errors.New("no conditions")
+	}
+	if t, ok, err := timeAttr(cond, "NotBefore"); err != nil {
+		return err
+	} else if ok && now.Add(clockSkew).Before(t) {
+		return errors.New("assertion not yet valid")
+	}
+	if t, ok, err := timeAttr(cond, "NotOnOrAfter"); err != nil {
+		return err
+	} else if ok && !now.Add(-clockSkew).Before(t) {
+		return errors.New("assertion expired")
+	}
+
+	// every audience restriction must include us
+	restrictions := cond.all(nsAssertion, "AudienceRestriction")
+	if len(restrictions) == 0 {
+		return errors.New("no audience restriction")
+	}
+	for _, r := range restrictions {
+		found := false
+		for _, aud := range r.all(nsAssertion, "Audience") {
+			found = found || aud.text() == sp.EntityID
+		}
+		if !found {
+			return errors.New("wrong audience")
+		}
+	}
+	return nil
+}
+
+// checkConfirmation checks that the subject has a bearer confirmation for
+// us, in response to the request, that has not expired.
+func (sp *ServiceProvider) checkConfirmation(subject *element, requestID string, now time.Time) error {
+	for _, sc := range subject.all(nsAssertion, "SubjectConfirmation") {
+		data := sc.child(nsAssertion, "SubjectConfirmationData")
+		if sc.attr("Method") != confirmationBearer || data == nil {
+			continue
+		}
+		if data.attr("Recipient") != sp.ACSURL {
+			continue
+		}
+		if data.hasAttr("InResponseTo") && data.attr("InResponseTo") != requestID {
+			continue
+		}
+		t, ok, err := timeAttr(data, "NotOnOrAfter")
+		if err != nil {
+			return err
+		}
+		if ok && now.Add(-clockSkew).Before(t) {
+			return nil
+		}
+	}
+	return errors.New("no valid bearer subject confirmation")
+}
+
+func timeAttr(el *element, name string) (time.Time, bool, error) {
+	if !el.hasAttr(name) {
+		return time.Time{}, false, nil
+	}
+	t, err := time.Parse(time.RFC3339, el.attr(name))
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("malformed %s", name)
+	}
+	return t, true, nil
+}
+
+// newID returns a random ID, which must not start with a digit.
+func newID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "_" + hex.EncodeToString(b), nil
+}
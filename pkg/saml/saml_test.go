@@ -0,0 +1,275 @@
+package saml_test
+
+import (
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"sambhav/pkg/saml"
+	"sambhav/pkg/saml/samltest"
+)
+
+const (
+	spEntityID = "https://sp.example.com/saml/acme/metadata"
+	spACSURL   = "https://sp.example.com/saml/acme/acs"
+	requestID  = "_4f1d2c3b4a5968778695a4b3c2d1e0f0a1b2c3d4"
+)
+
+var assertionPattern = regexp.MustCompile(`<saml:Assertion[\s\S]*</saml:Assertion>`)
+
+var sp = &saml.ServiceProvider{EntityID: spEntityID, ACSURL: spACSURL}
+
+// newIdP returns a mock identity provider signing in alice@acme.example,
+// and the identity provider as the service provider trusts it.
+func newIdP(t *testing.T) (*samltest.IdP, *saml.IdentityProvider) {
+	t.Helper()
+	idp, err := samltest.New("https://idp.example.com/metadata", "alice@acme.example")
+	if err != nil {
+		t.Fatalf("samltest.New: %v", err)
+	}
+	idp.Attributes["displayName"] = []string{"Alice"}
+	trusted, err := saml.ParseMetadata(idp.Metadata("https://idp.example.com/sso"))
+	if err != nil {
+		t.Fatalf("ParseMetadata: %v", err)
+	}
+	return idp, trusted
+}
+
+// response returns the decoded response of idp.
+func response(t *testing.T, idp *samltest.IdP, audience, acsURL, inResponseTo string) string {
+	t.Helper()
+	res, err := idp.Response(audience, acsURL, inResponseTo)
+	if err != nil {
+		t.Fatalf("Response: %v", err)
+	}
+	doc, err := base64.StdEncoding.DecodeString(res)
+	if err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	return string(doc)
+}
+
+func parse(trusted *saml.IdentityProvider, doc string) (*saml.Assertion, error) {
+	return sp.ParseResponse(trusted, base64.StdEncoding.EncodeToString([]byte(doc)), requestID, time.Now())
+}
+
+// unsigned returns a copy of the signed assertion of doc with its
+// signature removed and its subject replaced by nameID, as an attacker
+// would forge one.
+func unsigned(t *testing.T, doc, id, nameID string) string {
+	t.Helper()
+	as := assertionPattern.FindString(doc)
+	if as == "" {
+		t.Fatal("response has no assertion")
+	}
+	as = regexp.MustCompile(`<ds:Signature[\s\S]*</ds:Signature>`).ReplaceAllString(as, "")
+	as = regexp.MustCompile(` ID="[^"]*"`).ReplaceAllString(as, ` ID="`+id+`"`)
+	return strings.Replace(as, "alice@acme.example", nameID, 1)
+}
+
+func TestParseResponse(t *testing.T) {
+	for _, tc := range []struct {
+		name                        string
+		signResponse, signAssertion bool
+	}{
+		{"signed assertion", false, true},
+		{"signed response", true, false},
+		{"signed response and assertion", true, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idp, trusted := newIdP(t)
+			idp.SignResponse, idp.SignAssertion = tc.signResponse, tc.signAssertion
+
+			a, err := parse(trusted, response(t, idp, spEntityID, spACSURL, requestID))
+			if err != nil {
+				t.Fatalf("ParseResponse: %v", err)
+			}
+			if a.NameID != "alice@acme.example" || a.Attribute("displayName") != "Alice" || a.SessionIndex == "" {
+				t.Errorf("got assertion %+v", a)
+			}
+		})
+	}
+}
+
+func TestParseResponseRejects(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		// doc returns the response to parse.
+		doc    func(t *testing.T, idp *samltest.IdP) string
+		reason string
+	}{
+		{
+			name: "unsigned response",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				idp.SignAssertion = false
+				return response(t, idp, spEntityID, spACSURL, requestID)
+			},
+			reason: "neither the response nor the assertion is signed",
+		},
+		{
+			name: "signed by another key",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				other, err := samltest.New(idp.EntityID, idp.NameID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				idp.Key, idp.Certificate = other.Key, other.Certificate
+				return response(t, idp, spEntityID, spACSURL, requestID)
+			},
+			reason: "not made by a trusted certificate",
+		},
+		{
+			name: "tampered assertion",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				return strings.Replace(doc, "alice@acme.example", "mallory@acme.example", 1)
+			},
+			reason: "digest mismatch",
+		},
+		{
+			name: "tampered attribute",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				return strings.Replace(doc, ">Alice<", ">Administrator<", 1)
+			},
+			reason: "digest mismatch",
+		},
+		{
+			name: "tampered assertion of a signed response",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				idp.SignResponse, idp.SignAssertion = true, false
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				return strings.Replace(doc, "alice@acme.example", "mallory@acme.example", 1)
+			},
+			reason: "response signature: digest mismatch",
+		},
+		{
+			name: "signed assertion moved and an unsigned one injected",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				signed := assertionPattern.FindString(doc)
+				forged := unsigned(t, doc, "_forged", "mallory@acme.example")
+				return strings.Replace(doc, signed,
+					`<samlp:Extensions>`+signed+`</samlp:Extensions>`+forged, 1)
+			},
+			reason: "neither the response nor the assertion is signed",
+		},
+		{
+			name: "signed assertion wrapped in an unsigned one",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				signed := assertionPattern.FindString(doc)
+				forged := unsigned(t, doc, "_forged", "mallory@acme.example")
+				forged = strings.Replace(forged, "</saml:Assertion>", signed+"</saml:Assertion>", 1)
+				return strings.Replace(doc, signed, forged, 1)
+			},
+			reason: "neither the response nor the assertion is signed",
+		},
+		{
+			name: "unsigned assertion injected next to the signed one",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				signed := assertionPattern.FindString(doc)
+				forged := unsigned(t, doc, "_forged", "mallory@acme.example")
+				return strings.Replace(doc, signed, forged+signed, 1)
+			},
+			reason: "exactly one assertion",
+		},
+		{
+			name: "signed response wrapping an injected assertion",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				idp.SignResponse, idp.SignAssertion = true, false
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				signed := assertionPattern.FindString(doc)
+				forged := unsigned(t, doc, "_forged", "mallory@acme.example")
+				return strings.Replace(doc, signed, forged, 1)
+			},
+			reason: "response signature: digest mismatch",
+		},
+		{
+			name: "duplicate IDs",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				doc := response(t, idp, spEntityID, spACSURL, requestID)
+				signed := assertionPattern.FindString(doc)
+				id := regexp.MustCompile(` ID="([^"]*)"`).FindStringSubmatch(signed)[1]
+				forged := unsigned(t, doc, id, "mallory@acme.example")
+				return strings.Replace(doc, signed, `<samlp:Extensions>`+signed+`</samlp:Extensions>`+forged, 1)
+			},
+			reason: "duplicate IDs",
+		},
+		{
+			name: "wrong audience",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				return response(t, idp, "https://other.example.com/metadata", spACSURL, requestID)
+			},
+			reason: "wrong audience",
+		},
+		{
+			name: "wrong destination",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				return response(t, idp, spEntityID, "https://other.example.com/acs", requestID)
+			},
+			reason: "wrong destination",
+		},
+		{
+			name: "wrong recipient",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				// the destination of the response is not signed, the
+				// recipient of the assertion is
+				doc := response(t, idp, spEntityID, "https://other.example.com/acs", requestID)
+				return strings.Replace(doc, ` Destination="https://other.example.com/acs"`, "", 1)
+			},
+			reason: "no valid bearer subject confirmation",
+		},
+		{
+			name: "expired conditions",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				idp.Now = func() time.Time { return time.Now().Add(-time.Hour) }
+				return response(t, idp, spEntityID, spACSURL, requestID)
+			},
+			reason: "assertion expired",
+		},
+		{
+			name: "not yet valid",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				idp.Now = func() time.Time { return time.Now().Add(time.Hour) }
+				return response(t, idp, spEntityID, spACSURL, requestID)
+			},
+			reason: "assertion not yet valid",
+		},
+		{
+			name: "in response to another request",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				return response(t, idp, spEntityID, spACSURL, "_another")
+			},
+			reason: "not in response to the request",
+		},
+		{
+			name: "assertion in response to another request",
+			doc: func(t *testing.T, idp *samltest.IdP) string {
+				// the InResponseTo of the response is not signed, that of
+				// the subject confirmation is
+				doc := response(t, idp, spEntityID, spACSURL, "_another")
+				return strings.Replace(doc, `InResponseTo="_another"`, `InResponseTo="`+requestID+`"`, 1)
+			},
+			reason: "no valid bearer subject confirmation",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			idp, trusted := newIdP(t)
+			a, err := parse(trusted, tc.doc(t, idp))
+			if err == nil {
+				t.Fatalf("accepted a response signing in %s", a.NameID)
+			}
+			if !errors.Is(err, saml.ErrInvalidResponse) {
+				t.Errorf("got %v, want %v", err, saml.ErrInvalidResponse)
+			}
+			if !strings.Contains(err.Error(), tc.reason) {
+				t.Errorf("rejected with %q, want %q", err, tc.reason)
+			}
+		})
+	}
+}
@@ -0,0 +1,261 @@
+// Package samltest provides a mock SAML 2.0 identity provider, for testing
+// the service provider without a real one. It signs in a fixed user
+// without asking for credentials.
+package samltest
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"sambhav/pkg/saml"
+)
+
+// IdP is a mock identity provider. Its Handler serves its metadata at
+// /metadata and its single sign-on service at /sso.
+type IdP struct {
+	EntityID    string
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+
+	// NameID and Attributes are asserted about the user signed in.
+	NameID     string
+	Attributes map[string][]string
+
+	// SignResponse and SignAssertion choose what is signed. New signs the
+	// assertion only, as most identity providers do by default.
+	SignResponse  bool
+	SignAssertion bool
+
+	// SPCertificate, when set, is the certificate authentication requests
+	// must be signed with.
+	SPCertificate *x509.Certificate
+
+	// Now returns the time responses are issued at, time.Now when nil.
+	Now func() time.Time
+}
+
+// New returns an identity provider with a new key pair, which signs in
+// nameID.
+func New(entityID, nameID string) (*IdP, error) {
+	key, cert, err := saml.GenerateKeyPair("samltest")
+	if err != nil {
+		return nil, err
+	}
+	return &IdP{
+		EntityID:      entityID,
+		Key:           key,
+		Certificate:   cert,
+		NameID:        nameID,
+		Attributes:    map[string][]string{},
+		SignAssertion: true,
+	}, nil
+}
+
+// Metadata returns the EntityDescriptor of the identity provider, with its
+// single sign-on service at ssoURL.
+func (idp *IdP) Metadata(ssoURL string) []byte {
+	return []byte(`<md:EntityDescriptor xmlns:md="urn:oasis:names:tc:SAML:2.0:metadata" entityID="` + escape(idp.EntityID) + `">` +
+		`<md:IDPSSODescriptor protocolSupportEnumeration="urn:oasis:names:tc:SAML:2.0:protocol">` +
+		`<md:KeyDescriptor use="signing"><ds:KeyInfo xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:X509Data><ds:X509Certificate>` +
+		base64.StdEncoding.EncodeToString(idp.Certificate.Raw) +
+		`</ds:X509Certificate></ds:X509Data></ds:KeyInfo></md:KeyDescriptor>` +
+		`<md:SingleSignOnService Binding="` + saml.BindingRedirect + `" Location="` + escape(ssoURL) + `"/>` +
+		`</md:IDPSSODescriptor></md:EntityDescriptor>`)
+}
+
+// Response returns a base64 encoded SAMLResponse signing the user in to the
+// service provider audience, posted to acsURL in response to requestID.
+func (idp *IdP) Response(audience, acsURL, requestID string) (string, error) {
+	now := time.Now()
+	if idp.Now != nil {
+		now = idp.Now()
+	}
+	instant := now.UTC().Format(time.RFC3339)
+	expires := now.Add(5 * time.Minute).UTC().Format(time.RFC3339)
+	responseID, assertionID := newID(), newID()
+
+	names := make([]string, 0, len(idp.Attributes))
+	for name := range idp.Attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var attrs strings.Builder
+	for _, name := range names {
+		attrs.WriteString(`<saml:Attribute Name="` + escape(name) + `">`)
+		for _, v := range idp.Attributes[name] {
+			attrs.WriteString(`<saml:AttributeValue>` + escape(v) + `</saml:AttributeValue>`)
+		}
+		attrs.WriteString(`</saml:Attribute>`)
+	}
+
+	doc := []byte(`<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"` +
+		` ID="` + responseID + `" Version="2.0" IssueInstant="` + instant + `" Destination="` + escape(acsURL) + `" InResponseTo="` + escape(requestID) + `">` +
+		`<saml:Issuer>` + escape(idp.EntityID) + `</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		`<saml:Assertion ID="` + assertionID + `" Version="2.0" IssueInstant="` + instant + `">` +
+		`<saml:Issuer>` + escape(idp.EntityID) + `</saml:Issuer>` +
+		`<saml:Subject><saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">` + escape(idp.NameID) + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">` +
+		`<saml:SubjectConfirmationData InResponseTo="` + escape(requestID) + `" Recipient="` + escape(acsURL) + `" NotOnOrAfter="` + expires + `"/>` +
+		`</saml:SubjectConfirmation></saml:Subject>` +
+		`<saml:Conditions NotBefore="` + instant + `" NotOnOrAfter="` + expires + `">` +
+		`<saml:AudienceRestriction><saml:Audience>` + escape(audience) + `</saml:Audience></saml:AudienceRestriction></saml:Conditions>` +
+		`<saml:AuthnStatement AuthnInstant="` + instant + `" SessionIndex="` + assertionID + `">` +
+		`<saml:AuthnContext><saml:AuthnContextClassRef>urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport</saml:AuthnContextClassRef></saml:AuthnContext>` +
+		`</saml:AuthnStatement>` +
+		`<saml:AttributeStatement>` + attrs.String() + `</saml:AttributeStatement>` +
+		`</saml:Assertion></samlp:Response>`)
+
+	var err error
+	if idp.SignAssertion {
+		if doc, err = saml.Sign(doc, assertionID, idp.Key, idp.Certificate); err != nil {
+			return "", err
+		}
+	}
+	if idp.SignResponse {
+		if doc, err = saml.Sign(doc, responseID, idp.Key, idp.Certificate); err != nil {
+			return "", err
+		}
+	}
+	return base64.StdEncoding.EncodeToString(doc), nil
+}
+
+// Handler serves the metadata and the single sign-on service, which answers
+// authentication requests with a page that posts the response to the
+// service provider.
+func (idp *IdP) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metadata", func(w http.ResponseWriter, r *http.Request) {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		w.Header().Set("Content-Type", "application/samlmetadata+xml")
+		w.Write(idp.Metadata(scheme + "://" + r.Host + "/sso"))
+	})
+	mux.HandleFunc("GET /sso", func(w http.ResponseWriter, r *http.Request) {
+		req, err := idp.readRequest(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		res, err := idp.Response(req.Issuer, req.ACSURL, req.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		postForm.Execute(w, map[string]string{
+			"URL":          req.ACSURL,
+			"SAMLResponse": res,
+			"RelayState":   r.URL.Query().Get("RelayState"),
+		})
+	})
+	return mux
+}
+
+var postForm = template.Must(template.New("post").Parse(`<!DOCTYPE html>
+<html><body onload="document.forms[0].submit()">
+<form method="post" action="{{.URL}}">
+<input type="hidden" name="SAMLResponse" value="{{.SAMLResponse}}">
+<input type="hidden" name="RelayState" value="{{.RelayState}}">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body></html>
+`))
+
+type authnRequest struct {
+	ID     string `xml:"ID,attr"`
+	ACSURL string `xml:"AssertionConsumerServiceURL,attr"`
+	Issuer string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+// readRequest decodes the authentication request of the HTTP-Redirect
+// binding, checking its signature when SPCertificate is set.
+func (idp *IdP) readRequest(r *http.Request) (*authnRequest, error) {
+	if idp.SPCertificate != nil {
+		if err := verifyRedirect(r.URL.RawQuery, idp.SPCertificate); err != nil {
+			return nil, err
+		}
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(r.URL.Query().Get("SAMLRequest"))
+	if err != nil {
+		return nil, fmt.Errorf("decode request: %w", err)
+	}
+	data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(raw)), 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("inflate request: %w", err)
+	}
+	var req authnRequest
+	if err := xml.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("parse request: %w", err)
+	}
+	if req.ID == "" || req.ACSURL == "" || req.Issuer == "" {
+		return nil, errors.New("incomplete request")
+	}
+	return &req, nil
+}
+
+// verifyRedirect verifies the signature of the HTTP-Redirect binding, which
+// is over the query parameters as they were sent.
+func verifyRedirect(rawQuery string, cert *x509.Certificate) error {
+	params := map[string]string{}
+	for _, p := range strings.Split(rawQuery, "&") {
+		k, _, _ := strings.Cut(p, "=")
+		params[k] = p
+	}
+	if params["SigAlg"] != "SigAlg="+url.QueryEscape("http://www.w3.org/2001/04/xmldsig-more#rsa-sha256") {
+		return errors.New("request not signed with RSA-SHA256")
+	}
+
+	signed := params["SAMLRequest"]
+	if rs, ok := params["RelayState"]; ok {
+		signed += "&" + rs
+	}
+	signed += "&" + params["SigAlg"]
+
+	_, value, _ := strings.Cut(params["Signature"], "=")
+	value, err := url.QueryUnescape(value)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	sum := sha256.Sum256([]byte(signed))
+	if err := rsa.VerifyPKCS1v15(cert.PublicKey.(*rsa.PublicKey), crypto.SHA256, sum[:], sig); err != nil {
+		return errors.New("invalid request signature")
+	}
+	return nil
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return "_" + hex.EncodeToString(b)
+}
+
+func escape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
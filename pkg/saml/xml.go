@@ -0,0 +1,293 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const nsXML = "http://www.w3.org/XML/1998/namespace"
+
+// element is a node of the small DOM signatures are verified on. Unlike
+// encoding/xml it keeps the prefixes and namespace declarations of the
+// document, which canonicalization needs.
+type element struct {
+	prefix, local string
+	// space is the namespace the prefix resolves to.
+	space    string
+	attrs    []attr
+	nsDecls  []attr
+	children []any // *element or string
+	parent   *element
+}
+
+type attr struct {
+	prefix, local, space, value string
+}
+
+func (e *element) is(space, local string) bool {
+	return e.space == space && e.local == local
+}
+
+func (e *element) attr(local string) string {
+	for _, a := range e.attrs {
+		if a.space == "" && a.local == local {
+			return a.value
+		}
+	}
+	return ""
+}
+
+func (e *element) hasAttr(local string) bool {
+	for _, a := range e.attrs {
+		if a.space == "" && a.local == local {
+			return true
+		}
+	}
+	return false
+}
+
+// child returns the first child element named space:local.
+func (e *element) child(space, local string) *element {
+	for _, c := range e.children {
+		if el, ok := c.(*element); ok && el.is(space, local) {
+			return el
+		}
+	}
+	return nil
+}
+
+func (e *element) all(space, local string) []*element {
+	var els []*element
+	for _, c := range e.children {
+		if el, ok := c.(*element); ok && el.is(space, local) {
+			els = append(els, el)
+		}
+	}
+	return els
+}
+
+// text returns the character data of the element, trimmed.
+func (e *element) text() string {
+	var b strings.Builder
+	for _, c := range e.children {
+		if s, ok := c.(string); ok {
+			b.WriteString(s)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// lookup resolves prefix in the scope of the element.
+func (e *element) lookup(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return nsXML, true
+	}
+	for el := e; el != nil; el = el.parent {
+		for _, ns := range el.nsDecls {
+			if ns.local == prefix {
+				return ns.value, true
+			}
+		}
+	}
+	return "", prefix == ""
+}
+
+// walk calls fn for the element and each element below it.
+func (e *element) walk(fn func(*element)) {
+	fn(e)
+	for _, c := range e.children {
+		if el, ok := c.(*element); ok {
+			el.walk(fn)
+		}
+	}
+}
+
+// parseXML parses a document into its root element. Documents with a DTD
+// are rejected, and comments and processing instructions are dropped.
+func parseXML(data []byte) (*element, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, cur *element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse xml: %w", err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil && cur == nil {
+				return nil, errors.New("parse xml: more than one root element")
+			}
+			el := &element{prefix: t.Name.Space, local: t.Name.Local, parent: cur}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "xmlns":
+					el.nsDecls = append(el.nsDecls, attr{local: a.Name.Local, value: a.Value})
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					el.nsDecls = append(el.nsDecls, attr{value: a.Value})
+				default:
+					el.attrs = append(el.attrs, attr{prefix: a.Name.Space, local: a.Name.Local, value: a.Value})
+				}
+			}
+			var ok bool
+			if el.space, ok = el.lookup(el.prefix); !ok {
+				return nil, fmt.Errorf("parse xml: undeclared prefix %q", el.prefix)
+			}
+			for i, a := range el.attrs {
+				if a.prefix == "" {
+					continue
+				}
+				if el.attrs[i].space, ok = el.lookup(a.prefix); !ok {
+					return nil, fmt.Errorf("parse xml: undeclared prefix %q", a.prefix)
+				}
+			}
+			if cur == nil {
+				root = el
+			} else {
+				cur.children = append(cur.children, el)
+			}
+			cur = el
+		case xml.EndElement:
+			if cur == nil || cur.prefix != t.Name.Space || cur.local != t.Name.Local {
+				return nil, errors.New("parse xml: mismatched end element")
+			}
+			cur = cur.parent
+		case xml.CharData:
+			if cur != nil {
+				cur.children = append(cur.children, string(t))
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("parse xml: text outside of the root element")
+			}
+		case xml.Directive:
+			return nil, errors.New("parse xml: DTDs are not allowed")
+		}
+	}
+	if root == nil || cur != nil {
+		return nil, errors.New("parse xml: incomplete document")
+	}
+	return root, nil
+}
+
+// canonicalize writes el in Exclusive XML Canonicalization form, without
+// comments (https://www.w3.org/TR/xml-exc-c14n/). inclusive lists the
+// prefixes of the InclusiveNamespaces PrefixList, and skip, when not nil,
+// is left out as the enveloped signature transform requires.
+func canonicalize(el *element, inclusive []string, skip *element) []byte {
+	var b bytes.Buffer
+	writeCanonical(&b, el, map[string]string{}, inclusive, skip)
+	return b.Bytes()
+}
+
+func writeCanonical(b *bytes.Buffer, el *element, rendered map[string]string, inclusive []string, skip *element) {
+	// the namespaces the element and its attributes visibly use, and those
+	// of the prefix list that are in scope
+	used := map[string]bool{el.prefix: true}
+	for _, a := range el.attrs {
+		if a.prefix != "" && a.prefix != "xml" {
+			used[a.prefix] = true
+		}
+	}
+	for _, p := range inclusive {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := el.lookup(p); ok {
+			used[p] = true
+		}
+	}
+
+	var decls []attr
+	scope, copied := rendered, false
+	for p := range used {
+		uri, _ := el.lookup(p)
+		prev, seen := rendered[p]
+		if uri == prev && (seen || uri == "") {
+			continue
+		}
+		if !copied {
+			scope, copied = make(map[string]string, len(rendered)+1), true
+			for k, v := range rendered {
+				scope[k] = v
+			}
+		}
+		scope[p] = uri
+		decls = append(decls, attr{local: p, value: uri})
+	}
+	sort.Slice(decls, func(i, j int) bool { return decls[i].local < decls[j].local })
+
+	attrs := append([]attr(nil), el.attrs...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return attrs[i].local < attrs[j].local
+	})
+
+	b.WriteByte('<')
+	writeName(b, el.prefix, el.local)
+	for _, ns := range decls {
+		if ns.local == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(" xmlns:" + ns.local + `="`)
+		}
+		escapeAttr(b, ns.value)
+		b.WriteByte('"')
+	}
+	for _, a := range attrs {
+		b.WriteByte(' ')
+		writeName(b, a.prefix, a.local)
+		b.WriteString(`="`)
+		escapeAttr(b, a.value)
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	for _, c := range el.children {
+		switch c := c.(type) {
+		case *element:
+			if c != skip {
+				writeCanonical(b, c, scope, inclusive, skip)
+			}
+		case string:
+			escapeText(b, c)
+		}
+	}
+
+	b.WriteString("</")
+	writeName(b, el.prefix, el.local)
+	b.WriteByte('>')
+}
+
+func writeName(b *bytes.Buffer, prefix, local string) {
+	if prefix != "" {
+		b.WriteString(prefix)
+		b.WriteByte(':')
+	}
+	b.WriteString(local)
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeText(b *bytes.Buffer, s string) { textEscaper.WriteString(b, s) }
+
+func escapeAttr(b *bytes.Buffer, s string) { attrEscaper.WriteString(b, s) }
+
+// escape escapes s for use in text and attribute values of the documents
+// built in this package.
+func escape(s string) string {
+	var b bytes.Buffer
+	escapeAttr(&b, s)
+	return b.String()
+}
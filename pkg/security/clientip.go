@@ -0,0 +1,41 @@
+package security
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type clientIPKey struct{}
+
+// ClientIPMiddleware stores the client IP resolved by Gin, which honours
+// the trusted proxies set with SetTrustedProxies, in the request context
+// for code outside of Gin handlers; see ClientIP.
+func ClientIPMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), clientIPKey{}, c.ClientIP()))
+		c.Next()
+	}
+}
+
+// ClientIP returns the client IP stored by ClientIPMiddleware, or else the
+// address of the connection without its port.
+func ClientIP(r *http.Request) string {
+	if ip := ClientIPFromContext(r.Context()); ip != "" {
+		return ip
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// ClientIPFromContext returns the client IP stored by ClientIPMiddleware in
+// ctx, or "" when there is none.
+func ClientIPFromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(clientIPKey{}).(string)
+	return ip
+}
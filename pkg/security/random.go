@@ -0,0 +1,25 @@
+package security
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// RandomHex returns n random bytes, hex encoded, for IDs.
+func RandomHex(n int) string {
+	return hex.EncodeToString(randomBytes(n))
+}
+
+// RandomToken returns n random bytes, base64url encoded without padding,
+// for secrets handed to clients.
+func RandomToken(n int) string {
+	return base64.RawURLEncoding.EncodeToString(randomBytes(n))
+}
+
+// randomBytes returns n random bytes. crypto/rand.Read never fails.
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return b
+}
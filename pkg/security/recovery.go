@@ -0,0 +1,42 @@
+package security
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Recovery recovers from panics in handlers, logging the panic and its
+// stack trace and responding 500 with a generic JSON error, so that no
+// internals leak to the client.
+func Recovery(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			err := recover()
+			if err == nil {
+				return
+			}
+			// net/http aborts the response without logging on this one
+			if e, ok := err.(error); ok && errors.Is(e, http.ErrAbortHandler) {
+				panic(err)
+			}
+
+			logger.ErrorContext(c.Request.Context(), "panic serving request",
+				"method", c.Request.Method,
+				"path", c.Request.URL.Path,
+				"panic", err,
+				"stack", string(debug.Stack()),
+			)
+			if c.Writer.Written() {
+				// too late for an error response, cut the connection
+				c.Abort()
+				panic(http.ErrAbortHandler)
+			}
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "Internal server error"})
+		}()
+		c.Next()
+	}
+}
@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceIDHeader is the response header carrying the ID of the request's
+// trace, so that clients can quote it when reporting an error.
+const TraceIDHeader = "X-Trace-Id"
+
+const instrumentationName = "sambhav/pkg/tracing"
+
+// Middleware starts a server span for every request, continuing the trace
+// given by the W3C traceparent header if there is one. Spans are named after
+// the route template rather than the raw path.
+func Middleware() gin.HandlerFunc {
+	tracer := otel.Tracer(instrumentationName)
+
+	return func(c *gin.Context) {
+		ctx := otel.GetTextMapPropagator().Extract(c.Request.Context(), propagation.HeaderCarrier(c.Request.Header))
+
+		route := c.FullPath()
+		name := c.Request.Method
+		if route != "" {
+			name = fmt.Sprintf("%s %s", c.Request.Method, route)
+		}
+
+		ctx, span := tracer.Start(ctx, name,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(c.Request.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(c.Request.URL.Path),
+				semconv.ClientAddress(c.ClientIP()),
+				semconv.UserAgentOriginal(c.Request.UserAgent()),
+			),
+		)
+		defer span.End()
+
+		c.Request = c.Request.WithContext(ctx)
+		if traceID := TraceID(ctx); traceID != "" {
+			c.Header(TraceIDHeader, traceID)
+		}
+
+		c.Next()
+
+		status := c.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(status))
+		}
+		for _, err := range c.Errors {
+			span.RecordError(err.Err)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package tracing sets up OpenTelemetry tracing for the application.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Exporters that spans can be sent to.
+const (
+	// ExporterNone keeps tracing active for propagation and trace IDs but
+	// exports nothing.
+	ExporterNone = "none"
+	// ExporterStdout writes spans to stdout, for local development.
+	ExporterStdout = "stdout"
+	// ExporterOTLP sends spans to an OTLP/HTTP collector.
+	ExporterOTLP = "otlp"
+)
+
+// Config configures how spans are sampled and where they are exported.
+type Config struct {
+	ServiceName string
+	// Exporter is one of ExporterNone, ExporterStdout or ExporterOTLP.
+	Exporter string
+	// Endpoint is the URL of the OTLP collector. When empty the standard
+	// OTEL_EXPORTER_OTLP_* environment variables apply.
+	Endpoint string
+	// Insecure sends spans to the collector over plain HTTP.
+	Insecure bool
+	// SampleRatio is the fraction of new traces that are sampled. Traces
+	// started by a caller follow the caller's sampling decision.
+	SampleRatio float64
+}
+
+// Setup installs the global tracer provider and the W3C trace context
+// propagator. The returned function flushes pending spans and must be called
+// before the application exits.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	if cfg.ServiceName == "" {
+		return nil, errors.New("tracing: service name is required")
+	}
+	if cfg.SampleRatio < 0 || cfg.SampleRatio > 1 {
+		return nil, fmt.Errorf("tracing: sample ratio %v is not between 0 and 1", cfg.SampleRatio)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(
+		semconv.SchemaURL,
+		semconv.ServiceName(cfg.ServiceName),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("tracing: failed to build resource: %w", err)
+	}
+
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+	}
+
+	switch cfg.Exporter {
+	case "", ExporterNone:
+	case ExporterStdout:
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		if err != nil {
+			return nil, fmt.Errorf("tracing: failed to create stdout exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	case ExporterOTLP:
+		var clientOpts []otlptracehttp.Option
+		if cfg.Endpoint != "" {
+			clientOpts = append(clientOpts, otlptracehttp.WithEndpointURL(cfg.Endpoint))
+		}
+		if cfg.Insecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+		exporter, err := otlptracehttp.New(ctx, clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("tracing: failed to create OTLP exporter: %w", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+	default:
+		return nil, fmt.Errorf("tracing: unknown exporter %q", cfg.Exporter)
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	return provider.Shutdown, nil
+}
+
+// TraceID returns the ID of the trace the context belongs to, or an empty
+// string when it carries no sampled or unsampled span.
+func TraceID(ctx context.Context) string {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.HasTraceID() {
+		return ""
+	}
+	return sc.TraceID().String()
+}
+
+// RecordError marks the span as failed with err. It does nothing when err is
+// nil.
+func RecordError(span trace.Span, err error) {
+	if err == nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
+
+// End records the error err points to on the span and ends it. It is meant
+// to be deferred with a pointer to a named error result.
+func End(span trace.Span, err *error) {
+	RecordError(span, *err)
+	span.End()
+}